@@ -296,3 +296,86 @@ func (v *CacheDB) DeleteData(table int, id int64) (int64, error) {
 
 	return result.RowsAffected()
 }
+
+func (v *CacheDB) GetLastId(table int) (int64, error) {
+	v.Lock()
+	defer v.Unlock()
+
+	if v.tables <= table {
+		return -1, errors.New("Not support table.")
+	}
+
+	tname := fmt.Sprintf("T%02d", table)
+	query := fmt.Sprintf("SELECT ifnull(max(id), 0) FROM `%s`", tname)
+
+	var id int64
+	if err := v.conn.QueryRow(query).Scan(&id); err != nil {
+		return -1, err
+	}
+
+	return id, nil
+}
+
+/**
+ * 저장된 데이터의 전체 크기(byte)
+ */
+func (v *CacheDB) DataSize(table int) (int64, error) {
+	v.Lock()
+	defer v.Unlock()
+
+	if v.tables <= table {
+		return -1, errors.New("Not support table.")
+	}
+
+	tname := fmt.Sprintf("T%02d", table)
+	query := fmt.Sprintf("SELECT ifnull(sum(length(data)), 0) FROM `%s`", tname)
+
+	var size int64
+	if err := v.conn.QueryRow(query).Scan(&size); err != nil {
+		return -1, err
+	}
+
+	return size, nil
+}
+
+/**
+ * id 가 작은 순서로 count 개를 삭제한다.
+ */
+func (v *CacheDB) DeleteOldData(table int, count int64) (int64, error) {
+	v.Lock()
+	defer v.Unlock()
+
+	if v.tables <= table {
+		return -1, errors.New("Not support table.")
+	}
+
+	tname := fmt.Sprintf("T%02d", table)
+	query := fmt.Sprintf("DELETE FROM `%s` WHERE id IN (SELECT id FROM `%s` ORDER BY id ASC LIMIT ?)", tname, tname)
+	result, err := v.conn.Exec(query, count)
+	if err != nil {
+		return -1, err
+	}
+
+	return result.RowsAffected()
+}
+
+/**
+ * id 가 max 보다 작은 데이터를 삭제한다.
+ */
+func (v *CacheDB) DeleteBefore(table int, max int64) (int64, error) {
+	v.Lock()
+	defer v.Unlock()
+
+	if v.tables <= table {
+		return -1, errors.New("Not support table.")
+	}
+
+	tname := fmt.Sprintf("T%02d", table)
+	query := fmt.Sprintf("DELETE FROM `%s` WHERE id < ?", tname)
+	result, err := v.conn.Exec(query, max)
+	if err != nil {
+		return -1, err
+	}
+
+	return result.RowsAffected()
+}
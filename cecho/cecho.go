@@ -2,13 +2,12 @@ package cecho
 
 import (
 	"crypto/tls"
-	"crypto/x509"
 	"encoding/json"
 	"fmt"
 	"github.com/industry-netsecurity-solution/ins-security-channel/ins"
 	"github.com/industry-netsecurity-solution/ins-security-channel/logger"
 	echo "github.com/labstack/echo/v4"
-	"io/ioutil"
+	"net"
 	"net/http"
 	"strings"
 )
@@ -36,50 +35,44 @@ func Start(config *ins.ServiceConfigurations, ud interface{}, callback func(*ech
 
 	callback(e)
 
+	if config.ProxyProtocol.Enable {
+		// PROXY protocol 헤더의 실제 클라이언트 주소를 Request.RemoteAddr 로 사용한다.
+		listener, err := net.Listen("tcp", fmt.Sprintf("%s:%d", config.Address, config.Port))
+		if err != nil {
+			logger.Error(err)
+			return e
+		}
+		proxied, err := ins.WrapProxyListener(listener, &config.ProxyProtocol)
+		if err != nil {
+			listener.Close()
+			logger.Error(err)
+			return e
+		}
+		e.Listener = proxied
+	}
+
 	go func() {
 		if config.EnableTls {
-			certpool := x509.NewCertPool()
-			if 0 < len(config.CaCert) {
-				pemCerts, err := ioutil.ReadFile(config.CaCert)
-				if err == nil {
-					certpool.AppendCertsFromPEM(pemCerts)
-				}
-			}
-
 			// 2022-08-03
 			address := fmt.Sprintf("%s:%d", config.Address, config.Port)
 			//e.Logger.Fatal(e.StartTLS(address, config.TlsCert, config.TlsKey))
 
-			cert, err := tls.LoadX509KeyPair(config.TlsCert, config.TlsKey)
+			// 인증서 파일이 변경되면 다시 읽는다.
+			tlsConfig, err := config.ServerTLSConfig()
 			if err != nil {
 				logger.Error(err)
 				return
 			}
-			if len(cert.Certificate) == 0 {
-				return
-			}
-			// Just to print out the client certificate..
-			cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
-			if err != nil {
-				logger.Error(err)
-				return
+			server := &http.Server{
+				Addr:      address,
+				TLSConfig: tlsConfig,
 			}
-
-			config := &tls.Config{
-				MinVersion:       tls.VersionTLS12,
-				CurvePreferences: []tls.CurveID{tls.CurveP521, tls.CurveP384, tls.CurveP256},
-				CipherSuites: []uint16{
-					tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
-					tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
-					tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
-				},
-				RootCAs:      certpool,
-				Certificates: []tls.Certificate{cert},
+			if hasNextProto(tlsConfig.NextProtos, "h2") == false {
+				// ALPN 에 h2 가 없으면 HTTP/2 를 사용하지 않는다.
+				server.TLSNextProto = make(map[string]func(*http.Server, *tls.Conn, http.Handler), 0)
 			}
-			server := &http.Server{
-				Addr:         address,
-				TLSConfig:    config,
-				TLSNextProto: make(map[string]func(*http.Server, *tls.Conn, http.Handler), 0),
+			if e.Listener != nil {
+				e.TLSListener = tls.NewListener(e.Listener, tlsConfig)
 			}
 
 			e.Logger.Fatal(e.StartServer(server))
@@ -91,6 +84,15 @@ func Start(config *ins.ServiceConfigurations, ud interface{}, callback func(*ech
 	return e
 }
 
+func hasNextProto(protos []string, proto string) bool {
+	for _, v := range protos {
+		if v == proto {
+			return true
+		}
+	}
+	return false
+}
+
 func Unmarshal(c echo.Context, v interface{}) (err error) {
 	/*
 		err := c.Bind(v)
@@ -0,0 +1,95 @@
+package cecho
+
+import (
+	"crypto/subtle"
+	"errors"
+	"github.com/gorilla/websocket"
+	"github.com/industry-netsecurity-solution/ins-security-channel/ins"
+	"github.com/industry-netsecurity-solution/ins-security-channel/logger"
+	echo "github.com/labstack/echo/v4"
+	"net"
+	"net/http"
+	"net/url"
+)
+
+/**
+ * config.Path 에 WebSocket 연결을 받는 경로를 등록한다.
+ *
+ * 연결마다 callback 을 TCP 서버(StartServer, ins.Server)와 같은 형태로 호출하므로
+ * MessageRelay.Serve 등 같은 처리 함수(화이트리스트, 경로 규칙)를 그대로 사용한다.
+ * Authorization 을 지정하면 Authorization 헤더가 같아야 하며, TLS 클라이언트 인증서 확인은
+ * HTTPS 서버(Start)의 TLS 설정을 따른다.
+ */
+func WebSocket(e *echo.Echo, config *ins.WebSocketConfigurations, ud interface{}, callback func(net.Conn, interface{}) error) error {
+	if config == nil {
+		return errors.New("WebSocketConfigurations is nil")
+	}
+	if callback == nil {
+		return errors.New("callback is nil")
+	}
+
+	upgrader := websocket.Upgrader{
+		CheckOrigin: func(r *http.Request) bool {
+			return checkOrigin(config.Origins, r)
+		},
+	}
+
+	e.GET(config.Path, func(c echo.Context) error {
+		if 0 < len(config.Authorization) {
+			authorization := c.Request().Header.Get(echo.HeaderAuthorization)
+			if subtle.ConstantTimeCompare([]byte(authorization), []byte(config.Authorization)) != 1 {
+				logger.Warningf("websocket from %s rejected: unauthorized", c.Request().RemoteAddr)
+				return echo.ErrUnauthorized
+			}
+		}
+
+		ws, err := upgrader.Upgrade(c.Response(), c.Request(), nil)
+		if err != nil {
+			// Upgrade 가 이미 오류 응답을 보냈다.
+			logger.Warningf("websocket from %s: %v", c.Request().RemoteAddr, err)
+			return nil
+		}
+		if 0 < config.MaxMessageSize {
+			ws.SetReadLimit(config.MaxMessageSize)
+		}
+
+		conn := ins.NewWebSocketConn(ws)
+		defer conn.Close()
+
+		// 클라이언트 인증서로 송신 게이트웨이를 확인한다. (ins.PeerCommonName)
+		if state := c.Request().TLS; state != nil && 0 < len(state.VerifiedChains) {
+			conn.SetPeerCommonName(state.VerifiedChains[0][0].Subject.CommonName)
+		}
+
+		if err = callback(conn, ud); err != nil {
+			logger.Debugf("websocket from %s closed: %v", conn.RemoteAddr(), err)
+		}
+
+		return nil
+	})
+
+	return nil
+}
+
+/**
+ * Origins 가 비어 있으면 Origin 헤더가 없거나 Host 와 같은 경우만 허용한다.
+ */
+func checkOrigin(origins []string, r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if len(origin) == 0 {
+		return true
+	}
+
+	for _, allowed := range origins {
+		if allowed == "*" || allowed == origin {
+			return true
+		}
+	}
+
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+
+	return len(origins) == 0 && u.Host == r.Host
+}
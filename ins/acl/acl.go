@@ -0,0 +1,416 @@
+package acl
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/industry-netsecurity-solution/ins-security-channel/ins"
+	"github.com/industry-netsecurity-solution/ins-security-channel/insreport"
+	"github.com/industry-netsecurity-solution/ins-security-channel/logger"
+	_ "github.com/mattn/go-sqlite3"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	ACTION_PUBLISH   = "publish"
+	ACTION_SUBSCRIBE = "subscribe"
+	// 규칙 파일/테이블에서 발행과 구독 모두
+	ACTION_ALL = "all"
+)
+
+// 모든 게이트웨이에 적용하는 규칙의 Identity
+const ANY_IDENTITY = "*"
+
+// 토픽 필터 안의 이 문자열은 게이트웨이 식별자로 바뀐다. (예: ins/+/+/%u/#)
+const IDENTITY_PATTERN = "%u"
+
+const DefaultACLEventType = "MQTT_ACL_VIOLATION"
+
+var ErrTopicDenied = errors.New("topic not allowed")
+
+/**
+ * 게이트웨이 식별자(MQTT 사용자 이름 또는 클라이언트 인증서 CN)별 허용 토픽
+ */
+type Rule struct {
+	Identity  string
+	Publish   []string
+	Subscribe []string
+}
+
+/**
+ * 규칙 위반
+ */
+type Violation struct {
+	Identity string `json:"identity"`
+	Action   string `json:"action"`
+	Topic    string `json:"topic"`
+	Source   string `json:"source"`
+	Time     string `json:"time"`
+}
+
+/**
+ * MQTT 토픽 접근 규칙
+ *
+ * 게이트웨이는 자신의 규칙(Identity 일치)과 ANY_IDENTITY 규칙의 토픽 필터 아래에만
+ * 발행/구독할 수 있다. 위반하면 OnViolation 으로 등록한 함수를 호출한다.
+ */
+type TopicACL struct {
+	sync.RWMutex
+	config   ins.TopicACLConfigurations
+	rules    map[string]*Rule
+	handlers []func(Violation)
+	allowed  int64
+	denied   int64
+	stop     chan struct{}
+	once     sync.Once
+}
+
+func NewTopicACL(config *ins.TopicACLConfigurations) (*TopicACL, error) {
+	if config == nil {
+		return nil, errors.New("TopicACLConfigurations is nil")
+	}
+
+	v := new(TopicACL)
+	v.config = *config
+	v.rules = make(map[string]*Rule)
+	v.stop = make(chan struct{})
+
+	if err := v.Reload(); err != nil {
+		return nil, err
+	}
+
+	if 0 < config.ReloadInterval {
+		go v.reloader(time.Duration(config.ReloadInterval) * time.Second)
+	}
+
+	return v, nil
+}
+
+func (v *TopicACL) reloader(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := v.Reload(); err != nil {
+				logger.Errorf("topic ACL reload failed: %v", err)
+			}
+		case <-v.stop:
+			return
+		}
+	}
+}
+
+/**
+ * 규칙 파일과 데이터베이스를 다시 읽는다. 실패하면 기존 규칙을 유지한다.
+ */
+func (v *TopicACL) Reload() error {
+	rules := []Rule{}
+
+	if 0 < len(v.config.File) {
+		loaded, err := LoadRuleFile(v.config.File)
+		if err != nil {
+			return err
+		}
+		rules = append(rules, loaded...)
+	}
+
+	if 0 < len(v.config.Database) {
+		loaded, err := LoadRuleDatabase(v.config.Database)
+		if err != nil {
+			return err
+		}
+		rules = append(rules, loaded...)
+	}
+
+	v.SetRules(rules)
+
+	return nil
+}
+
+/**
+ * 규칙을 바꾼다. 같은 Identity 의 규칙은 합친다.
+ */
+func (v *TopicACL) SetRules(rules []Rule) {
+	merged := make(map[string]*Rule)
+	for _, rule := range rules {
+		r, ok := merged[rule.Identity]
+		if ok == false {
+			r = &Rule{Identity: rule.Identity}
+			merged[rule.Identity] = r
+		}
+		r.Publish = append(r.Publish, rule.Publish...)
+		r.Subscribe = append(r.Subscribe, rule.Subscribe...)
+	}
+
+	v.Lock()
+	v.rules = merged
+	v.Unlock()
+}
+
+/**
+ * JSON 규칙 파일: [{"Identity": "GW01", "Publish": ["ins/factory/+/GW01/#"], "Subscribe": [...]}, ...]
+ */
+func LoadRuleFile(filepath string) ([]Rule, error) {
+	data, err := ioutil.ReadFile(filepath)
+	if err != nil {
+		return nil, err
+	}
+
+	rules := []Rule{}
+	if err = json.Unmarshal(data, &rules); err != nil {
+		return nil, fmt.Errorf("%s: %v", filepath, err)
+	}
+
+	return rules, nil
+}
+
+/**
+ * sqlite 규칙 테이블: topic_acl(identity, action, filter), action 은 publish, subscribe, all
+ * 데이터베이스는 읽기 전용으로 연다. 테이블은 규칙을 관리하는 쪽에서 만든다. (InitRuleDatabase)
+ */
+func LoadRuleDatabase(datasource string) ([]Rule, error) {
+	conn, err := sql.Open("sqlite3", readOnlyDatasource(datasource))
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	rows, err := conn.Query("SELECT `identity`, `action`, `filter` FROM `topic_acl`")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	rules := []Rule{}
+	for rows.Next() {
+		var identity, action, filter string
+		if err = rows.Scan(&identity, &action, &filter); err != nil {
+			return nil, err
+		}
+
+		rule := Rule{Identity: identity}
+		switch strings.ToLower(action) {
+		case ACTION_PUBLISH:
+			rule.Publish = []string{filter}
+		case ACTION_SUBSCRIBE:
+			rule.Subscribe = []string{filter}
+		case ACTION_ALL:
+			rule.Publish = []string{filter}
+			rule.Subscribe = []string{filter}
+		default:
+			logger.Warningf("topic ACL: unknown action %s for %s", action, identity)
+			continue
+		}
+		rules = append(rules, rule)
+	}
+
+	return rules, rows.Err()
+}
+
+/**
+ * 파일 경로 또는 "file:" URI 를 읽기 전용(mode=ro) URI 로 바꾼다.
+ */
+func readOnlyDatasource(datasource string) string {
+	if strings.HasPrefix(datasource, "file:") == false {
+		datasource = "file:" + datasource
+	}
+	if strings.Contains(datasource, "?") {
+		return datasource + "&mode=ro"
+	}
+	return datasource + "?mode=ro"
+}
+
+func InitRuleDatabase(conn *sql.DB) error {
+	query := "CREATE TABLE IF NOT EXISTS `topic_acl` ("
+	query += "`identity` TEXT NOT NULL, "
+	query += "`action` TEXT NOT NULL, "
+	query += "`filter` TEXT NOT NULL"
+	query += ")"
+	_, err := conn.Exec(query)
+
+	return err
+}
+
+/**
+ * 위반 시 호출할 함수를 등록한다.
+ */
+func (v *TopicACL) OnViolation(handler func(Violation)) {
+	v.Lock()
+	defer v.Unlock()
+
+	v.handlers = append(v.handlers, handler)
+}
+
+func (v *TopicACL) EventType() string {
+	if len(v.config.EventType) == 0 {
+		return DefaultACLEventType
+	}
+	return v.config.EventType
+}
+
+/**
+ * identity 가 topic 에 action(ACTION_PUBLISH, ACTION_SUBSCRIBE) 할 수 있는지 확인한다.
+ * 구독은 topic(필터) 전체가 허용된 필터 안에 있어야 한다.
+ * 거부하면 source(연결 주소 등)와 함께 위반을 알린다.
+ */
+func (v *TopicACL) Check(identity, action, topic, source string) bool {
+	if v.Allow(identity, action, topic) {
+		atomic.AddInt64(&v.allowed, 1)
+		return true
+	}
+	atomic.AddInt64(&v.denied, 1)
+
+	violation := Violation{
+		Identity: identity,
+		Action:   action,
+		Topic:    topic,
+		Source:   source,
+		Time:     ins.TimeYYmmddHHMMSS(nil),
+	}
+	logger.Warningf("topic ACL: %s %s %s denied (%s)", identity, action, topic, source)
+
+	v.RLock()
+	handlers := make([]func(Violation), len(v.handlers))
+	copy(handlers, v.handlers)
+	v.RUnlock()
+
+	for _, handler := range handlers {
+		handler(violation)
+	}
+
+	return false
+}
+
+/**
+ * Check 와 같지만 위반을 알리지 않는다.
+ */
+func (v *TopicACL) Allow(identity, action, topic string) bool {
+	v.RLock()
+	rules := []*Rule{}
+	if rule, ok := v.rules[identity]; ok && 0 < len(identity) {
+		rules = append(rules, rule)
+	}
+	if rule, ok := v.rules[ANY_IDENTITY]; ok {
+		rules = append(rules, rule)
+	}
+	v.RUnlock()
+
+	if len(rules) == 0 {
+		return strings.ToLower(v.config.Default) == "allow"
+	}
+
+	for _, rule := range rules {
+		filters := rule.Publish
+		if action == ACTION_SUBSCRIBE {
+			filters = rule.Subscribe
+		}
+		for _, filter := range filters {
+			if strings.Contains(filter, IDENTITY_PATTERN) {
+				if len(identity) == 0 {
+					continue
+				}
+				filter = strings.ReplaceAll(filter, IDENTITY_PATTERN, ins.TopicLevel(identity))
+			}
+			if action == ACTION_SUBSCRIBE {
+				if CoverFilter(filter, topic) {
+					return true
+				}
+			} else if ins.MatchTopic(filter, topic) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+/**
+ * filter 가 subfilter 에 맞는 모든 토픽을 포함하는지 확인한다.
+ */
+func CoverFilter(filter, subfilter string) bool {
+	filters := strings.Split(filter, "/")
+	levels := strings.Split(subfilter, "/")
+
+	for i, f := range filters {
+		if f == ins.TOPIC_WILDCARD_MULTI {
+			return true
+		}
+		if len(levels) <= i {
+			return false
+		}
+		switch levels[i] {
+		case ins.TOPIC_WILDCARD_MULTI:
+			return false
+		case ins.TOPIC_WILDCARD_LEVEL:
+			if f != ins.TOPIC_WILDCARD_LEVEL {
+				return false
+			}
+		default:
+			if f != ins.TOPIC_WILDCARD_LEVEL && f != levels[i] {
+				return false
+			}
+		}
+	}
+
+	return len(filters) == len(levels)
+}
+
+/**
+ * 위반을 보안 이벤트(ReportSecurityLog)로 보고하는 함수. securityUrl 이 nil 이면 보고하지 않는다.
+ */
+func (v *TopicACL) SecurityReporter(securityUrl *ins.HttpConfigurations, sourceId, evtGwType string) func(Violation) {
+	return func(violation Violation) {
+		if securityUrl == nil {
+			return
+		}
+
+		content := ""
+		if data, err := json.Marshal(violation); err == nil {
+			content = string(data)
+		}
+		message := fmt.Sprintf("%s %s denied: %s", violation.Identity, violation.Action, violation.Topic)
+
+		// 이벤트 보고는 메시지 처리를 지연시키지 않도록 따로 보낸다.
+		go func() {
+			if err := insreport.ReportSecurityLog(securityUrl, v.EventType(), violation.Source, evtGwType, sourceId, message, content); err != nil {
+				logger.Errorf("topic ACL report failed: %v", err)
+			}
+		}()
+	}
+}
+
+/**
+ * 진단 출력용 문자열
+ */
+func (v *TopicACL) Diagnostics() []string {
+	v.RLock()
+	identities := make([]string, 0, len(v.rules))
+	for identity := range v.rules {
+		identities = append(identities, identity)
+	}
+	v.RUnlock()
+	sort.Strings(identities)
+
+	strings := []string{}
+	strings = append(strings, fmt.Sprintf("Identities: %v", identities))
+	strings = append(strings, fmt.Sprintf("Allowed: %d", atomic.LoadInt64(&v.allowed)))
+	strings = append(strings, fmt.Sprintf("Denied: %d", atomic.LoadInt64(&v.denied)))
+
+	return strings
+}
+
+func (v *TopicACL) Close() error {
+	v.once.Do(func() {
+		close(v.stop)
+	})
+
+	return nil
+}
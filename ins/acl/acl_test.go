@@ -0,0 +1,163 @@
+package acl
+
+import (
+	"database/sql"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/industry-netsecurity-solution/ins-security-channel/ins"
+)
+
+func newTestACL(t *testing.T, rules []Rule, defaultAction string) *TopicACL {
+	t.Helper()
+
+	topicACL, err := NewTopicACL(&ins.TopicACLConfigurations{Default: defaultAction})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { topicACL.Close() })
+	topicACL.SetRules(rules)
+
+	return topicACL
+}
+
+func TestCoverFilter(t *testing.T) {
+	tests := []struct {
+		filter    string
+		subfilter string
+		want      bool
+	}{
+		{"ins/#", "ins/#", true},
+		{"ins/#", "ins/GW01/data", true},
+		{"ins/#", "ins", true},
+		{"ins/+/data", "ins/GW01/data", true},
+		{"ins/+/data", "ins/+/data", true},
+		{"ins/GW01/#", "ins/+/data", false},
+		{"ins/+/data", "ins/#", false},
+		{"ins/+/data", "ins/GW01/data/more", false},
+		{"ins/+/data", "ins/GW01", false},
+		{"ins/GW01/data", "ins/GW02/data", false},
+		{"#", "#", true},
+		{"+", "+", true},
+		{"+", "#", false},
+	}
+
+	for _, test := range tests {
+		if got := CoverFilter(test.filter, test.subfilter); got != test.want {
+			t.Errorf("CoverFilter(%q, %q) = %t, want %t", test.filter, test.subfilter, got, test.want)
+		}
+	}
+}
+
+func TestAllow(t *testing.T) {
+	topicACL := newTestACL(t, []Rule{
+		{Identity: ANY_IDENTITY, Publish: []string{"ins/%u/#"}, Subscribe: []string{"ins/%u/#", "ins/notice"}},
+		{Identity: "GW02", Publish: []string{"ins/shared/+"}, Subscribe: []string{"ins/#"}},
+	}, "")
+
+	tests := []struct {
+		identity string
+		action   string
+		topic    string
+		want     bool
+	}{
+		// %u 는 자신의 식별자로 바뀐다.
+		{"GW01", ACTION_PUBLISH, "ins/GW01/data", true},
+		{"GW01", ACTION_PUBLISH, "ins/GW02/data", false},
+		{"GW01", ACTION_SUBSCRIBE, "ins/GW01/#", true},
+		{"GW01", ACTION_SUBSCRIBE, "ins/+/data", false},
+		{"GW01", ACTION_SUBSCRIBE, "ins/notice", true},
+		// 식별자 규칙과 ANY_IDENTITY 규칙을 함께 적용한다.
+		{"GW02", ACTION_PUBLISH, "ins/GW02/data", true},
+		{"GW02", ACTION_PUBLISH, "ins/shared/status", true},
+		{"GW02", ACTION_SUBSCRIBE, "ins/+/data", true},
+		{"GW01", ACTION_PUBLISH, "ins/shared/status", false},
+		// 토픽 단계로 쓸 수 없는 문자는 바뀐다. (ins.TopicLevel)
+		{"GW/+", ACTION_PUBLISH, "ins/GW__/data", true},
+		{"GW/+", ACTION_PUBLISH, "ins/GW/data", false},
+		// 식별자를 모르면 %u 규칙은 맞지 않는다.
+		{"", ACTION_PUBLISH, "ins/unknown/data", false},
+		{"", ACTION_SUBSCRIBE, "ins/notice", true},
+	}
+
+	for _, test := range tests {
+		if got := topicACL.Allow(test.identity, test.action, test.topic); got != test.want {
+			t.Errorf("Allow(%q, %s, %q) = %t, want %t", test.identity, test.action, test.topic, got, test.want)
+		}
+	}
+}
+
+func TestAllowDefault(t *testing.T) {
+	tests := []struct {
+		defaultAction string
+		rules         []Rule
+		want          bool
+	}{
+		{"", nil, false},
+		{"deny", nil, false},
+		{"allow", nil, true},
+		{"Allow", nil, true},
+		// 규칙이 있으면 Default 를 사용하지 않는다.
+		{"allow", []Rule{{Identity: "GW01", Publish: []string{"ins/GW01/#"}}}, false},
+	}
+
+	for _, test := range tests {
+		topicACL := newTestACL(t, test.rules, test.defaultAction)
+		if got := topicACL.Allow("GW01", ACTION_PUBLISH, "ins/other"); got != test.want {
+			t.Errorf("Default %q, rules %v: Allow = %t, want %t", test.defaultAction, test.rules, got, test.want)
+		}
+	}
+}
+
+func TestLoadRuleDatabase(t *testing.T) {
+	dir := t.TempDir()
+
+	// 없는 데이터베이스는 만들지 않는다.
+	missing := filepath.Join(dir, "missing.db")
+	if _, err := LoadRuleDatabase(missing); err == nil {
+		t.Fatal("loading a missing database must fail")
+	}
+	if _, err := os.Stat(missing); os.IsNotExist(err) == false {
+		t.Fatalf("missing database was created: %v", err)
+	}
+
+	datasource := filepath.Join(dir, "acl.db")
+	conn, err := sql.Open("sqlite3", datasource)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = InitRuleDatabase(conn); err != nil {
+		t.Fatal(err)
+	}
+	_, err = conn.Exec("INSERT INTO `topic_acl` (`identity`, `action`, `filter`) VALUES (?,?,?), (?,?,?), (?,?,?)",
+		"GW01", ACTION_PUBLISH, "ins/GW01/#",
+		"GW01", ACTION_ALL, "ins/common/#",
+		"GW02", "unknown", "ins/#")
+	conn.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rules, err := LoadRuleDatabase(datasource)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rules) != 2 {
+		t.Fatalf("rules: %+v", rules)
+	}
+
+	topicACL := newTestACL(t, rules, "")
+	if topicACL.Allow("GW01", ACTION_PUBLISH, "ins/GW01/data") == false {
+		t.Error("GW01 publish ins/GW01/data must be allowed")
+	}
+	if topicACL.Allow("GW01", ACTION_SUBSCRIBE, "ins/common/+") == false {
+		t.Error("GW01 subscribe ins/common/+ must be allowed")
+	}
+	if topicACL.Allow("GW01", ACTION_SUBSCRIBE, "ins/GW01/#") {
+		t.Error("GW01 subscribe ins/GW01/# must be denied")
+	}
+	if topicACL.Allow("GW02", ACTION_PUBLISH, "ins/GW02/data") {
+		t.Error("rule with unknown action must be ignored")
+	}
+}
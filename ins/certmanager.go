@@ -0,0 +1,446 @@
+package ins
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"github.com/industry-netsecurity-solution/ins-security-channel/logger"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+// 인증서 파일 변경 확인 주기
+var DefaultCertWatchInterval = 30 * time.Second
+
+type certFileStat struct {
+	modTime time.Time
+	size    int64
+}
+
+/**
+ * CA 번들과 인증서/키 파일을 읽어 두고, 파일이 변경되면 다시 읽는다.
+ * 리스너/클라이언트는 GetCertificate, GetClientCertificate 콜백을 통해
+ * 항상 최신 인증서를 사용한다.
+ */
+type CertManager struct {
+	sync.RWMutex
+	cacertFile  string
+	certFile    string
+	keyFile     string
+	certificate *tls.Certificate
+	certpool    *x509.CertPool
+	cacerts     []*x509.Certificate
+	stats       map[string]certFileStat
+	loadedAt    time.Time
+	lastError   error
+	handlers    []func(*CertManager, error)
+	stop        chan struct{}
+}
+
+var certManagers = make(map[string]*CertManager)
+var certManagersLock sync.Mutex
+
+/**
+ * 인증서 관리자를 생성하고 파일을 읽는다.
+ * certFile, keyFile 이 비어 있으면 CA 번들만 관리한다.
+ */
+func NewCertManager(cacertFile, certFile, keyFile string) (*CertManager, error) {
+	v := new(CertManager)
+	v.cacertFile = cacertFile
+	v.certFile = certFile
+	v.keyFile = keyFile
+	v.stats = make(map[string]certFileStat)
+
+	if err := v.Reload(); err != nil {
+		return nil, err
+	}
+
+	return v, nil
+}
+
+/**
+ * 동일한 파일 조합에 대해 하나의 인증서 관리자를 공유한다.
+ * 처음 생성될 때 DefaultCertWatchInterval 주기로 파일 감시를 시작한다.
+ */
+func LoadCertManager(cacertFile, certFile, keyFile string) (*CertManager, error) {
+	key := fmt.Sprintf("%s|%s|%s", cacertFile, certFile, keyFile)
+
+	certManagersLock.Lock()
+	defer certManagersLock.Unlock()
+
+	if v, ok := certManagers[key]; ok {
+		return v, nil
+	}
+
+	v, err := NewCertManager(cacertFile, certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	v.Watch(DefaultCertWatchInterval)
+
+	certManagers[key] = v
+
+	return v, nil
+}
+
+/**
+ * 등록된 모든 인증서 관리자를 반환한다.
+ */
+func GetCertManagers() []*CertManager {
+	certManagersLock.Lock()
+	defer certManagersLock.Unlock()
+
+	results := make([]*CertManager, 0, len(certManagers))
+	for _, v := range certManagers {
+		results = append(results, v)
+	}
+
+	return results
+}
+
+func (v ServiceConfigurations) CertManager() (*CertManager, error) {
+	return LoadCertManager(v.CaCert, v.TlsCert, v.TlsKey)
+}
+
+func (v HttpConfigurations) CertManager() (*CertManager, error) {
+	return LoadCertManager(v.CaCert, v.TlsCert, v.TlsKey)
+}
+
+func (v MQTTConfigurations) CertManager() (*CertManager, error) {
+	return LoadCertManager(v.Cacertfile, v.Certfile, v.Keyfile)
+}
+
+func (v *CertManager) CaCertFile() string {
+	return v.cacertFile
+}
+
+func (v *CertManager) CertFile() string {
+	return v.certFile
+}
+
+func (v *CertManager) KeyFile() string {
+	return v.keyFile
+}
+
+func (v *CertManager) HasCertificate() bool {
+	return 0 < len(v.certFile) && 0 < len(v.keyFile)
+}
+
+/**
+ * 인증서 변경/오류 발생 시 호출할 함수를 등록한다.
+ * 정상적으로 다시 읽은 경우 err 는 nil 이다.
+ */
+func (v *CertManager) OnReload(handler func(*CertManager, error)) {
+	v.Lock()
+	defer v.Unlock()
+
+	v.handlers = append(v.handlers, handler)
+}
+
+/**
+ * 마지막 파일 읽기 오류. 정상이면 nil
+ */
+func (v *CertManager) LastError() error {
+	v.RLock()
+	defer v.RUnlock()
+
+	return v.lastError
+}
+
+func (v *CertManager) LoadedAt() time.Time {
+	v.RLock()
+	defer v.RUnlock()
+
+	return v.loadedAt
+}
+
+func (v *CertManager) Certificate() *tls.Certificate {
+	v.RLock()
+	defer v.RUnlock()
+
+	return v.certificate
+}
+
+func (v *CertManager) CertPool() *x509.CertPool {
+	v.RLock()
+	defer v.RUnlock()
+
+	return v.certpool
+}
+
+/**
+ * CA 번들에 포함된 인증서 목록
+ */
+func (v *CertManager) CaCertificates() []*x509.Certificate {
+	v.RLock()
+	defer v.RUnlock()
+
+	return v.cacerts
+}
+
+func loadCertPool(cacertFile string) (*x509.CertPool, []*x509.Certificate, error) {
+	certpool := x509.NewCertPool()
+	cacerts := []*x509.Certificate{}
+	if len(cacertFile) == 0 {
+		return certpool, cacerts, nil
+	}
+
+	pemCerts, err := ioutil.ReadFile(cacertFile)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for {
+		var block *pem.Block
+		block, pemCerts = pem.Decode(pemCerts)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			// 읽을 수 없는 인증서는 건너뛴다.
+			logger.Warningf("%s: invalid CA certificate ignored: %v", cacertFile, err)
+			continue
+		}
+		certpool.AddCert(cert)
+		cacerts = append(cacerts, cert)
+	}
+
+	if len(cacerts) == 0 {
+		return nil, nil, fmt.Errorf("%s: no valid certificates", cacertFile)
+	}
+
+	return certpool, cacerts, nil
+}
+
+func loadKeyPair(certFile, keyFile string) (*tls.Certificate, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	if len(cert.Certificate) == 0 {
+		return nil, fmt.Errorf("%s: no certificates", certFile)
+	}
+
+	cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+
+	return &cert, nil
+}
+
+func (v *CertManager) files() []string {
+	files := []string{}
+	if 0 < len(v.cacertFile) {
+		files = append(files, v.cacertFile)
+	}
+	if v.HasCertificate() {
+		files = append(files, v.certFile, v.keyFile)
+	}
+
+	return files
+}
+
+/**
+ * 파일을 다시 읽는다.
+ * 읽기에 실패하면 기존 인증서를 유지하고, 오류를 기록/보고한다.
+ */
+func (v *CertManager) Reload() error {
+	stats := make(map[string]certFileStat)
+	for _, name := range v.files() {
+		if fi, err := os.Stat(name); err == nil {
+			stats[name] = certFileStat{fi.ModTime(), fi.Size()}
+		}
+	}
+
+	// 처음 읽을 때 실패하면 NewCertManager 가 실패한다. 다시 읽을 때 실패하면 기존 CA 번들을 유지한다.
+	certpool, cacerts, err := loadCertPool(v.cacertFile)
+
+	var certificate *tls.Certificate = nil
+	if err == nil && v.HasCertificate() {
+		certificate, err = loadKeyPair(v.certFile, v.keyFile)
+	}
+
+	v.Lock()
+	v.stats = stats
+	if err == nil {
+		v.certpool = certpool
+		v.cacerts = cacerts
+		v.certificate = certificate
+		v.loadedAt = time.Now()
+	}
+	v.lastError = err
+	handlers := make([]func(*CertManager, error), len(v.handlers))
+	copy(handlers, v.handlers)
+	v.Unlock()
+
+	if err != nil {
+		logger.Errorf("certificate reload failed (%s, %s, %s): %v", v.cacertFile, v.certFile, v.keyFile, err)
+	}
+
+	for _, handler := range handlers {
+		handler(v, err)
+	}
+
+	return err
+}
+
+/**
+ * 마지막으로 읽은 이후 파일이 변경되었는지 확인한다.
+ */
+func (v *CertManager) IsModified() bool {
+	v.RLock()
+	defer v.RUnlock()
+
+	for _, name := range v.files() {
+		fi, err := os.Stat(name)
+		if err != nil {
+			// 파일 교체 중일 수 있으므로 다음 주기에 확인한다.
+			continue
+		}
+
+		stat, ok := v.stats[name]
+		if ok == false {
+			return true
+		}
+		if stat.modTime.Equal(fi.ModTime()) == false || stat.size != fi.Size() {
+			return true
+		}
+	}
+
+	return false
+}
+
+/**
+ * interval 주기로 파일 변경을 확인하여 다시 읽는다.
+ */
+func (v *CertManager) Watch(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+
+	v.Lock()
+	if v.stop != nil {
+		v.Unlock()
+		return
+	}
+	stop := make(chan struct{})
+	v.stop = stop
+	v.Unlock()
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				if v.IsModified() {
+					if err := v.Reload(); err == nil {
+						logger.Infof("certificate reloaded (%s, %s, %s)", v.cacertFile, v.certFile, v.keyFile)
+					}
+				}
+			}
+		}
+	}()
+}
+
+func (v *CertManager) Stop() {
+	v.Lock()
+	defer v.Unlock()
+
+	if v.stop != nil {
+		close(v.stop)
+		v.stop = nil
+	}
+}
+
+func (v *CertManager) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	certificate := v.Certificate()
+	if certificate == nil {
+		return nil, errors.New("no server certificate")
+	}
+
+	return certificate, nil
+}
+
+func (v *CertManager) GetClientCertificate(info *tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	certificate := v.Certificate()
+	if certificate == nil {
+		// 인증서가 없으면 빈 인증서를 보낸다.
+		return &tls.Certificate{}, nil
+	}
+
+	return certificate, nil
+}
+
+/**
+ * base 설정에 서버 인증서 콜백을 지정한다.
+ * CA 번들은 연결마다 최신 값으로 교체된다.
+ */
+func (v *CertManager) ServerConfig(base *tls.Config) *tls.Config {
+	var config *tls.Config
+	if base == nil {
+		config = &tls.Config{}
+	} else {
+		config = base.Clone()
+	}
+
+	config.Certificates = nil
+	config.GetCertificate = v.GetCertificate
+	config.RootCAs = v.CertPool()
+	if config.ClientCAs != nil {
+		config.ClientCAs = v.CertPool()
+	}
+
+	useClientCAs := config.ClientCAs != nil
+	config.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		c := config.Clone()
+		c.GetConfigForClient = nil
+		c.RootCAs = v.CertPool()
+		if useClientCAs {
+			c.ClientCAs = v.CertPool()
+		}
+		return c, nil
+	}
+
+	return config
+}
+
+/**
+ * base 설정에 클라이언트 인증서 콜백과 현재 CA 번들을 지정한다.
+ * CA 번들이 없으면 시스템 CA 를 사용한다.
+ *
+ * RootCAs 는 호출 시점의 CA 번들이다. CA 번들이 다시 읽히면 설정을 새로 만들어야 한다.
+ * (MQTT 는 접속할 때마다, HttpClient 는 OnReload 에서 다시 만든다.)
+ */
+func (v *CertManager) ClientConfig(base *tls.Config) *tls.Config {
+	var config *tls.Config
+	if base == nil {
+		config = &tls.Config{}
+	} else {
+		config = base.Clone()
+	}
+
+	config.RootCAs = nil
+	if 0 < len(v.CaCertificates()) {
+		config.RootCAs = v.CertPool()
+	}
+	config.Certificates = nil
+	if v.HasCertificate() {
+		config.GetClientCertificate = v.GetClientCertificate
+	}
+
+	return config
+}
@@ -28,6 +28,24 @@ type MQTTConfigurations struct {
 	Cacertfile string
 	Certfile   string
 	Keyfile    string
+	Revocation RevocationConfigurations
+	TLSPolicy  TLSPolicyConfigurations
+	// 초 단위
+	KeepAlive            int64
+	ConnectTimeout       int64
+	MaxReconnectInterval int64
+	Will                 MQTTWillConfigurations
+	// 연결이 끊어진 동안 보낼 메시지를 저장한다. (Database 가 비어 있으면 사용하지 않는다.)
+	Buffer ForwardConfigurations
+}
+
+// Topic 을 지정하면 비정상 종료 시 Payload 를, 연결되면 OnlinePayload 를 보낸다.
+type MQTTWillConfigurations struct {
+	Topic         string
+	Payload       string
+	OnlinePayload string
+	Qos           int
+	Retain        bool
 }
 
 type ServiceConfigurations struct {
@@ -40,6 +58,16 @@ type ServiceConfigurations struct {
 	Timeout      int64
 	ReadTimeout  int64
 	WriteTimeout int64
+	IdleTimeout  int64
+	// 동시 연결 수 제한 (0: 제한 없음)
+	MaxConnections      int64
+	MaxConnectionsPerIp int64
+	// 클라이언트 인증서 확인: "" 또는 "none", "optional"(보낸 경우 확인), "require"
+	// 클라이언트 인증서는 CaCert 로 검증한다.
+	ClientAuth    string
+	Revocation    RevocationConfigurations
+	TLSPolicy     TLSPolicyConfigurations
+	ProxyProtocol ProxyProtocolConfigurations
 }
 
 type HttpConfigurations struct {
@@ -52,6 +80,223 @@ type HttpConfigurations struct {
 	Port          int64
 	Path          string
 	Timeout       int64
+	Revocation    RevocationConfigurations
+	TLSPolicy     TLSPolicyConfigurations
+	// 멱등 요청 재시도 횟수 (0: 기본값, 음수: 재시도 안 함)
+	Retries int64
+	// 호스트에 연속 BreakerThreshold 번 실패하면 BreakerCooldown(초) 동안 요청하지 않는다. (0: 기본값)
+	BreakerThreshold int64
+	BreakerCooldown  int64
+}
+
+// PROXY protocol(v1/v2) 헤더는 TrustedCidrs 에서 온 연결만 해석한다.
+type ProxyProtocolConfigurations struct {
+	Enable       bool
+	TrustedCidrs []string
+	// 헤더 수신 대기 시간 (초)
+	HeaderTimeout int64
+	// 헤더 수신 대기 중인 연결 수 제한 (0: 기본값)
+	MaxPending int64
+}
+
+/**
+ * 인증서 폐기 확인 설정
+ * CrlFile, CrlFiles 의 CRL 중 인증서 발급자의 것으로 확인한다. (발급자(중간 CA)마다 CRL 이 필요하다.)
+ * HardFail 이 false 이면 폐기 여부를 확인할 수 없을 때 연결을 허용한다.
+ */
+type RevocationConfigurations struct {
+	CrlFile       string
+	CrlFiles      []string
+	EnableOcsp    bool
+	OcspResponder string
+	OcspStapling  bool
+	HardFail      bool
+	CacheTimeout  int64
+	Timeout       int64
+}
+
+/**
+ * 재접속 클라이언트 설정
+ * Remotes 는 우선 순위 순서이며, 첫 번째가 주 서버이다.
+ * 백오프 시간은 밀리초, FailbackInterval 은 초 단위이다.
+ */
+type DialerConfigurations struct {
+	Remotes          []ServiceConfigurations
+	InitialBackoff   int64
+	MaxBackoff       int64
+	MaxRetries       int64
+	FailbackInterval int64
+}
+
+/**
+ * 저장 후 전달(store-and-forward) 설정
+ * Database 는 cachedb 파일, Table 은 사용할 테이블 번호이다.
+ * MaxCount, MaxBytes, MaxAge(초) 를 넘으면 오래된 메시지부터 삭제한다. (0: 제한 없음)
+ * RetryInterval(밀리초) 은 전송 실패 시 첫 재시도 대기 시간이다.
+ */
+type ForwardConfigurations struct {
+	Database      string
+	Table         int64
+	MaxCount      int64
+	MaxBytes      int64
+	MaxAge        int64
+	RetryInterval int64
+}
+
+/**
+ * 메시지 단위 중계 설정
+ * GatewayId 는 Wrap 시 0x8001 태그에 넣는 이 중계기의 식별자이다.
+ * WrapRemoteAddress 는 Wrap 시 송신 주소를 0x8003 태그로 추가한다.
+ * DropTypes 는 전달하지 않을 메시지 종류(GetMessageType 값)이다.
+ * RateLimit 은 연결당 초당 메시지 수 (0: 제한 없음), 넘는 메시지는 버린다.
+ * Ack 는 TCP 로 받은 메시지를 처리한 뒤 수신 확인(CODE_ACK)을 보낸다. (StoreForwarder 의 TcpRelay, NewAckPooledRelay 용)
+ */
+type MessageRelayConfigurations struct {
+	GatewayId         string
+	Wrap              bool
+	WrapRemoteAddress bool
+	DropTypes         []string
+	RateLimit         int64
+	RateBurst         int64
+	MaxMessageSize    int64
+	Ack               bool
+}
+
+/**
+ * 중계 경로 규칙
+ * Types(GetMessageType 값), Vendors(Wrapped, ELSSEN, YMTECH, TELEFIELD, ABRAIN),
+ * Gateways(송신 게이트웨이 ID) 가 모두 맞으면 Destinations 로 보낸다. 비어 있는 조건은 항상 맞다.
+ */
+type RouteConfigurations struct {
+	Types        []string
+	Vendors      []string
+	Gateways     []string
+	Destinations []string
+}
+
+/**
+ * 다중 목적지 중계 설정
+ * 맞는 규칙이 없으면 Default 목적지로 보낸다.
+ * QueueSize 는 목적지별 대기열 크기이다.
+ */
+type FanoutConfigurations struct {
+	Routes    []RouteConfigurations
+	Default   []string
+	QueueSize int64
+}
+
+// Authorization 을 지정하면 같은 Authorization 헤더로 연결한 경우만 허용한다.
+type WebSocketConfigurations struct {
+	Path           string
+	Authorization  string
+	Origins        []string
+	MaxMessageSize int64
+}
+
+type DatagramConfigurations struct {
+	Address string
+	Port    int64
+	// AES-256-GCM 키를 만드는 암호. 비어 있으면 암호화하지 않는다.
+	Passphrase     string
+	MaxMessageSize int64
+	// 재전송(replay)으로 보지 않는 시간 차이 (초)
+	ReplayWindow int64
+}
+
+// 수신 대기열 (Overflow: block, drop-oldest, drop-newest)
+type RecvQueueConfigurations struct {
+	QueueSize int64
+	Overflow  string
+}
+
+// 메시지 종류별 전송 경로 (Method: socket, mqtt, drop)
+type DispatchRouteConfigurations struct {
+	Type   string
+	Method string
+	Topic  string
+}
+
+type DispatchConfigurations struct {
+	GatewayId string
+	// 장비 코드(GW_TYPE_*). 지정하면 Prefix/현장 종류/게이트웨이 종류/게이트웨이 ID/메시지 이름 토픽을 사용한다.
+	GatewayType int
+	Routes      []DispatchRouteConfigurations
+}
+
+/**
+ * TLS 정책
+ * Preset: "legacy"(기존 동작), "default", "strict"
+ * Preset 이 비어 있으면 클라이언트는 legacy, 서버(리스너)는 default 를 사용한다.
+ * 나머지 값은 지정된 경우 Preset 값을 대체한다.
+ * strict 는 InsecureSkipVerify 를 허용하지 않는다.
+ */
+type TLSPolicyConfigurations struct {
+	Preset                string
+	MinVersion            string
+	MaxVersion            string
+	CipherSuites          []string
+	Curves                []string
+	DisableSessionTickets bool
+	NextProtos            []string
+	InsecureSkipVerify    bool
+}
+
+/**
+ * 인증서 만료 감시 설정
+ * Thresholds 는 경고를 보낼 만료 전 일 수(예: 30, 14, 7, 1)
+ */
+type CertMonitorConfigurations struct {
+	Interval   int64
+	Thresholds []int64
+	EventType  string
+}
+
+/**
+ * 내장 MQTT broker 설정
+ * Listeners 중 EnableTls 인 것은 TLS 로 받으며, CaCert 가 있으면 클라이언트 인증서를 확인한다.
+ * Users 는 사용자 이름별 비밀번호(bcrypt 해시 또는 평문)이다.
+ * CertAuth 이면 확인된 클라이언트 인증서의 CN 을 사용자 이름으로 사용한다.
+ * Users 와 CertAuth 를 모두 지정하지 않으면 인증하지 않는다.
+ * QueueSize 는 클라이언트별 전송 대기열과 오프라인 세션의 QoS 1 메시지 보관 수이다.
+ */
+type BrokerConfigurations struct {
+	Listeners      []ServiceConfigurations
+	Users          map[string]string
+	AllowAnonymous bool
+	CertAuth       bool
+	MaxPacketSize  int64
+	QueueSize      int64
+}
+
+/**
+ * MQTT 토픽 접근 규칙 설정
+ * File 은 JSON 규칙 파일, Database 는 sqlite 파일(topic_acl 테이블)이며 둘 다 지정하면 합친다.
+ * 규칙이 없는 게이트웨이는 Default 가 "allow" 이면 허용하고, 그 외에는 거부한다.
+ * ReloadInterval(초) 마다 규칙을 다시 읽는다. (0: 다시 읽지 않음)
+ */
+type TopicACLConfigurations struct {
+	File           string
+	Database       string
+	Default        string
+	ReloadInterval int64
+	EventType      string
+}
+
+/**
+ * 대용량 파일(블랙박스 영상, 가속도 원시 파일 등) 분할 전송 설정
+ * Directory 는 수신 측 저장 위치이며, 받는 동안 <파일ID>.part, <파일ID>.meta 파일을 둔다.
+ * ChunkSize 는 보내는 조각 크기(바이트), Timeout(초)은 응답 대기 시간, MaxRetries 는 다시 연결해 이어 보내는 횟수이다.
+ * MaxFileSize 를 넘는 파일은 받지 않는다. (0: 제한 없음)
+ * IdleTimeout(초) 동안 조각이 오지 않은 받는 중인 파일은 닫고, 동시에 받는 파일은 MaxIncoming 개까지이다.
+ */
+type FileTransferConfigurations struct {
+	Directory   string
+	ChunkSize   int64
+	Timeout     int64
+	MaxRetries  int64
+	MaxFileSize int64
+	IdleTimeout int64
+	MaxIncoming int64
 }
 
 type PublishConfigurations struct {
@@ -59,6 +304,7 @@ type PublishConfigurations struct {
 	Remote       ServiceConfigurations
 	MQTT         MQTTConfigurations
 	SourceId     string
+	GatewayType  int
 	EventLogUrl  string
 	DiagInterval int64
 }
@@ -66,6 +312,7 @@ type PublishConfigurations struct {
 type SubscribeConfigurations struct {
 	Remote       ServiceConfigurations
 	MQTT         MQTTConfigurations
+	Topics       []string
 	SourceId     string
 	EventLogUrl  string
 	DiagInterval int64
@@ -103,7 +350,7 @@ type FirmwareConfigurations struct {
 func (v GatewayConfigurations) ToString() []string {
 	strings := []string{}
 	strings = append(strings, fmt.Sprintf("Date: %s", v.Date))
-	strings = append(strings, fmt.Sprintf("Model: %t", v.Model))
+	strings = append(strings, fmt.Sprintf("Model: %s", v.Model))
 	strings = append(strings, fmt.Sprintf("Manufacture: %s", v.Manufacture))
 	strings = append(strings, fmt.Sprintf("Serial: %s", v.Serial))
 
@@ -117,6 +364,167 @@ func (v MQTTConfigurations) ToString() []string {
 	strings = append(strings, fmt.Sprintf("ClientId: %s", v.ClientId))
 	strings = append(strings, fmt.Sprintf("User: %s", v.User))
 	strings = append(strings, fmt.Sprintf("Password: %s", v.Password))
+	strings = append(strings, fmt.Sprintf("KeepAlive: %d", v.KeepAlive))
+	strings = append(strings, fmt.Sprintf("ConnectTimeout: %d", v.ConnectTimeout))
+	strings = append(strings, fmt.Sprintf("MaxReconnectInterval: %d", v.MaxReconnectInterval))
+	strings = append(strings, fmt.Sprintf("Will: %s", v.Will.ToString()))
+	strings = append(strings, fmt.Sprintf("Buffer: %s", v.Buffer.ToString()))
+
+	return strings
+}
+
+func (v MQTTWillConfigurations) ToString() []string {
+	strings := []string{}
+	strings = append(strings, fmt.Sprintf("Topic: %s", v.Topic))
+	strings = append(strings, fmt.Sprintf("Payload: %s", v.Payload))
+	strings = append(strings, fmt.Sprintf("OnlinePayload: %s", v.OnlinePayload))
+	strings = append(strings, fmt.Sprintf("Qos: %d", v.Qos))
+	strings = append(strings, fmt.Sprintf("Retain: %t", v.Retain))
+
+	return strings
+}
+
+func (v RevocationConfigurations) ToString() []string {
+	strings := []string{}
+	strings = append(strings, fmt.Sprintf("CrlFile: %s", v.CrlFile))
+	strings = append(strings, fmt.Sprintf("CrlFiles: %v", v.CrlFiles))
+	strings = append(strings, fmt.Sprintf("EnableOcsp: %t", v.EnableOcsp))
+	strings = append(strings, fmt.Sprintf("OcspResponder: %s", v.OcspResponder))
+	strings = append(strings, fmt.Sprintf("OcspStapling: %t", v.OcspStapling))
+	strings = append(strings, fmt.Sprintf("HardFail: %t", v.HardFail))
+	strings = append(strings, fmt.Sprintf("CacheTimeout: %d", v.CacheTimeout))
+	strings = append(strings, fmt.Sprintf("Timeout: %d", v.Timeout))
+
+	return strings
+}
+
+func (v DialerConfigurations) ToString() []string {
+	strings := []string{}
+	for i, remote := range v.Remotes {
+		strings = append(strings, fmt.Sprintf("Remotes[%d]: %s", i, remote.ToString()))
+	}
+	strings = append(strings, fmt.Sprintf("InitialBackoff: %d", v.InitialBackoff))
+	strings = append(strings, fmt.Sprintf("MaxBackoff: %d", v.MaxBackoff))
+	strings = append(strings, fmt.Sprintf("MaxRetries: %d", v.MaxRetries))
+	strings = append(strings, fmt.Sprintf("FailbackInterval: %d", v.FailbackInterval))
+
+	return strings
+}
+
+func (v ForwardConfigurations) ToString() []string {
+	strings := []string{}
+	strings = append(strings, fmt.Sprintf("Database: %s", v.Database))
+	strings = append(strings, fmt.Sprintf("Table: %d", v.Table))
+	strings = append(strings, fmt.Sprintf("MaxCount: %d", v.MaxCount))
+	strings = append(strings, fmt.Sprintf("MaxBytes: %d", v.MaxBytes))
+	strings = append(strings, fmt.Sprintf("MaxAge: %d", v.MaxAge))
+	strings = append(strings, fmt.Sprintf("RetryInterval: %d", v.RetryInterval))
+
+	return strings
+}
+
+func (v MessageRelayConfigurations) ToString() []string {
+	strings := []string{}
+	strings = append(strings, fmt.Sprintf("GatewayId: %s", v.GatewayId))
+	strings = append(strings, fmt.Sprintf("Wrap: %t", v.Wrap))
+	strings = append(strings, fmt.Sprintf("WrapRemoteAddress: %t", v.WrapRemoteAddress))
+	strings = append(strings, fmt.Sprintf("DropTypes: %v", v.DropTypes))
+	strings = append(strings, fmt.Sprintf("RateLimit: %d", v.RateLimit))
+	strings = append(strings, fmt.Sprintf("RateBurst: %d", v.RateBurst))
+	strings = append(strings, fmt.Sprintf("MaxMessageSize: %d", v.MaxMessageSize))
+	strings = append(strings, fmt.Sprintf("Ack: %t", v.Ack))
+
+	return strings
+}
+
+func (v RouteConfigurations) ToString() []string {
+	strings := []string{}
+	strings = append(strings, fmt.Sprintf("Types: %v", v.Types))
+	strings = append(strings, fmt.Sprintf("Vendors: %v", v.Vendors))
+	strings = append(strings, fmt.Sprintf("Gateways: %v", v.Gateways))
+	strings = append(strings, fmt.Sprintf("Destinations: %v", v.Destinations))
+
+	return strings
+}
+
+func (v FanoutConfigurations) ToString() []string {
+	strings := []string{}
+	for i, route := range v.Routes {
+		strings = append(strings, fmt.Sprintf("Routes[%d]: %s", i, route.ToString()))
+	}
+	strings = append(strings, fmt.Sprintf("Default: %v", v.Default))
+	strings = append(strings, fmt.Sprintf("QueueSize: %d", v.QueueSize))
+
+	return strings
+}
+
+func (v WebSocketConfigurations) ToString() []string {
+	strings := []string{}
+	strings = append(strings, fmt.Sprintf("Path: %s", v.Path))
+	strings = append(strings, fmt.Sprintf("Authorization: %t", 0 < len(v.Authorization)))
+	strings = append(strings, fmt.Sprintf("Origins: %v", v.Origins))
+	strings = append(strings, fmt.Sprintf("MaxMessageSize: %d", v.MaxMessageSize))
+
+	return strings
+}
+
+func (v DatagramConfigurations) ToString() []string {
+	strings := []string{}
+	strings = append(strings, fmt.Sprintf("Address: %s", v.Address))
+	strings = append(strings, fmt.Sprintf("Port: %d", v.Port))
+	strings = append(strings, fmt.Sprintf("Encrypted: %t", 0 < len(v.Passphrase)))
+	strings = append(strings, fmt.Sprintf("MaxMessageSize: %d", v.MaxMessageSize))
+	strings = append(strings, fmt.Sprintf("ReplayWindow: %d", v.ReplayWindow))
+
+	return strings
+}
+
+func (v RecvQueueConfigurations) ToString() []string {
+	strings := []string{}
+	strings = append(strings, fmt.Sprintf("QueueSize: %d", v.QueueSize))
+	strings = append(strings, fmt.Sprintf("Overflow: %s", v.Overflow))
+
+	return strings
+}
+
+func (v DispatchRouteConfigurations) ToString() []string {
+	strings := []string{}
+	strings = append(strings, fmt.Sprintf("Type: %s", v.Type))
+	strings = append(strings, fmt.Sprintf("Method: %s", v.Method))
+	strings = append(strings, fmt.Sprintf("Topic: %s", v.Topic))
+
+	return strings
+}
+
+func (v DispatchConfigurations) ToString() []string {
+	strings := []string{}
+	strings = append(strings, fmt.Sprintf("GatewayId: %s", v.GatewayId))
+	for i, route := range v.Routes {
+		strings = append(strings, fmt.Sprintf("Routes[%d]: %s", i, route.ToString()))
+	}
+
+	return strings
+}
+
+func (v TLSPolicyConfigurations) ToString() []string {
+	strings := []string{}
+	strings = append(strings, fmt.Sprintf("Preset: %s", v.Preset))
+	strings = append(strings, fmt.Sprintf("MinVersion: %s", v.MinVersion))
+	strings = append(strings, fmt.Sprintf("MaxVersion: %s", v.MaxVersion))
+	strings = append(strings, fmt.Sprintf("CipherSuites: %v", v.CipherSuites))
+	strings = append(strings, fmt.Sprintf("Curves: %v", v.Curves))
+	strings = append(strings, fmt.Sprintf("DisableSessionTickets: %t", v.DisableSessionTickets))
+	strings = append(strings, fmt.Sprintf("NextProtos: %v", v.NextProtos))
+	strings = append(strings, fmt.Sprintf("InsecureSkipVerify: %t", v.InsecureSkipVerify))
+
+	return strings
+}
+
+func (v CertMonitorConfigurations) ToString() []string {
+	strings := []string{}
+	strings = append(strings, fmt.Sprintf("Interval: %d", v.Interval))
+	strings = append(strings, fmt.Sprintf("Thresholds: %v", v.Thresholds))
+	strings = append(strings, fmt.Sprintf("EventType: %s", v.EventType))
 
 	return strings
 }
@@ -129,6 +537,23 @@ func (v ServiceConfigurations) ToString() []string {
 	strings = append(strings, fmt.Sprintf("Address: %s", v.Address))
 	strings = append(strings, fmt.Sprintf("Port: %d", v.Port))
 	strings = append(strings, fmt.Sprintf("Timeout: %d", v.Timeout))
+	strings = append(strings, fmt.Sprintf("ReadTimeout: %d", v.ReadTimeout))
+	strings = append(strings, fmt.Sprintf("WriteTimeout: %d", v.WriteTimeout))
+	strings = append(strings, fmt.Sprintf("IdleTimeout: %d", v.IdleTimeout))
+	strings = append(strings, fmt.Sprintf("MaxConnections: %d", v.MaxConnections))
+	strings = append(strings, fmt.Sprintf("MaxConnectionsPerIp: %d", v.MaxConnectionsPerIp))
+	strings = append(strings, fmt.Sprintf("ClientAuth: %s", v.ClientAuth))
+	strings = append(strings, fmt.Sprintf("ProxyProtocol: %s", v.ProxyProtocol.ToString()))
+
+	return strings
+}
+
+func (v ProxyProtocolConfigurations) ToString() []string {
+	strings := []string{}
+	strings = append(strings, fmt.Sprintf("Enable: %t", v.Enable))
+	strings = append(strings, fmt.Sprintf("TrustedCidrs: %v", v.TrustedCidrs))
+	strings = append(strings, fmt.Sprintf("HeaderTimeout: %d", v.HeaderTimeout))
+	strings = append(strings, fmt.Sprintf("MaxPending: %d", v.MaxPending))
 
 	return strings
 }
@@ -143,6 +568,9 @@ func (v HttpConfigurations) ToString() []string {
 	strings = append(strings, fmt.Sprintf("Port: %d", v.Port))
 	strings = append(strings, fmt.Sprintf("Path: %s", v.Path))
 	strings = append(strings, fmt.Sprintf("Timeout: %d", v.Timeout))
+	strings = append(strings, fmt.Sprintf("Retries: %d", v.Retries))
+	strings = append(strings, fmt.Sprintf("BreakerThreshold: %d", v.BreakerThreshold))
+	strings = append(strings, fmt.Sprintf("BreakerCooldown: %d", v.BreakerCooldown))
 
 	return strings
 }
@@ -227,12 +655,55 @@ func (v HttpConfigurations) Url(args ...string) (*url.URL, error) {
 	return u, nil
 }
 
+func (v BrokerConfigurations) ToString() []string {
+	strings := []string{}
+	for i, listener := range v.Listeners {
+		strings = append(strings, fmt.Sprintf("Listeners[%d]: %s", i, listener.ToString()))
+	}
+	users := []string{}
+	for user := range v.Users {
+		users = append(users, user)
+	}
+	strings = append(strings, fmt.Sprintf("Users: %v", users))
+	strings = append(strings, fmt.Sprintf("AllowAnonymous: %t", v.AllowAnonymous))
+	strings = append(strings, fmt.Sprintf("CertAuth: %t", v.CertAuth))
+	strings = append(strings, fmt.Sprintf("MaxPacketSize: %d", v.MaxPacketSize))
+	strings = append(strings, fmt.Sprintf("QueueSize: %d", v.QueueSize))
+
+	return strings
+}
+
+func (v TopicACLConfigurations) ToString() []string {
+	strings := []string{}
+	strings = append(strings, fmt.Sprintf("File: %s", v.File))
+	strings = append(strings, fmt.Sprintf("Database: %s", v.Database))
+	strings = append(strings, fmt.Sprintf("Default: %s", v.Default))
+	strings = append(strings, fmt.Sprintf("ReloadInterval: %d", v.ReloadInterval))
+	strings = append(strings, fmt.Sprintf("EventType: %s", v.EventType))
+
+	return strings
+}
+
+func (v FileTransferConfigurations) ToString() []string {
+	strings := []string{}
+	strings = append(strings, fmt.Sprintf("Directory: %s", v.Directory))
+	strings = append(strings, fmt.Sprintf("ChunkSize: %d", v.ChunkSize))
+	strings = append(strings, fmt.Sprintf("Timeout: %d", v.Timeout))
+	strings = append(strings, fmt.Sprintf("MaxRetries: %d", v.MaxRetries))
+	strings = append(strings, fmt.Sprintf("MaxFileSize: %d", v.MaxFileSize))
+	strings = append(strings, fmt.Sprintf("IdleTimeout: %d", v.IdleTimeout))
+	strings = append(strings, fmt.Sprintf("MaxIncoming: %d", v.MaxIncoming))
+
+	return strings
+}
+
 func (v PublishConfigurations) ToString() []string {
 	strings := []string{}
 	strings = append(strings, fmt.Sprintf("Service: %s", v.Service.ToString()))
 	strings = append(strings, fmt.Sprintf("Remote: %s", v.Remote.ToString()))
 	strings = append(strings, fmt.Sprintf("MQTT: %s", v.MQTT.ToString()))
 	strings = append(strings, fmt.Sprintf("SourceId: %s", v.SourceId))
+	strings = append(strings, fmt.Sprintf("GatewayType: 0x%02X", v.GatewayType))
 	strings = append(strings, fmt.Sprintf("EventLogUrl: %s", v.EventLogUrl))
 	strings = append(strings, fmt.Sprintf("DiagInterval: %d", v.DiagInterval))
 
@@ -243,6 +714,7 @@ func (v SubscribeConfigurations) ToString() []string {
 	strings := []string{}
 	strings = append(strings, fmt.Sprintf("Remote: %s", v.Remote.ToString()))
 	strings = append(strings, fmt.Sprintf("MQTT: %s", v.MQTT.ToString()))
+	strings = append(strings, fmt.Sprintf("Topics: %v", v.Topics))
 	strings = append(strings, fmt.Sprintf("SourceId: %s", v.SourceId))
 	strings = append(strings, fmt.Sprintf("EventLogUrl: %s", v.EventLogUrl))
 	strings = append(strings, fmt.Sprintf("DiagInterval: %d", v.DiagInterval))
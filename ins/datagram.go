@@ -0,0 +1,360 @@
+package ins
+
+import (
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/industry-netsecurity-solution/ins-security-channel/encrypt"
+	"github.com/industry-netsecurity-solution/ins-security-channel/logger"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// UDP 로 보낼 수 있는 최대 크기 (IPv4)
+const MaxDatagramSize = 65507
+
+// 재전송(replay) 허용 시간 기본값
+var DefaultReplayWindow = 30 * time.Second
+
+// 암호화된 datagram 형식: 버전(1) + nonce(12) + AES-256-GCM(시간(8) + TLV 메시지)
+const datagramVersion byte = 0x01
+const datagramTimestampSize = 8
+
+var ErrInvalidDatagram = errors.New("invalid datagram")
+var ErrDatagramTooLarge = errors.New("datagram too large")
+var ErrReplayedDatagram = errors.New("replayed datagram")
+
+type datagramCipher struct {
+	sync.Mutex
+	aead   cipher.AEAD
+	window time.Duration
+	seen   map[string]time.Time
+	pruned time.Time
+}
+
+func newDatagramCipher(config *DatagramConfigurations) (*datagramCipher, error) {
+	if len(config.Passphrase) == 0 {
+		return nil, nil
+	}
+
+	key, err := encrypt.GenSecretkeyByPassphrase([]byte(config.Passphrase))
+	if err != nil {
+		return nil, err
+	}
+	aead, err := encrypt.GetGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	v := new(datagramCipher)
+	v.aead = aead
+	v.window = DefaultReplayWindow
+	if 0 < config.ReplayWindow {
+		v.window = time.Duration(config.ReplayWindow) * time.Second
+	}
+	v.seen = make(map[string]time.Time)
+
+	return v, nil
+}
+
+func (v *datagramCipher) overhead() int {
+	return 1 + v.aead.NonceSize() + datagramTimestampSize + v.aead.Overhead()
+}
+
+func (v *datagramCipher) seal(data []byte) ([]byte, error) {
+	nonceSize := v.aead.NonceSize()
+
+	packet := make([]byte, 1+nonceSize, v.overhead()+len(data))
+	packet[0] = datagramVersion
+	if _, err := io.ReadFull(rand.Reader, packet[1:]); err != nil {
+		return nil, err
+	}
+
+	plaintext := make([]byte, datagramTimestampSize, datagramTimestampSize+len(data))
+	binary.BigEndian.PutUint64(plaintext, uint64(time.Now().UnixNano()))
+	plaintext = append(plaintext, data...)
+
+	return v.aead.Seal(packet, packet[1:], plaintext, packet[:1]), nil
+}
+
+func (v *datagramCipher) open(packet []byte) ([]byte, error) {
+	nonceSize := v.aead.NonceSize()
+	if len(packet) < v.overhead() || packet[0] != datagramVersion {
+		return nil, ErrInvalidDatagram
+	}
+
+	nonce := packet[1 : 1+nonceSize]
+	plaintext, err := v.aead.Open(nil, nonce, packet[1+nonceSize:], packet[:1])
+	if err != nil {
+		return nil, ErrInvalidDatagram
+	}
+
+	now := time.Now()
+	sent := time.Unix(0, int64(binary.BigEndian.Uint64(plaintext)))
+	if sent.Before(now.Add(-v.window)) || sent.After(now.Add(v.window)) {
+		return nil, ErrReplayedDatagram
+	}
+
+	v.Lock()
+	defer v.Unlock()
+
+	// 허용 시간 안에 같은 nonce 가 다시 오면 재전송이다.
+	if _, ok := v.seen[string(nonce)]; ok {
+		return nil, ErrReplayedDatagram
+	}
+	v.seen[string(nonce)] = sent
+
+	if v.window < now.Sub(v.pruned) {
+		for key, t := range v.seen {
+			if t.Before(now.Add(-v.window)) {
+				delete(v.seen, key)
+			}
+		}
+		v.pruned = now
+	}
+
+	return plaintext[datagramTimestampSize:], nil
+}
+
+func datagramMaxMessageSize(config *DatagramConfigurations) int {
+	if 0 < config.MaxMessageSize && config.MaxMessageSize < MaxDatagramSize {
+		return int(config.MaxMessageSize)
+	}
+	return MaxDatagramSize
+}
+
+/**
+ * datagram 하나가 TLV 메시지 하나인지 확인한다.
+ */
+func CheckDatagramMessage(order binary.ByteOrder, data []byte, max int) (*TL32V, error) {
+	if len(data) < 6 {
+		return nil, ErrInvalidDatagram
+	}
+	if max < len(data) {
+		return nil, ErrDatagramTooLarge
+	}
+	if uint64(order.Uint32(data[2:6])) != uint64(len(data)-6) {
+		return nil, ErrInvalidDatagram
+	}
+
+	return DecTL32V(order, data)
+}
+
+func datagramAddress(config *DatagramConfigurations, any bool) string {
+	address := config.Address
+	if len(address) == 0 && any {
+		address = "0.0.0.0"
+	}
+	if strings.Contains(address, ":") {
+		// IPv6
+		return fmt.Sprintf("[%s]:%d", address, config.Port)
+	}
+	return fmt.Sprintf("%s:%d", address, config.Port)
+}
+
+/**
+ * UDP 로 TLV 메시지를 받는다. datagram 하나에 메시지 하나를 담는다.
+ *
+ * Passphrase 를 지정하면 AES-256-GCM 으로 인증/복호화하고 허용 시간을 벗어나거나
+ * 이미 받은 datagram 은 버린다. 손실과 순서 바뀜은 처리하지 않는다.
+ */
+type DatagramServer struct {
+	config   DatagramConfigurations
+	order    binary.ByteOrder
+	conn     *net.UDPConn
+	cipher   *datagramCipher
+	ud       interface{}
+	callback func(net.Addr, []byte, interface{}) error
+	received int64
+	invalid  int64
+	replayed int64
+	failed   int64
+	wg       sync.WaitGroup
+}
+
+/**
+ * callback 은 수신 goroutine 에서 호출되므로 오래 걸리는 처리는 따로 넘긴다.
+ */
+func ListenDatagram(config *DatagramConfigurations, ud interface{}, callback func(net.Addr, []byte, interface{}) error) (*DatagramServer, error) {
+	if config == nil {
+		return nil, errors.New("DatagramConfigurations is nil")
+	}
+	if callback == nil {
+		return nil, errors.New("callback is nil")
+	}
+
+	aead, err := newDatagramCipher(config)
+	if err != nil {
+		return nil, err
+	}
+
+	addr, err := net.ResolveUDPAddr("udp", datagramAddress(config, true))
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	v := new(DatagramServer)
+	v.config = *config
+	v.order = binary.LittleEndian
+	v.conn = conn
+	v.cipher = aead
+	v.ud = ud
+	v.callback = callback
+
+	v.wg.Add(1)
+	go v.serve()
+
+	return v, nil
+}
+
+func (v *DatagramServer) serve() {
+	defer v.wg.Done()
+
+	max := datagramMaxMessageSize(&v.config)
+	b := make([]byte, MaxDatagramSize+1)
+	for {
+		n, remote, err := v.conn.ReadFrom(b)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			logger.Errorf("datagram: %v", err)
+			continue
+		}
+		atomic.AddInt64(&v.received, 1)
+
+		data := make([]byte, n)
+		copy(data, b[:n])
+
+		if v.cipher != nil {
+			if data, err = v.cipher.open(data); err != nil {
+				if err == ErrReplayedDatagram {
+					atomic.AddInt64(&v.replayed, 1)
+				} else {
+					atomic.AddInt64(&v.invalid, 1)
+				}
+				logger.Warningf("datagram from %v dropped: %v", remote, err)
+				continue
+			}
+		}
+
+		if _, err = CheckDatagramMessage(v.order, data, max); err != nil {
+			atomic.AddInt64(&v.invalid, 1)
+			logger.Warningf("datagram from %v dropped: %v", remote, err)
+			continue
+		}
+
+		if err = v.callback(remote, data, v.ud); err != nil {
+			atomic.AddInt64(&v.failed, 1)
+			logger.Debugf("datagram from %v: %v", remote, err)
+		}
+	}
+}
+
+func (v *DatagramServer) Addr() net.Addr {
+	return v.conn.LocalAddr()
+}
+
+/**
+ * 진단 출력용 문자열
+ */
+func (v *DatagramServer) Diagnostics() []string {
+	strings := []string{}
+	strings = append(strings, fmt.Sprintf("Received: %d", atomic.LoadInt64(&v.received)))
+	strings = append(strings, fmt.Sprintf("Invalid: %d", atomic.LoadInt64(&v.invalid)))
+	strings = append(strings, fmt.Sprintf("Replayed: %d", atomic.LoadInt64(&v.replayed)))
+	strings = append(strings, fmt.Sprintf("Failed: %d", atomic.LoadInt64(&v.failed)))
+
+	return strings
+}
+
+func (v *DatagramServer) Close() error {
+	err := v.conn.Close()
+	v.wg.Wait()
+
+	return err
+}
+
+/**
+ * UDP 로 TLV 메시지를 보내는 DataRelay. 보낸 바이트 수(메시지 길이)를 반환한다.
+ */
+type DatagramSender struct {
+	config DatagramConfigurations
+	order  binary.ByteOrder
+	conn   *net.UDPConn
+	cipher *datagramCipher
+}
+
+func NewDatagramSender(config *DatagramConfigurations) (*DatagramSender, error) {
+	if config == nil {
+		return nil, errors.New("DatagramConfigurations is nil")
+	}
+
+	aead, err := newDatagramCipher(config)
+	if err != nil {
+		return nil, err
+	}
+
+	addr, err := net.ResolveUDPAddr("udp", datagramAddress(config, false))
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.DialUDP("udp", nil, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	v := new(DatagramSender)
+	v.config = *config
+	v.order = binary.LittleEndian
+	v.conn = conn
+	v.cipher = aead
+
+	return v, nil
+}
+
+func (v *DatagramSender) DoSend(args ...interface{}) (interface{}, error) {
+	if len(args) == 0 {
+		return 0, errors.New("no data")
+	}
+	data, ok := args[0].([]byte)
+	if ok == false {
+		return 0, errors.New("data is not []byte")
+	}
+
+	max := datagramMaxMessageSize(&v.config)
+	if v.cipher != nil && MaxDatagramSize-v.cipher.overhead() < max {
+		max = MaxDatagramSize - v.cipher.overhead()
+	}
+	if _, err := CheckDatagramMessage(v.order, data, max); err != nil {
+		return 0, err
+	}
+
+	packet := data
+	if v.cipher != nil {
+		var err error
+		if packet, err = v.cipher.seal(data); err != nil {
+			return 0, err
+		}
+	}
+
+	if _, err := v.conn.Write(packet); err != nil {
+		return 0, err
+	}
+
+	return len(data), nil
+}
+
+func (v *DatagramSender) Close() error {
+	return v.conn.Close()
+}
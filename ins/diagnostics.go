@@ -0,0 +1,65 @@
+package ins
+
+import (
+	"github.com/industry-netsecurity-solution/ins-security-channel/logger"
+	"sort"
+	"sync"
+)
+
+var diagnostics = make(map[string]func() []string)
+var diagnosticsLock sync.Mutex
+
+/**
+ * 진단 정보 제공 함수를 등록한다. 같은 이름이 있으면 교체한다.
+ */
+func RegisterDiagnostics(name string, provider func() []string) {
+	diagnosticsLock.Lock()
+	defer diagnosticsLock.Unlock()
+
+	diagnostics[name] = provider
+}
+
+func UnregisterDiagnostics(name string) {
+	diagnosticsLock.Lock()
+	defer diagnosticsLock.Unlock()
+
+	delete(diagnostics, name)
+}
+
+/**
+ * 등록된 진단 정보를 이름 순으로 수집한다.
+ */
+func GetDiagnostics() ([]string, map[string][]string) {
+	diagnosticsLock.Lock()
+	providers := make(map[string]func() []string, len(diagnostics))
+	for name, provider := range diagnostics {
+		providers[name] = provider
+	}
+	diagnosticsLock.Unlock()
+
+	names := make([]string, 0, len(providers))
+	for name := range providers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	results := make(map[string][]string, len(providers))
+	for _, name := range names {
+		results[name] = providers[name]()
+	}
+
+	return names, results
+}
+
+/**
+ * 진단 정보를 로그로 출력한다.
+ */
+func PrintDiagnostics() {
+	names, results := GetDiagnostics()
+	for _, name := range names {
+		logger.Infof("[%s]", name)
+		for _, line := range results[name] {
+			logger.Infof("  %s", line)
+		}
+	}
+}
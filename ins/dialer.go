@@ -0,0 +1,548 @@
+package ins
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/industry-netsecurity-solution/ins-security-channel/logger"
+	"math/rand"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// 재접속 대기 시간 기본값
+var DefaultInitialBackoff = 500 * time.Millisecond
+var DefaultMaxBackoff = 60 * time.Second
+
+// 보조 서버에 연결된 동안 우선 순위가 높은 서버를 확인하는 주기 기본값
+var DefaultFailbackInterval = 60 * time.Second
+
+var ErrDialerClosed = errors.New("dialer closed")
+
+type ConnState int
+
+const (
+	STATE_DISCONNECTED ConnState = iota
+	STATE_CONNECTING
+	STATE_CONNECTED
+	STATE_CLOSED
+)
+
+func (v ConnState) String() string {
+	switch v {
+	case STATE_DISCONNECTED:
+		return "DISCONNECTED"
+	case STATE_CONNECTING:
+		return "CONNECTING"
+	case STATE_CONNECTED:
+		return "CONNECTED"
+	case STATE_CLOSED:
+		return "CLOSED"
+	}
+	return fmt.Sprintf("ConnState(%d)", int(v))
+}
+
+const (
+	maxHealthScore = 100
+	minHealthScore = 0
+)
+
+type endpoint struct {
+	index       int
+	remote      ServiceConfigurations
+	score       int
+	successes   int64
+	failures    int64
+	lastError   error
+	lastAttempt time.Time
+	lastSuccess time.Time
+	latency     time.Duration
+}
+
+/**
+ * 연결 대상 상태 조회용 정보
+ */
+type EndpointInfo struct {
+	Index       int
+	Address     string
+	Score       int
+	Successes   int64
+	Failures    int64
+	LastError   string
+	LastAttempt time.Time
+	LastSuccess time.Time
+	Latency     time.Duration
+	Current     bool
+}
+
+func (v EndpointInfo) ToString() string {
+	return fmt.Sprintf("[%d] %s score %d, success %d, failure %d, latency %v, current %t, last error %s",
+		v.Index, v.Address, v.Score, v.Successes, v.Failures, v.Latency, v.Current, v.LastError)
+}
+
+/**
+ * 여러 연결 대상에 대해 재접속, failover/failback 을 수행하는 클라이언트
+ *
+ * 연결 실패 시 지수 백오프(jitter 포함) 후 다시 시도하며, 연결 대상은
+ * 상태 점수가 높은 순, 같으면 우선 순위 순으로 선택한다.
+ * 보조 서버에 연결된 동안에는 FailbackInterval 주기로 우선 순위가 높은 서버를 확인하여
+ * 연결되면 그쪽으로 전환한다.
+ */
+type ReconnectDialer struct {
+	sync.Mutex
+	initialBackoff   time.Duration
+	maxBackoff       time.Duration
+	maxRetries       int64
+	failbackInterval time.Duration
+	endpoints        []*endpoint
+	current          *endpoint
+	conn             net.Conn
+	state            ConnState
+	handlers         []func(ConnState, *ServiceConfigurations, error)
+	dial             func(*ServiceConfigurations) (net.Conn, error)
+	stop             chan struct{}
+	connecting       chan struct{}
+	// 실행 중인 failback 확인을 중지한다.
+	failbackStop chan struct{}
+}
+
+func NewReconnectDialer(config *DialerConfigurations) (*ReconnectDialer, error) {
+	if config == nil || len(config.Remotes) == 0 {
+		return nil, errors.New("no remote endpoints")
+	}
+
+	v := new(ReconnectDialer)
+	v.initialBackoff = DefaultInitialBackoff
+	if 0 < config.InitialBackoff {
+		v.initialBackoff = time.Duration(config.InitialBackoff) * time.Millisecond
+	}
+	v.maxBackoff = DefaultMaxBackoff
+	if 0 < config.MaxBackoff {
+		v.maxBackoff = time.Duration(config.MaxBackoff) * time.Millisecond
+	}
+	if v.maxBackoff < v.initialBackoff {
+		v.maxBackoff = v.initialBackoff
+	}
+	v.maxRetries = config.MaxRetries
+	v.failbackInterval = DefaultFailbackInterval
+	if 0 < config.FailbackInterval {
+		v.failbackInterval = time.Duration(config.FailbackInterval) * time.Second
+	}
+
+	for i, remote := range config.Remotes {
+		v.endpoints = append(v.endpoints, &endpoint{
+			index:  i,
+			remote: remote,
+			score:  maxHealthScore,
+		})
+	}
+	v.state = STATE_DISCONNECTED
+	v.dial = Dial
+	v.stop = make(chan struct{})
+
+	return v, nil
+}
+
+/**
+ * 연결 상태가 바뀔 때 호출할 함수를 등록한다.
+ * remote 는 연결된(또는 시도 중인) 대상이며, 없으면 nil 이다.
+ */
+func (v *ReconnectDialer) OnStateChange(handler func(state ConnState, remote *ServiceConfigurations, err error)) {
+	v.Lock()
+	defer v.Unlock()
+
+	v.handlers = append(v.handlers, handler)
+}
+
+func (v *ReconnectDialer) setState(state ConnState, ep *endpoint, err error) {
+	v.Lock()
+	if v.state == STATE_CLOSED || (v.state == state && state != STATE_CONNECTED) {
+		v.Unlock()
+		return
+	}
+	v.state = state
+	handlers := make([]func(ConnState, *ServiceConfigurations, error), len(v.handlers))
+	copy(handlers, v.handlers)
+	v.Unlock()
+
+	notifyState(handlers, state, ep, err)
+}
+
+func notifyState(handlers []func(ConnState, *ServiceConfigurations, error), state ConnState, ep *endpoint, err error) {
+	var remote *ServiceConfigurations = nil
+	if ep != nil {
+		r := ep.remote
+		remote = &r
+	}
+
+	for _, handler := range handlers {
+		handler(state, remote, err)
+	}
+}
+
+func (v *ReconnectDialer) State() ConnState {
+	v.Lock()
+	defer v.Unlock()
+
+	return v.state
+}
+
+/**
+ * 현재 연결. 연결되어 있지 않으면 nil
+ */
+func (v *ReconnectDialer) Conn() net.Conn {
+	v.Lock()
+	defer v.Unlock()
+
+	return v.conn
+}
+
+/**
+ * 현재 연결 대상. 연결되어 있지 않으면 nil
+ */
+func (v *ReconnectDialer) Current() *ServiceConfigurations {
+	v.Lock()
+	defer v.Unlock()
+
+	if v.current == nil {
+		return nil
+	}
+	r := v.current.remote
+	return &r
+}
+
+func (v *ReconnectDialer) Endpoints() []EndpointInfo {
+	v.Lock()
+	defer v.Unlock()
+
+	results := []EndpointInfo{}
+	for _, ep := range v.endpoints {
+		info := EndpointInfo{
+			Index:       ep.index,
+			Address:     fmt.Sprintf("%s:%d", ep.remote.Address, ep.remote.Port),
+			Score:       ep.score,
+			Successes:   ep.successes,
+			Failures:    ep.failures,
+			LastAttempt: ep.lastAttempt,
+			LastSuccess: ep.lastSuccess,
+			Latency:     ep.latency,
+			Current:     ep == v.current,
+		}
+		if ep.lastError != nil {
+			info.LastError = ep.lastError.Error()
+		}
+		results = append(results, info)
+	}
+
+	return results
+}
+
+/**
+ * 진단 출력용 문자열
+ */
+func (v *ReconnectDialer) Diagnostics() []string {
+	strings := []string{fmt.Sprintf("State: %s", v.State())}
+	for _, info := range v.Endpoints() {
+		strings = append(strings, info.ToString())
+	}
+
+	return strings
+}
+
+func (v *ReconnectDialer) success(ep *endpoint, latency time.Duration) {
+	v.Lock()
+	defer v.Unlock()
+
+	ep.successes++
+	ep.lastSuccess = time.Now()
+	ep.lastError = nil
+	ep.latency = latency
+	if ep.score += 25; maxHealthScore < ep.score {
+		ep.score = maxHealthScore
+	}
+}
+
+func (v *ReconnectDialer) failure(ep *endpoint, err error) {
+	v.Lock()
+	defer v.Unlock()
+
+	ep.failures++
+	ep.lastError = err
+	if ep.score /= 2; ep.score < minHealthScore {
+		ep.score = minHealthScore
+	}
+}
+
+/**
+ * 시도 순서: 상태 점수가 높은 순, 같으면 우선 순위 순
+ */
+func (v *ReconnectDialer) candidates() []*endpoint {
+	v.Lock()
+	defer v.Unlock()
+
+	results := make([]*endpoint, len(v.endpoints))
+	copy(results, v.endpoints)
+	sort.SliceStable(results, func(i, j int) bool {
+		if results[i].score != results[j].score {
+			return results[i].score > results[j].score
+		}
+		return results[i].index < results[j].index
+	})
+
+	return results
+}
+
+func (v *ReconnectDialer) tryDial(ep *endpoint) (net.Conn, error) {
+	v.Lock()
+	ep.lastAttempt = time.Now()
+	remote := ep.remote
+	v.Unlock()
+
+	start := time.Now()
+	conn, err := v.dial(&remote)
+	if err != nil {
+		v.failure(ep, err)
+		return nil, err
+	}
+	v.success(ep, time.Since(start))
+
+	return conn, nil
+}
+
+func (v *ReconnectDialer) backoff(attempt int64) time.Duration {
+	backoff := v.initialBackoff
+	for i := int64(0); i < attempt && backoff < v.maxBackoff; i++ {
+		backoff *= 2
+	}
+	if v.maxBackoff < backoff {
+		backoff = v.maxBackoff
+	}
+
+	// equal jitter: backoff/2 ~ backoff
+	half := backoff / 2
+	return half + time.Duration(rand.Int63n(int64(half)+1))
+}
+
+/**
+ * 연결될 때까지 시도한다. 이미 연결되어 있으면 현재 연결을 반환한다.
+ * ctx 가 끝나거나 MaxRetries 회 모두 실패하면 오류를 반환한다.
+ */
+func (v *ReconnectDialer) Connect(ctx context.Context) (net.Conn, error) {
+	for {
+		v.Lock()
+		if v.state == STATE_CLOSED {
+			v.Unlock()
+			return nil, ErrDialerClosed
+		}
+		if v.conn != nil {
+			conn := v.conn
+			v.Unlock()
+			return conn, nil
+		}
+		if v.connecting == nil {
+			v.connecting = make(chan struct{})
+			v.Unlock()
+			break
+		}
+		// 다른 goroutine 이 연결 중이면 기다린다.
+		connecting := v.connecting
+		v.Unlock()
+
+		select {
+		case <-connecting:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	conn, err := v.connect(ctx)
+
+	v.Lock()
+	close(v.connecting)
+	v.connecting = nil
+	v.Unlock()
+
+	return conn, err
+}
+
+func (v *ReconnectDialer) connect(ctx context.Context) (net.Conn, error) {
+	var lastErr error = nil
+
+	for attempt := int64(0); v.maxRetries <= 0 || attempt < v.maxRetries; attempt++ {
+		for _, ep := range v.candidates() {
+			v.setState(STATE_CONNECTING, ep, lastErr)
+
+			conn, err := v.tryDial(ep)
+			if err != nil {
+				logger.Warningf("connect to %s:%d failed: %v", ep.remote.Address, ep.remote.Port, err)
+				lastErr = err
+				continue
+			}
+
+			if v.attach(conn, ep) == false {
+				conn.Close()
+				return nil, ErrDialerClosed
+			}
+			v.setState(STATE_CONNECTED, ep, nil)
+
+			return conn, nil
+		}
+
+		v.setState(STATE_DISCONNECTED, nil, lastErr)
+
+		delay := v.backoff(attempt)
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		case <-v.stop:
+			timer.Stop()
+			return nil, ErrDialerClosed
+		}
+	}
+
+	return nil, fmt.Errorf("connect failed after %d retries: %v", v.maxRetries, lastErr)
+}
+
+func (v *ReconnectDialer) attach(conn net.Conn, ep *endpoint) bool {
+	v.Lock()
+	defer v.Unlock()
+
+	if v.state == STATE_CLOSED {
+		return false
+	}
+	v.conn = conn
+	v.current = ep
+	v.restartFailback(ep)
+
+	return true
+}
+
+/**
+ * 이전 failback 확인을 중지하고, 보조 서버에 연결되었으면 새로 시작한다.
+ * v.Lock 을 잡은 상태에서 호출한다.
+ */
+func (v *ReconnectDialer) restartFailback(ep *endpoint) {
+	if v.failbackStop != nil {
+		close(v.failbackStop)
+		v.failbackStop = nil
+	}
+	if ep == nil || ep.index == 0 || v.state == STATE_CLOSED {
+		return
+	}
+
+	v.failbackStop = make(chan struct{})
+	go v.failback(ep, v.failbackStop)
+}
+
+/**
+ * 연결 사용 중 오류가 발생하면 호출한다.
+ * conn 이 현재 연결이면 닫고 상태를 DISCONNECTED 로 바꾼다. 다음 Connect 에서 다시 연결한다.
+ */
+func (v *ReconnectDialer) Fail(conn net.Conn, err error) {
+	v.Lock()
+	if conn == nil || v.conn != conn {
+		v.Unlock()
+		return
+	}
+	ep := v.current
+	v.conn = nil
+	v.current = nil
+	v.restartFailback(nil)
+	v.Unlock()
+
+	conn.Close()
+	if ep != nil {
+		v.failure(ep, err)
+	}
+	v.setState(STATE_DISCONNECTED, ep, err)
+}
+
+/**
+ * 보조 서버에 연결된 동안 우선 순위가 높은 서버로 돌아갈 수 있는지 확인한다.
+ */
+func (v *ReconnectDialer) failback(connected *endpoint, stop chan struct{}) {
+	ticker := time.NewTicker(v.failbackInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-v.stop:
+			return
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		v.Lock()
+		if v.current != connected || v.conn == nil {
+			v.Unlock()
+			return
+		}
+		preferred := make([]*endpoint, 0, connected.index)
+		for _, ep := range v.endpoints {
+			if ep.index < connected.index {
+				preferred = append(preferred, ep)
+			}
+		}
+		v.Unlock()
+
+		for _, ep := range preferred {
+			conn, err := v.tryDial(ep)
+			if err != nil {
+				continue
+			}
+
+			v.Lock()
+			if v.failbackStop != stop || v.current != connected || v.state == STATE_CLOSED {
+				v.Unlock()
+				conn.Close()
+				return
+			}
+			old := v.conn
+			v.conn = conn
+			v.current = ep
+			v.restartFailback(ep)
+			v.Unlock()
+
+			logger.Infof("failback to %s:%d", ep.remote.Address, ep.remote.Port)
+			if old != nil {
+				old.Close()
+			}
+			v.setState(STATE_CONNECTED, ep, nil)
+			return
+		}
+	}
+}
+
+/**
+ * 연결을 닫고 더 이상 연결하지 않는다.
+ */
+func (v *ReconnectDialer) Close() error {
+	v.Lock()
+	if v.state == STATE_CLOSED {
+		v.Unlock()
+		return nil
+	}
+	conn := v.conn
+	ep := v.current
+	v.conn = nil
+	v.current = nil
+	v.restartFailback(nil)
+	v.state = STATE_CLOSED
+	close(v.stop)
+	handlers := make([]func(ConnState, *ServiceConfigurations, error), len(v.handlers))
+	copy(handlers, v.handlers)
+	v.Unlock()
+
+	notifyState(handlers, STATE_CLOSED, ep, nil)
+
+	if conn != nil {
+		return conn.Close()
+	}
+	return nil
+}
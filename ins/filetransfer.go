@@ -0,0 +1,1076 @@
+package ins
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+	"github.com/industry-netsecurity-solution/ins-security-channel/logger"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/*
+ * 대용량 파일 분할 전송
+ *
+ * CODE_FILE(2) 길이(4) [ 종류(2) 길이(4) [ 필드 TLV ... ] ]
+ *
+ * 보내는 쪽: FILE_OFFER -> (FILE_STATUS) -> FILE_CHUNK ... -> FILE_END -> (FILE_STATUS)
+ * 받는 쪽은 FILE_OFFER 에 이미 받은 크기(offset)를 응답하므로 연결이 끊어진 뒤에도 이어서 보낼 수 있다.
+ * 조각마다 SHA-256 을 확인하고, 마지막에 파일 전체의 SHA-256 을 확인한다.
+ */
+
+// 메시지 종류
+var FILE_OFFER = []byte{0x00, 0x01}
+var FILE_CHUNK = []byte{0x00, 0x02}
+var FILE_END = []byte{0x00, 0x03}
+var FILE_STATUS = []byte{0x00, 0x04}
+
+// 필드
+var FILE_TAG_ID = []byte{0x00, 0x01}
+var FILE_TAG_NAME = []byte{0x00, 0x02}
+var FILE_TAG_SIZE = []byte{0x00, 0x03}
+var FILE_TAG_SHA256 = []byte{0x00, 0x04}
+var FILE_TAG_CODE = []byte{0x00, 0x05}
+var FILE_TAG_GATEWAY_ID = []byte{0x00, 0x06}
+var FILE_TAG_OFFSET = []byte{0x00, 0x07}
+var FILE_TAG_DATA = []byte{0x00, 0x08}
+var FILE_TAG_STATUS = []byte{0x00, 0x09}
+
+// FILE_STATUS 의 상태
+const (
+	// offset 부터 보낸다.
+	FILE_STATUS_CONTINUE uint32 = 0
+	// 받기를 마쳤다.
+	FILE_STATUS_COMPLETE uint32 = 1
+	// 전체 SHA-256 이 다르다. 처음부터 다시 보낸다.
+	FILE_STATUS_CORRUPTED uint32 = 2
+	// 받지 않는다.
+	FILE_STATUS_REJECTED uint32 = 3
+)
+
+const DefaultFileChunkSize int64 = 256 * 1024
+const MaxFileChunkSize int64 = 4 * 1024 * 1024
+const DefaultFileTransferTimeout int64 = 30
+const DefaultFileTransferRetries int64 = 5
+const DefaultFileIdleTimeout int64 = 300
+const DefaultMaxIncomingFiles int64 = 16
+
+// 파일 ID 길이 (파일 SHA-256 의 앞부분)
+const FILE_ID_SIZE = 16
+
+var ErrFileRejected = errors.New("file rejected by receiver")
+var ErrFileCorrupted = errors.New("file checksum mismatch")
+var ErrMessageTooLarge = errors.New("message too large")
+var ErrTooManyIncomingFiles = errors.New("too many incoming files")
+
+/**
+ * 파일 전송 메시지
+ */
+type FileMessage struct {
+	Kind      []byte
+	Id        []byte
+	Name      string
+	Size      uint64
+	Sha256    []byte
+	Code      []byte
+	GatewayId string
+	Offset    uint64
+	Data      []byte
+	Status    uint32
+}
+
+func (v *FileMessage) IdString() string {
+	return hex.EncodeToString(v.Id)
+}
+
+func (v *FileMessage) Encode() []byte {
+	order := binary.LittleEndian
+
+	body := new(bytes.Buffer)
+	body.Write(EncTagLnV(order, FILE_TAG_ID, 32, v.Id))
+
+	if bytes.Equal(v.Kind, FILE_OFFER) || bytes.Equal(v.Kind, FILE_END) {
+		body.Write(EncTagLnUInt64(order, FILE_TAG_SIZE, 32, v.Size))
+		body.Write(EncTagLnV(order, FILE_TAG_SHA256, 32, v.Sha256))
+	}
+	if bytes.Equal(v.Kind, FILE_OFFER) {
+		body.Write(EncTagLnString(order, FILE_TAG_NAME, 32, v.Name))
+		body.Write(EncTagLnV(order, FILE_TAG_CODE, 32, v.Code))
+		body.Write(EncTagLnString(order, FILE_TAG_GATEWAY_ID, 32, v.GatewayId))
+	}
+	if bytes.Equal(v.Kind, FILE_CHUNK) {
+		body.Write(EncTagLnUInt64(order, FILE_TAG_OFFSET, 32, v.Offset))
+		body.Write(EncTagLnV(order, FILE_TAG_SHA256, 32, v.Sha256))
+		body.Write(EncTagLnV(order, FILE_TAG_DATA, 32, v.Data))
+	}
+	if bytes.Equal(v.Kind, FILE_STATUS) {
+		body.Write(EncTagLnUInt64(order, FILE_TAG_OFFSET, 32, v.Offset))
+		body.Write(EncTagLnUInt32(order, FILE_TAG_STATUS, 32, v.Status))
+	}
+
+	return EncTagLnV(order, CODE_FILE, 32, EncTagLnV(order, v.Kind, 32, body.Bytes()))
+}
+
+/**
+ * 길이를 확인하며 TLV(태그 2, 길이 4) 하나를 읽는다.
+ */
+func splitTL32V(order binary.ByteOrder, data []byte) ([]byte, []byte, []byte, error) {
+	if len(data) < 6 {
+		return nil, nil, nil, io.ErrUnexpectedEOF
+	}
+	length := order.Uint32(data[2:6])
+	if uint64(len(data)-6) < uint64(length) {
+		return nil, nil, nil, io.ErrUnexpectedEOF
+	}
+
+	return data[:2], data[6 : 6+length], data[6+length:], nil
+}
+
+func DecodeFileMessage(data []byte) (*FileMessage, error) {
+	order := binary.LittleEndian
+
+	code, inner, _, err := splitTL32V(order, data)
+	if err != nil {
+		return nil, err
+	}
+	if bytes.Equal(code, CODE_FILE) == false {
+		return nil, fmt.Errorf("not a file message: %X", code)
+	}
+
+	kind, body, _, err := splitTL32V(order, inner)
+	if err != nil {
+		return nil, err
+	}
+
+	v := new(FileMessage)
+	v.Kind = append([]byte{}, kind...)
+
+	for 0 < len(body) {
+		var tag, value []byte
+		if tag, value, body, err = splitTL32V(order, body); err != nil {
+			return nil, err
+		}
+
+		switch {
+		case bytes.Equal(tag, FILE_TAG_ID):
+			v.Id = value
+		case bytes.Equal(tag, FILE_TAG_NAME):
+			v.Name = string(value)
+		case bytes.Equal(tag, FILE_TAG_SIZE) && len(value) == 8:
+			v.Size = order.Uint64(value)
+		case bytes.Equal(tag, FILE_TAG_SHA256):
+			v.Sha256 = value
+		case bytes.Equal(tag, FILE_TAG_CODE):
+			v.Code = value
+		case bytes.Equal(tag, FILE_TAG_GATEWAY_ID):
+			v.GatewayId = string(value)
+		case bytes.Equal(tag, FILE_TAG_OFFSET) && len(value) == 8:
+			v.Offset = order.Uint64(value)
+		case bytes.Equal(tag, FILE_TAG_DATA):
+			v.Data = value
+		case bytes.Equal(tag, FILE_TAG_STATUS) && len(value) == 4:
+			v.Status = order.Uint32(value)
+		}
+	}
+
+	if len(v.Id) != FILE_ID_SIZE {
+		return nil, errors.New("invalid file id")
+	}
+
+	return v, nil
+}
+
+/**
+ * 메시지(태그 2, 길이 4, 값) 하나를 읽는다. RecvTL32V 와 달리 max 보다 긴 메시지는 읽지 않는다.
+ */
+func ReadTL32VMessage(reader io.Reader, order binary.ByteOrder, max int64) ([]byte, error) {
+	header := make([]byte, 6)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return nil, err
+	}
+
+	length := int64(order.Uint32(header[2:]))
+	if 0 < max && max < length {
+		return nil, ErrMessageTooLarge
+	}
+
+	data := make([]byte, 6+length)
+	copy(data, header)
+	if _, err := io.ReadFull(reader, data[6:]); err != nil {
+		return nil, err
+	}
+
+	return data, nil
+}
+
+/**
+ * 파일 전송 메시지를 주고받는 통로
+ */
+type FileChannel interface {
+	Send(data []byte) error
+	Recv(timeout time.Duration) ([]byte, error)
+	Close() error
+}
+
+/**
+ * TCP(또는 TLS) 연결
+ */
+type ConnFileChannel struct {
+	conn net.Conn
+}
+
+func NewConnFileChannel(conn net.Conn) *ConnFileChannel {
+	return &ConnFileChannel{conn: conn}
+}
+
+func (v *ConnFileChannel) Send(data []byte) error {
+	_, err := v.conn.Write(data)
+	return err
+}
+
+func (v *ConnFileChannel) Recv(timeout time.Duration) ([]byte, error) {
+	if 0 < timeout {
+		v.conn.SetReadDeadline(time.Now().Add(timeout))
+		defer v.conn.SetReadDeadline(time.Time{})
+	}
+
+	return ReadTL32VMessage(v.conn, binary.LittleEndian, MaxFileChunkSize+1024)
+}
+
+func (v *ConnFileChannel) Close() error {
+	return v.conn.Close()
+}
+
+/**
+ * 게이트웨이가 파일 메시지를 발행하는 토픽: prefix/file/gatewayId
+ * 받는 쪽은 같은 토픽 + "/status" 로 응답한다.
+ */
+func FileTopic(prefix, gatewayId string) string {
+	return joinTopic(prefix, "file", TopicLevel(gatewayId))
+}
+
+func FileTopicFilter(prefix string) string {
+	return joinTopic(prefix, "file", TOPIC_WILDCARD_LEVEL)
+}
+
+/**
+ * MQTT: topic 으로 발행하고 topic/status 에서 응답을 받는다.
+ */
+type MQTTFileChannel struct {
+	client *MQTTClient
+	topic  string
+	status chan []byte
+}
+
+func NewMQTTFileChannel(client *MQTTClient, topic string) (*MQTTFileChannel, error) {
+	v := new(MQTTFileChannel)
+	v.client = client
+	v.topic = topic
+	v.status = make(chan []byte, 16)
+
+	err := client.Subscribe(topic+"/status", 1, func(c MQTT.Client, msg MQTT.Message) {
+		select {
+		case v.status <- msg.Payload():
+		default:
+			// 기다리는 쪽이 없으면 버린다. 보내는 쪽은 시간 초과 후 다시 묻는다.
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return v, nil
+}
+
+func (v *MQTTFileChannel) Send(data []byte) error {
+	return v.client.Publish(v.topic, 1, false, data)
+}
+
+func (v *MQTTFileChannel) Recv(timeout time.Duration) ([]byte, error) {
+	if timeout <= 0 {
+		return <-v.status, nil
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case data := <-v.status:
+		return data, nil
+	case <-timer.C:
+		return nil, fmt.Errorf("no response on %s/status", v.topic)
+	}
+}
+
+func (v *MQTTFileChannel) Close() error {
+	return v.client.Unsubscribe(v.topic + "/status")
+}
+
+func fileTransferDefaults(config *FileTransferConfigurations) FileTransferConfigurations {
+	c := FileTransferConfigurations{}
+	if config != nil {
+		c = *config
+	}
+	if c.ChunkSize <= 0 {
+		c.ChunkSize = DefaultFileChunkSize
+	}
+	if MaxFileChunkSize < c.ChunkSize {
+		c.ChunkSize = MaxFileChunkSize
+	}
+	if c.Timeout <= 0 {
+		c.Timeout = DefaultFileTransferTimeout
+	}
+	if c.MaxRetries <= 0 {
+		c.MaxRetries = DefaultFileTransferRetries
+	}
+	if c.IdleTimeout <= 0 {
+		c.IdleTimeout = DefaultFileIdleTimeout
+	}
+	if c.MaxIncoming <= 0 {
+		c.MaxIncoming = DefaultMaxIncomingFiles
+	}
+
+	return c
+}
+
+/**
+ * 파일을 나누어 보낸다.
+ * open 은 통로를 연다. 보내다가 통로가 끊어지면 닫고 다시 열어 받는 쪽이 알려준 위치부터 이어 보낸다.
+ */
+type FileSender struct {
+	config  FileTransferConfigurations
+	open    func() (FileChannel, error)
+	channel FileChannel
+	sent    int64
+	resumed int64
+	failed  int64
+}
+
+func NewFileSender(config *FileTransferConfigurations, open func() (FileChannel, error)) *FileSender {
+	v := new(FileSender)
+	v.config = fileTransferDefaults(config)
+	v.open = open
+
+	return v
+}
+
+/**
+ * 파일 크기와 SHA-256
+ */
+func FileSha256(path string) (int64, []byte, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	size, err := io.Copy(hash, file)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	return size, hash.Sum(nil), nil
+}
+
+/**
+ * path 파일을 보낸다. code 는 파일 종류(BB_FRONT_VIDEO, BB_RAW_ACCELEROMETER 등)이다.
+ * progress 가 nil 이 아니면 조각을 보낼 때마다 (보낸 크기, 전체 크기) 로 호출한다.
+ */
+func (v *FileSender) Send(path string, code []byte, gatewayId string, progress func(int64, int64)) error {
+	size, sum, err := FileSha256(path)
+	if err != nil {
+		return err
+	}
+	if 0 < v.config.MaxFileSize && v.config.MaxFileSize < size {
+		return fmt.Errorf("%s: file too large (%d)", path, size)
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	offer := &FileMessage{
+		Kind:      FILE_OFFER,
+		Id:        sum[:FILE_ID_SIZE],
+		Name:      filepath.Base(path),
+		Size:      uint64(size),
+		Sha256:    sum,
+		Code:      code,
+		GatewayId: gatewayId,
+	}
+
+	for retry := int64(0); ; retry++ {
+		err = v.transfer(file, offer, progress)
+		if err == nil {
+			atomic.AddInt64(&v.sent, 1)
+			return nil
+		}
+		if err == ErrFileRejected || v.config.MaxRetries <= retry {
+			break
+		}
+
+		logger.Warningf("file %s (%s): %v, retry %d", offer.Name, offer.IdString(), err, retry+1)
+		if err != ErrFileCorrupted {
+			v.reset()
+			time.Sleep(time.Duration(retry+1) * time.Second)
+		}
+		atomic.AddInt64(&v.resumed, 1)
+	}
+
+	atomic.AddInt64(&v.failed, 1)
+
+	return err
+}
+
+func (v *FileSender) reset() {
+	if v.channel != nil {
+		v.channel.Close()
+		v.channel = nil
+	}
+}
+
+func (v *FileSender) transfer(file *os.File, offer *FileMessage, progress func(int64, int64)) error {
+	if v.channel == nil {
+		channel, err := v.open()
+		if err != nil {
+			return err
+		}
+		v.channel = channel
+	}
+
+	if err := v.channel.Send(offer.Encode()); err != nil {
+		return err
+	}
+	status, err := v.wait(offer.Id)
+	if err != nil {
+		return err
+	}
+
+	chunk := make([]byte, v.config.ChunkSize)
+	size := int64(offer.Size)
+
+	// 받는 쪽이 빠진 부분을 알려주면 그 위치부터 다시 보낸다. (MQTT 에서 메시지를 잃은 경우 등)
+	for {
+		switch status.Status {
+		case FILE_STATUS_COMPLETE:
+			return nil
+		case FILE_STATUS_REJECTED:
+			return ErrFileRejected
+		case FILE_STATUS_CORRUPTED:
+			return ErrFileCorrupted
+		}
+
+		offset := int64(status.Offset)
+		if size < offset {
+			return fmt.Errorf("invalid offset %d", offset)
+		}
+
+		for offset < size {
+			n, err := file.ReadAt(chunk, offset)
+			if n == 0 && err != nil {
+				return err
+			}
+			sum := sha256.Sum256(chunk[:n])
+			msg := &FileMessage{Kind: FILE_CHUNK, Id: offer.Id, Offset: uint64(offset), Sha256: sum[:], Data: chunk[:n]}
+			if err = v.channel.Send(msg.Encode()); err != nil {
+				return err
+			}
+			offset += int64(n)
+			if progress != nil {
+				progress(offset, size)
+			}
+		}
+
+		end := &FileMessage{Kind: FILE_END, Id: offer.Id, Size: offer.Size, Sha256: offer.Sha256}
+		if err := v.channel.Send(end.Encode()); err != nil {
+			return err
+		}
+		if status, err = v.wait(offer.Id); err != nil {
+			return err
+		}
+	}
+}
+
+/**
+ * id 파일의 FILE_STATUS 를 기다린다. 다른 파일의 응답은 무시한다.
+ */
+func (v *FileSender) wait(id []byte) (*FileMessage, error) {
+	timeout := time.Duration(v.config.Timeout) * time.Second
+	deadline := time.Now().Add(timeout)
+
+	for {
+		remain := time.Until(deadline)
+		if remain <= 0 {
+			return nil, errors.New("file status timed out")
+		}
+		data, err := v.channel.Recv(remain)
+		if err != nil {
+			return nil, err
+		}
+
+		msg, err := DecodeFileMessage(data)
+		if err != nil || bytes.Equal(msg.Kind, FILE_STATUS) == false || bytes.Equal(msg.Id, id) == false {
+			continue
+		}
+
+		return msg, nil
+	}
+}
+
+func (v *FileSender) Close() error {
+	v.reset()
+	return nil
+}
+
+/**
+ * 진단 출력용 문자열
+ */
+func (v *FileSender) Diagnostics() []string {
+	strings := []string{}
+	strings = append(strings, fmt.Sprintf("Sent: %d", atomic.LoadInt64(&v.sent)))
+	strings = append(strings, fmt.Sprintf("Resumed: %d", atomic.LoadInt64(&v.resumed)))
+	strings = append(strings, fmt.Sprintf("Failed: %d", atomic.LoadInt64(&v.failed)))
+
+	return strings
+}
+
+/**
+ * 받기를 마친 파일
+ */
+type ReceivedFile struct {
+	Id        string
+	Name      string
+	GatewayId string
+	Code      []byte
+	Size      int64
+	Sha256    string
+	Path      string
+}
+
+// <파일ID>.meta 에 저장하는 받는 중인 파일 정보
+type fileMeta struct {
+	Id        string
+	Name      string
+	GatewayId string
+	Code      string
+	Size      int64
+	Sha256    string
+	Complete  bool
+	Path      string
+}
+
+type incomingFile struct {
+	sync.Mutex
+	meta       fileMeta
+	part       *os.File
+	offset     int64
+	lastActive time.Time
+}
+
+/**
+ * 나누어 받은 파일을 메모리에 모으지 않고 바로 Directory 에 쓴다.
+ * 받기를 마친 파일은 Directory/<게이트웨이ID>/<파일 이름> 으로 옮기며,
+ * 같은 이름의 파일이 있으면 <파일ID>_<파일 이름> 으로 옮긴다.
+ * 게이트웨이ID 는 메시지의 GatewayId 가 아니라 연결(클라이언트 인증서 CN) 또는 토픽에서 확인한 값이다.
+ *
+ * 잠금 순서는 FileReceiver -> incomingFile 이다.
+ */
+type FileReceiver struct {
+	sync.Mutex
+	config   FileTransferConfigurations
+	files    map[string]*incomingFile
+	handlers []func(ReceivedFile)
+	received int64
+	bytes    int64
+	rejected int64
+	corrupt  int64
+	dropped  int64
+	expired  int64
+	stop     chan struct{}
+	once     sync.Once
+}
+
+func NewFileReceiver(config *FileTransferConfigurations) (*FileReceiver, error) {
+	if config == nil {
+		return nil, errors.New("FileTransferConfigurations is nil")
+	}
+	if len(config.Directory) == 0 {
+		return nil, errors.New("file transfer directory is empty")
+	}
+	if err := os.MkdirAll(config.Directory, 0755); err != nil {
+		return nil, err
+	}
+
+	v := new(FileReceiver)
+	v.config = fileTransferDefaults(config)
+	v.files = make(map[string]*incomingFile)
+	v.stop = make(chan struct{})
+
+	go v.expirer(time.Duration(v.config.IdleTimeout) * time.Second)
+
+	return v, nil
+}
+
+func (v *FileReceiver) expirer(timeout time.Duration) {
+	ticker := time.NewTicker(timeout / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-v.stop:
+			return
+		case <-ticker.C:
+			v.Lock()
+			v.expire(timeout)
+			v.Unlock()
+		}
+	}
+}
+
+/**
+ * timeout 동안 조각이 오지 않은 파일을 닫는다. .part 파일은 남겨 두어 다음에 이어 받는다.
+ * v 를 잠근 상태에서 호출한다.
+ */
+func (v *FileReceiver) expire(timeout time.Duration) {
+	for id, f := range v.files {
+		f.Lock()
+		idle := timeout < time.Since(f.lastActive)
+		if idle {
+			if f.part != nil {
+				f.part.Close()
+				f.part = nil
+			}
+			logger.Debugf("file %s (%s): idle at %d/%d, closed", f.meta.Name, id, f.offset, f.meta.Size)
+		}
+		f.Unlock()
+
+		if idle {
+			delete(v.files, id)
+			atomic.AddInt64(&v.expired, 1)
+		}
+	}
+}
+
+/**
+ * 받기를 마쳤을 때 호출할 함수를 등록한다.
+ */
+func (v *FileReceiver) OnReceive(handler func(ReceivedFile)) {
+	v.Lock()
+	defer v.Unlock()
+
+	v.handlers = append(v.handlers, handler)
+}
+
+// 경로에 쓸 수 없는 이름은 바꾼다.
+func safeFileName(name, fallback string) string {
+	name = filepath.Base(strings.ReplaceAll(name, "\\", "/"))
+	if name == "." || name == ".." || name == "/" || len(name) == 0 {
+		return fallback
+	}
+
+	return name
+}
+
+func (v *FileReceiver) metaPath(id string) string {
+	return filepath.Join(v.config.Directory, id+".meta")
+}
+
+func (v *FileReceiver) partPath(id string) string {
+	return filepath.Join(v.config.Directory, id+".part")
+}
+
+func (v *FileReceiver) loadMeta(id string) (*fileMeta, error) {
+	data, err := ioutil.ReadFile(v.metaPath(id))
+	if err != nil {
+		return nil, err
+	}
+
+	meta := new(fileMeta)
+	if err = json.Unmarshal(data, meta); err != nil {
+		return nil, err
+	}
+
+	return meta, nil
+}
+
+func (v *FileReceiver) saveMeta(meta *fileMeta) error {
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(v.metaPath(meta.Id), data, 0644)
+}
+
+/**
+ * 메시지 하나를 처리하고 보낼 응답(FILE_STATUS)을 반환한다. 응답이 없으면 nil 이다.
+ * gatewayId 는 연결 또는 토픽에서 확인한 보낸 게이트웨이이며, 모르면 빈 문자열이다.
+ */
+func (v *FileReceiver) Handle(data []byte, gatewayId string) ([]byte, error) {
+	msg, err := DecodeFileMessage(data)
+	if err != nil {
+		return nil, err
+	}
+
+	var status *FileMessage
+	switch {
+	case bytes.Equal(msg.Kind, FILE_OFFER):
+		status, err = v.offer(msg, safeFileName(gatewayId, "unknown"))
+	case bytes.Equal(msg.Kind, FILE_CHUNK):
+		err = v.chunk(msg)
+	case bytes.Equal(msg.Kind, FILE_END):
+		status, err = v.end(msg)
+	default:
+		return nil, fmt.Errorf("unexpected file message %X", msg.Kind)
+	}
+
+	if status == nil {
+		return nil, err
+	}
+
+	return status.Encode(), err
+}
+
+func (v *FileReceiver) offer(msg *FileMessage, gatewayId string) (*FileMessage, error) {
+	id := msg.IdString()
+	status := &FileMessage{Kind: FILE_STATUS, Id: msg.Id}
+
+	if 0 < v.config.MaxFileSize && v.config.MaxFileSize < int64(msg.Size) {
+		atomic.AddInt64(&v.rejected, 1)
+		status.Status = FILE_STATUS_REJECTED
+		return status, fmt.Errorf("file %s too large (%d)", id, msg.Size)
+	}
+	if len(msg.Sha256) != sha256.Size || bytes.HasPrefix(msg.Sha256, msg.Id) == false {
+		atomic.AddInt64(&v.rejected, 1)
+		status.Status = FILE_STATUS_REJECTED
+		return status, fmt.Errorf("file %s has invalid checksum", id)
+	}
+
+	v.Lock()
+	defer v.Unlock()
+
+	if f, ok := v.files[id]; ok {
+		f.Lock()
+		defer f.Unlock()
+		if f.meta.GatewayId != gatewayId {
+			atomic.AddInt64(&v.rejected, 1)
+			status.Status = FILE_STATUS_REJECTED
+			return status, fmt.Errorf("file %s is being received from %s", id, f.meta.GatewayId)
+		}
+		f.lastActive = time.Now()
+		status.Offset = uint64(f.offset)
+		return status, nil
+	}
+
+	if v.config.MaxIncoming <= int64(len(v.files)) {
+		v.expire(time.Duration(v.config.IdleTimeout) * time.Second)
+	}
+	if v.config.MaxIncoming <= int64(len(v.files)) {
+		// 응답하지 않는다. 보내는 쪽은 시간 초과 후 다시 제안한다.
+		atomic.AddInt64(&v.dropped, 1)
+		return nil, fmt.Errorf("file %s: %v (%d)", id, ErrTooManyIncomingFiles, len(v.files))
+	}
+
+	meta, err := v.loadMeta(id)
+	if err == nil && meta.GatewayId != gatewayId {
+		// 다른 게이트웨이가 보낸 파일은 이어 받지 않는다.
+		err = os.ErrNotExist
+	}
+	if err == nil && meta.Complete && meta.Size == int64(msg.Size) {
+		// 이미 받은 파일
+		status.Status = FILE_STATUS_COMPLETE
+		status.Offset = msg.Size
+		return status, nil
+	}
+
+	f := new(incomingFile)
+	if err == nil && meta.Size == int64(msg.Size) && meta.Sha256 == hex.EncodeToString(msg.Sha256) {
+		f.meta = *meta
+	} else {
+		f.meta = fileMeta{
+			Id:        id,
+			Name:      safeFileName(msg.Name, id),
+			GatewayId: gatewayId,
+			Code:      hex.EncodeToString(msg.Code),
+			Size:      int64(msg.Size),
+			Sha256:    hex.EncodeToString(msg.Sha256),
+		}
+		if err = v.saveMeta(&f.meta); err != nil {
+			return nil, err
+		}
+		os.Remove(v.partPath(id))
+	}
+
+	part, err := os.OpenFile(v.partPath(id), os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	info, err := part.Stat()
+	if err != nil {
+		part.Close()
+		return nil, err
+	}
+
+	f.part = part
+	f.offset = info.Size()
+	f.lastActive = time.Now()
+	if f.meta.Size < f.offset {
+		part.Truncate(0)
+		f.offset = 0
+	}
+	v.files[id] = f
+
+	if 0 < f.offset {
+		logger.Debugf("file %s (%s): resume from %d/%d", f.meta.Name, id, f.offset, f.meta.Size)
+	}
+	status.Offset = uint64(f.offset)
+
+	return status, nil
+}
+
+func (v *FileReceiver) incoming(id string) *incomingFile {
+	v.Lock()
+	defer v.Unlock()
+
+	return v.files[id]
+}
+
+func (v *FileReceiver) chunk(msg *FileMessage) error {
+	f := v.incoming(msg.IdString())
+	if f == nil {
+		atomic.AddInt64(&v.dropped, 1)
+		return nil
+	}
+
+	f.Lock()
+	defer f.Unlock()
+
+	// 순서가 맞지 않는 조각은 버린다. FILE_END 에서 받은 위치부터 다시 보내게 한다.
+	if f.part == nil || int64(msg.Offset) != f.offset || f.meta.Size < f.offset+int64(len(msg.Data)) {
+		atomic.AddInt64(&v.dropped, 1)
+		return nil
+	}
+	sum := sha256.Sum256(msg.Data)
+	if bytes.Equal(sum[:], msg.Sha256) == false {
+		atomic.AddInt64(&v.dropped, 1)
+		return fmt.Errorf("file %s: chunk checksum mismatch at %d", msg.IdString(), msg.Offset)
+	}
+
+	n, err := f.part.WriteAt(msg.Data, f.offset)
+	f.offset += int64(n)
+	f.lastActive = time.Now()
+	atomic.AddInt64(&v.bytes, int64(n))
+
+	return err
+}
+
+func (v *FileReceiver) end(msg *FileMessage) (*FileMessage, error) {
+	id := msg.IdString()
+	status := &FileMessage{Kind: FILE_STATUS, Id: msg.Id}
+
+	v.Lock()
+	f, ok := v.files[id]
+	if ok == false {
+		v.Unlock()
+		// 받는 쪽이 다시 시작되었다. 처음부터 다시 제안하게 한다.
+		status.Status = FILE_STATUS_CORRUPTED
+		return status, nil
+	}
+
+	f.Lock()
+	if f.offset < f.meta.Size {
+		f.lastActive = time.Now()
+		status.Offset = uint64(f.offset)
+		f.Unlock()
+		v.Unlock()
+		return status, nil
+	}
+
+	// 목록에서 빼면 이 파일은 여기서만 사용한다.
+	delete(v.files, id)
+	f.part.Sync()
+	f.part.Close()
+	f.part = nil
+	meta := f.meta
+	f.Unlock()
+	v.Unlock()
+
+	_, sum, err := FileSha256(v.partPath(id))
+	if err != nil || hex.EncodeToString(sum) != meta.Sha256 {
+		atomic.AddInt64(&v.corrupt, 1)
+		os.Remove(v.partPath(id))
+		os.Remove(v.metaPath(id))
+		status.Status = FILE_STATUS_CORRUPTED
+		if err == nil {
+			err = fmt.Errorf("file %s: %v", id, ErrFileCorrupted)
+		}
+		return status, err
+	}
+
+	dir := filepath.Join(v.config.Directory, meta.GatewayId)
+	if err = os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	// 같은 이름의 파일을 덮어쓰지 않는다.
+	v.Lock()
+	path := filepath.Join(dir, meta.Name)
+	if _, err = os.Lstat(path); err == nil {
+		path = filepath.Join(dir, id+"_"+meta.Name)
+	}
+	err = os.Rename(v.partPath(id), path)
+	v.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	meta.Complete = true
+	meta.Path = path
+	if err = v.saveMeta(&meta); err != nil {
+		logger.Errorf("file %s: %v", id, err)
+	}
+	atomic.AddInt64(&v.received, 1)
+	logger.Debugf("file %s (%s) received: %s", meta.Name, id, path)
+
+	code, _ := hex.DecodeString(meta.Code)
+	received := ReceivedFile{
+		Id:        id,
+		Name:      meta.Name,
+		GatewayId: meta.GatewayId,
+		Code:      code,
+		Size:      meta.Size,
+		Sha256:    meta.Sha256,
+		Path:      path,
+	}
+
+	v.Lock()
+	handlers := make([]func(ReceivedFile), len(v.handlers))
+	copy(handlers, v.handlers)
+	v.Unlock()
+
+	for _, handler := range handlers {
+		handler(received)
+	}
+
+	status.Status = FILE_STATUS_COMPLETE
+	status.Offset = msg.Size
+
+	return status, nil
+}
+
+/**
+ * ins.Server 의 callback: 연결이 끊어질 때까지 파일 메시지를 받는다.
+ * 확인된 클라이언트 인증서의 CN 을 보낸 게이트웨이로 사용한다. (없으면 "unknown")
+ */
+func (v *FileReceiver) Serve(conn net.Conn, ud interface{}) error {
+	channel := NewConnFileChannel(conn)
+
+	gatewayId := ""
+	for {
+		data, err := channel.Recv(0)
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+
+		if len(gatewayId) == 0 {
+			// 첫 Read 에서 handshake 가 끝난다.
+			gatewayId = PeerCommonName(conn)
+		}
+
+		reply, err := v.Handle(data, gatewayId)
+		if err != nil {
+			logger.Warningf("file transfer from %v: %v", conn.RemoteAddr(), err)
+		}
+		if reply != nil {
+			if err = channel.Send(reply); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+/**
+ * filter(FileTopicFilter) 를 구독해 파일 메시지를 받고 받은 토픽 + "/status" 로 응답한다.
+ * 토픽의 마지막 단계(FileTopic 의 게이트웨이)를 보낸 게이트웨이로 사용한다.
+ * 게이트웨이가 자신의 토픽에만 발행하도록 broker 의 토픽 접근 규칙을 설정한다. (예: prefix/file/%u)
+ */
+func (v *FileReceiver) ServeMQTT(client *MQTTClient, filter string) error {
+	return client.Subscribe(filter, 1, func(c MQTT.Client, msg MQTT.Message) {
+		gatewayId := msg.Topic()
+		if i := strings.LastIndex(gatewayId, "/"); 0 <= i {
+			gatewayId = gatewayId[i+1:]
+		}
+
+		reply, err := v.Handle(msg.Payload(), gatewayId)
+		if err != nil {
+			logger.Warningf("file transfer on %s: %v", msg.Topic(), err)
+		}
+		if reply != nil {
+			// 메시지 처리 중에 발행 완료를 기다리면 수신이 멈추므로 따로 보낸다.
+			go client.Publish(msg.Topic()+"/status", 1, false, reply)
+		}
+	})
+}
+
+/**
+ * 진단 출력용 문자열
+ */
+func (v *FileReceiver) Diagnostics() []string {
+	v.Lock()
+	receiving := len(v.files)
+	v.Unlock()
+
+	strings := []string{}
+	strings = append(strings, fmt.Sprintf("Directory: %s", v.config.Directory))
+	strings = append(strings, fmt.Sprintf("Receiving: %d", receiving))
+	strings = append(strings, fmt.Sprintf("Received: %d", atomic.LoadInt64(&v.received)))
+	strings = append(strings, fmt.Sprintf("Bytes: %d", atomic.LoadInt64(&v.bytes)))
+	strings = append(strings, fmt.Sprintf("Rejected: %d", atomic.LoadInt64(&v.rejected)))
+	strings = append(strings, fmt.Sprintf("Corrupted: %d", atomic.LoadInt64(&v.corrupt)))
+	strings = append(strings, fmt.Sprintf("Dropped: %d", atomic.LoadInt64(&v.dropped)))
+	strings = append(strings, fmt.Sprintf("Expired: %d", atomic.LoadInt64(&v.expired)))
+
+	return strings
+}
+
+/**
+ * 받는 중인 파일을 닫는다. .part 파일은 남겨 두어 다음에 이어 받는다.
+ */
+func (v *FileReceiver) Close() error {
+	v.once.Do(func() {
+		close(v.stop)
+	})
+
+	v.Lock()
+	defer v.Unlock()
+
+	for id, f := range v.files {
+		f.Lock()
+		if f.part != nil {
+			f.part.Close()
+			f.part = nil
+		}
+		f.Unlock()
+		delete(v.files, id)
+	}
+
+	return nil
+}
@@ -0,0 +1,332 @@
+package ins
+
+import (
+	"errors"
+	"fmt"
+	"github.com/industry-netsecurity-solution/ins-security-channel/cachedb"
+	"github.com/industry-netsecurity-solution/ins-security-channel/logger"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 전송 재시도 대기 시간 기본값/최대값
+var DefaultForwardRetryInterval = 1 * time.Second
+var MaxForwardRetryInterval = 60 * time.Second
+
+// 보관 한도 확인 주기
+var ForwardRetentionInterval = 10 * time.Second
+
+// 한 번에 읽어 전송하는 메시지 수
+const forwardBatchSize = 100
+
+/**
+ * 메시지를 cachedb 에 먼저 저장하고, 저장된 순서대로 relay 로 전송하는 DataRelay
+ *
+ * relay 는 상대의 수신 확인(ack)을 받은 뒤에 반환하는 AckRelay 이며, SendAck 가 성공하면 저장된 메시지를 삭제한다.
+ * 소켓으로 보낼 때는 TcpRelay 또는 NewAckPooledRelay 를 사용하고, 받는 쪽은 ack 를 보내야 한다. (MessageRelayConfigurations.Ack)
+ *
+ * 전송에 실패하면 같은 메시지부터 다시 시도하므로 메시지는 순서대로 한 번 이상 전달된다.
+ * 재시작하면 남아 있는 메시지부터 이어서 전송한다.
+ */
+type StoreForwarder struct {
+	sync.Mutex
+	config  ForwardConfigurations
+	db      *cachedb.CacheDB
+	table   int
+	relay   AckRelay
+	lastId  int64
+	inserts int64
+	sent    int64
+	dropped int64
+	failed  int64
+	signal  chan struct{}
+	resume  chan struct{}
+	stop    chan struct{}
+	once    sync.Once
+	wg      sync.WaitGroup
+}
+
+func NewStoreForwarder(config *ForwardConfigurations, relay AckRelay) (*StoreForwarder, error) {
+	if config == nil {
+		return nil, errors.New("ForwardConfigurations is nil")
+	}
+	if relay == nil {
+		return nil, errors.New("relay is nil")
+	}
+
+	db, err := cachedb.ConnectDB(config.Database)
+	if err != nil {
+		return nil, err
+	}
+	if err = db.InitDB(int(config.Table) + 1); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	lastId, err := db.GetLastId(int(config.Table))
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	v := new(StoreForwarder)
+	v.config = *config
+	v.db = db
+	v.table = int(config.Table)
+	v.relay = relay
+	v.lastId = lastId
+	v.signal = make(chan struct{}, 1)
+	v.resume = make(chan struct{}, 1)
+	v.stop = make(chan struct{})
+
+	if count, err := db.Count(v.table, -1, -1); err == nil && 0 < count {
+		logger.Infof("forwarder: %d messages pending", count)
+	}
+
+	v.wg.Add(2)
+	go v.run()
+	go v.maintain()
+
+	return v, nil
+}
+
+/**
+ * 메시지를 저장한다. 저장에 성공하면 보낸 것으로 보고 데이터 길이를 반환한다.
+ */
+func (v *StoreForwarder) DoSend(args ...interface{}) (interface{}, error) {
+	if len(args) == 0 {
+		return 0, errors.New("no data")
+	}
+	data, ok := args[0].([]byte)
+	if ok == false {
+		return 0, errors.New("data is not []byte")
+	}
+
+	select {
+	case <-v.stop:
+		return 0, ErrRelayClosed
+	default:
+	}
+
+	// id 는 저장 시각(ns) 기준으로 증가하며, 보관 기간 확인에 사용한다.
+	v.Lock()
+	id := time.Now().UnixNano()
+	if id <= v.lastId {
+		id = v.lastId + 1
+	}
+	v.lastId = id
+	v.Unlock()
+
+	if _, err := v.db.InsertData(v.table, id, data); err != nil {
+		return 0, err
+	}
+
+	if atomic.AddInt64(&v.inserts, 1)%forwardBatchSize == 0 {
+		v.enforceRetention()
+	}
+
+	select {
+	case v.signal <- struct{}{}:
+	default:
+	}
+
+	return len(data), nil
+}
+
+func (v *StoreForwarder) wait(d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-v.stop:
+		return false
+	case <-v.signal:
+	case <-timer.C:
+	}
+
+	return true
+}
+
+func (v *StoreForwarder) run() {
+	defer v.wg.Done()
+
+	retry := DefaultForwardRetryInterval
+	if 0 < v.config.RetryInterval {
+		retry = time.Duration(v.config.RetryInterval) * time.Millisecond
+	}
+	delay := retry
+
+	for {
+		select {
+		case <-v.stop:
+			return
+		default:
+		}
+
+		rows, err := v.db.GetNextLimitData(v.table, -1, forwardBatchSize)
+		if err != nil {
+			logger.Errorf("forwarder: %v", err)
+			if v.wait(delay) == false {
+				return
+			}
+			continue
+		}
+
+		if rows.Len() == 0 {
+			if v.wait(ForwardRetentionInterval) == false {
+				return
+			}
+			continue
+		}
+
+		for e := rows.Front(); e != nil; e = e.Next() {
+			row := e.Value.(*cachedb.Data)
+
+			if err = v.relay.SendAck(row.Data); err != nil {
+				break
+			}
+
+			// 수신 확인된 메시지를 삭제한다.
+			if _, err = v.db.DeleteData(v.table, row.Id); err != nil {
+				logger.Errorf("forwarder: %v", err)
+			}
+			atomic.AddInt64(&v.sent, 1)
+			delay = retry
+		}
+
+		if err != nil {
+			atomic.AddInt64(&v.failed, 1)
+			logger.Warningf("forwarder: send failed, retry in %v: %v", delay, err)
+
+			timer := time.NewTimer(delay)
+			select {
+			case <-v.stop:
+				timer.Stop()
+				return
+			case <-v.resume:
+				timer.Stop()
+				delay = retry
+				continue
+			case <-timer.C:
+			}
+
+			if delay *= 2; MaxForwardRetryInterval < delay {
+				delay = MaxForwardRetryInterval
+			}
+		}
+	}
+}
+
+func (v *StoreForwarder) maintain() {
+	defer v.wg.Done()
+
+	ticker := time.NewTicker(ForwardRetentionInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-v.stop:
+			return
+		case <-ticker.C:
+			v.enforceRetention()
+		}
+	}
+}
+
+func (v *StoreForwarder) drop(n int64, reason string) {
+	if n <= 0 {
+		return
+	}
+	atomic.AddInt64(&v.dropped, n)
+	logger.Warningf("forwarder: %d messages dropped (%s)", n, reason)
+}
+
+/**
+ * 보관 한도를 넘은 오래된 메시지를 삭제한다.
+ */
+func (v *StoreForwarder) enforceRetention() {
+	if 0 < v.config.MaxAge {
+		before := time.Now().Add(-time.Duration(v.config.MaxAge) * time.Second).UnixNano()
+		if n, err := v.db.DeleteBefore(v.table, before); err == nil {
+			v.drop(n, "max age")
+		}
+	}
+
+	if 0 < v.config.MaxCount {
+		count, err := v.db.Count(v.table, -1, -1)
+		if err == nil && v.config.MaxCount < count {
+			if n, err := v.db.DeleteOldData(v.table, count-v.config.MaxCount); err == nil {
+				v.drop(n, "max count")
+			}
+		}
+	}
+
+	if 0 < v.config.MaxBytes {
+		for {
+			size, err := v.db.DataSize(v.table)
+			if err != nil || size <= v.config.MaxBytes {
+				break
+			}
+			count, err := v.db.Count(v.table, -1, -1)
+			if err != nil || count == 0 {
+				break
+			}
+
+			// 평균 크기로 삭제할 개수를 추정한다.
+			excess := (size-v.config.MaxBytes)*count/size + 1
+			n, err := v.db.DeleteOldData(v.table, excess)
+			if err != nil || n == 0 {
+				break
+			}
+			v.drop(n, "max bytes")
+		}
+	}
+}
+
+/**
+ * 재시도 대기를 멈추고 바로 전송한다. relay 가 다시 연결되었을 때 호출한다.
+ */
+func (v *StoreForwarder) Resume() {
+	select {
+	case v.resume <- struct{}{}:
+	default:
+	}
+}
+
+/**
+ * 전송 대기 중인 메시지 수
+ */
+func (v *StoreForwarder) Pending() int64 {
+	count, err := v.db.Count(v.table, -1, -1)
+	if err != nil {
+		return -1
+	}
+	return count
+}
+
+/**
+ * 진단 출력용 문자열
+ */
+func (v *StoreForwarder) Diagnostics() []string {
+	strings := []string{}
+	strings = append(strings, fmt.Sprintf("Pending: %d", v.Pending()))
+	strings = append(strings, fmt.Sprintf("Sent: %d", atomic.LoadInt64(&v.sent)))
+	strings = append(strings, fmt.Sprintf("Failed: %d", atomic.LoadInt64(&v.failed)))
+	strings = append(strings, fmt.Sprintf("Dropped: %d", atomic.LoadInt64(&v.dropped)))
+
+	return strings
+}
+
+/**
+ * 전송을 멈추고 저장소를 닫는다. 남은 메시지는 다음 실행 때 전송된다.
+ */
+func (v *StoreForwarder) Close() error {
+	v.once.Do(func() {
+		close(v.stop)
+		v.wg.Wait()
+		v.db.Close()
+	})
+
+	return nil
+}
@@ -0,0 +1,371 @@
+package ins
+
+import (
+	"errors"
+	"fmt"
+	resty "github.com/go-resty/resty/v2"
+	"github.com/industry-netsecurity-solution/ins-security-channel/logger"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const DefaultHttpRetries = 3
+const DefaultHttpBreakerThreshold = 5
+const DefaultHttpBreakerCooldown = 30
+
+// 호스트별 유지하는 유휴 연결 수
+const DefaultHttpIdleConnsPerHost = 16
+
+var ErrCircuitOpen = errors.New("circuit open")
+
+/**
+ * 호스트별 회로 차단기
+ * 연속 실패가 threshold 번이면 cooldown 동안 요청하지 않고, 그 뒤 요청 하나로 다시 확인한다.
+ */
+type circuitBreaker struct {
+	failures  int
+	openUntil time.Time
+	probing   bool
+}
+
+/**
+ * 회로 차단을 적용하는 http.RoundTripper
+ * 연결 오류와 5xx 응답을 실패로 센다.
+ * base 는 인증서가 다시 읽히면 바뀐다. (setBase)
+ */
+type breakerTransport struct {
+	sync.Mutex
+	base      *http.Transport
+	threshold int
+	cooldown  time.Duration
+	hosts     map[string]*circuitBreaker
+	rejected  int64
+}
+
+func (v *breakerTransport) transport() *http.Transport {
+	v.Lock()
+	defer v.Unlock()
+
+	return v.base
+}
+
+/**
+ * base 를 바꾸고 이전 transport 의 유휴 연결을 닫는다.
+ * 이전 transport 로 처리 중인 요청은 그대로 끝난다.
+ */
+func (v *breakerTransport) setBase(base *http.Transport) {
+	v.Lock()
+	old := v.base
+	v.base = base
+	v.Unlock()
+
+	old.CloseIdleConnections()
+}
+
+func (v *breakerTransport) allow(host string) bool {
+	v.Lock()
+	defer v.Unlock()
+
+	b, ok := v.hosts[host]
+	if ok == false || b.failures < v.threshold {
+		return true
+	}
+	if time.Now().Before(b.openUntil) || b.probing {
+		return false
+	}
+	b.probing = true
+
+	return true
+}
+
+func (v *breakerTransport) record(host string, failed bool) {
+	v.Lock()
+	defer v.Unlock()
+
+	b, ok := v.hosts[host]
+	if ok == false {
+		if failed == false {
+			return
+		}
+		b = new(circuitBreaker)
+		v.hosts[host] = b
+	}
+
+	b.probing = false
+	if failed == false {
+		delete(v.hosts, host)
+		return
+	}
+
+	b.failures++
+	if v.threshold <= b.failures {
+		if b.failures == v.threshold {
+			logger.Warningf("http: circuit open for %s", host)
+		}
+		b.openUntil = time.Now().Add(v.cooldown)
+	}
+}
+
+func (v *breakerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	host := req.URL.Host
+	if v.allow(host) == false {
+		atomic.AddInt64(&v.rejected, 1)
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		return nil, fmt.Errorf("%s: %w", host, ErrCircuitOpen)
+	}
+
+	resp, err := v.transport().RoundTrip(req)
+	v.record(host, err != nil || http.StatusInternalServerError <= resp.StatusCode)
+
+	return resp, err
+}
+
+func (v *breakerTransport) openHosts() []string {
+	v.Lock()
+	defer v.Unlock()
+
+	hosts := []string{}
+	for host, b := range v.hosts {
+		if v.threshold <= b.failures {
+			hosts = append(hosts, host)
+		}
+	}
+	sort.Strings(hosts)
+
+	return hosts
+}
+
+/**
+ * HttpConfigurations 별로 공유하는 HTTP 클라이언트
+ *
+ * 연결을 유지(keep-alive)해 다시 사용하고, Timeout(초)을 연결, TLS 핸드셰이크, 응답 헤더 대기에 적용한다.
+ * 멱등 요청(GET, HEAD, PUT, DELETE, OPTIONS)은 연결 오류, 429, 5xx 응답이면 백오프하며 다시 보낸다.
+ * EnableTls 이면 인증서 관리자가 인증서/CA 번들을 다시 읽을 때 새 TLS 설정으로 transport 를 바꾼다.
+ */
+type HttpClient struct {
+	client  *resty.Client
+	breaker *breakerTransport
+	retried int64
+}
+
+var httpClients = struct {
+	sync.Mutex
+	clients map[string]*HttpClient
+}{clients: make(map[string]*HttpClient)}
+
+/**
+ * 공유 클라이언트의 키: 연결 대상과 TLS, 재시도, 회로 차단 설정 (Path, Authorization 은 제외)
+ */
+func httpClientKey(config *HttpConfigurations) string {
+	return fmt.Sprintf("%t|%s|%d|%s|%s|%s|%d|%+v|%+v|%d|%d|%d",
+		config.EnableTls, config.Address, config.Port, config.CaCert, config.TlsCert, config.TlsKey, config.Timeout,
+		config.Revocation, config.TLSPolicy, config.Retries, config.BreakerThreshold, config.BreakerCooldown)
+}
+
+/**
+ * config 에 해당하는 공유 클라이언트. 없으면 만든다.
+ * 같은 서버에 다른 Path, Authorization 으로 요청하는 설정은 클라이언트를 같이 사용한다.
+ */
+func GetHttpClient(config *HttpConfigurations) (*HttpClient, error) {
+	if config == nil {
+		return nil, errors.New("HttpConfigurations is nil")
+	}
+	key := httpClientKey(config)
+
+	httpClients.Lock()
+	defer httpClients.Unlock()
+
+	if client, ok := httpClients.clients[key]; ok {
+		return client, nil
+	}
+
+	client, err := NewHttpClient(config)
+	if err != nil {
+		return nil, err
+	}
+	httpClients.clients[key] = client
+
+	return client, nil
+}
+
+func NewHttpClient(config *HttpConfigurations) (*HttpClient, error) {
+	if config == nil {
+		return nil, errors.New("HttpConfigurations is nil")
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConnsPerHost = DefaultHttpIdleConnsPerHost
+	if config.EnableTls {
+		tlsConfig, err := config.ClientTLSConfig()
+		if err != nil {
+			return nil, err
+		}
+		transport.TLSClientConfig = tlsConfig
+	}
+	if 0 < config.Timeout {
+		timeout := time.Duration(config.Timeout) * time.Second
+		transport.DialContext = (&net.Dialer{Timeout: timeout, KeepAlive: 30 * time.Second}).DialContext
+		transport.TLSHandshakeTimeout = timeout
+		transport.ResponseHeaderTimeout = timeout
+	}
+
+	v := newHttpClient(transport, config.Retries, config.BreakerThreshold, config.BreakerCooldown)
+
+	if config.EnableTls {
+		manager, err := config.CertManager()
+		if err != nil {
+			return nil, err
+		}
+		reload := *config
+		manager.OnReload(func(m *CertManager, err error) {
+			if err == nil {
+				v.reload(&reload)
+			}
+		})
+	}
+
+	return v, nil
+}
+
+/**
+ * 다시 읽은 인증서/CA 번들로 TLS 설정을 만들어 transport 를 바꾼다.
+ * 실패하면 기존 transport 를 유지한다.
+ */
+func (v *HttpClient) reload(config *HttpConfigurations) {
+	tlsConfig, err := config.ClientTLSConfig()
+	if err != nil {
+		logger.Warningf("http: TLS reload failed (%s:%d): %v", config.Address, config.Port, err)
+		return
+	}
+
+	transport := v.breaker.transport().Clone()
+	transport.TLSClientConfig = tlsConfig
+	v.breaker.setBase(transport)
+}
+
+/**
+ * 설정 없이 transport 를 사용하는 클라이언트 (재시도, 회로 차단은 기본값)
+ */
+func NewHttpClientWithTransport(transport *http.Transport) *HttpClient {
+	if transport == nil {
+		transport = http.DefaultTransport.(*http.Transport).Clone()
+	}
+
+	return newHttpClient(transport, 0, 0, 0)
+}
+
+func newHttpClient(transport *http.Transport, retries, threshold, cooldown int64) *HttpClient {
+	if retries == 0 {
+		retries = DefaultHttpRetries
+	} else if retries < 0 {
+		retries = 0
+	}
+	if threshold <= 0 {
+		threshold = DefaultHttpBreakerThreshold
+	}
+	if cooldown <= 0 {
+		cooldown = DefaultHttpBreakerCooldown
+	}
+
+	v := new(HttpClient)
+	v.breaker = &breakerTransport{
+		base:      transport,
+		threshold: int(threshold),
+		cooldown:  time.Duration(cooldown) * time.Second,
+		hosts:     make(map[string]*circuitBreaker),
+	}
+
+	v.client = resty.New()
+	v.client.SetLogger(restyLogger{})
+	v.client.SetTransport(v.breaker)
+	v.client.SetRetryCount(int(retries))
+	v.client.SetRetryWaitTime(500 * time.Millisecond)
+	v.client.SetRetryMaxWaitTime(10 * time.Second)
+	v.client.AddRetryCondition(v.retryable)
+	v.client.AddRetryHook(func(resp *resty.Response, err error) {
+		atomic.AddInt64(&v.retried, 1)
+	})
+
+	return v
+}
+
+/**
+ * resty 로그. 오류는 호출한 쪽에 반환되므로 디버그 로그로만 남긴다.
+ */
+type restyLogger struct{}
+
+func (restyLogger) Errorf(format string, args ...interface{}) {
+	logger.Debugf("http: "+format, args...)
+}
+
+func (restyLogger) Warnf(format string, args ...interface{}) {
+	logger.Debugf("http: "+format, args...)
+}
+
+func (restyLogger) Debugf(format string, args ...interface{}) {
+	logger.Debugf("http: "+format, args...)
+}
+
+func idempotent(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPut, http.MethodDelete, http.MethodOptions:
+		return true
+	}
+
+	return false
+}
+
+func (v *HttpClient) retryable(resp *resty.Response, err error) bool {
+	if resp == nil || resp.Request == nil || idempotent(resp.Request.Method) == false {
+		return false
+	}
+	// 다시 읽을 수 없는 본문
+	if _, ok := resp.Request.Body.(io.Reader); ok {
+		return false
+	}
+	if err != nil {
+		return errors.Is(err, ErrCircuitOpen) == false
+	}
+
+	status := resp.StatusCode()
+
+	return status == http.StatusTooManyRequests || http.StatusInternalServerError <= status
+}
+
+/**
+ * 요청을 만든다.
+ */
+func (v *HttpClient) R() *resty.Request {
+	return v.client.R()
+}
+
+func (v *HttpClient) Client() *resty.Client {
+	return v.client
+}
+
+/**
+ * 진단 출력용 문자열
+ */
+func (v *HttpClient) Diagnostics() []string {
+	strings := []string{}
+	strings = append(strings, fmt.Sprintf("Retried: %d", atomic.LoadInt64(&v.retried)))
+	strings = append(strings, fmt.Sprintf("Rejected: %d", atomic.LoadInt64(&v.breaker.rejected)))
+	strings = append(strings, fmt.Sprintf("OpenCircuits: %v", v.breaker.openHosts()))
+
+	return strings
+}
+
+/**
+ * 유휴 연결을 닫는다.
+ */
+func (v *HttpClient) Close() error {
+	v.breaker.transport().CloseIdleConnections()
+	return nil
+}
@@ -27,6 +27,10 @@ var CODE_ELSSEN = []byte{0xEA, 0xCE}
 var CODE_YMTECH = []byte{0xEF, 0xFE}
 var CODE_TELEFIELD = []byte{0x8F, 0x8F}
 var CODE_ABRAIN = []byte{0xAB, 0xAB}
+var CODE_FILE = []byte{0xEF, 0xF1}
+
+// 수신 확인(ack). 값이 없는 TLV 로 메시지 하나마다 순서대로 보낸다.
+var CODE_ACK = []byte{0xEF, 0xF2}
 
 // 제조현장 집중 GW
 var GW_TYPE_CENTER_FACTORY byte = 0x01
@@ -179,6 +183,7 @@ var NAME_CODE_ELSSEN = "ELSSEN"
 var NAME_CODE_YMTECH = "YMTECH"
 var NAME_CODE_TELEFIELD = "TELEFIELD"
 var NAME_CODE_ABRAIN = "ABRAIN"
+var NAME_CODE_FILE = "file"
 
 // 전방/후방 영상 파일
 var NAME_BB_FRONT_VIDEO = "front.video"
@@ -240,6 +245,7 @@ var TYPE_CODE_ELSSEN = "ELSSEN"
 var TYPE_CODE_YMTECH = "YMTECH"
 var TYPE_CODE_TELEFIELD = "TELEFIELD"
 var TYPE_CODE_ABRAIN = "ABRAIN"
+var TYPE_CODE_FILE = "파일 전송"
 
 // 전방/후방 영상 파일
 var TYPE_BB_FRONT_VIDEO = "전방 영상 파일"
@@ -504,6 +510,8 @@ func GetTransmissionMethod(order binary.ByteOrder, data []byte) int {
 		return METHOD_SOCKET
 	} else if bytes.HasPrefix(data, CODE_ABRAIN) {
 		return METHOD_MQTT
+	} else if bytes.HasPrefix(data, CODE_FILE) {
+		return METHOD_SOCKET
 	}
 
 	return METHOD_UNKNOWN
@@ -699,6 +707,8 @@ func GetMessageType(order binary.ByteOrder, data []byte) string {
 		return TYPE_CODE_TELEFIELD
 	} else if bytes.HasPrefix(data, CODE_ABRAIN) {
 		return TYPE_CODE_ABRAIN
+	} else if bytes.HasPrefix(data, CODE_FILE) {
+		return TYPE_CODE_FILE
 	}
 
 	return TYPE_UNKNOWN
@@ -896,6 +906,8 @@ func GetMessageName(order binary.ByteOrder, data []byte) string {
 		return NAME_CODE_TELEFIELD
 	} else if bytes.HasPrefix(data, CODE_ABRAIN) {
 		return NAME_CODE_ABRAIN
+	} else if bytes.HasPrefix(data, CODE_FILE) {
+		return NAME_CODE_FILE
 	}
 
 	return NAME_UNKNOWN
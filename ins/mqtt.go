@@ -1,14 +1,32 @@
 package ins
 
 import (
+	"crypto/tls"
 	"errors"
 	MQTT "github.com/eclipse/paho.mqtt.golang"
+	"net/url"
+	"strings"
+	"time"
 )
 
-func GetMQTTClient(config *MQTTConfigurations) (MQTT.Client, error) {
-	if config == nil {
-		return nil, errors.New("MQTTConfigurations is nil")
+/**
+ * TLS 를 사용하는 broker 주소인지 확인한다. (ssl, tls, mqtts, tcps, wss)
+ */
+func isSecureBroker(broker string) bool {
+	u, err := url.Parse(broker)
+	if err != nil {
+		return false
 	}
+
+	switch strings.ToLower(u.Scheme) {
+	case "ssl", "tls", "mqtts", "tcps", "wss":
+		return true
+	}
+
+	return false
+}
+
+func newMQTTClientOptions(config *MQTTConfigurations) (*MQTT.ClientOptions, error) {
 	opts := MQTT.NewClientOptions()
 	opts.AddBroker(config.Broker)
 	opts.SetClientID(config.ClientId)
@@ -19,11 +37,51 @@ func GetMQTTClient(config *MQTTConfigurations) (MQTT.Client, error) {
 		}
 	}
 
-	tlsconfig := NewTLSConfig(&config.Cacertfile, &config.Certfile, &config.Keyfile)
-	opts.SetTLSConfig(tlsconfig)
+	if isSecureBroker(config.Broker) {
+		tlsconfig, err := config.ClientTLSConfig()
+		if err != nil {
+			return nil, err
+		}
+		opts.SetTLSConfig(tlsconfig)
+		if manager, err := config.CertManager(); err == nil {
+			// 재접속 시 최신 CA 번들을 사용한다.
+			opts.SetConnectionAttemptHandler(func(broker *url.URL, tlsCfg *tls.Config) *tls.Config {
+				if tlsCfg == nil {
+					return nil
+				}
+				return manager.ClientConfig(tlsCfg)
+			})
+		}
+	}
+
+	if 0 < config.KeepAlive {
+		opts.SetKeepAlive(time.Duration(config.KeepAlive) * time.Second)
+	}
+	if 0 < config.ConnectTimeout {
+		opts.SetConnectTimeout(time.Duration(config.ConnectTimeout) * time.Second)
+	}
+	if 0 < config.MaxReconnectInterval {
+		opts.SetMaxReconnectInterval(time.Duration(config.MaxReconnectInterval) * time.Second)
+	}
+	if 0 < len(config.Will.Topic) {
+		opts.SetWill(config.Will.Topic, config.Will.Payload, byte(config.Will.Qos), config.Will.Retain)
+	}
 
 	opts.SetCleanSession(config.Cleansess)
 
+	return opts, nil
+}
+
+func GetMQTTClient(config *MQTTConfigurations) (MQTT.Client, error) {
+	if config == nil {
+		return nil, errors.New("MQTTConfigurations is nil")
+	}
+
+	opts, err := newMQTTClientOptions(config)
+	if err != nil {
+		return nil, err
+	}
+
 	client := MQTT.NewClient(opts)
 
 	if token := client.Connect(); token.Wait() && token.Error() != nil {
@@ -0,0 +1,362 @@
+package ins
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+	"github.com/industry-netsecurity-solution/ins-security-channel/logger"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 발행/구독 완료 대기 시간
+var MQTTTokenTimeout = 10 * time.Second
+
+// 종료 시 전송 중인 메시지를 기다리는 시간 (ms)
+const mqttDisconnectQuiesce = 250
+
+var ErrMQTTNotConnected = errors.New("MQTT client is not connected")
+
+type mqttSubscription struct {
+	qos     byte
+	handler MQTT.MessageHandler
+}
+
+/**
+ * 자동 재연결, 오프라인 저장, LWT, 재구독을 지원하는 MQTT 클라이언트
+ *
+ * Buffer.Database 를 지정하면 발행 메시지를 cachedb 에 먼저 저장하고 연결된 동안 순서대로 보낸다.
+ * 저장된 메시지는 브로커가 수신을 확인(PUBACK)한 뒤에 삭제하므로 QoS 1 이상으로 발행된다.
+ * 지정하지 않으면 연결되지 않은 동안의 Publish 는 ErrMQTTNotConnected 로 실패한다.
+ * Will.Topic 을 지정하면 비정상 종료 시 broker 가 Will.Payload 를 발행하고,
+ * 연결될 때마다 Will.OnlinePayload, 정상 종료(Close) 시 Will.Payload 를 같은 토픽에 발행한다.
+ */
+type MQTTClient struct {
+	sync.Mutex
+	config    MQTTConfigurations
+	client    MQTT.Client
+	forwarder *StoreForwarder
+	subs      map[string]mqttSubscription
+	state     ConnState
+	handlers  []func(ConnState, error)
+	published int64
+	failed    int64
+	closeOnce sync.Once
+}
+
+func NewMQTTClient(config *MQTTConfigurations) (*MQTTClient, error) {
+	if config == nil {
+		return nil, errors.New("MQTTConfigurations is nil")
+	}
+
+	opts, err := newMQTTClientOptions(config)
+	if err != nil {
+		return nil, err
+	}
+
+	v := new(MQTTClient)
+	v.config = *config
+	v.subs = make(map[string]mqttSubscription)
+	v.state = STATE_DISCONNECTED
+
+	opts.SetAutoReconnect(true)
+	opts.SetConnectRetry(true)
+	// 재구독은 OnConnect 에서 직접 한다.
+	opts.SetResumeSubs(false)
+	opts.SetOnConnectHandler(v.onConnect)
+	opts.SetConnectionLostHandler(func(client MQTT.Client, err error) {
+		logger.Warningf("MQTT connection lost: %v", err)
+		v.setState(STATE_DISCONNECTED, err)
+	})
+	opts.SetReconnectingHandler(func(client MQTT.Client, opts *MQTT.ClientOptions) {
+		v.setState(STATE_CONNECTING, nil)
+	})
+	v.client = MQTT.NewClient(opts)
+
+	if 0 < len(config.Buffer.Database) {
+		if v.forwarder, err = NewStoreForwarder(&config.Buffer, &mqttPublisher{v}); err != nil {
+			return nil, err
+		}
+	}
+
+	return v, nil
+}
+
+/**
+ * 연결 상태가 바뀌면 handler 를 호출한다.
+ */
+func (v *MQTTClient) OnStateChange(handler func(state ConnState, err error)) {
+	v.Lock()
+	defer v.Unlock()
+
+	v.handlers = append(v.handlers, handler)
+}
+
+func (v *MQTTClient) setState(state ConnState, err error) {
+	v.Lock()
+	if v.state == STATE_CLOSED || v.state == state {
+		v.Unlock()
+		return
+	}
+	v.state = state
+	handlers := make([]func(ConnState, error), len(v.handlers))
+	copy(handlers, v.handlers)
+	v.Unlock()
+
+	for _, handler := range handlers {
+		handler(state, err)
+	}
+}
+
+func (v *MQTTClient) State() ConnState {
+	v.Lock()
+	defer v.Unlock()
+
+	return v.state
+}
+
+func (v *MQTTClient) onConnect(client MQTT.Client) {
+	logger.Infof("MQTT connected: %s", v.config.Broker)
+
+	if 0 < len(v.config.Will.Topic) && 0 < len(v.config.Will.OnlinePayload) {
+		token := client.Publish(v.config.Will.Topic, byte(v.config.Will.Qos), v.config.Will.Retain, v.config.Will.OnlinePayload)
+		if token.WaitTimeout(MQTTTokenTimeout) && token.Error() != nil {
+			logger.Warningf("MQTT online status: %v", token.Error())
+		}
+	}
+
+	// 구독을 복구한다.
+	v.Lock()
+	subs := make(map[string]mqttSubscription, len(v.subs))
+	for topic, sub := range v.subs {
+		subs[topic] = sub
+	}
+	v.Unlock()
+
+	for topic, sub := range subs {
+		token := client.Subscribe(topic, sub.qos, sub.handler)
+		if token.WaitTimeout(MQTTTokenTimeout) && token.Error() != nil {
+			logger.Errorf("MQTT resubscribe %s: %v", topic, token.Error())
+		}
+	}
+
+	v.setState(STATE_CONNECTED, nil)
+
+	if v.forwarder != nil {
+		v.forwarder.Resume()
+	}
+}
+
+/**
+ * broker 에 연결한다. 연결될 때까지 재시도하며, timeout 안에 연결되지 않아도
+ * 백그라운드에서 계속 시도한다. (timeout <= 0 이면 기다리지 않는다.)
+ */
+func (v *MQTTClient) Connect(timeout time.Duration) error {
+	v.setState(STATE_CONNECTING, nil)
+
+	token := v.client.Connect()
+	if timeout <= 0 {
+		return nil
+	}
+	if token.WaitTimeout(timeout) == false {
+		return fmt.Errorf("MQTT connect to %s timed out", v.config.Broker)
+	}
+
+	return token.Error()
+}
+
+func (v *MQTTClient) IsConnected() bool {
+	return v.client.IsConnectionOpen()
+}
+
+/**
+ * 내부 클라이언트. 이 타입이 제공하지 않는 기능에 사용한다.
+ */
+func (v *MQTTClient) Client() MQTT.Client {
+	return v.client
+}
+
+func (v *MQTTClient) publish(topic string, qos byte, retain bool, payload []byte) error {
+	if v.client.IsConnectionOpen() == false {
+		return ErrMQTTNotConnected
+	}
+
+	token := v.client.Publish(topic, qos, retain, payload)
+	if token.WaitTimeout(MQTTTokenTimeout) == false {
+		return fmt.Errorf("publish to %s timed out", topic)
+	}
+	if err := token.Error(); err != nil {
+		return err
+	}
+	atomic.AddInt64(&v.published, 1)
+
+	return nil
+}
+
+/**
+ * 메시지를 발행한다. 오프라인 저장을 사용하면 저장에 성공했을 때 nil 을 반환한다.
+ */
+func (v *MQTTClient) Publish(topic string, qos byte, retain bool, payload []byte) error {
+	if v.forwarder != nil {
+		_, err := v.forwarder.DoSend(encodeMQTTMessage(topic, qos, retain, payload))
+		return err
+	}
+
+	if err := v.publish(topic, qos, retain, payload); err != nil {
+		atomic.AddInt64(&v.failed, 1)
+		return err
+	}
+
+	return nil
+}
+
+/**
+ * 구독한다. 연결되지 않았으면 연결된 뒤 구독하며, 다시 연결될 때마다 복구한다.
+ */
+func (v *MQTTClient) Subscribe(topic string, qos byte, handler MQTT.MessageHandler) error {
+	v.Lock()
+	v.subs[topic] = mqttSubscription{qos: qos, handler: handler}
+	v.Unlock()
+
+	if v.client.IsConnectionOpen() == false {
+		return nil
+	}
+
+	token := v.client.Subscribe(topic, qos, handler)
+	if token.WaitTimeout(MQTTTokenTimeout) == false {
+		return fmt.Errorf("subscribe to %s timed out", topic)
+	}
+
+	return token.Error()
+}
+
+func (v *MQTTClient) Unsubscribe(topics ...string) error {
+	v.Lock()
+	for _, topic := range topics {
+		delete(v.subs, topic)
+	}
+	v.Unlock()
+
+	if v.client.IsConnectionOpen() == false {
+		return nil
+	}
+
+	token := v.client.Unsubscribe(topics...)
+	if token.WaitTimeout(MQTTTokenTimeout) == false {
+		return errors.New("unsubscribe timed out")
+	}
+
+	return token.Error()
+}
+
+/**
+ * 진단 출력용 문자열
+ */
+func (v *MQTTClient) Diagnostics() []string {
+	v.Lock()
+	state := v.state
+	topics := make([]string, 0, len(v.subs))
+	for topic := range v.subs {
+		topics = append(topics, topic)
+	}
+	v.Unlock()
+	sort.Strings(topics)
+
+	strings := []string{}
+	strings = append(strings, fmt.Sprintf("Broker: %s", v.config.Broker))
+	strings = append(strings, fmt.Sprintf("State: %s", state.String()))
+	strings = append(strings, fmt.Sprintf("Published: %d", atomic.LoadInt64(&v.published)))
+	strings = append(strings, fmt.Sprintf("Failed: %d", atomic.LoadInt64(&v.failed)))
+	strings = append(strings, fmt.Sprintf("Subscriptions: %v", topics))
+	if v.forwarder != nil {
+		strings = append(strings, v.forwarder.Diagnostics()...)
+	}
+
+	return strings
+}
+
+/**
+ * 오프라인 상태를 알리고 연결을 끊는다. 저장된 메시지는 다음 실행 때 보낸다.
+ */
+func (v *MQTTClient) Close() error {
+	v.closeOnce.Do(func() {
+		if v.forwarder != nil {
+			v.forwarder.Close()
+		}
+
+		// 정상 종료에는 LWT 가 발행되지 않으므로 직접 알린다.
+		if 0 < len(v.config.Will.Topic) && v.client.IsConnectionOpen() {
+			token := v.client.Publish(v.config.Will.Topic, byte(v.config.Will.Qos), v.config.Will.Retain, v.config.Will.Payload)
+			token.WaitTimeout(MQTTTokenTimeout)
+		}
+
+		v.client.Disconnect(mqttDisconnectQuiesce)
+		v.setState(STATE_CLOSED, nil)
+	})
+
+	return nil
+}
+
+/**
+ * 저장된 메시지 형식: 토픽 길이(2) + 토픽 + QoS(1) + retain(1) + payload
+ */
+func encodeMQTTMessage(topic string, qos byte, retain bool, payload []byte) []byte {
+	data := make([]byte, 2, 2+len(topic)+2+len(payload))
+	binary.BigEndian.PutUint16(data, uint16(len(topic)))
+	data = append(data, topic...)
+	data = append(data, qos)
+	if retain {
+		data = append(data, 1)
+	} else {
+		data = append(data, 0)
+	}
+
+	return append(data, payload...)
+}
+
+func decodeMQTTMessage(data []byte) (string, byte, bool, []byte, error) {
+	if len(data) < 2 {
+		return "", 0, false, nil, errors.New("malformed MQTT message")
+	}
+	length := int(binary.BigEndian.Uint16(data))
+	if len(data) < 2+length+2 {
+		return "", 0, false, nil, errors.New("malformed MQTT message")
+	}
+
+	topic := string(data[2 : 2+length])
+	qos := data[2+length]
+	retain := data[2+length+1] == 1
+
+	return topic, qos, retain, data[2+length+2:], nil
+}
+
+/**
+ * StoreForwarder 가 저장된 메시지를 보내는 AckRelay
+ * 브로커의 수신 확인(PUBACK) 후 반환하도록 QoS 0 메시지도 QoS 1 로 발행한다.
+ */
+type mqttPublisher struct {
+	client *MQTTClient
+}
+
+func (v *mqttPublisher) SendAck(data []byte) error {
+	topic, qos, retain, payload, err := decodeMQTTMessage(data)
+	if err != nil {
+		// 보낼 수 없는 메시지는 버린다.
+		logger.Error(err)
+		return nil
+	}
+
+	if qos == 0 {
+		qos = 1
+	}
+
+	if err = v.client.publish(topic, qos, retain, payload); err != nil {
+		atomic.AddInt64(&v.client.failed, 1)
+		return err
+	}
+
+	return nil
+}
@@ -2,8 +2,8 @@ package ins
 
 import (
 	"bytes"
+	"context"
 	"crypto/tls"
-	"crypto/x509"
 	"encoding/base64"
 	"encoding/binary"
 	"errors"
@@ -11,132 +11,68 @@ import (
 	resty "github.com/go-resty/resty/v2"
 	"github.com/industry-netsecurity-solution/ins-security-channel/logger"
 	"io"
-	"io/ioutil"
 	"net"
-	"net/http"
 	"time"
 )
 
-func NewTLSConfig(cacertFile *string, certFile *string, keyFile *string) *tls.Config {
-	// Import trusted certificates from CAfile.pem.
-	// Alternatively, manually add CA certificates to
-	// default openssl CA bundle.
-	certpool := x509.NewCertPool()
+/**
+ * legacy TLS 정책으로 클라이언트 설정을 만든다.
+ * 정책을 지정하려면 NewPolicyTLSConfig 또는 XXXConfigurations.ClientTLSConfig 를 사용한다.
+ */
+func NewTLSConfig(cacertFile *string, certFile *string, keyFile *string, revocation ...*RevocationConfigurations) *tls.Config {
+	// Import trusted certificates from CAfile.pem and client certificate/key pair.
+	// 파일이 변경되면 CertManager 가 다시 읽는다.
+	manager, err := LoadCertManager(stringValue(cacertFile), stringValue(certFile), stringValue(keyFile))
+	if err != nil {
+		logger.Error(err)
+		return nil
+	}
 
-	if (cacertFile != nil) && (0 < len(*cacertFile)) {
-		pemCerts, err := ioutil.ReadFile(*cacertFile)
-		if err == nil {
-			certpool.AppendCertsFromPEM(pemCerts)
-		}
+	var r *RevocationConfigurations = nil
+	if 0 < len(revocation) {
+		r = revocation[0]
 	}
 
-	var certificates []tls.Certificate = nil
-	// Import client certificate/key pair
-	if (certFile != nil && 0 < len(*certFile)) && (keyFile != nil && 0 < len(*keyFile)) {
-		cert, err := tls.LoadX509KeyPair(*certFile, *keyFile)
-		if err != nil {
-			logger.Error(err)
-			return nil
-		}
-		if len(cert.Certificate) == 0 {
-			return nil
-		}
-		// Just to print out the client certificate..
-		cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
-		if err != nil {
-			logger.Error(err)
-			return nil
-		}
-		certificates = []tls.Certificate{cert}
-		//logger.Println(cert.Leaf)
-	}
-
-	// Create net.Config with desired net properties
-	return &tls.Config{
-		MinVersion:       tls.VersionTLS12,
-		MaxVersion:       tls.VersionTLS12,
-		CurvePreferences: []tls.CurveID{tls.CurveP521, tls.CurveP384, tls.CurveP256},
-		CipherSuites: []uint16{
-			tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
-			tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
-			tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
-		},
-
-		// RootCAs = certs used to verify server cert.
-		RootCAs: certpool,
-		// ClientAuth = whether to request cert from server.
-		// Since the server is set up for SSL, this happens
-		// anyways.
-		ClientAuth: tls.NoClientCert,
-		// ClientCAs = certs used to validate client cert.
-		ClientCAs: nil,
-		// InsecureSkipVerify = verify that cert contents
-		// match server. IP matches what is in cert etc.
-		InsecureSkipVerify: true,
-		// Certificates = list of certs client sends to server.
-		Certificates: certificates,
+	config, err := NewPolicyTLSConfig(nil, manager, r)
+	if err != nil {
+		logger.Error(err)
+		return nil
 	}
+
+	return config
 }
 
-func NewTLSServerConfig(cacertFile *string, certFile *string, keyFile *string) *tls.Config {
-	// Import trusted certificates from CAfile.pem.
-	// Alternatively, manually add CA certificates to
-	// default openssl CA bundle.
-	certpool := x509.NewCertPool()
+/**
+ * legacy TLS 정책으로 서버 설정을 만든다.
+ */
+func NewTLSServerConfig(cacertFile *string, certFile *string, keyFile *string, revocation ...*RevocationConfigurations) *tls.Config {
+	// Import trusted certificates from CAfile.pem and server certificate/key pair.
+	// 파일이 변경되면 CertManager 가 다시 읽는다.
+	manager, err := LoadCertManager(stringValue(cacertFile), stringValue(certFile), stringValue(keyFile))
+	if err != nil {
+		logger.Error(err)
+		return nil
+	}
 
-	if (cacertFile != nil) && (0 < len(*cacertFile)) {
-		pemCerts, err := ioutil.ReadFile(*cacertFile)
-		if err == nil {
-			certpool.AppendCertsFromPEM(pemCerts)
-		}
+	var r *RevocationConfigurations = nil
+	if 0 < len(revocation) {
+		r = revocation[0]
 	}
 
-	var certificates []tls.Certificate = nil
-	// Import client certificate/key pair
-	if (certFile != nil && 0 < len(*certFile)) && (keyFile != nil && 0 < len(*keyFile)) {
-		cert, err := tls.LoadX509KeyPair(*certFile, *keyFile)
-		if err != nil {
-			logger.Error(err)
-			return nil
-		}
-		if len(cert.Certificate) == 0 {
-			return nil
-		}
-		// Just to print out the client certificate..
-		cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
-		if err != nil {
-			logger.Error(err)
-			return nil
-		}
-		certificates = []tls.Certificate{cert}
-		//logger.Println(cert.Leaf)
-	}
-
-	// Create net.Config with desired net properties
-	return &tls.Config{
-		MinVersion:       tls.VersionTLS12,
-		MaxVersion:       tls.VersionTLS12,
-		CurvePreferences: []tls.CurveID{tls.CurveP521, tls.CurveP384, tls.CurveP256},
-		CipherSuites: []uint16{
-			tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
-			tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
-			tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
-		},
-
-		// RootCAs = certs used to verify server cert.
-		RootCAs: certpool,
-		// ClientAuth = whether to request cert from server.
-		// Since the server is set up for SSL, this happens
-		// anyways.
-		ClientAuth: tls.NoClientCert,
-		// ClientCAs = certs used to validate client cert.
-		ClientCAs: nil,
-		// InsecureSkipVerify = verify that cert contents
-		// match server. IP matches what is in cert etc.
-		InsecureSkipVerify: true,
-		// Certificates = list of certs client sends to server.
-		Certificates: certificates,
+	config, err := NewPolicyTLSServerConfig(nil, manager, r, tls.NoClientCert)
+	if err != nil {
+		logger.Error(err)
+		return nil
+	}
+
+	return config
+}
+
+func stringValue(s *string) string {
+	if s == nil {
+		return ""
 	}
+	return *s
 }
 
 func RecvTL32V(conn net.Conn, order binary.ByteOrder) (*TL32V, error) {
@@ -270,6 +206,29 @@ func RecvTLV(conn net.Conn, order binary.ByteOrder) ([]byte, error) {
 	return buf.Bytes(), nil
 }
 
+/**
+ * TCP 연결을 기다린다. PROXY protocol 을 사용하면 ProxyListener 로 감싼다.
+ */
+func listenProxy(localurl string, proxyConfig *ProxyProtocolConfigurations) (net.Listener, error) {
+	addr, err := net.ResolveTCPAddr("tcp", localurl)
+	if err != nil {
+		return nil, err
+	}
+
+	listener, err := net.ListenTCP("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	proxied, err := WrapProxyListener(listener, proxyConfig)
+	if err != nil {
+		listener.Close()
+		return nil, err
+	}
+
+	return proxied, nil
+}
+
 func ReadyServer(serviceConfig *ServiceConfigurations, ud interface{}, callback func(net.Conn, interface{}) error) int {
 
 	if serviceConfig == nil {
@@ -303,16 +262,20 @@ func ReadyServer(serviceConfig *ServiceConfigurations, ud interface{}, callback
 			config = &tls.Config{Certificates: []tls.Certificate{cer}}
 		*/
 
-		config = NewTLSServerConfig(&serviceConfig.CaCert, &serviceConfig.TlsCert, &serviceConfig.TlsKey)
+		config, err = serviceConfig.ServerTLSConfig()
+		if err != nil {
+			panic(err)
+			return -1
+		}
 
-		listener, err = tls.Listen("tcp", localurl, config)
+		listener, err = listenProxy(localurl, &serviceConfig.ProxyProtocol)
 		if err != nil {
 			panic(err)
 			return -1
 		}
+		listener = tls.NewListener(listener, config)
 	} else {
-		addr, err := net.ResolveTCPAddr("tcp", localurl)
-		listener, err = net.ListenTCP("tcp", addr)
+		listener, err = listenProxy(localurl, &serviceConfig.ProxyProtocol)
 		if err != nil {
 			panic(err)
 			return -1
@@ -356,21 +319,21 @@ func StartServer(serviceConfig *ServiceConfigurations, ud interface{}, callback
 	if serviceConfig.EnableTls {
 		var config *tls.Config = nil
 		//cer, err := tls.LoadX509KeyPair("server.pem", "server.key")
-		cer, err := tls.LoadX509KeyPair(serviceConfig.TlsCert, serviceConfig.TlsKey)
+		config, err := serviceConfig.ServerTLSConfig()
 		if err != nil {
 			panic(err)
 			return nil
 		}
 
-		config = &tls.Config{Certificates: []tls.Certificate{cer}}
-		listener, err = tls.Listen("tcp", localurl, config)
+		listener, err = listenProxy(localurl, &serviceConfig.ProxyProtocol)
 		if err != nil {
 			panic(err)
 			return nil
 		}
+		listener = tls.NewListener(listener, config)
 	} else {
-		addr, err := net.ResolveTCPAddr("tcp", localurl)
-		listener, err = net.ListenTCP("tcp", addr)
+		var err error
+		listener, err = listenProxy(localurl, &serviceConfig.ProxyProtocol)
 		if err != nil {
 			panic(err)
 			return nil
@@ -411,9 +374,13 @@ func Dial(remote *ServiceConfigurations) (net.Conn, error) {
 
 	var conn net.Conn = nil
 	if remote.EnableTls {
-		var config *tls.Config = nil
-		config = &tls.Config{
-			InsecureSkipVerify: true,
+		config, err := remote.ClientTLSConfig()
+		if err != nil {
+			return nil, err
+		}
+		if len(config.ServerName) == 0 {
+			// 주소를 IP 로 변환하여 연결하므로 서버 이름을 지정한다.
+			config.ServerName = remote.Address
 		}
 
 		// TCP/TLS 연결
@@ -440,7 +407,9 @@ func Dial(remote *ServiceConfigurations) (net.Conn, error) {
 }
 
 /**
- *
+ * 수신한 데이터를 c 로, 수신 오류를 e 로 전달한다. c, e 는 대기열이 없으므로
+ * e 는 c 로 보낸 데이터를 모두 읽은 뒤에 전달된다.
+ * 수신을 멈출 수 없으므로 새로 작성하는 코드는 NewRecvChannel 을 사용한다.
  */
 func MakeRecvChannel(conn net.Conn, ud interface{}, callback func(net.Conn, interface{}) ([]byte, error)) (chan []byte, chan error) {
 
@@ -486,51 +455,17 @@ func MakeRecvChannel(conn net.Conn, ud interface{}, callback func(net.Conn, inte
 }
 
 /**
- *  있는 그대로 읽고 전달한다.
+ * 두 연결 사이에서 데이터를 중계한다. 정상 종료는 0, 오류는 -1
+ * 중계 결과가 필요하면 RelayConn 을 사용한다.
  */
 func Relay(conn1 net.Conn, ud1 interface{},
 	callback1 func(net.Conn, interface{}) ([]byte, error),
 	conn2 net.Conn, ud2 interface{},
 	callback2 func(net.Conn, interface{}) ([]byte, error)) int {
 
-	chan1, echan1 := MakeRecvChannel(conn1, ud1, callback1)
-	chan2, echan2 := MakeRecvChannel(conn2, ud2, callback2)
-
-	for {
-		select {
-		case b1 := <-chan1:
-			if b1 == nil {
-				return 0
-			} else {
-				// 수신한 데이터를 상대 소켓에 보낸다.
-				_, err := conn2.Write(b1)
-				if err != nil {
-					return -1
-				}
-			}
-			break
-		case e1 := <-echan1:
-			if e1 == io.EOF {
-				return 0
-			}
-			return -1
-		case b2 := <-chan2:
-			if b2 == nil {
-				return 0
-			} else {
-				// 수신한 데이터를 상대 소켓에 보낸다.
-				_, err := conn1.Write(b2)
-				if err != nil {
-					return -1
-				}
-			}
-			break
-		case e2 := <-echan2:
-			if e2 == io.EOF {
-				return 0
-			}
-			return -1
-		}
+	result := RelayConn(context.Background(), conn1, ud1, callback1, conn2, ud2, callback2)
+	if result.Err != nil {
+		return -1
 	}
 
 	return 0
@@ -563,23 +498,11 @@ func HttpPost(requestUrl *HttpConfigurations, querypath []string, headers map[st
 
 	rawurl := u.String()
 
-	client := resty.New()
-	if requestUrl.EnableTls {
-		var tr *http.Transport = nil
-		if 0 < len(requestUrl.TlsCert) {
-			tr = &http.Transport{
-				TLSClientConfig: NewTLSConfig(&requestUrl.CaCert, &requestUrl.TlsCert, &requestUrl.TlsKey),
-			}
-		} else {
-			tr = &http.Transport{
-				TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
-			}
-		}
-		client.SetTransport(tr)
+	client, err := GetHttpClient(requestUrl)
+	if err != nil {
+		return -1, err
 	}
 
-	client.SetCloseConnection(true)
-
 	if 0 < len(requestUrl.Authorization) {
 		encoded := base64.StdEncoding.EncodeToString([]byte(requestUrl.Authorization))
 		headers["Authorization"] = fmt.Sprintf("Bearer %s", encoded)
@@ -611,6 +534,53 @@ type DataRelay interface {
 	DoSend(args ...interface{}) (interface{}, error)
 }
 
+// 수신 확인(ack) 대기 시간 기본값
+var DefaultAckTimeout = 30 * time.Second
+
+var ErrInvalidAck = errors.New("invalid ack")
+
+var ErrAckNotEnabled = errors.New("ack is not enabled")
+
+/**
+ * 상대가 수신을 확인(ack)한 뒤에 반환하는 relay
+ * SendAck 가 nil 을 반환하면 상대가 메시지를 받아 처리한 것이다.
+ */
+type AckRelay interface {
+	SendAck(data []byte) error
+}
+
+/**
+ * 받은 메시지 하나에 대한 수신 확인(CODE_ACK)을 보낸다.
+ */
+func WriteAck(conn net.Conn) error {
+	ack := TL32V{Type: CODE_ACK, Length: 0}
+	_, err := conn.Write(ack.Bytes(binary.LittleEndian))
+	return err
+}
+
+/**
+ * 수신 확인(CODE_ACK) 하나를 읽는다.
+ */
+func ReadAck(reader io.Reader) error {
+	header := make([]byte, 6)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return err
+	}
+
+	if bytes.Equal(header[:2], CODE_ACK) == false || binary.LittleEndian.Uint32(header[2:]) != 0 {
+		return ErrInvalidAck
+	}
+
+	return nil
+}
+
+func ackTimeout(remote *ServiceConfigurations) time.Duration {
+	if 0 < remote.ReadTimeout {
+		return time.Duration(remote.ReadTimeout) * time.Second
+	}
+	return DefaultAckTimeout
+}
+
 type TcpRelay struct {
 	ServiceConfigurations
 }
@@ -630,3 +600,22 @@ func (v TcpRelay) DoSend(args ...interface{}) (interface{}, error) {
 
 	return nwrite, nil
 }
+
+/**
+ * 메시지를 보내고 상대의 수신 확인(ack)을 기다린다.
+ * 상대는 메시지마다 ack 를 보내야 한다. (MessageRelayConfigurations.Ack)
+ */
+func (v TcpRelay) SendAck(data []byte) error {
+	conn, err := Dial(&v.ServiceConfigurations)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if _, err = SendMessage(data, conn); err != nil {
+		return err
+	}
+
+	conn.SetReadDeadline(time.Now().Add(ackTimeout(&v.ServiceConfigurations)))
+	return ReadAck(conn)
+}
@@ -0,0 +1,258 @@
+package ins
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"time"
+)
+
+// 연결 당 한 번에 모아 보내는 최대 메시지 수
+const pooledRelayBatchSize = 64
+
+var ErrRelayClosed = errors.New("relay closed")
+
+type relayRequest struct {
+	data   []byte
+	result chan relayResult
+}
+
+type relayResult struct {
+	n   int
+	err error
+}
+
+/**
+ * 원격 서비스와의 연결을 유지하며 메시지를 전송하는 DataRelay
+ *
+ * size 개의 연결을 유지하고, 대기 중인 메시지를 연결마다 모아서 한 번에 쓴다.
+ * 연결이 끊어지면 다시 연결하여 전송을 한 번 더 시도한다.
+ * (일부만 전송된 경우 상대가 같은 메시지를 다시 받을 수 있다.)
+ * TcpRelay 와 같이 DoSend(data []byte) 로 사용하며 보낸 바이트 수를 반환한다.
+ *
+ * NewAckPooledRelay 로 만들면 메시지마다 상대의 수신 확인(ack)을 받은 뒤에 반환한다.
+ * ack 를 받지 못한 메시지만 다시 보낸다.
+ */
+type PooledRelay struct {
+	remote  ServiceConfigurations
+	ack     bool
+	dialers []*ReconnectDialer
+	queue   chan *relayRequest
+	stop    chan struct{}
+	once    sync.Once
+	wg      sync.WaitGroup
+}
+
+func NewPooledRelay(remote *ServiceConfigurations, size int) (*PooledRelay, error) {
+	return newPooledRelay(remote, size, false)
+}
+
+/**
+ * 상대의 수신 확인(ack)을 기다리는 PooledRelay 를 만든다. StoreForwarder 의 relay 로 사용한다.
+ * ack 대기 시간은 remote.ReadTimeout(초), 지정되지 않으면 DefaultAckTimeout 이다.
+ */
+func NewAckPooledRelay(remote *ServiceConfigurations, size int) (*PooledRelay, error) {
+	return newPooledRelay(remote, size, true)
+}
+
+func newPooledRelay(remote *ServiceConfigurations, size int, ack bool) (*PooledRelay, error) {
+	if remote == nil {
+		return nil, errors.New("remote is nil")
+	}
+	if size <= 0 {
+		size = 1
+	}
+
+	v := new(PooledRelay)
+	v.remote = *remote
+	v.ack = ack
+	v.queue = make(chan *relayRequest, size*pooledRelayBatchSize)
+	v.stop = make(chan struct{})
+
+	for i := 0; i < size; i++ {
+		dialer, err := NewReconnectDialer(&DialerConfigurations{
+			Remotes:    []ServiceConfigurations{*remote},
+			MaxRetries: 3,
+		})
+		if err != nil {
+			v.Close()
+			return nil, err
+		}
+		v.dialers = append(v.dialers, dialer)
+
+		v.wg.Add(1)
+		go v.worker(dialer)
+	}
+
+	return v, nil
+}
+
+func (v *PooledRelay) DoSend(args ...interface{}) (interface{}, error) {
+	if len(args) == 0 {
+		return 0, errors.New("no data")
+	}
+	data, ok := args[0].([]byte)
+	if ok == false {
+		return 0, errors.New("data is not []byte")
+	}
+
+	req := &relayRequest{data: data, result: make(chan relayResult, 1)}
+
+	select {
+	case <-v.stop:
+		return 0, ErrRelayClosed
+	case v.queue <- req:
+	}
+
+	select {
+	case <-v.stop:
+		return 0, ErrRelayClosed
+	case result := <-req.result:
+		return result.n, result.err
+	}
+}
+
+/**
+ * 메시지를 보내고 상대의 수신 확인(ack)을 기다린다. NewAckPooledRelay 로 만든 경우에만 사용할 수 있다.
+ */
+func (v *PooledRelay) SendAck(data []byte) error {
+	if v.ack == false {
+		return ErrAckNotEnabled
+	}
+
+	_, err := v.DoSend(data)
+	return err
+}
+
+func (v *PooledRelay) worker(dialer *ReconnectDialer) {
+	defer v.wg.Done()
+
+	var watched net.Conn = nil
+	for {
+		var req *relayRequest
+		select {
+		case <-v.stop:
+			return
+		case req = <-v.queue:
+		}
+
+		// 대기 중인 메시지를 모은다.
+		batch := []*relayRequest{req}
+	collect:
+		for len(batch) < pooledRelayBatchSize {
+			select {
+			case req = <-v.queue:
+				batch = append(batch, req)
+			default:
+				break collect
+			}
+		}
+
+		watched = v.write(dialer, watched, batch)
+	}
+}
+
+/**
+ * 상대가 연결을 끊으면 쓰기 전에 알 수 있도록 수신 데이터를 읽어서 버린다.
+ */
+func watchConn(dialer *ReconnectDialer, conn net.Conn) {
+	_, err := io.Copy(ioutil.Discard, conn)
+	if err == nil {
+		err = io.EOF
+	}
+	dialer.Fail(conn, err)
+}
+
+func (v *PooledRelay) write(dialer *ReconnectDialer, watched net.Conn, batch []*relayRequest) net.Conn {
+	var err error = nil
+
+	for attempt := 0; attempt < 2 && 0 < len(batch); attempt++ {
+		var conn net.Conn
+		conn, err = dialer.Connect(context.Background())
+		if err != nil {
+			break
+		}
+		if v.ack == false && conn != watched {
+			// ack 를 사용하면 write 에서 ack 를 읽는다.
+			watched = conn
+			go watchConn(dialer, conn)
+		}
+
+		if 0 < v.remote.WriteTimeout {
+			conn.SetWriteDeadline(time.Now().Add(time.Duration(v.remote.WriteTimeout) * time.Second))
+		}
+
+		buffers := make(net.Buffers, 0, len(batch))
+		for _, req := range batch {
+			buffers = append(buffers, req.data)
+		}
+		if _, err = buffers.WriteTo(conn); err == nil {
+			if v.ack == false {
+				for _, req := range batch {
+					req.result <- relayResult{len(req.data), nil}
+				}
+				return watched
+			}
+
+			if batch, err = v.waitAck(conn, batch); err == nil {
+				return watched
+			}
+		}
+
+		// 끊어진 연결을 버리고 다시 연결한다.
+		dialer.Fail(conn, err)
+	}
+
+	for _, req := range batch {
+		req.result <- relayResult{0, err}
+	}
+
+	return watched
+}
+
+/**
+ * 보낸 순서대로 ack 를 읽어 메시지를 완료한다. ack 를 받지 못한 메시지를 반환한다.
+ */
+func (v *PooledRelay) waitAck(conn net.Conn, batch []*relayRequest) ([]*relayRequest, error) {
+	conn.SetReadDeadline(time.Now().Add(ackTimeout(&v.remote)))
+
+	for 0 < len(batch) {
+		if err := ReadAck(conn); err != nil {
+			return batch, err
+		}
+		batch[0].result <- relayResult{len(batch[0].data), nil}
+		batch = batch[1:]
+	}
+
+	return batch, nil
+}
+
+/**
+ * 연결 상태 (진단용)
+ */
+func (v *PooledRelay) Diagnostics() []string {
+	strings := []string{}
+	for _, dialer := range v.dialers {
+		strings = append(strings, dialer.Diagnostics()...)
+	}
+
+	return strings
+}
+
+/**
+ * 연결을 모두 닫는다. 전송 대기 중인 메시지는 ErrRelayClosed 로 실패한다.
+ */
+func (v *PooledRelay) Close() error {
+	v.once.Do(func() {
+		close(v.stop)
+		for _, dialer := range v.dialers {
+			dialer.Close()
+		}
+		v.wg.Wait()
+	})
+
+	return nil
+}
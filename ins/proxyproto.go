@@ -0,0 +1,359 @@
+package ins
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/industry-netsecurity-solution/ins-security-channel/logger"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// PROXY protocol 헤더 수신 대기 시간 기본값
+var DefaultProxyHeaderTimeout = 5 * time.Second
+
+// PROXY protocol 헤더 수신 대기 중인 연결 수 제한 기본값
+var DefaultProxyMaxPending int64 = 128
+
+var ErrInvalidProxyHeader = errors.New("invalid PROXY protocol header")
+
+var ErrNoProxyHeader = errors.New("no PROXY protocol header")
+
+var proxyV1Prefix = []byte("PROXY ")
+var proxyV2Signature = []byte{0x0D, 0x0A, 0x0D, 0x0A, 0x00, 0x0D, 0x0A, 0x51, 0x55, 0x49, 0x54, 0x0A}
+
+// v1 헤더 최대 길이 (CRLF 포함)
+const proxyV1MaxLength = 107
+
+/**
+ * 신뢰하는 주소에서 온 연결의 PROXY protocol 헤더를 해석하는 Listener
+ *
+ * 헤더는 연결에서 처음 읽거나 RemoteAddr 를 호출할 때 읽으므로 Accept 는 막히지 않는다.
+ * 신뢰하는 주소에서 온 연결은 헤더가 있어야 하며, 헤더가 없거나 잘못되었으면 연결을 닫는다.
+ * 신뢰하지 않는 주소에서 온 연결은 그대로 반환한다(헤더를 데이터로 본다).
+ * TLS 를 사용하면 이 Listener 를 tls.NewListener 로 감싼다.
+ */
+type ProxyListener struct {
+	net.Listener
+	trusted []*net.IPNet
+	timeout time.Duration
+}
+
+func NewProxyListener(listener net.Listener, config *ProxyProtocolConfigurations) (*ProxyListener, error) {
+	if config == nil {
+		return nil, errors.New("ProxyProtocolConfigurations is nil")
+	}
+
+	v := new(ProxyListener)
+	v.Listener = listener
+	v.timeout = DefaultProxyHeaderTimeout
+	if 0 < config.HeaderTimeout {
+		v.timeout = time.Duration(config.HeaderTimeout) * time.Second
+	}
+
+	for _, cidr := range config.TrustedCidrs {
+		if strings.Contains(cidr, "/") == false {
+			// 단일 주소
+			if ip := net.ParseIP(cidr); ip != nil && ip.To4() != nil {
+				cidr += "/32"
+			} else {
+				cidr += "/128"
+			}
+		}
+		_, ipnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		v.trusted = append(v.trusted, ipnet)
+	}
+
+	return v, nil
+}
+
+/**
+ * ProxyProtocol 을 사용하도록 설정되어 있으면 listener 를 ProxyListener 로 감싼다.
+ */
+func WrapProxyListener(listener net.Listener, config *ProxyProtocolConfigurations) (net.Listener, error) {
+	if config == nil || config.Enable == false {
+		return listener, nil
+	}
+
+	proxy, err := NewProxyListener(listener, config)
+	if err != nil {
+		return nil, err
+	}
+
+	return proxy, nil
+}
+
+func (v *ProxyListener) isTrusted(addr net.Addr) bool {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if ok == false {
+		return false
+	}
+
+	for _, ipnet := range v.trusted {
+		if ipnet.Contains(tcpAddr.IP) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (v *ProxyListener) Accept() (net.Conn, error) {
+	conn, err := v.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	if v.isTrusted(conn.RemoteAddr()) == false {
+		return conn, nil
+	}
+
+	return &ProxyConn{Conn: conn, reader: bufio.NewReader(conn), timeout: v.timeout}, nil
+}
+
+/**
+ * PROXY protocol 헤더를 해석한 연결
+ * RemoteAddr 는 헤더의 송신 주소(실제 클라이언트)이며, LOCAL/UNKNOWN 헤더이거나 헤더 오류이면 연결된 주소이다.
+ */
+type ProxyConn struct {
+	net.Conn
+	reader  *bufio.Reader
+	timeout time.Duration
+	once    sync.Once
+	source  net.Addr
+	dest    net.Addr
+	err     error
+	// 헤더를 읽은 뒤 되돌릴 읽기 시간 제한
+	deadline time.Time
+	lock     sync.Mutex
+}
+
+func (v *ProxyConn) readHeader() {
+	v.once.Do(func() {
+		v.Conn.SetReadDeadline(time.Now().Add(v.timeout))
+		defer func() {
+			v.lock.Lock()
+			v.Conn.SetReadDeadline(v.deadline)
+			v.lock.Unlock()
+		}()
+
+		source, dest, err := ReadProxyHeader(v.reader)
+		if err != nil {
+			// 헤더 오류(시간 초과 포함)인 연결은 더 사용하지 않는다.
+			v.err = fmt.Errorf("%w from %v: %v", ErrInvalidProxyHeader, v.Conn.RemoteAddr(), err)
+			logger.Warning(v.err)
+			v.Conn.Close()
+			return
+		}
+		v.source, v.dest = source, dest
+	})
+}
+
+func (v *ProxyConn) SetDeadline(t time.Time) error {
+	v.lock.Lock()
+	v.deadline = t
+	v.lock.Unlock()
+
+	return v.Conn.SetDeadline(t)
+}
+
+func (v *ProxyConn) SetReadDeadline(t time.Time) error {
+	v.lock.Lock()
+	v.deadline = t
+	v.lock.Unlock()
+
+	return v.Conn.SetReadDeadline(t)
+}
+
+func (v *ProxyConn) Read(b []byte) (int, error) {
+	v.readHeader()
+	if v.err != nil {
+		return 0, v.err
+	}
+
+	return v.reader.Read(b)
+}
+
+func (v *ProxyConn) RemoteAddr() net.Addr {
+	v.readHeader()
+	if v.source != nil {
+		return v.source
+	}
+
+	return v.Conn.RemoteAddr()
+}
+
+func (v *ProxyConn) LocalAddr() net.Addr {
+	v.readHeader()
+	if v.dest != nil {
+		return v.dest
+	}
+
+	return v.Conn.LocalAddr()
+}
+
+/**
+ * 부하 분산기(PROXY protocol 송신측)의 주소
+ */
+func (v *ProxyConn) ProxyAddr() net.Addr {
+	return v.Conn.RemoteAddr()
+}
+
+/**
+ * 쓰기 방향만 닫는다(TCP half-close).
+ */
+func (v *ProxyConn) CloseWrite() error {
+	if c, ok := v.Conn.(interface{ CloseWrite() error }); ok {
+		return c.CloseWrite()
+	}
+
+	return errors.New("CloseWrite is not supported")
+}
+
+/**
+ * PROXY protocol v1/v2 헤더를 읽어 송신/수신 주소를 반환한다.
+ * 헤더가 없으면 ErrNoProxyHeader, LOCAL/UNKNOWN 이면 nil 주소를 반환한다.
+ */
+func ReadProxyHeader(reader *bufio.Reader) (net.Addr, net.Addr, error) {
+	// 첫 바이트로 헤더가 없는 연결을 바로 구분한다.
+	first, err := reader.Peek(1)
+	if err != nil {
+		return nil, nil, err
+	}
+	if first[0] != proxyV1Prefix[0] && first[0] != proxyV2Signature[0] {
+		return nil, nil, ErrNoProxyHeader
+	}
+
+	peek, err := reader.Peek(len(proxyV1Prefix))
+	if 0 < len(peek) && bytes.HasPrefix(proxyV1Prefix, peek) == false && bytes.HasPrefix(proxyV2Signature, peek) == false {
+		// 헤더 없음
+		return nil, nil, ErrNoProxyHeader
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if bytes.Equal(peek, proxyV1Prefix) {
+		return readProxyHeaderV1(reader)
+	}
+
+	if bytes.HasPrefix(proxyV2Signature, peek) {
+		peek, err = reader.Peek(len(proxyV2Signature))
+		if err == nil && bytes.Equal(peek, proxyV2Signature) {
+			return readProxyHeaderV2(reader)
+		}
+	}
+
+	// 헤더 없음
+	return nil, nil, ErrNoProxyHeader
+}
+
+func readProxyHeaderV1(reader *bufio.Reader) (net.Addr, net.Addr, error) {
+	line := make([]byte, 0, proxyV1MaxLength)
+	for {
+		b, err := reader.ReadByte()
+		if err != nil {
+			return nil, nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+		if proxyV1MaxLength <= len(line) {
+			return nil, nil, errors.New("v1 header too long")
+		}
+	}
+
+	if bytes.HasSuffix(line, []byte("\r\n")) == false {
+		return nil, nil, errors.New("v1 header must end with CRLF")
+	}
+
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if 2 <= len(fields) && fields[1] == "UNKNOWN" {
+		return nil, nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, nil, fmt.Errorf("malformed v1 header: %q", string(line))
+	}
+
+	sourceIp := net.ParseIP(fields[2])
+	destIp := net.ParseIP(fields[3])
+	if sourceIp == nil || destIp == nil {
+		return nil, nil, fmt.Errorf("malformed v1 address: %q", string(line))
+	}
+	sourcePort, err := strconv.ParseUint(fields[4], 10, 16)
+	if err != nil {
+		return nil, nil, err
+	}
+	destPort, err := strconv.ParseUint(fields[5], 10, 16)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return &net.TCPAddr{IP: sourceIp, Port: int(sourcePort)}, &net.TCPAddr{IP: destIp, Port: int(destPort)}, nil
+}
+
+func readProxyHeaderV2(reader *bufio.Reader) (net.Addr, net.Addr, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return nil, nil, err
+	}
+
+	version := header[12] >> 4
+	command := header[12] & 0x0F
+	family := header[13]
+	length := binary.BigEndian.Uint16(header[14:])
+
+	if version != 2 {
+		return nil, nil, fmt.Errorf("unsupported version: %d", version)
+	}
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(reader, payload); err != nil {
+		return nil, nil, err
+	}
+
+	switch command {
+	case 0x00:
+		// LOCAL: 부하 분산기 자체의 연결(상태 확인 등)
+		return nil, nil, nil
+	case 0x01:
+		// PROXY
+	default:
+		return nil, nil, fmt.Errorf("unsupported command: %d", command)
+	}
+
+	var size int
+	switch family {
+	case 0x11, 0x12:
+		// TCP/UDP over IPv4
+		size = net.IPv4len
+	case 0x21, 0x22:
+		// TCP/UDP over IPv6
+		size = net.IPv6len
+	default:
+		// UNSPEC, UNIX 등은 주소를 사용하지 않는다.
+		return nil, nil, nil
+	}
+
+	if len(payload) < size*2+4 {
+		return nil, nil, errors.New("v2 address too short")
+	}
+
+	sourceIp := net.IP(append([]byte{}, payload[:size]...))
+	destIp := net.IP(append([]byte{}, payload[size:size*2]...))
+	sourcePort := int(binary.BigEndian.Uint16(payload[size*2:]))
+	destPort := int(binary.BigEndian.Uint16(payload[size*2+2:]))
+	// 나머지(TLV)는 사용하지 않는다.
+
+	return &net.TCPAddr{IP: sourceIp, Port: sourcePort}, &net.TCPAddr{IP: destIp, Port: destPort}, nil
+}
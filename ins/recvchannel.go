@@ -0,0 +1,193 @@
+package ins
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// 수신 대기열 크기 기본값
+var DefaultRecvQueueSize int64 = 16
+
+// 대기열이 가득 찼을 때의 처리 방법
+const (
+	OVERFLOW_BLOCK       = "block"
+	OVERFLOW_DROP_OLDEST = "drop-oldest"
+	OVERFLOW_DROP_NEWEST = "drop-newest"
+)
+
+/**
+ * 연결에서 수신한 데이터를 크기가 정해진 대기열(C)로 전달한다.
+ *
+ * 수신이 끝나면 오류를 E 에 넣고(정상 종료는 io.EOF) C, E 를 닫는다.
+ * Close 또는 ctx 취소 시 대기 중인 Read 를 깨우고 수신을 멈춘다. 연결은 닫지 않는다.
+ * 이때 지정한 읽기 시간 제한은 C, E 가 닫히기 전에 0(제한 없음)으로 되돌린다.
+ * 대기열이 가득 차면 Overflow 에 따라 기다리거나(block), 가장 오래된 데이터(drop-oldest)
+ * 또는 새 데이터(drop-newest)를 버린다.
+ */
+type RecvChannel struct {
+	C        chan []byte
+	E        chan error
+	conn     net.Conn
+	overflow string
+	dropped  int64
+	ctx      context.Context
+	cancel   context.CancelFunc
+	done     chan struct{}
+	// interrupt goroutine 이 끝나면 닫힌다. interrupted 는 읽기 시간 제한을 지정했는지 여부
+	interruptDone chan struct{}
+	interrupted   bool
+}
+
+/**
+ * config 가 nil 이면 기본 크기의 대기열에 block 으로 동작한다.
+ */
+func NewRecvChannel(ctx context.Context, conn net.Conn, ud interface{}, callback func(net.Conn, interface{}) ([]byte, error), config *RecvQueueConfigurations) (*RecvChannel, error) {
+	size := DefaultRecvQueueSize
+	overflow := OVERFLOW_BLOCK
+	if config != nil {
+		if 0 < config.QueueSize {
+			size = config.QueueSize
+		}
+		if 0 < len(config.Overflow) {
+			overflow = config.Overflow
+		}
+	}
+
+	switch overflow {
+	case OVERFLOW_BLOCK, OVERFLOW_DROP_OLDEST, OVERFLOW_DROP_NEWEST:
+	default:
+		return nil, fmt.Errorf("unknown overflow policy: %s", overflow)
+	}
+
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	v := new(RecvChannel)
+	v.C = make(chan []byte, size)
+	v.E = make(chan error, 1)
+	v.conn = conn
+	v.overflow = overflow
+	v.ctx, v.cancel = context.WithCancel(ctx)
+	v.done = make(chan struct{})
+	v.interruptDone = make(chan struct{})
+
+	go v.interrupt()
+	go v.receive(ud, callback)
+
+	return v, nil
+}
+
+/**
+ * 취소되면 대기 중인 Read 가 반환되도록 읽기 시간 제한을 지난 시각으로 지정한다.
+ */
+func (v *RecvChannel) interrupt() {
+	defer close(v.interruptDone)
+
+	select {
+	case <-v.done:
+	case <-v.ctx.Done():
+		v.conn.SetReadDeadline(time.Now())
+		v.interrupted = true
+	}
+}
+
+func (v *RecvChannel) receive(ud interface{}, callback func(net.Conn, interface{}) ([]byte, error)) {
+	defer func() {
+		close(v.done)
+		// 연결을 계속 사용할 수 있도록 읽기 시간 제한을 되돌린다.
+		<-v.interruptDone
+		if v.interrupted {
+			v.conn.SetReadDeadline(time.Time{})
+		}
+		close(v.C)
+		close(v.E)
+		v.cancel()
+	}()
+
+	b := make([]byte, 4096)
+	for {
+		if v.ctx.Err() != nil {
+			v.E <- v.ctx.Err()
+			return
+		}
+
+		var data []byte = nil
+		var err error = nil
+		if callback == nil {
+			var n int
+			n, err = v.conn.Read(b)
+			if 0 < n {
+				data = make([]byte, n)
+				copy(data, b[:n])
+			}
+		} else {
+			data, err = callback(v.conn, ud)
+		}
+
+		if data != nil && v.put(data) == false {
+			v.E <- v.ctx.Err()
+			return
+		}
+
+		if err != nil {
+			if v.ctx.Err() != nil {
+				err = v.ctx.Err()
+			}
+			v.E <- err
+			return
+		}
+	}
+}
+
+func (v *RecvChannel) put(data []byte) bool {
+	switch v.overflow {
+	case OVERFLOW_DROP_NEWEST:
+		select {
+		case v.C <- data:
+		default:
+			atomic.AddInt64(&v.dropped, 1)
+		}
+		return true
+	case OVERFLOW_DROP_OLDEST:
+		for {
+			select {
+			case v.C <- data:
+				return true
+			default:
+			}
+
+			select {
+			case <-v.C:
+				atomic.AddInt64(&v.dropped, 1)
+			default:
+			}
+		}
+	}
+
+	select {
+	case v.C <- data:
+		return true
+	case <-v.ctx.Done():
+		return false
+	}
+}
+
+/**
+ * 대기열이 가득 차서 버린 데이터 수
+ */
+func (v *RecvChannel) Dropped() int64 {
+	return atomic.LoadInt64(&v.dropped)
+}
+
+/**
+ * 수신을 멈춘다. C, E 는 수신 goroutine 이 끝나면 닫힌다.
+ * E 가 닫힌 뒤에는 연결을 다시 읽을 수 있다. (WebSocketConn 은 제외)
+ */
+func (v *RecvChannel) Close() error {
+	v.cancel()
+	return nil
+}
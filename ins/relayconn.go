@@ -0,0 +1,244 @@
+package ins
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/industry-netsecurity-solution/ins-security-channel/logger"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 중계 종료 사유
+const (
+	RELAY_REASON_EOF         = "eof"
+	RELAY_REASON_READ_ERROR  = "read error"
+	RELAY_REASON_WRITE_ERROR = "write error"
+	RELAY_REASON_CANCELED    = "canceled"
+	RELAY_REASON_IDLE        = "idle timeout"
+)
+
+// 한쪽 방향이 끝난(half-close) 뒤 반대 방향에서 데이터 없이 기다리는 최대 시간
+var DefaultRelayHalfCloseTimeout = 60 * time.Second
+
+var ErrRelayIdleTimeout = errors.New("relay idle timeout after half-close")
+
+/**
+ * 양방향 중계 결과
+ * Up 은 conn1 -> conn2, Down 은 conn2 -> conn1 방향이다.
+ * Reads 는 수신 단위의 수이다. callback 이 있으면 callback 이 반환한 메시지 수, 없으면 Read 횟수이다.
+ */
+type RelayResult struct {
+	Started   time.Time
+	Duration  time.Duration
+	BytesUp   int64
+	BytesDown int64
+	ReadsUp   int64
+	ReadsDown int64
+	Reason    string
+	Err       error
+}
+
+func (v RelayResult) ToString() string {
+	return fmt.Sprintf("up %d bytes/%d reads, down %d bytes/%d reads, duration %v, reason %s, error %v",
+		v.BytesUp, v.ReadsUp, v.BytesDown, v.ReadsDown, v.Duration, v.Reason, v.Err)
+}
+
+// 전체 중계 통계 (진단용)
+var relayStats struct {
+	active    int64
+	completed int64
+	failed    int64
+	bytesUp   int64
+	bytesDown int64
+}
+var relayDiagnosticsOnce sync.Once
+
+func relayDiagnostics() []string {
+	strings := []string{}
+	strings = append(strings, fmt.Sprintf("Active: %d", atomic.LoadInt64(&relayStats.active)))
+	strings = append(strings, fmt.Sprintf("Completed: %d", atomic.LoadInt64(&relayStats.completed)))
+	strings = append(strings, fmt.Sprintf("Failed: %d", atomic.LoadInt64(&relayStats.failed)))
+	strings = append(strings, fmt.Sprintf("BytesUp: %d", atomic.LoadInt64(&relayStats.bytesUp)))
+	strings = append(strings, fmt.Sprintf("BytesDown: %d", atomic.LoadInt64(&relayStats.bytesDown)))
+
+	return strings
+}
+
+/**
+ * 쓰기 방향만 닫는다(TCP half-close). 지원하지 않으면 false
+ */
+func closeWrite(conn net.Conn) bool {
+	if c, ok := conn.(*ServerConn); ok {
+		conn = c.Conn
+	}
+
+	if c, ok := conn.(interface{ CloseWrite() error }); ok {
+		return c.CloseWrite() == nil
+	}
+
+	return false
+}
+
+type relayDirection struct {
+	bytes  int64
+	reads  int64
+	reason string
+	err    error
+	// 이 방향이 끝나 상대 연결의 쓰기를 닫으면 닫힌다.
+	halfClosed chan struct{}
+}
+
+func relayCopy(ctx context.Context, cancel context.CancelFunc, src net.Conn, ud interface{},
+	callback func(net.Conn, interface{}) ([]byte, error), dst net.Conn, result *relayDirection, peer *relayDirection) {
+
+	rc, err := NewRecvChannel(ctx, src, ud, callback, nil)
+	if err != nil {
+		result.reason = RELAY_REASON_READ_ERROR
+		result.err = err
+		cancel()
+		return
+	}
+	defer rc.Close()
+
+	// 반대 방향이 끝나면 데이터 없이 DefaultRelayHalfCloseTimeout 이 지날 때 멈춘다.
+	peerClosed := peer.halfClosed
+	var timer *time.Timer = nil
+	var idle <-chan time.Time = nil
+	defer func() {
+		if timer != nil {
+			timer.Stop()
+		}
+	}()
+
+receive:
+	for {
+		select {
+		case data, ok := <-rc.C:
+			if ok == false {
+				break receive
+			}
+
+			// 수신한 데이터를 상대 소켓에 보낸다.
+			if _, err = dst.Write(data); err != nil {
+				result.reason = RELAY_REASON_WRITE_ERROR
+				result.err = err
+				cancel()
+				return
+			}
+			result.bytes += int64(len(data))
+			result.reads++
+
+			if timer != nil {
+				if timer.Stop() == false {
+					<-timer.C
+				}
+				timer.Reset(DefaultRelayHalfCloseTimeout)
+			}
+		case <-peerClosed:
+			peerClosed = nil
+			timer = time.NewTimer(DefaultRelayHalfCloseTimeout)
+			idle = timer.C
+		case <-idle:
+			result.reason = RELAY_REASON_IDLE
+			result.err = ErrRelayIdleTimeout
+			cancel()
+			return
+		}
+	}
+
+	err = <-rc.E
+	switch {
+	case err == nil || err == io.EOF:
+		// 상대에게 더 보낼 데이터가 없음을 알리고, 반대 방향은 계속 중계한다.
+		result.reason = RELAY_REASON_EOF
+		if closeWrite(dst) == false {
+			cancel()
+		} else {
+			close(result.halfClosed)
+		}
+	case err == context.Canceled:
+		result.reason = RELAY_REASON_CANCELED
+	default:
+		result.reason = RELAY_REASON_READ_ERROR
+		result.err = err
+		cancel()
+	}
+}
+
+/**
+ * 두 연결 사이에서 데이터를 중계하고 결과를 반환한다.
+ *
+ * 한쪽이 EOF 를 보내면 상대 연결의 쓰기만 닫고(CloseWrite) 반대 방향이 끝날 때까지 중계한다.
+ * 이때 반대 방향에서 DefaultRelayHalfCloseTimeout 동안 데이터가 없으면 멈춘다.
+ * half-close 를 지원하지 않는 연결이거나 오류가 발생하면 양방향 모두 멈춘다.
+ * ctx 가 취소되면 중계를 멈춘다. 연결은 닫지 않는다.
+ */
+func RelayConn(ctx context.Context, conn1 net.Conn, ud1 interface{},
+	callback1 func(net.Conn, interface{}) ([]byte, error),
+	conn2 net.Conn, ud2 interface{},
+	callback2 func(net.Conn, interface{}) ([]byte, error)) RelayResult {
+
+	relayDiagnosticsOnce.Do(func() {
+		RegisterDiagnostics("relay", relayDiagnostics)
+	})
+	atomic.AddInt64(&relayStats.active, 1)
+	defer atomic.AddInt64(&relayStats.active, -1)
+
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	parent := ctx
+	ctx, cancel := context.WithCancel(parent)
+	defer cancel()
+
+	result := RelayResult{Started: time.Now()}
+	up := relayDirection{halfClosed: make(chan struct{})}
+	down := relayDirection{halfClosed: make(chan struct{})}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		relayCopy(ctx, cancel, conn1, ud1, callback1, conn2, &up, &down)
+	}()
+	go func() {
+		defer wg.Done()
+		relayCopy(ctx, cancel, conn2, ud2, callback2, conn1, &down, &up)
+	}()
+	wg.Wait()
+
+	result.Duration = time.Since(result.Started)
+	result.BytesUp = up.bytes
+	result.ReadsUp = up.reads
+	result.BytesDown = down.bytes
+	result.ReadsDown = down.reads
+
+	// 오류가 발생한 방향의 사유를 종료 사유로 한다. 다른 방향은 취소되어 끝난다.
+	result.Reason = RELAY_REASON_EOF
+	if parent.Err() != nil {
+		result.Reason = RELAY_REASON_CANCELED
+	}
+	for _, direction := range []relayDirection{up, down} {
+		if direction.err != nil {
+			result.Reason = direction.reason
+			result.Err = direction.err
+			break
+		}
+	}
+
+	atomic.AddInt64(&relayStats.bytesUp, result.BytesUp)
+	atomic.AddInt64(&relayStats.bytesDown, result.BytesDown)
+	if result.Err != nil {
+		atomic.AddInt64(&relayStats.failed, 1)
+	} else {
+		atomic.AddInt64(&relayStats.completed, 1)
+	}
+
+	logger.Infof("relay %v <-> %v: %s", conn1.RemoteAddr(), conn2.RemoteAddr(), result.ToString())
+
+	return result
+}
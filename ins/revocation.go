@@ -0,0 +1,510 @@
+package ins
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/sha1"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"github.com/industry-netsecurity-solution/ins-security-channel/logger"
+	"golang.org/x/crypto/ocsp"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// OCSP 응답 캐시 유지 시간 (NextUpdate 가 먼저 지나면 다시 요청한다)
+var DefaultOcspCacheTimeout = 1 * time.Hour
+
+// OCSP 응답 대기 시간
+var DefaultOcspTimeout = 5 * time.Second
+
+var ErrCertificateRevoked = errors.New("certificate revoked")
+
+// 인증서 발급자의 CRL 이 없다.
+var errNoCRLForIssuer = errors.New("no CRL for issuer")
+
+type ocspCacheEntry struct {
+	response  *ocsp.Response
+	raw       []byte
+	fetchedAt time.Time
+}
+
+type revocationList struct {
+	crl     *x509.RevocationList
+	revoked map[string]time.Time
+}
+
+type crlCacheEntry struct {
+	modTime time.Time
+	size    int64
+	lists   []*revocationList
+}
+
+var ocspCache = make(map[string]*ocspCacheEntry)
+var ocspCacheLock sync.Mutex
+
+var crlCache = make(map[string]*crlCacheEntry)
+var crlCacheLock sync.Mutex
+
+/**
+ * CRL 파일과 OCSP 응답으로 인증서 폐기 여부를 확인한다.
+ */
+type RevocationChecker struct {
+	config  RevocationConfigurations
+	manager *CertManager
+	client  *http.Client
+}
+
+func (v RevocationConfigurations) IsEnabled() bool {
+	return 0 < len(v.crlFiles()) || v.EnableOcsp || v.OcspStapling
+}
+
+func (v RevocationConfigurations) crlFiles() []string {
+	files := []string{}
+	if 0 < len(v.CrlFile) {
+		files = append(files, v.CrlFile)
+	}
+	for _, name := range v.CrlFiles {
+		if 0 < len(name) {
+			files = append(files, name)
+		}
+	}
+
+	return files
+}
+
+func NewRevocationChecker(config *RevocationConfigurations, manager *CertManager) *RevocationChecker {
+	v := new(RevocationChecker)
+	if config != nil {
+		v.config = *config
+	}
+	v.manager = manager
+
+	timeout := DefaultOcspTimeout
+	if 0 < v.config.Timeout {
+		timeout = time.Duration(v.config.Timeout) * time.Second
+	}
+	v.client = &http.Client{Timeout: timeout}
+
+	return v
+}
+
+func (v *RevocationChecker) cacheTimeout() time.Duration {
+	if 0 < v.config.CacheTimeout {
+		return time.Duration(v.config.CacheTimeout) * time.Second
+	}
+	return DefaultOcspCacheTimeout
+}
+
+/**
+ * 폐기 여부를 확인할 수 없는 경우의 처리
+ * HardFail 이면 오류, 아니면 경고만 남긴다.
+ */
+func (v *RevocationChecker) unknown(cert *x509.Certificate, err error) error {
+	if v.config.HardFail {
+		return fmt.Errorf("revocation status unknown (%s): %v", cert.Subject.CommonName, err)
+	}
+
+	logger.Warningf("revocation status unknown (%s): %v", cert.Subject.CommonName, err)
+	return nil
+}
+
+/**
+ * tls.Config.VerifyConnection 에 지정한다.
+ */
+func (v *RevocationChecker) VerifyConnection(cs tls.ConnectionState) error {
+	if len(cs.PeerCertificates) == 0 {
+		return nil
+	}
+
+	chain := v.buildChain(cs)
+	for i, cert := range chain {
+		var issuer *x509.Certificate = nil
+		if i+1 < len(chain) {
+			issuer = chain[i+1]
+		} else if bytes.Equal(cert.RawIssuer, cert.RawSubject) {
+			// 최상위 인증서
+			break
+		}
+
+		var staple []byte = nil
+		if i == 0 {
+			staple = cs.OCSPResponse
+		}
+
+		if err := v.CheckCertificate(cert, issuer, staple); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (v *RevocationChecker) buildChain(cs tls.ConnectionState) []*x509.Certificate {
+	if 0 < len(cs.VerifiedChains) {
+		return cs.VerifiedChains[0]
+	}
+
+	// InsecureSkipVerify 인 경우 CA 번들로 경로를 구성한다.
+	if v.manager != nil {
+		intermediates := x509.NewCertPool()
+		for _, cert := range cs.PeerCertificates[1:] {
+			intermediates.AddCert(cert)
+		}
+
+		chains, err := cs.PeerCertificates[0].Verify(x509.VerifyOptions{
+			Roots:         v.manager.CertPool(),
+			Intermediates: intermediates,
+			KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+		})
+		if err == nil && 0 < len(chains) {
+			return chains[0]
+		}
+	}
+
+	return cs.PeerCertificates
+}
+
+/**
+ * 인증서 하나의 폐기 여부를 확인한다.
+ * issuer 가 nil 이면 확인할 수 없는 것으로 처리한다.
+ */
+func (v *RevocationChecker) CheckCertificate(cert, issuer *x509.Certificate, staple []byte) error {
+	if issuer == nil {
+		return v.unknown(cert, errors.New("issuer certificate not found"))
+	}
+
+	checked := false
+
+	if 0 < len(v.config.crlFiles()) {
+		revoked, err := v.checkCRL(cert, issuer)
+		if err != nil {
+			// 상위 CA 의 CRL 을 두지 않은 경우 중간 CA 인증서는 CRL 로 확인하지 않는다.
+			if cert.IsCA == false || errors.Is(err, errNoCRLForIssuer) == false {
+				if e := v.unknown(cert, err); e != nil {
+					return e
+				}
+			}
+		} else if revoked {
+			return fmt.Errorf("%w: %s (serial %s, crl)", ErrCertificateRevoked, cert.Subject.CommonName, cert.SerialNumber.Text(16))
+		} else {
+			checked = true
+		}
+	}
+
+	if 0 < len(staple) {
+		response, err := ocsp.ParseResponseForCert(staple, cert, issuer)
+		if err == nil && isOcspValid(response) {
+			return v.checkOcspStatus(cert, response)
+		}
+		logger.Warningf("invalid OCSP staple (%s): %v", cert.Subject.CommonName, err)
+	}
+
+	if v.config.EnableOcsp {
+		response, err := v.GetOcspResponse(cert, issuer)
+		if err != nil {
+			if checked {
+				logger.Warningf("OCSP request failed (%s): %v", cert.Subject.CommonName, err)
+				return nil
+			}
+			return v.unknown(cert, err)
+		}
+		return v.checkOcspStatus(cert, response)
+	}
+
+	return nil
+}
+
+func (v *RevocationChecker) checkOcspStatus(cert *x509.Certificate, response *ocsp.Response) error {
+	switch response.Status {
+	case ocsp.Good:
+		return nil
+	case ocsp.Revoked:
+		return fmt.Errorf("%w: %s (serial %s, ocsp)", ErrCertificateRevoked, cert.Subject.CommonName, cert.SerialNumber.Text(16))
+	}
+
+	return v.unknown(cert, errors.New("OCSP status unknown"))
+}
+
+func isOcspValid(response *ocsp.Response) bool {
+	if response == nil {
+		return false
+	}
+
+	now := time.Now()
+	if now.Before(response.ThisUpdate.Add(-5 * time.Minute)) {
+		return false
+	}
+	if response.NextUpdate.IsZero() == false && now.After(response.NextUpdate) {
+		return false
+	}
+
+	return true
+}
+
+func ocspCacheKey(cert, issuer *x509.Certificate) string {
+	hash := sha1.Sum(issuer.RawSubjectPublicKeyInfo)
+	return hex.EncodeToString(hash[:]) + ":" + cert.SerialNumber.Text(16)
+}
+
+func (v *RevocationChecker) responderUrl(cert *x509.Certificate) string {
+	if 0 < len(v.config.OcspResponder) {
+		return v.config.OcspResponder
+	}
+	if 0 < len(cert.OCSPServer) {
+		return cert.OCSPServer[0]
+	}
+	return ""
+}
+
+/**
+ * OCSP 응답을 캐시에서 찾고, 없으면 OCSP 서버에 요청한다.
+ */
+func (v *RevocationChecker) GetOcspResponse(cert, issuer *x509.Certificate) (*ocsp.Response, error) {
+	response, _, err := v.getOcspResponse(cert, issuer)
+	return response, err
+}
+
+func (v *RevocationChecker) getOcspResponse(cert, issuer *x509.Certificate) (*ocsp.Response, []byte, error) {
+	key := ocspCacheKey(cert, issuer)
+
+	ocspCacheLock.Lock()
+	entry, ok := ocspCache[key]
+	ocspCacheLock.Unlock()
+	if ok && time.Now().Before(entry.fetchedAt.Add(v.cacheTimeout())) && isOcspValid(entry.response) {
+		return entry.response, entry.raw, nil
+	}
+
+	responder := v.responderUrl(cert)
+	if len(responder) == 0 {
+		return nil, nil, errors.New("no OCSP responder")
+	}
+
+	request, err := ocsp.CreateRequest(cert, issuer, &ocsp.RequestOptions{Hash: crypto.SHA1})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	resp, err := v.client.Post(responder, "application/ocsp-request", bytes.NewReader(request))
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, nil, fmt.Errorf("%d %s - %s", resp.StatusCode, http.StatusText(resp.StatusCode), responder)
+	}
+
+	raw, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	response, err := ocsp.ParseResponseForCert(raw, cert, issuer)
+	if err != nil {
+		return nil, nil, err
+	}
+	if isOcspValid(response) == false {
+		return nil, nil, errors.New("stale OCSP response")
+	}
+
+	ocspCacheLock.Lock()
+	ocspCache[key] = &ocspCacheEntry{response, raw, time.Now()}
+	ocspCacheLock.Unlock()
+
+	return response, raw, nil
+}
+
+/**
+ * CRL 파일을 읽는다. 파일이 변경된 경우에만 다시 읽는다.
+ * PEM 파일에는 여러 CRL(발급자별)을 넣을 수 있다.
+ */
+func loadCRL(crlFile string) (*crlCacheEntry, error) {
+	fi, err := os.Stat(crlFile)
+	if err != nil {
+		return nil, err
+	}
+
+	crlCacheLock.Lock()
+	defer crlCacheLock.Unlock()
+
+	if entry, ok := crlCache[crlFile]; ok {
+		if entry.modTime.Equal(fi.ModTime()) && entry.size == fi.Size() {
+			return entry, nil
+		}
+	}
+
+	data, err := ioutil.ReadFile(crlFile)
+	if err != nil {
+		return nil, err
+	}
+
+	// PEM, DER 모두 지원
+	ders := [][]byte{}
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte("-----BEGIN")) {
+		for {
+			var block *pem.Block
+			block, data = pem.Decode(data)
+			if block == nil {
+				break
+			}
+			if block.Type == "X509 CRL" {
+				ders = append(ders, block.Bytes)
+			}
+		}
+		if len(ders) == 0 {
+			return nil, fmt.Errorf("%s: no X509 CRL", crlFile)
+		}
+	} else {
+		ders = append(ders, data)
+	}
+
+	entry := new(crlCacheEntry)
+	entry.modTime = fi.ModTime()
+	entry.size = fi.Size()
+	for _, der := range ders {
+		crl, err := x509.ParseRevocationList(der)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", crlFile, err)
+		}
+
+		list := &revocationList{crl: crl, revoked: make(map[string]time.Time)}
+		for _, revoked := range crl.RevokedCertificates {
+			list.revoked[revoked.SerialNumber.Text(16)] = revoked.RevocationTime
+		}
+		entry.lists = append(entry.lists, list)
+	}
+
+	crlCache[crlFile] = entry
+
+	return entry, nil
+}
+
+/**
+ * CrlFile, CrlFiles 중 cert 발급자의 CRL 로 폐기 여부를 확인한다.
+ */
+func (v *RevocationChecker) checkCRL(cert, issuer *x509.Certificate) (bool, error) {
+	var signatureErr error = nil
+	for _, crlFile := range v.config.crlFiles() {
+		entry, err := loadCRL(crlFile)
+		if err != nil {
+			return false, err
+		}
+
+		for _, list := range entry.lists {
+			if bytes.Equal(list.crl.RawIssuer, cert.RawIssuer) == false {
+				continue
+			}
+
+			if err := list.crl.CheckSignatureFrom(issuer); err != nil {
+				// 이름이 같은 다른 CA 의 CRL
+				signatureErr = err
+				continue
+			}
+
+			if list.crl.NextUpdate.IsZero() == false && time.Now().After(list.crl.NextUpdate) {
+				return false, errors.New("CRL expired: " + crlFile)
+			}
+
+			_, revoked := list.revoked[cert.SerialNumber.Text(16)]
+
+			return revoked, nil
+		}
+	}
+
+	if signatureErr != nil {
+		return false, signatureErr
+	}
+
+	return false, fmt.Errorf("%w: %s", errNoCRLForIssuer, issuer.Subject.String())
+}
+
+/**
+ * 서버 인증서에 OCSP 응답을 첨부(stapling)하는 GetCertificate 함수를 만든다.
+ */
+func (v *RevocationChecker) StapledGetCertificate(getCertificate func(*tls.ClientHelloInfo) (*tls.Certificate, error)) func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		certificate, err := getCertificate(hello)
+		if err != nil || certificate == nil || certificate.Leaf == nil {
+			return certificate, err
+		}
+
+		issuer := v.findIssuer(certificate)
+		if issuer == nil {
+			return certificate, nil
+		}
+
+		_, raw, err := v.getOcspResponse(certificate.Leaf, issuer)
+		if err != nil {
+			logger.Warningf("OCSP stapling failed (%s): %v", certificate.Leaf.Subject.CommonName, err)
+			return certificate, nil
+		}
+
+		stapled := *certificate
+		stapled.OCSPStaple = raw
+
+		return &stapled, nil
+	}
+}
+
+func (v *RevocationChecker) findIssuer(certificate *tls.Certificate) *x509.Certificate {
+	intermediates := x509.NewCertPool()
+	for _, der := range certificate.Certificate[1:] {
+		if cert, err := x509.ParseCertificate(der); err == nil {
+			intermediates.AddCert(cert)
+		}
+	}
+
+	opts := x509.VerifyOptions{
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	}
+	if v.manager != nil {
+		opts.Roots = v.manager.CertPool()
+	}
+
+	chains, err := certificate.Leaf.Verify(opts)
+	if err != nil || len(chains) == 0 || len(chains[0]) < 2 {
+		return nil
+	}
+
+	return chains[0][1]
+}
+
+/**
+ * 클라이언트 설정에 폐기 확인을 적용한다.
+ */
+func ApplyClientRevocation(config *tls.Config, manager *CertManager, revocation ...*RevocationConfigurations) *tls.Config {
+	if config == nil || len(revocation) == 0 || revocation[0] == nil || revocation[0].IsEnabled() == false {
+		return config
+	}
+
+	checker := NewRevocationChecker(revocation[0], manager)
+	config.VerifyConnection = checker.VerifyConnection
+
+	return config
+}
+
+/**
+ * 서버 설정에 폐기 확인과 OCSP stapling 을 적용한다.
+ */
+func ApplyServerRevocation(config *tls.Config, manager *CertManager, revocation ...*RevocationConfigurations) *tls.Config {
+	if config == nil || len(revocation) == 0 || revocation[0] == nil || revocation[0].IsEnabled() == false {
+		return config
+	}
+
+	checker := NewRevocationChecker(revocation[0], manager)
+	config.VerifyConnection = checker.VerifyConnection
+	if revocation[0].OcspStapling {
+		config.GetCertificate = checker.StapledGetCertificate(config.GetCertificate)
+	}
+
+	return config
+}
@@ -0,0 +1,395 @@
+package ins
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+var testSerial int64 = 1000
+
+func newTestCert(t *testing.T, cn string, issuer *testCert, isCA bool) *testCert {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testSerial++
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(testSerial),
+		Subject:               pkix.Name{CommonName: cn},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		BasicConstraintsValid: true,
+		IsCA:                  isCA,
+	}
+	if isCA {
+		template.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature
+	} else {
+		template.KeyUsage = x509.KeyUsageDigitalSignature
+		template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth}
+		template.DNSNames = []string{"localhost"}
+		template.IPAddresses = []net.IP{net.ParseIP("127.0.0.1")}
+	}
+
+	parent, signer := template, key
+	if issuer != nil {
+		parent, signer = issuer.cert, issuer.key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &testCert{cert, key}
+}
+
+/**
+ * root -> intermediate -> leaf 인증서 체인
+ */
+type testPKI struct {
+	root         *testCert
+	intermediate *testCert
+	good         *testCert
+	revoked      *testCert
+}
+
+func newTestPKI(t *testing.T) *testPKI {
+	v := new(testPKI)
+	v.root = newTestCert(t, "test root", nil, true)
+	v.intermediate = newTestCert(t, "test intermediate", v.root, true)
+	v.good = newTestCert(t, "good", v.intermediate, false)
+	v.revoked = newTestCert(t, "revoked", v.intermediate, false)
+
+	return v
+}
+
+func (v *testPKI) chain(leaf *testCert) []*x509.Certificate {
+	return []*x509.Certificate{leaf.cert, v.intermediate.cert, v.root.cert}
+}
+
+/**
+ * intermediate 가 발급한, revoked 를 폐기한 CRL 파일
+ */
+func (v *testPKI) writeCRL(t *testing.T, dir string) string {
+	t.Helper()
+
+	template := &x509.RevocationList{
+		Number:     big.NewInt(1),
+		ThisUpdate: time.Now().Add(-time.Minute),
+		NextUpdate: time.Now().Add(time.Hour),
+		RevokedCertificates: []pkix.RevokedCertificate{
+			{SerialNumber: v.revoked.cert.SerialNumber, RevocationTime: time.Now().Add(-time.Minute)},
+		},
+	}
+	der, err := x509.CreateRevocationList(rand.Reader, template, v.intermediate.cert, v.intermediate.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	name := filepath.Join(dir, "intermediate.crl")
+	writePEM(t, name, "X509 CRL", der)
+
+	return name
+}
+
+func writePEM(t *testing.T, name, blockType string, der ...[]byte) {
+	t.Helper()
+
+	data := []byte{}
+	for _, b := range der {
+		data = append(data, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: b})...)
+	}
+	if err := ioutil.WriteFile(name, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func writeKeyPair(t *testing.T, dir, name string, cert *testCert, chain ...*testCert) (string, string) {
+	t.Helper()
+
+	certs := [][]byte{cert.cert.Raw}
+	for _, c := range chain {
+		certs = append(certs, c.cert.Raw)
+	}
+	certFile := filepath.Join(dir, name+".pem")
+	writePEM(t, certFile, "CERTIFICATE", certs...)
+
+	der, err := x509.MarshalECPrivateKey(cert.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFile := filepath.Join(dir, name+".key")
+	writePEM(t, keyFile, "EC PRIVATE KEY", der)
+
+	return certFile, keyFile
+}
+
+/**
+ * intermediate 가 서명하는 OCSP 응답기
+ */
+func newTestOcspResponder(t *testing.T, pki *testPKI) (*httptest.Server, *int64) {
+	requests := int64(0)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&requests, 1)
+
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		request, err := ocsp.ParseRequest(body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		template := ocsp.Response{
+			Status:       ocsp.Good,
+			SerialNumber: request.SerialNumber,
+			ThisUpdate:   time.Now().Add(-time.Minute),
+			NextUpdate:   time.Now().Add(time.Hour),
+		}
+		if request.SerialNumber.Cmp(pki.revoked.cert.SerialNumber) == 0 {
+			template.Status = ocsp.Revoked
+			template.RevokedAt = time.Now().Add(-time.Minute)
+		}
+
+		response, err := ocsp.CreateResponse(pki.intermediate.cert, pki.intermediate.cert, template, pki.intermediate.key)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/ocsp-response")
+		w.Write(response)
+	}))
+	t.Cleanup(server.Close)
+
+	return server, &requests
+}
+
+func TestRevocationCRL(t *testing.T) {
+	pki := newTestPKI(t)
+	crlFile := pki.writeCRL(t, t.TempDir())
+
+	checker := NewRevocationChecker(&RevocationConfigurations{CrlFile: crlFile, HardFail: true}, nil)
+
+	if err := checker.CheckCertificate(pki.good.cert, pki.intermediate.cert, nil); err != nil {
+		t.Errorf("good certificate: %v", err)
+	}
+	if err := checker.CheckCertificate(pki.revoked.cert, pki.intermediate.cert, nil); errors.Is(err, ErrCertificateRevoked) == false {
+		t.Errorf("revoked certificate: %v", err)
+	}
+
+	// 3 단계 체인: 중간 CA 인증서는 root 가 발급했으므로 CRL 로 확인하지 않는다.
+	if err := checker.VerifyConnection(tls.ConnectionState{
+		PeerCertificates: pki.chain(pki.good)[:2],
+		VerifiedChains:   [][]*x509.Certificate{pki.chain(pki.good)},
+	}); err != nil {
+		t.Errorf("good chain: %v", err)
+	}
+	if err := checker.VerifyConnection(tls.ConnectionState{
+		PeerCertificates: pki.chain(pki.revoked)[:2],
+		VerifiedChains:   [][]*x509.Certificate{pki.chain(pki.revoked)},
+	}); errors.Is(err, ErrCertificateRevoked) == false {
+		t.Errorf("revoked chain: %v", err)
+	}
+
+	// 다른 발급자의 단말 인증서는 HardFail 이면 거부한다.
+	other := newTestCert(t, "other", pki.root, false)
+	if err := checker.CheckCertificate(other.cert, pki.root.cert, nil); err == nil {
+		t.Error("leaf without CRL accepted with HardFail")
+	}
+
+	// 발급자마다 CRL 을 둔다. (CrlFiles, 여러 CRL 을 넣은 PEM 파일)
+	second := newTestPKI(t)
+	secondFile := second.writeCRL(t, t.TempDir())
+	multi := NewRevocationChecker(&RevocationConfigurations{CrlFile: crlFile, CrlFiles: []string{secondFile}, HardFail: true}, nil)
+	for _, p := range []*testPKI{pki, second} {
+		if err := multi.CheckCertificate(p.good.cert, p.intermediate.cert, nil); err != nil {
+			t.Errorf("good certificate with CrlFiles: %v", err)
+		}
+		if err := multi.CheckCertificate(p.revoked.cert, p.intermediate.cert, nil); errors.Is(err, ErrCertificateRevoked) == false {
+			t.Errorf("revoked certificate with CrlFiles: %v", err)
+		}
+	}
+
+	first, err := ioutil.ReadFile(crlFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bundle, err := ioutil.ReadFile(secondFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bundleFile := filepath.Join(t.TempDir(), "bundle.crl")
+	if err := ioutil.WriteFile(bundleFile, append(first, bundle...), 0644); err != nil {
+		t.Fatal(err)
+	}
+	bundled := NewRevocationChecker(&RevocationConfigurations{CrlFile: bundleFile, HardFail: true}, nil)
+	if err := bundled.CheckCertificate(second.revoked.cert, second.intermediate.cert, nil); errors.Is(err, ErrCertificateRevoked) == false {
+		t.Errorf("revoked certificate with CRL bundle: %v", err)
+	}
+	if err := bundled.CheckCertificate(pki.good.cert, pki.intermediate.cert, nil); err != nil {
+		t.Errorf("good certificate with CRL bundle: %v", err)
+	}
+}
+
+func TestRevocationOCSP(t *testing.T) {
+	pki := newTestPKI(t)
+	responder, requests := newTestOcspResponder(t, pki)
+
+	checker := NewRevocationChecker(&RevocationConfigurations{EnableOcsp: true, OcspResponder: responder.URL, HardFail: true}, nil)
+
+	if err := checker.CheckCertificate(pki.good.cert, pki.intermediate.cert, nil); err != nil {
+		t.Errorf("good certificate: %v", err)
+	}
+	if err := checker.CheckCertificate(pki.revoked.cert, pki.intermediate.cert, nil); errors.Is(err, ErrCertificateRevoked) == false {
+		t.Errorf("revoked certificate: %v", err)
+	}
+
+	// 캐시된 응답을 사용한다.
+	count := atomic.LoadInt64(requests)
+	if err := checker.CheckCertificate(pki.good.cert, pki.intermediate.cert, nil); err != nil {
+		t.Errorf("cached response: %v", err)
+	}
+	if atomic.LoadInt64(requests) != count {
+		t.Errorf("OCSP response not cached: %d requests", atomic.LoadInt64(requests))
+	}
+
+	// 응답기에 접속할 수 없는 경우
+	down := newTestPKI(t)
+	responder.Close()
+	if err := checker.CheckCertificate(down.good.cert, down.intermediate.cert, nil); err == nil {
+		t.Error("unreachable responder accepted with HardFail")
+	}
+	soft := NewRevocationChecker(&RevocationConfigurations{EnableOcsp: true, OcspResponder: responder.URL}, nil)
+	if err := soft.CheckCertificate(down.good.cert, down.intermediate.cert, nil); err != nil {
+		t.Errorf("unreachable responder with soft fail: %v", err)
+	}
+}
+
+func TestRevocationServerClientAuth(t *testing.T) {
+	pki := newTestPKI(t)
+	dir := t.TempDir()
+
+	caFile := filepath.Join(dir, "ca.pem")
+	writePEM(t, caFile, "CERTIFICATE", pki.root.cert.Raw)
+	server := newTestCert(t, "server", pki.intermediate, false)
+	certFile, keyFile := writeKeyPair(t, dir, "server", server, pki.intermediate)
+
+	config := ServiceConfigurations{
+		EnableTls:  true,
+		CaCert:     caFile,
+		TlsCert:    certFile,
+		TlsKey:     keyFile,
+		ClientAuth: CLIENT_AUTH_REQUIRE,
+		Revocation: RevocationConfigurations{CrlFile: pki.writeCRL(t, dir), HardFail: true},
+	}
+	serverConfig, err := config.ServerTLSConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", serverConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				if err := conn.(*tls.Conn).Handshake(); err == nil {
+					conn.Write([]byte("ok"))
+				}
+			}()
+		}
+	}()
+
+	dial := func(client *testCert) error {
+		roots := x509.NewCertPool()
+		roots.AddCert(pki.root.cert)
+		clientConfig := &tls.Config{RootCAs: roots, ServerName: "localhost"}
+		if client != nil {
+			clientConfig.Certificates = []tls.Certificate{{
+				Certificate: [][]byte{client.cert.Raw, pki.intermediate.cert.Raw},
+				PrivateKey:  client.key,
+			}}
+		}
+
+		conn, err := tls.Dial("tcp", listener.Addr().String(), clientConfig)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+
+		// TLS 1.3 에서는 클라이언트 인증서 거부가 읽기에서 보고된다.
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		data, err := ioutil.ReadAll(conn)
+		if err != nil {
+			return err
+		}
+		if string(data) != "ok" {
+			return errors.New("connection closed")
+		}
+		return nil
+	}
+
+	if err := dial(pki.good); err != nil {
+		t.Errorf("good client certificate: %v", err)
+	}
+	if err := dial(pki.revoked); err == nil {
+		t.Error("revoked client certificate accepted")
+	}
+	if err := dial(nil); err == nil {
+		t.Error("missing client certificate accepted")
+	}
+}
+
+func TestClientAuthRequiresCaCert(t *testing.T) {
+	manager, err := NewCertManager("", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewPolicyTLSServerConfig(nil, manager, nil, tls.RequireAndVerifyClientCert); err == nil {
+		t.Error("client auth without CA certificate accepted")
+	}
+
+	if _, err := parseClientAuth("sometimes"); err == nil {
+		t.Error("unknown client auth accepted")
+	}
+}
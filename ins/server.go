@@ -0,0 +1,559 @@
+package ins
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"github.com/industry-netsecurity-solution/ins-security-channel/logger"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+var ErrServerClosed = errors.New("server closed")
+
+/**
+ * 연결 목록 조회용 정보
+ */
+type ConnInfo struct {
+	Id         uint64
+	RemoteAddr string
+	LocalAddr  string
+	CreatedAt  time.Time
+	LastActive time.Time
+	ReadBytes  int64
+	WriteBytes int64
+}
+
+func (v ConnInfo) ToString() string {
+	return fmt.Sprintf("#%d %s -> %s, created %s, last active %s, read %d, write %d",
+		v.Id, v.RemoteAddr, v.LocalAddr,
+		v.CreatedAt.Format("2006-01-02 15:04:05"), v.LastActive.Format("2006-01-02 15:04:05"),
+		v.ReadBytes, v.WriteBytes)
+}
+
+/**
+ * Server 가 관리하는 연결
+ * Read/Write 마다 ReadTimeout, IdleTimeout, WriteTimeout 에 따라 deadline 을 갱신한다.
+ */
+type ServerConn struct {
+	net.Conn
+	id         uint64
+	server     *Server
+	ip         string
+	createdAt  time.Time
+	lastActive int64
+	readBytes  int64
+	writeBytes int64
+	ctx        context.Context
+	cancel     context.CancelFunc
+	closeOnce  sync.Once
+}
+
+func (v *ServerConn) Id() uint64 {
+	return v.id
+}
+
+/**
+ * 서버 종료가 시작되면 취소된다.
+ * 처리 함수는 Done 을 확인하여 처리 중인 메시지를 마무리하고 반환한다.
+ */
+func (v *ServerConn) Context() context.Context {
+	return v.ctx
+}
+
+/**
+ * TLS 연결이면 확인된 클라이언트 인증서의 CN, 아니면 빈 문자열
+ * handshake 전(첫 Read 전)에는 빈 문자열이다.
+ * WebSocketConn 은 SetPeerCommonName 으로 지정된 값이다.
+ */
+func PeerCommonName(conn net.Conn) string {
+	if c, ok := conn.(*WebSocketConn); ok {
+		return c.commonName
+	}
+	if c, ok := conn.(*ServerConn); ok {
+		conn = c.Conn
+	}
+
+	tlsConn, ok := conn.(*tls.Conn)
+	if ok == false {
+		return ""
+	}
+
+	state := tlsConn.ConnectionState()
+	if len(state.VerifiedChains) == 0 {
+		return ""
+	}
+
+	return state.PeerCertificates[0].Subject.CommonName
+}
+
+func (v *ServerConn) touch() {
+	atomic.StoreInt64(&v.lastActive, time.Now().UnixNano())
+}
+
+func (v *ServerConn) Read(b []byte) (int, error) {
+	config := v.server.config
+
+	timeout := time.Duration(config.ReadTimeout) * time.Second
+	idle := time.Duration(config.IdleTimeout) * time.Second
+	if 0 < idle && (timeout <= 0 || idle < timeout) {
+		timeout = idle
+	}
+	if 0 < timeout {
+		v.Conn.SetReadDeadline(time.Now().Add(timeout))
+	}
+	if v.ctx.Err() != nil {
+		// 서버 종료 중에는 새 데이터를 기다리지 않는다.
+		v.Conn.SetReadDeadline(time.Now())
+	}
+
+	n, err := v.Conn.Read(b)
+	if 0 < n {
+		atomic.AddInt64(&v.readBytes, int64(n))
+		v.touch()
+	}
+
+	return n, err
+}
+
+func (v *ServerConn) Write(b []byte) (int, error) {
+	timeout := time.Duration(v.server.config.WriteTimeout) * time.Second
+	if 0 < timeout {
+		v.Conn.SetWriteDeadline(time.Now().Add(timeout))
+	}
+
+	n, err := v.Conn.Write(b)
+	if 0 < n {
+		atomic.AddInt64(&v.writeBytes, int64(n))
+		v.touch()
+	}
+
+	return n, err
+}
+
+func (v *ServerConn) Close() error {
+	var err error
+	v.closeOnce.Do(func() {
+		v.cancel()
+		err = v.Conn.Close()
+		v.server.remove(v)
+	})
+
+	return err
+}
+
+func (v *ServerConn) Info() ConnInfo {
+	return ConnInfo{
+		Id:         v.id,
+		RemoteAddr: v.RemoteAddr().String(),
+		LocalAddr:  v.LocalAddr().String(),
+		CreatedAt:  v.createdAt,
+		LastActive: time.Unix(0, atomic.LoadInt64(&v.lastActive)),
+		ReadBytes:  atomic.LoadInt64(&v.readBytes),
+		WriteBytes: atomic.LoadInt64(&v.writeBytes),
+	}
+}
+
+/**
+ * 연결에 지정된 context. Server 가 관리하지 않는 연결이면 Background
+ */
+func ConnContext(conn net.Conn) context.Context {
+	if c, ok := conn.(*ServerConn); ok {
+		return c.Context()
+	}
+	return context.Background()
+}
+
+/**
+ * 연결 수 제한, deadline, 종료 처리를 지원하는 TCP/TLS 서버
+ */
+type Server struct {
+	sync.Mutex
+	config   ServiceConfigurations
+	ud       interface{}
+	callback func(net.Conn, interface{}) error
+	listener net.Listener
+	conns    map[uint64]*ServerConn
+	perIp    map[string]int64
+	nextId   uint64
+	closing  bool
+	ctx      context.Context
+	cancel   context.CancelFunc
+	wg       sync.WaitGroup
+	// PROXY protocol 헤더 수신 대기 중인 연결
+	pending chan struct{}
+}
+
+func NewServer(serviceConfig *ServiceConfigurations, ud interface{}, callback func(net.Conn, interface{}) error) *Server {
+	v := new(Server)
+	if serviceConfig != nil {
+		v.config = *serviceConfig
+	}
+	v.ud = ud
+	v.callback = callback
+	v.conns = make(map[uint64]*ServerConn)
+	v.perIp = make(map[string]int64)
+	v.ctx, v.cancel = context.WithCancel(context.Background())
+
+	return v
+}
+
+/**
+ * 리스너를 열고 연결 수락을 시작한다.
+ */
+func (v *Server) Start() error {
+	if v.callback == nil {
+		return errors.New("callback is nil")
+	}
+
+	var localurl string
+	if len(v.config.Address) == 0 {
+		localurl = fmt.Sprintf("0.0.0.0:%d", v.config.Port)
+	} else {
+		localurl = fmt.Sprintf("%s:%d", v.config.Address, v.config.Port)
+	}
+
+	listener, err := net.Listen("tcp", localurl)
+	if err != nil {
+		return err
+	}
+
+	proxied, err := WrapProxyListener(listener, &v.config.ProxyProtocol)
+	if err != nil {
+		listener.Close()
+		return err
+	}
+	listener = proxied
+	if v.config.ProxyProtocol.Enable {
+		maxPending := v.config.ProxyProtocol.MaxPending
+		if maxPending <= 0 {
+			maxPending = DefaultProxyMaxPending
+		}
+		v.pending = make(chan struct{}, maxPending)
+	}
+
+	if v.config.EnableTls {
+		config, err := v.config.ServerTLSConfig()
+		if err != nil {
+			listener.Close()
+			return err
+		}
+		listener = tls.NewListener(listener, config)
+	}
+
+	v.Lock()
+	if v.closing || v.listener != nil {
+		v.Unlock()
+		listener.Close()
+		return ErrServerClosed
+	}
+	v.listener = listener
+	v.Unlock()
+
+	go v.serve(listener)
+
+	return nil
+}
+
+func (v *Server) Addr() net.Addr {
+	v.Lock()
+	defer v.Unlock()
+
+	if v.listener == nil {
+		return nil
+	}
+	return v.listener.Addr()
+}
+
+func (v *Server) serve(listener net.Listener) {
+	var delay time.Duration = 0
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if v.isClosing() || errors.Is(err, net.ErrClosed) {
+				return
+			}
+			if isTemporaryAcceptError(err) == false {
+				logger.Errorf("accept failed: %v", err)
+				return
+			}
+
+			// 일시적인 오류(파일 디스크립터 부족 등)는 잠시 후 다시 시도한다.
+			if delay == 0 {
+				delay = 5 * time.Millisecond
+			} else if delay *= 2; time.Second < delay {
+				delay = time.Second
+			}
+			logger.Errorf("accept failed: %v; retrying in %v", err, delay)
+			time.Sleep(delay)
+			continue
+		}
+		delay = 0
+
+		if v.pending != nil {
+			// PROXY protocol 헤더에서 실제 주소를 확인한 뒤 연결 수 제한을 적용한다.
+			// 헤더를 기다리는 연결 수는 MaxPending 으로 제한한다.
+			select {
+			case v.pending <- struct{}{}:
+			default:
+				// RemoteAddr 는 헤더를 읽으므로 여기서 호출하지 않는다.
+				logger.Warningf("connection rejected: max pending PROXY headers (%d)", cap(v.pending))
+				conn.Close()
+				continue
+			}
+
+			go func(conn net.Conn) {
+				conn.RemoteAddr()
+				<-v.pending
+				v.handle(conn)
+			}(conn)
+			continue
+		}
+
+		v.handle(conn)
+	}
+}
+
+/**
+ * 잠시 후 다시 시도하면 되는 Accept 오류 (파일 디스크립터 부족 등)
+ */
+func isTemporaryAcceptError(err error) bool {
+	var ne net.Error
+	if errors.As(err, &ne) && ne.Timeout() {
+		return true
+	}
+
+	return errors.Is(err, syscall.EMFILE) || errors.Is(err, syscall.ENFILE) ||
+		errors.Is(err, syscall.ENOBUFS) || errors.Is(err, syscall.ENOMEM) ||
+		errors.Is(err, syscall.ECONNABORTED)
+}
+
+func (v *Server) handle(conn net.Conn) {
+	c := v.add(conn)
+	if c == nil {
+		conn.Close()
+		return
+	}
+
+	go func() {
+		defer v.wg.Done()
+		defer c.Close()
+
+		if err := v.callback(c, v.ud); err != nil {
+			logger.Debugf("connection #%d (%s) closed: %v", c.id, c.RemoteAddr(), err)
+		}
+	}()
+}
+
+func (v *Server) isClosing() bool {
+	v.Lock()
+	defer v.Unlock()
+
+	return v.closing
+}
+
+func remoteIp(addr net.Addr) string {
+	if tcpAddr, ok := addr.(*net.TCPAddr); ok {
+		return tcpAddr.IP.String()
+	}
+
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+func (v *Server) add(conn net.Conn) *ServerConn {
+	ip := remoteIp(conn.RemoteAddr())
+
+	v.Lock()
+	defer v.Unlock()
+
+	if v.closing {
+		return nil
+	}
+	if 0 < v.config.MaxConnections && v.config.MaxConnections <= int64(len(v.conns)) {
+		logger.Warningf("connection from %s rejected: max connections (%d)", conn.RemoteAddr(), v.config.MaxConnections)
+		return nil
+	}
+	if 0 < v.config.MaxConnectionsPerIp && v.config.MaxConnectionsPerIp <= v.perIp[ip] {
+		logger.Warningf("connection from %s rejected: max connections per ip (%d)", conn.RemoteAddr(), v.config.MaxConnectionsPerIp)
+		return nil
+	}
+
+	v.nextId++
+	c := &ServerConn{
+		Conn:      conn,
+		id:        v.nextId,
+		server:    v,
+		ip:        ip,
+		createdAt: time.Now(),
+	}
+	c.lastActive = c.createdAt.UnixNano()
+	c.ctx, c.cancel = context.WithCancel(v.ctx)
+
+	v.conns[c.id] = c
+	v.perIp[ip]++
+	v.wg.Add(1)
+
+	return c
+}
+
+func (v *Server) remove(c *ServerConn) {
+	v.Lock()
+	defer v.Unlock()
+
+	if _, ok := v.conns[c.id]; ok == false {
+		return
+	}
+
+	delete(v.conns, c.id)
+	if v.perIp[c.ip]--; v.perIp[c.ip] <= 0 {
+		delete(v.perIp, c.ip)
+	}
+}
+
+/**
+ * 현재 연결 목록
+ */
+func (v *Server) Connections() []ConnInfo {
+	v.Lock()
+	conns := make([]*ServerConn, 0, len(v.conns))
+	for _, c := range v.conns {
+		conns = append(conns, c)
+	}
+	v.Unlock()
+
+	results := make([]ConnInfo, 0, len(conns))
+	for _, c := range conns {
+		results = append(results, c.Info())
+	}
+	sort.Slice(results, func(i, j int) bool { return results[i].Id < results[j].Id })
+
+	return results
+}
+
+func (v *Server) Count() int {
+	v.Lock()
+	defer v.Unlock()
+
+	return len(v.conns)
+}
+
+/**
+ * 지정한 연결을 끊는다.
+ */
+func (v *Server) Kill(id uint64) error {
+	v.Lock()
+	c, ok := v.conns[id]
+	v.Unlock()
+
+	if ok == false {
+		return fmt.Errorf("connection #%d not found", id)
+	}
+
+	return c.Close()
+}
+
+/**
+ * ip 에서 접속한 연결을 모두 끊는다. 끊은 연결 수를 반환한다.
+ */
+func (v *Server) KillIp(ip string) int {
+	v.Lock()
+	conns := []*ServerConn{}
+	for _, c := range v.conns {
+		if c.ip == ip {
+			conns = append(conns, c)
+		}
+	}
+	v.Unlock()
+
+	for _, c := range conns {
+		c.Close()
+	}
+
+	return len(conns)
+}
+
+func (v *Server) closeListener() {
+	v.Lock()
+	v.closing = true
+	listener := v.listener
+	v.Unlock()
+
+	v.cancel()
+	if listener != nil {
+		listener.Close()
+	}
+}
+
+func (v *Server) list() []*ServerConn {
+	v.Lock()
+	defer v.Unlock()
+
+	conns := make([]*ServerConn, 0, len(v.conns))
+	for _, c := range v.conns {
+		conns = append(conns, c)
+	}
+
+	return conns
+}
+
+/**
+ * 읽기를 기다리고 있는 처리 함수를 깨운다.
+ * 종료가 시작된 뒤의 Read 는 기다리지 않고 timeout 오류를 반환한다.
+ */
+func (v *Server) interruptReads() {
+	for _, c := range v.list() {
+		c.Conn.SetReadDeadline(time.Now())
+	}
+}
+
+func (v *Server) closeAll() {
+	for _, c := range v.list() {
+		c.Close()
+	}
+}
+
+/**
+ * 새 연결 수락을 중지하고, 처리 중인 연결이 끝나기를 기다린다.
+ * 연결의 Context 가 취소되고 Read 가 중단되므로, 처리 함수는 진행 중인 메시지의 응답을 보내고 반환한다.
+ * ctx 가 먼저 끝나면 남은 연결을 모두 끊고 ctx 의 오류를 반환한다.
+ */
+func (v *Server) Shutdown(ctx context.Context) error {
+	v.closeListener()
+	v.interruptReads()
+
+	done := make(chan struct{})
+	go func() {
+		v.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		v.closeAll()
+		<-done
+		return ctx.Err()
+	}
+}
+
+/**
+ * 즉시 모든 연결을 끊고 서버를 종료한다.
+ */
+func (v *Server) Close() error {
+	v.closeListener()
+	v.closeAll()
+	v.wg.Wait()
+
+	return nil
+}
@@ -0,0 +1,362 @@
+package ins
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+const (
+	TLS_POLICY_LEGACY  = "legacy"
+	TLS_POLICY_DEFAULT = "default"
+	TLS_POLICY_STRICT  = "strict"
+)
+
+const (
+	CLIENT_AUTH_NONE     = "none"
+	CLIENT_AUTH_OPTIONAL = "optional"
+	CLIENT_AUTH_REQUIRE  = "require"
+)
+
+var ErrInsecureSkipVerify = errors.New("InsecureSkipVerify is not allowed by strict TLS policy")
+
+type tlsPolicy struct {
+	minVersion     uint16
+	maxVersion     uint16
+	cipherSuites   []uint16
+	curves         []tls.CurveID
+	disableTickets bool
+	nextProtos     []string
+	skipVerify     bool
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+var tlsCurves = map[string]tls.CurveID{
+	"X25519": tls.X25519,
+	"P256":   tls.CurveP256,
+	"P384":   tls.CurveP384,
+	"P521":   tls.CurveP521,
+}
+
+func parseTLSVersion(s string) (uint16, error) {
+	name := strings.ToUpper(strings.TrimSpace(s))
+	name = strings.TrimPrefix(name, "TLS")
+	name = strings.TrimPrefix(name, "V")
+	name = strings.TrimSpace(name)
+	if len(name) == 2 && strings.Contains(name, ".") == false {
+		// "12" -> "1.2"
+		name = name[:1] + "." + name[1:]
+	}
+
+	if version, ok := tlsVersions[name]; ok {
+		return version, nil
+	}
+
+	return 0, fmt.Errorf("unknown TLS version: %s", s)
+}
+
+func parseClientAuth(s string) (tls.ClientAuthType, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "", CLIENT_AUTH_NONE:
+		return tls.NoClientCert, nil
+	case CLIENT_AUTH_OPTIONAL:
+		return tls.VerifyClientCertIfGiven, nil
+	case CLIENT_AUTH_REQUIRE:
+		return tls.RequireAndVerifyClientCert, nil
+	}
+
+	return tls.NoClientCert, fmt.Errorf("unknown client auth: %s", s)
+}
+
+func parseCipherSuite(s string, strict bool) (uint16, error) {
+	name := strings.ToUpper(strings.TrimSpace(s))
+	for _, suite := range tls.CipherSuites() {
+		if suite.Name == name {
+			return suite.ID, nil
+		}
+	}
+
+	for _, suite := range tls.InsecureCipherSuites() {
+		if suite.Name == name {
+			if strict {
+				return 0, fmt.Errorf("insecure cipher suite is not allowed by strict TLS policy: %s", s)
+			}
+			return suite.ID, nil
+		}
+	}
+
+	return 0, fmt.Errorf("unknown cipher suite: %s", s)
+}
+
+func parseCurve(s string) (tls.CurveID, error) {
+	name := strings.ToUpper(strings.TrimSpace(s))
+	name = strings.Replace(name, "-", "", -1)
+	name = strings.TrimPrefix(name, "SECP")
+	name = strings.TrimSuffix(name, "R1")
+	if strings.HasPrefix(name, "P") == false && name != "X25519" {
+		name = "P" + name
+	}
+
+	if curve, ok := tlsCurves[name]; ok {
+		return curve, nil
+	}
+
+	return 0, fmt.Errorf("unknown curve: %s", s)
+}
+
+/**
+ * Preset 이 지정되지 않으면 클라이언트는 legacy(기존 동작), 서버는 default 를 사용한다.
+ */
+func (v TLSPolicyConfigurations) preset(server bool) string {
+	if len(v.Preset) == 0 {
+		if server {
+			return TLS_POLICY_DEFAULT
+		}
+		return TLS_POLICY_LEGACY
+	}
+	return strings.ToLower(v.Preset)
+}
+
+func (v TLSPolicyConfigurations) IsStrict() bool {
+	return v.preset(false) == TLS_POLICY_STRICT
+}
+
+/**
+ * Preset 기본값에 지정된 값을 적용한 정책을 만든다.
+ *
+ * legacy : TLS 1.2 만, ECDHE AES-GCM 3종, P521/P384/P256, 서버 인증서 검증 생략(기존 동작)
+ * default: TLS 1.2 이상, Go 기본 암호군/곡선, 서버 인증서 검증
+ * strict : TLS 1.2 이상, ECDHE AEAD 암호군, X25519/P256/P384, 세션 티켓 사용 안 함, 검증 생략 불가
+ */
+func (v TLSPolicyConfigurations) resolve(server bool) (*tlsPolicy, error) {
+	policy := new(tlsPolicy)
+	strict := false
+
+	switch v.preset(server) {
+	case TLS_POLICY_LEGACY:
+		policy.minVersion = tls.VersionTLS12
+		policy.maxVersion = tls.VersionTLS12
+		policy.cipherSuites = []uint16{
+			tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+		}
+		policy.curves = []tls.CurveID{tls.CurveP521, tls.CurveP384, tls.CurveP256}
+		policy.skipVerify = true
+	case TLS_POLICY_DEFAULT:
+		policy.minVersion = tls.VersionTLS12
+		policy.skipVerify = v.InsecureSkipVerify
+	case TLS_POLICY_STRICT:
+		if v.InsecureSkipVerify {
+			return nil, ErrInsecureSkipVerify
+		}
+		strict = true
+		policy.minVersion = tls.VersionTLS12
+		policy.cipherSuites = []uint16{
+			tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256,
+			tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+		}
+		policy.curves = []tls.CurveID{tls.X25519, tls.CurveP256, tls.CurveP384}
+		policy.disableTickets = true
+	default:
+		return nil, fmt.Errorf("unknown TLS policy preset: %s", v.Preset)
+	}
+
+	var err error
+	if 0 < len(v.MinVersion) {
+		if policy.minVersion, err = parseTLSVersion(v.MinVersion); err != nil {
+			return nil, err
+		}
+		if strict && policy.minVersion < tls.VersionTLS12 {
+			return nil, fmt.Errorf("TLS version %s is not allowed by strict TLS policy", v.MinVersion)
+		}
+	}
+	if 0 < len(v.MaxVersion) {
+		if policy.maxVersion, err = parseTLSVersion(v.MaxVersion); err != nil {
+			return nil, err
+		}
+	} else if policy.maxVersion < policy.minVersion {
+		// Preset 의 최대 버전보다 높은 MinVersion 이 지정된 경우
+		policy.maxVersion = 0
+	}
+	if policy.maxVersion != 0 && policy.maxVersion < policy.minVersion {
+		return nil, fmt.Errorf("TLS max version %s is lower than min version", v.MaxVersion)
+	}
+
+	if 0 < len(v.CipherSuites) {
+		policy.cipherSuites = []uint16{}
+		for _, name := range v.CipherSuites {
+			id, err := parseCipherSuite(name, strict)
+			if err != nil {
+				return nil, err
+			}
+			policy.cipherSuites = append(policy.cipherSuites, id)
+		}
+	}
+
+	if 0 < len(v.Curves) {
+		policy.curves = []tls.CurveID{}
+		for _, name := range v.Curves {
+			curve, err := parseCurve(name)
+			if err != nil {
+				return nil, err
+			}
+			policy.curves = append(policy.curves, curve)
+		}
+	}
+
+	if v.DisableSessionTickets {
+		policy.disableTickets = true
+	}
+	policy.nextProtos = v.NextProtos
+
+	return policy, nil
+}
+
+/**
+ * 정책 설정 값을 확인한다.
+ */
+func (v TLSPolicyConfigurations) Validate() error {
+	_, err := v.resolve(false)
+	return err
+}
+
+/**
+ * 클라이언트 config 에 정책을 적용한다.
+ */
+func (v TLSPolicyConfigurations) Apply(config *tls.Config) (*tls.Config, error) {
+	return v.apply(config, false)
+}
+
+/**
+ * 서버 config 에 정책을 적용한다. 서버 설정에서는 InsecureSkipVerify 가 사용되지 않는다.
+ */
+func (v TLSPolicyConfigurations) ApplyServer(config *tls.Config) (*tls.Config, error) {
+	return v.apply(config, true)
+}
+
+func (v TLSPolicyConfigurations) apply(config *tls.Config, server bool) (*tls.Config, error) {
+	policy, err := v.resolve(server)
+	if err != nil {
+		return nil, err
+	}
+
+	if config == nil {
+		config = &tls.Config{}
+	}
+
+	config.MinVersion = policy.minVersion
+	config.MaxVersion = policy.maxVersion
+	config.CipherSuites = policy.cipherSuites
+	config.CurvePreferences = policy.curves
+	config.SessionTicketsDisabled = policy.disableTickets
+	if policy.disableTickets == false && config.ClientSessionCache == nil {
+		config.ClientSessionCache = tls.NewLRUClientSessionCache(0)
+	}
+	if 0 < len(policy.nextProtos) {
+		config.NextProtos = policy.nextProtos
+	}
+	config.InsecureSkipVerify = policy.skipVerify
+
+	return config, nil
+}
+
+/**
+ * 정책, 인증서 관리자, 폐기 확인 설정으로 클라이언트 TLS 설정을 만든다.
+ */
+func NewPolicyTLSConfig(policy *TLSPolicyConfigurations, manager *CertManager, revocation *RevocationConfigurations) (*tls.Config, error) {
+	if policy == nil {
+		policy = &TLSPolicyConfigurations{}
+	}
+
+	config, err := policy.Apply(&tls.Config{ClientAuth: tls.NoClientCert})
+	if err != nil {
+		return nil, err
+	}
+	if manager != nil {
+		config = manager.ClientConfig(config)
+	}
+
+	// 인증서 폐기 확인 (CRL, OCSP)
+	return ApplyClientRevocation(config, manager, revocation), nil
+}
+
+/**
+ * 정책, 인증서 관리자, 폐기 확인 설정으로 서버 TLS 설정을 만든다.
+ * clientAuth 가 tls.NoClientCert 가 아니면 클라이언트 인증서를 CA 번들로 검증하고 폐기 여부도 확인한다.
+ */
+func NewPolicyTLSServerConfig(policy *TLSPolicyConfigurations, manager *CertManager, revocation *RevocationConfigurations, clientAuth tls.ClientAuthType) (*tls.Config, error) {
+	if policy == nil {
+		policy = &TLSPolicyConfigurations{}
+	}
+
+	base := &tls.Config{ClientAuth: clientAuth}
+	if clientAuth != tls.NoClientCert {
+		if len(manager.CaCertificates()) == 0 {
+			return nil, errors.New("client certificate verification requires CA certificate")
+		}
+		// 연결마다 최신 CA 번들로 교체된다. (CertManager.ServerConfig)
+		base.ClientCAs = manager.CertPool()
+	}
+
+	config, err := policy.ApplyServer(base)
+	if err != nil {
+		return nil, err
+	}
+	config = manager.ServerConfig(config)
+
+	// 인증서 폐기 확인 (CRL, OCSP), OCSP stapling
+	return ApplyServerRevocation(config, manager, revocation), nil
+}
+
+func (v ServiceConfigurations) ClientTLSConfig() (*tls.Config, error) {
+	manager, err := v.CertManager()
+	if err != nil {
+		return nil, err
+	}
+
+	return NewPolicyTLSConfig(&v.TLSPolicy, manager, &v.Revocation)
+}
+
+func (v ServiceConfigurations) ServerTLSConfig() (*tls.Config, error) {
+	manager, err := v.CertManager()
+	if err != nil {
+		return nil, err
+	}
+
+	clientAuth, err := parseClientAuth(v.ClientAuth)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewPolicyTLSServerConfig(&v.TLSPolicy, manager, &v.Revocation, clientAuth)
+}
+
+func (v HttpConfigurations) ClientTLSConfig() (*tls.Config, error) {
+	manager, err := v.CertManager()
+	if err != nil {
+		return nil, err
+	}
+
+	return NewPolicyTLSConfig(&v.TLSPolicy, manager, &v.Revocation)
+}
+
+func (v MQTTConfigurations) ClientTLSConfig() (*tls.Config, error) {
+	manager, err := v.CertManager()
+	if err != nil {
+		return nil, err
+	}
+
+	return NewPolicyTLSConfig(&v.TLSPolicy, manager, &v.Revocation)
+}
@@ -0,0 +1,271 @@
+package ins
+
+import (
+	"encoding/binary"
+	"errors"
+	"strings"
+)
+
+/**
+ * MQTT 토픽: Prefix/현장 종류/게이트웨이 종류/게이트웨이 ID/메시지 이름
+ *
+ * 메시지 이름(NAME_*)은 현장이 달라도 같을 수 있으므로(center.gw.status 등)
+ * 현장 종류와 게이트웨이 종류를 토픽에 넣어 구분한다.
+ */
+
+// 현장 종류
+const SITE_FACTORY = "factory"
+const SITE_DANGERZONE = "dangerzone"
+const SITE_CONSTRUCTION = "construction"
+const SITE_PLATFORM = "platform"
+
+// 게이트웨이 종류
+const GATEWAY_CENTER = "center"
+const GATEWAY_RELAY = "relay"
+const GATEWAY_SMART = "smart"
+const GATEWAY_BLACKBOX = "blackbox"
+const GATEWAY_PORTABLE = "portable"
+const GATEWAY_API = "api"
+const GATEWAY_SERVER = "server"
+
+const TOPIC_WILDCARD_LEVEL = "+"
+const TOPIC_WILDCARD_MULTI = "#"
+
+var ErrInvalidTopic = errors.New("invalid topic")
+
+type gatewayTopic struct {
+	site    string
+	gateway string
+}
+
+// 장비 코드(GW_TYPE_*)별 현장 종류, 게이트웨이 종류
+var gatewayTopics = map[byte]gatewayTopic{
+	GW_TYPE_CENTER_FACTORY:        {SITE_FACTORY, GATEWAY_CENTER},
+	GW_TYPE_RELAY_FACTORY:         {SITE_FACTORY, GATEWAY_RELAY},
+	GW_TYPE_SMART_FACTORY:         {SITE_FACTORY, GATEWAY_SMART},
+	GW_TYPE_BLACKBOX_FACTORY:      {SITE_FACTORY, GATEWAY_BLACKBOX},
+	GW_TYPE_API_SERVER:            {SITE_PLATFORM, GATEWAY_API},
+	GW_TYPE_CENTER_DANGERZONE:     {SITE_DANGERZONE, GATEWAY_CENTER},
+	GW_TYPE_SMART_DANGERZONE:      {SITE_DANGERZONE, GATEWAY_SMART},
+	GW_TYPE_BLACKBOX_DANGERZONE:   {SITE_DANGERZONE, GATEWAY_BLACKBOX},
+	GW_TYPE_PORTABLE_CONSTRUCTION: {SITE_CONSTRUCTION, GATEWAY_PORTABLE},
+	GW_TYPE_RELAY_CONSTRUCTION:    {SITE_CONSTRUCTION, GATEWAY_RELAY},
+	GW_TYPE_RELAY_PLATFORM:        {SITE_PLATFORM, GATEWAY_RELAY},
+	GW_TYPE_SERVER_PLATFORM:       {SITE_PLATFORM, GATEWAY_SERVER},
+}
+
+// 게이트웨이 상태보고 메시지는 보낸 게이트웨이의 종류를 알 수 있다.
+var statusGatewayTypes = map[string]byte{
+	TYPE_GW_CENTER_STATUS_FACTORY:        GW_TYPE_CENTER_FACTORY,
+	TYPE_GW_RELAY_STATUS_FACTORY:         GW_TYPE_RELAY_FACTORY,
+	TYPE_GW_SMART_STATUS_FACTORY:         GW_TYPE_SMART_FACTORY,
+	TYPE_GW_CENTER_STATUS_DANGERZONE:     GW_TYPE_CENTER_DANGERZONE,
+	TYPE_GW_SMART_STATUS_DANGERZONE:      GW_TYPE_SMART_DANGERZONE,
+	TYPE_GW_PORTABLE_STATUS_CONSTRUCTION: GW_TYPE_PORTABLE_CONSTRUCTION,
+	TYPE_GW_RELAY_STATUS_CONSTRUCTION:    GW_TYPE_RELAY_CONSTRUCTION,
+}
+
+/**
+ * 장비 코드(GW_TYPE_*)에 해당하는 현장 종류와 게이트웨이 종류
+ * 알 수 없으면 NAME_UNKNOWN 을 반환한다.
+ */
+func GetGatewayTopic(code byte) (string, string) {
+	if topic, ok := gatewayTopics[code]; ok {
+		return topic.site, topic.gateway
+	}
+
+	return NAME_UNKNOWN, NAME_UNKNOWN
+}
+
+/**
+ * 현장 종류와 게이트웨이 종류에 해당하는 장비 코드(GW_TYPE_*)
+ */
+func GetGatewayType(site, gateway string) (byte, bool) {
+	for code, topic := range gatewayTopics {
+		if topic.site == site && topic.gateway == gateway {
+			return code, true
+		}
+	}
+
+	return 0, false
+}
+
+/**
+ * 게이트웨이 상태보고 메시지이면 보낸 게이트웨이의 장비 코드(GW_TYPE_*)를 반환한다.
+ */
+func GetStatusGatewayType(order binary.ByteOrder, data []byte) (byte, bool) {
+	code, ok := statusGatewayTypes[GetMessageType(order, data)]
+	return code, ok
+}
+
+/**
+ * 토픽 단계 하나로 쓸 수 있도록 '/', '+', '#' 을 '_' 로 바꾼다.
+ */
+func TopicLevel(s string) string {
+	if len(s) == 0 {
+		return NAME_UNKNOWN
+	}
+
+	return strings.NewReplacer("/", "_", TOPIC_WILDCARD_LEVEL, "_", TOPIC_WILDCARD_MULTI, "_").Replace(s)
+}
+
+func joinTopic(prefix string, levels ...string) string {
+	parts := []string{}
+	if prefix = strings.Trim(prefix, "/"); 0 < len(prefix) {
+		parts = append(parts, prefix)
+	}
+	parts = append(parts, levels...)
+
+	return strings.Join(parts, "/")
+}
+
+/**
+ * 토픽을 나눈 값
+ */
+type MessageTopic struct {
+	Prefix    string
+	Site      string
+	Gateway   string
+	GatewayId string
+	Name      string
+}
+
+func (v MessageTopic) ToString() string {
+	return joinTopic(v.Prefix, TopicLevel(v.Site), TopicLevel(v.Gateway), TopicLevel(v.GatewayId), TopicLevel(v.Name))
+}
+
+/**
+ * Prefix/현장 종류/게이트웨이 종류/게이트웨이 ID/메시지 이름
+ */
+func BuildTopic(prefix, site, gateway, gatewayId, name string) string {
+	return MessageTopic{Prefix: prefix, Site: site, Gateway: gateway, GatewayId: gatewayId, Name: name}.ToString()
+}
+
+/**
+ * BuildTopic 으로 만든 토픽을 나눈다. topic 이 prefix 로 시작하지 않거나
+ * 단계 수가 맞지 않으면 ErrInvalidTopic 을 반환한다.
+ */
+func ParseTopic(prefix, topic string) (*MessageTopic, error) {
+	prefix = strings.Trim(prefix, "/")
+	if 0 < len(prefix) {
+		if strings.HasPrefix(topic, prefix+"/") == false {
+			return nil, ErrInvalidTopic
+		}
+		topic = topic[len(prefix)+1:]
+	}
+
+	levels := strings.Split(topic, "/")
+	if len(levels) != 4 {
+		return nil, ErrInvalidTopic
+	}
+	for _, level := range levels {
+		if len(level) == 0 || level == TOPIC_WILDCARD_LEVEL || level == TOPIC_WILDCARD_MULTI {
+			return nil, ErrInvalidTopic
+		}
+	}
+
+	return &MessageTopic{Prefix: prefix, Site: levels[0], Gateway: levels[1], GatewayId: levels[2], Name: levels[3]}, nil
+}
+
+/**
+ * 구독용 토픽 필터. 빈 값은 '+' 로 바꾼다.
+ */
+func TopicFilter(prefix, site, gateway, gatewayId, name string) string {
+	levels := []string{site, gateway, gatewayId, name}
+	for i, level := range levels {
+		if len(level) == 0 || level == TOPIC_WILDCARD_LEVEL {
+			levels[i] = TOPIC_WILDCARD_LEVEL
+		} else {
+			levels[i] = TopicLevel(level)
+		}
+	}
+
+	return joinTopic(prefix, levels...)
+}
+
+/**
+ * 현장 종류 하나의 모든 메시지: Prefix/site/#
+ */
+func SiteTopicFilter(prefix, site string) string {
+	return joinTopic(prefix, TopicLevel(site), TOPIC_WILDCARD_MULTI)
+}
+
+// 제조현장
+func FactoryTopicFilter(prefix string) string {
+	return SiteTopicFilter(prefix, SITE_FACTORY)
+}
+
+// 위험구역
+func DangerzoneTopicFilter(prefix string) string {
+	return SiteTopicFilter(prefix, SITE_DANGERZONE)
+}
+
+// 건설현장
+func ConstructionTopicFilter(prefix string) string {
+	return SiteTopicFilter(prefix, SITE_CONSTRUCTION)
+}
+
+/**
+ * topic 이 구독 필터(filter)에 해당하는지 확인한다. ('+', '#' 지원)
+ */
+func MatchTopic(filter, topic string) bool {
+	filters := strings.Split(filter, "/")
+	levels := strings.Split(topic, "/")
+
+	for i, f := range filters {
+		if f == TOPIC_WILDCARD_MULTI {
+			return i == len(filters)-1
+		}
+		if len(levels) <= i {
+			return false
+		}
+		if f != TOPIC_WILDCARD_LEVEL && f != levels[i] {
+			return false
+		}
+	}
+
+	return len(filters) == len(levels)
+}
+
+/**
+ * 게이트웨이 하나가 보내는 메시지의 토픽을 만든다.
+ *
+ * 현장/게이트웨이 종류는 GatewayType 으로 정하며, 게이트웨이 상태보고 메시지는
+ * 메시지가 나타내는 게이트웨이 종류를 사용한다.
+ */
+type TopicBuilder struct {
+	Prefix      string
+	GatewayType byte
+	GatewayId   string
+}
+
+func NewTopicBuilder(prefix string, gatewayType byte, gatewayId string) *TopicBuilder {
+	return &TopicBuilder{Prefix: prefix, GatewayType: gatewayType, GatewayId: gatewayId}
+}
+
+/**
+ * gatewayId 가 비어 있으면 TopicBuilder 의 GatewayId 를 사용한다.
+ */
+func (v *TopicBuilder) MessageTopic(order binary.ByteOrder, data []byte, gatewayId string) *MessageTopic {
+	code := v.GatewayType
+	if status, ok := GetStatusGatewayType(order, data); ok {
+		code = status
+	}
+	site, gateway := GetGatewayTopic(code)
+
+	if len(gatewayId) == 0 {
+		gatewayId = v.GatewayId
+	}
+
+	return &MessageTopic{
+		Prefix:    strings.Trim(v.Prefix, "/"),
+		Site:      site,
+		Gateway:   gateway,
+		GatewayId: gatewayId,
+		Name:      GetMessageName(order, data),
+	}
+}
+
+func (v *TopicBuilder) Topic(order binary.ByteOrder, data []byte, gatewayId string) string {
+	return v.MessageTopic(order, data, gatewayId).ToString()
+}
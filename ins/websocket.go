@@ -0,0 +1,180 @@
+package ins
+
+import (
+	"errors"
+	"fmt"
+	"github.com/gorilla/websocket"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// WebSocket 연결 대기 시간 기본값
+var DefaultWebSocketHandshakeTimeout = 10 * time.Second
+
+/**
+ * WebSocket 을 net.Conn 으로 사용한다.
+ *
+ * Write 한 번이 binary frame 하나이며, Read 는 받은 binary frame 을 이어서 읽는다.
+ * 따라서 TCP 와 같은 코드(RecvTLV, MessageRelay.Serve 등)로 TLV 메시지를 주고받을 수 있다.
+ *
+ * TCP 와 달리 gorilla/websocket 의 읽기 오류는 영구적이다. 읽기 시간 제한으로 Read 가 한 번 실패하면
+ * 이후의 Read 도 모두 실패하므로, 시간 제한으로 읽기를 중단한(RecvChannel.Close 등) 연결은 닫아야 한다.
+ */
+type WebSocketConn struct {
+	ws     *websocket.Conn
+	reader io.Reader
+	rlock  sync.Mutex
+	wlock  sync.Mutex
+	once   sync.Once
+	// 확인된 클라이언트 인증서의 CN (PeerCommonName)
+	commonName string
+}
+
+func NewWebSocketConn(ws *websocket.Conn) *WebSocketConn {
+	return &WebSocketConn{ws: ws}
+}
+
+/**
+ * HTTPS 요청에서 확인된 클라이언트 인증서의 CN 을 지정한다. 없으면 빈 문자열
+ */
+func (v *WebSocketConn) SetPeerCommonName(commonName string) {
+	v.commonName = commonName
+}
+
+func (v *WebSocketConn) Read(b []byte) (int, error) {
+	v.rlock.Lock()
+	defer v.rlock.Unlock()
+
+	for {
+		if v.reader == nil {
+			messageType, reader, err := v.ws.NextReader()
+			if err != nil {
+				if websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+					return 0, io.EOF
+				}
+				return 0, err
+			}
+			if messageType != websocket.BinaryMessage {
+				// text frame 은 무시한다.
+				continue
+			}
+			v.reader = reader
+		}
+
+		n, err := v.reader.Read(b)
+		if err == io.EOF {
+			v.reader = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+
+		return n, err
+	}
+}
+
+func (v *WebSocketConn) Write(b []byte) (int, error) {
+	v.wlock.Lock()
+	defer v.wlock.Unlock()
+
+	if err := v.ws.WriteMessage(websocket.BinaryMessage, b); err != nil {
+		return 0, err
+	}
+
+	return len(b), nil
+}
+
+/**
+ * close frame 을 보내 더 보낼 데이터가 없음을 알린다. 상대가 닫을 때까지 읽을 수 있다.
+ */
+func (v *WebSocketConn) CloseWrite() error {
+	var err error = nil
+	v.once.Do(func() {
+		message := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")
+		err = v.ws.WriteControl(websocket.CloseMessage, message, time.Now().Add(time.Second))
+	})
+
+	return err
+}
+
+func (v *WebSocketConn) Close() error {
+	v.CloseWrite()
+	return v.ws.Close()
+}
+
+func (v *WebSocketConn) LocalAddr() net.Addr {
+	return v.ws.LocalAddr()
+}
+
+func (v *WebSocketConn) RemoteAddr() net.Addr {
+	return v.ws.RemoteAddr()
+}
+
+func (v *WebSocketConn) SetDeadline(t time.Time) error {
+	if err := v.ws.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return v.ws.SetWriteDeadline(t)
+}
+
+/**
+ * 시간 제한이 지나면 연결을 더 읽을 수 없다. (WebSocketConn 설명 참고)
+ */
+func (v *WebSocketConn) SetReadDeadline(t time.Time) error {
+	return v.ws.SetReadDeadline(t)
+}
+
+func (v *WebSocketConn) SetWriteDeadline(t time.Time) error {
+	return v.ws.SetWriteDeadline(t)
+}
+
+/**
+ * remote 의 WebSocket 서비스에 연결한다. (EnableTls 이면 wss)
+ * Authorization 을 지정하면 Authorization 헤더로 보낸다.
+ */
+func DialWebSocket(remote *HttpConfigurations) (*WebSocketConn, error) {
+	if remote == nil {
+		return nil, errors.New("remote is nil")
+	}
+
+	u, err := remote.Url()
+	if err != nil {
+		return nil, err
+	}
+
+	dialer := &websocket.Dialer{
+		Proxy:            http.ProxyFromEnvironment,
+		HandshakeTimeout: DefaultWebSocketHandshakeTimeout,
+	}
+	if 0 < remote.Timeout {
+		dialer.HandshakeTimeout = time.Duration(remote.Timeout) * time.Second
+	}
+
+	if remote.EnableTls {
+		u.Scheme = "wss"
+		if dialer.TLSClientConfig, err = remote.ClientTLSConfig(); err != nil {
+			return nil, err
+		}
+	} else {
+		u.Scheme = "ws"
+	}
+
+	header := http.Header{}
+	if 0 < len(remote.Authorization) {
+		header.Set("Authorization", remote.Authorization)
+	}
+
+	ws, resp, err := dialer.Dial(u.String(), header)
+	if err != nil {
+		if resp != nil {
+			return nil, fmt.Errorf("%v: %s", err, resp.Status)
+		}
+		return nil, err
+	}
+
+	return NewWebSocketConn(ws), nil
+}
@@ -0,0 +1,575 @@
+package insca
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"github.com/industry-netsecurity-solution/ins-security-channel/encrypt"
+	"github.com/industry-netsecurity-solution/ins-security-channel/ins"
+	"github.com/industry-netsecurity-solution/ins-security-channel/logger"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// 암호화된 CA 키 PEM 타입
+const PEM_ENCRYPTED_KEY = "INS ENCRYPTED PRIVATE KEY"
+
+type CAConfigurations struct {
+	CertFile     string
+	KeyFile      string
+	Passphrase   string
+	Database     string
+	CrlFile      string
+	CommonName   string
+	Organization string
+	ValidDays    int64
+	CaValidDays  int64
+	CrlInterval  int64
+	TokenTimeout int64
+}
+
+func (v CAConfigurations) ToString() []string {
+	strings := []string{}
+	strings = append(strings, fmt.Sprintf("CertFile: %s", v.CertFile))
+	strings = append(strings, fmt.Sprintf("KeyFile: %s", v.KeyFile))
+	strings = append(strings, fmt.Sprintf("Database: %s", v.Database))
+	strings = append(strings, fmt.Sprintf("CrlFile: %s", v.CrlFile))
+	strings = append(strings, fmt.Sprintf("CommonName: %s", v.CommonName))
+	strings = append(strings, fmt.Sprintf("Organization: %s", v.Organization))
+	strings = append(strings, fmt.Sprintf("ValidDays: %d", v.ValidDays))
+	strings = append(strings, fmt.Sprintf("CaValidDays: %d", v.CaValidDays))
+	strings = append(strings, fmt.Sprintf("CrlInterval: %d", v.CrlInterval))
+	strings = append(strings, fmt.Sprintf("TokenTimeout: %d", v.TokenTimeout))
+
+	return strings
+}
+
+/**
+ * 게이트웨이 인증서를 발급하는 로컬 인증기관
+ */
+type Authority struct {
+	sync.Mutex
+	config      CAConfigurations
+	certificate *x509.Certificate
+	certPEM     []byte
+	key         crypto.Signer
+	store       *Store
+	crl         []byte
+	stop        chan struct{}
+}
+
+/**
+ * 인증기관을 연다. CA 인증서/키 파일이 없으면 새로 생성한다.
+ */
+func OpenAuthority(config *CAConfigurations) (*Authority, error) {
+	if config == nil {
+		return nil, errors.New("CAConfigurations is nil")
+	}
+	if len(config.Passphrase) == 0 {
+		return nil, errors.New("CA passphrase is empty")
+	}
+
+	v := new(Authority)
+	v.config = *config
+	if v.config.ValidDays <= 0 {
+		v.config.ValidDays = 365
+	}
+	if v.config.CaValidDays <= 0 {
+		v.config.CaValidDays = 3650
+	}
+	if v.config.CrlInterval <= 0 {
+		v.config.CrlInterval = 24 * 60 * 60
+	}
+	if v.config.TokenTimeout <= 0 {
+		v.config.TokenTimeout = 24 * 60 * 60
+	}
+
+	if _, err := os.Stat(v.config.CertFile); os.IsNotExist(err) {
+		if err = v.create(); err != nil {
+			return nil, err
+		}
+	} else if err = v.load(); err != nil {
+		return nil, err
+	}
+
+	store, err := OpenStore(v.config.Database)
+	if err != nil {
+		return nil, err
+	}
+	v.store = store
+
+	if _, err = v.PublishCRL(); err != nil {
+		v.store.Close()
+		return nil, err
+	}
+
+	return v, nil
+}
+
+func (v *Authority) Close() {
+	v.Lock()
+	defer v.Unlock()
+
+	if v.stop != nil {
+		close(v.stop)
+		v.stop = nil
+	}
+	v.store.Close()
+}
+
+func (v *Authority) Certificate() *x509.Certificate {
+	return v.certificate
+}
+
+func (v *Authority) CertificatePEM() []byte {
+	return v.certPEM
+}
+
+func (v *Authority) Store() *Store {
+	return v.store
+}
+
+func secretKey(passphrase string) ([]byte, error) {
+	return encrypt.GenSecretkeyByPassphrase([]byte(passphrase))
+}
+
+/**
+ * 개인키를 PKCS#8 로 변환하여 AES-256-GCM 으로 암호화한다.
+ */
+func EncryptPrivateKey(key crypto.Signer, passphrase string) ([]byte, error) {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	secret, err := secretKey(passphrase)
+	if err != nil {
+		return nil, err
+	}
+
+	aesgcm, err := encrypt.GetGCM(secret)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce, err := encrypt.GenRandomData(aesgcm.NonceSize())
+	if err != nil {
+		return nil, err
+	}
+
+	// nonce || ciphertext
+	ciphertext := aesgcm.Seal(nonce, nonce, der, nil)
+
+	return pem.EncodeToMemory(&pem.Block{Type: PEM_ENCRYPTED_KEY, Bytes: ciphertext}), nil
+}
+
+func DecryptPrivateKey(data []byte, passphrase string) (crypto.Signer, error) {
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != PEM_ENCRYPTED_KEY {
+		return nil, errors.New("not an encrypted private key")
+	}
+
+	secret, err := secretKey(passphrase)
+	if err != nil {
+		return nil, err
+	}
+
+	aesgcm, err := encrypt.GetGCM(secret)
+	if err != nil {
+		return nil, err
+	}
+
+	nonceSize := aesgcm.NonceSize()
+	if len(block.Bytes) < nonceSize {
+		return nil, errors.New("malformed encrypted private key")
+	}
+
+	der, err := aesgcm.Open(nil, block.Bytes[:nonceSize], block.Bytes[nonceSize:], nil)
+	if err != nil {
+		return nil, errors.New("invalid CA passphrase")
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, err
+	}
+
+	signer, ok := key.(crypto.Signer)
+	if ok == false {
+		return nil, errors.New("unsupported private key")
+	}
+
+	return signer, nil
+}
+
+func randomSerial() (*big.Int, error) {
+	limit := new(big.Int).Lsh(big.NewInt(1), 128)
+	return rand.Int(rand.Reader, limit)
+}
+
+func writeFile(filename string, data []byte, perm os.FileMode) error {
+	if dir := filepath.Dir(filename); 0 < len(dir) {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return err
+		}
+	}
+
+	// 인증서를 읽는 쪽에서 쓰다 만 파일을 보지 않도록 교체한다.
+	tmp := filename + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, perm); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, filename)
+}
+
+func (v *Authority) create() error {
+	key, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		return err
+	}
+
+	serial, err := randomSerial()
+	if err != nil {
+		return err
+	}
+
+	commonName := v.config.CommonName
+	if len(commonName) == 0 {
+		commonName = "INS Gateway CA"
+	}
+
+	subject := pkix.Name{CommonName: commonName}
+	if 0 < len(v.config.Organization) {
+		subject.Organization = []string{v.config.Organization}
+	}
+
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               subject,
+		NotBefore:             now.Add(-5 * time.Minute),
+		NotAfter:              now.Add(time.Duration(v.config.CaValidDays) * 24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		return err
+	}
+
+	keyPEM, err := EncryptPrivateKey(key, v.config.Passphrase)
+	if err != nil {
+		return err
+	}
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+
+	if err = writeFile(v.config.KeyFile, keyPEM, 0600); err != nil {
+		return err
+	}
+	if err = writeFile(v.config.CertFile, certPEM, 0644); err != nil {
+		return err
+	}
+
+	logger.Infof("CA created: %s", v.config.CertFile)
+
+	return v.load()
+}
+
+func (v *Authority) load() error {
+	certPEM, err := ioutil.ReadFile(v.config.CertFile)
+	if err != nil {
+		return err
+	}
+
+	block, _ := pem.Decode(certPEM)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return fmt.Errorf("%s: no CA certificate", v.config.CertFile)
+	}
+
+	certificate, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return err
+	}
+
+	keyPEM, err := ioutil.ReadFile(v.config.KeyFile)
+	if err != nil {
+		return err
+	}
+
+	key, err := DecryptPrivateKey(keyPEM, v.config.Passphrase)
+	if err != nil {
+		return err
+	}
+
+	if publicKeyEqual(certificate.PublicKey, key.Public()) == false {
+		return errors.New("CA certificate and key do not match")
+	}
+
+	v.certificate = certificate
+	v.certPEM = certPEM
+	v.key = key
+
+	return nil
+}
+
+func publicKeyEqual(a, b crypto.PublicKey) bool {
+	type equaler interface {
+		Equal(crypto.PublicKey) bool
+	}
+
+	if e, ok := a.(equaler); ok {
+		return e.Equal(b)
+	}
+
+	return false
+}
+
+/**
+ * 게이트웨이 정보를 인증서 Subject 에 기록한다.
+ * Type -> OU, Serial -> serialNumber, Manufacture -> O
+ */
+func gatewaySubject(commonName string, gateway *ins.GatewayConfigurations) pkix.Name {
+	subject := pkix.Name{CommonName: commonName}
+	if gateway == nil {
+		return subject
+	}
+
+	if 0 < len(gateway.Type) {
+		subject.OrganizationalUnit = []string{gateway.Type}
+	}
+	if 0 < len(gateway.Serial) {
+		subject.SerialNumber = gateway.Serial
+	}
+	if 0 < len(gateway.Manufacture) {
+		subject.Organization = []string{gateway.Manufacture}
+	}
+
+	return subject
+}
+
+/**
+ * 게이트웨이 인증서에서 게이트웨이 정보를 읽는다.
+ */
+func GatewayFromCertificate(cert *x509.Certificate) ins.GatewayConfigurations {
+	gateway := ins.GatewayConfigurations{}
+	if 0 < len(cert.Subject.OrganizationalUnit) {
+		gateway.Type = cert.Subject.OrganizationalUnit[0]
+	}
+	if 0 < len(cert.Subject.Organization) {
+		gateway.Manufacture = cert.Subject.Organization[0]
+	}
+	gateway.Serial = cert.Subject.SerialNumber
+
+	return gateway
+}
+
+/**
+ * CSR 로 게이트웨이 인증서를 발급하고 저장한다.
+ */
+func (v *Authority) Sign(csr *x509.CertificateRequest, gateway *ins.GatewayConfigurations) (*x509.Certificate, []byte, error) {
+	certificate, certPEM, err := v.issue(csr, gateway)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if err = v.store.InsertCertificate(certificate, certPEM); err != nil {
+		return nil, nil, err
+	}
+	v.issued(certificate)
+
+	return certificate, certPEM, nil
+}
+
+func (v *Authority) issued(certificate *x509.Certificate) {
+	logger.Infof("certificate issued: %s (serial %s)", certificate.Subject.CommonName, certificate.SerialNumber.Text(16))
+}
+
+/**
+ * CSR 로 인증서를 만든다. 저장은 호출한 쪽에서 한다.
+ * 게이트웨이 인증서는 클라이언트 인증에만 사용하므로 CSR 의 SAN 은 넣지 않는다.
+ */
+func (v *Authority) issue(csr *x509.CertificateRequest, gateway *ins.GatewayConfigurations) (*x509.Certificate, []byte, error) {
+	if err := csr.CheckSignature(); err != nil {
+		return nil, nil, err
+	}
+
+	commonName := csr.Subject.CommonName
+	if len(commonName) == 0 {
+		return nil, nil, errors.New("CSR has no common name")
+	}
+
+	serial, err := randomSerial()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	keyUsage := x509.KeyUsageDigitalSignature
+	if _, ok := csr.PublicKey.(*rsa.PublicKey); ok {
+		keyUsage |= x509.KeyUsageKeyEncipherment
+	}
+
+	now := time.Now()
+	notAfter := now.Add(time.Duration(v.config.ValidDays) * 24 * time.Hour)
+	if v.certificate.NotAfter.Before(notAfter) {
+		notAfter = v.certificate.NotAfter
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:   serial,
+		Subject:        gatewaySubject(commonName, gateway),
+		NotBefore:      now.Add(-5 * time.Minute),
+		NotAfter:       notAfter,
+		KeyUsage:       keyUsage,
+		ExtKeyUsage:    []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		AuthorityKeyId: v.certificate.SubjectKeyId,
+	}
+
+	v.Lock()
+	der, err := x509.CreateCertificate(rand.Reader, template, v.certificate, csr.PublicKey, v.key)
+	v.Unlock()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	certificate, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+
+	return certificate, certPEM, nil
+}
+
+/**
+ * 일회용 등록 토큰을 발급한다.
+ * gwid 는 필수이며, 해당 이름(CN)으로만 등록할 수 있다.
+ * gateway 는 발급할 인증서에 기록된다. (게이트웨이가 보낸 정보는 사용하지 않는다)
+ */
+func (v *Authority) NewEnrollmentToken(gwid string, gateway *ins.GatewayConfigurations) (string, error) {
+	if len(gwid) == 0 {
+		return "", errors.New("enrollment token requires gateway id")
+	}
+
+	data, err := encrypt.GenRandomData(32)
+	if err != nil {
+		return "", err
+	}
+
+	token := fmt.Sprintf("%x", data)
+	expire := time.Now().Add(time.Duration(v.config.TokenTimeout) * time.Second)
+	if err = v.store.InsertToken(tokenHash(token), gwid, gateway, expire); err != nil {
+		return "", err
+	}
+
+	return token, nil
+}
+
+func tokenHash(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return fmt.Sprintf("%x", hash[:])
+}
+
+/**
+ * 인증서를 폐기하고 CRL 을 다시 발행한다.
+ */
+func (v *Authority) Revoke(serial *big.Int, reason int) error {
+	if err := v.store.RevokeCertificate(serial.Text(16), reason); err != nil {
+		return err
+	}
+
+	logger.Infof("certificate revoked: serial %s", serial.Text(16))
+
+	_, err := v.PublishCRL()
+	return err
+}
+
+/**
+ * CRL 을 생성하여 CrlFile 에 기록한다.
+ */
+func (v *Authority) PublishCRL() ([]byte, error) {
+	revoked, err := v.store.RevokedCertificates()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	template := &x509.RevocationList{
+		Number:              big.NewInt(now.UnixNano()),
+		ThisUpdate:          now,
+		NextUpdate:          now.Add(2 * time.Duration(v.config.CrlInterval) * time.Second),
+		RevokedCertificates: revoked,
+	}
+
+	v.Lock()
+	defer v.Unlock()
+
+	der, err := x509.CreateRevocationList(rand.Reader, template, v.certificate, v.key)
+	if err != nil {
+		return nil, err
+	}
+
+	crlPEM := pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: der})
+	if 0 < len(v.config.CrlFile) {
+		if err = writeFile(v.config.CrlFile, crlPEM, 0644); err != nil {
+			return nil, err
+		}
+	}
+	v.crl = crlPEM
+
+	return crlPEM, nil
+}
+
+func (v *Authority) CRL() []byte {
+	v.Lock()
+	defer v.Unlock()
+
+	return v.crl
+}
+
+/**
+ * CrlInterval 주기로 CRL 을 다시 발행한다.
+ */
+func (v *Authority) StartPublisher() {
+	v.Lock()
+	if v.stop != nil {
+		v.Unlock()
+		return
+	}
+	stop := make(chan struct{})
+	v.stop = stop
+	v.Unlock()
+
+	go func() {
+		ticker := time.NewTicker(time.Duration(v.config.CrlInterval) * time.Second)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				if _, err := v.PublishCRL(); err != nil {
+					logger.Error(err)
+				}
+			}
+		}
+	}()
+}
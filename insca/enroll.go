@@ -0,0 +1,421 @@
+package insca
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	resty "github.com/go-resty/resty/v2"
+	"github.com/industry-netsecurity-solution/ins-security-channel/cecho"
+	"github.com/industry-netsecurity-solution/ins-security-channel/ins"
+	"github.com/industry-netsecurity-solution/ins-security-channel/logger"
+	"github.com/industry-netsecurity-solution/ins-security-channel/request"
+	echo "github.com/labstack/echo/v4"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+)
+
+// POST {prefix}/enroll
+// {"token": "...", "csr": "-----BEGIN CERTIFICATE REQUEST-----..."}
+
+// POST {prefix}/renew
+// {"certificate": "-----BEGIN CERTIFICATE-----...", "csr": "...", "signature": "base64(sign(sha256(csr der)))"}
+// CSR 의 공개키는 새 키여야 한다.
+
+// GET {prefix}/crl, GET {prefix}/ca
+
+type EnrollRequest struct {
+	Token string `json:"token"`
+	Csr   string `json:"csr"`
+}
+
+type RenewRequest struct {
+	Certificate string `json:"certificate"`
+	Csr         string `json:"csr"`
+	Signature   string `json:"signature"`
+}
+
+type EnrollResult struct {
+	Certificate   string `json:"certificate"`
+	CaCertificate string `json:"caCertificate"`
+}
+
+type EnrollResponse struct {
+	Type     string        `json:"type"`
+	Message  string        `json:"message"`
+	Result   *EnrollResult `json:"result,omitempty"`
+	RespDate string        `json:"respDate"`
+}
+
+func parseCSR(data string) (*x509.CertificateRequest, error) {
+	block, _ := pem.Decode([]byte(data))
+	if block == nil || block.Type != "CERTIFICATE REQUEST" {
+		return nil, errors.New("no certificate request")
+	}
+
+	csr, err := x509.ParseCertificateRequest(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	if err = csr.CheckSignature(); err != nil {
+		return nil, err
+	}
+
+	return csr, nil
+}
+
+func parseCertificate(data string) (*x509.Certificate, error) {
+	block, _ := pem.Decode([]byte(data))
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, errors.New("no certificate")
+	}
+
+	return x509.ParseCertificate(block.Bytes)
+}
+
+func fail(c echo.Context, status int, err error) error {
+	logger.Warning(err)
+	return c.JSON(status, EnrollResponse{
+		Type:     "FAIL",
+		Message:  err.Error(),
+		RespDate: ins.TimeYYmmddHHMMSS(nil),
+	})
+}
+
+func (v *Authority) success(c echo.Context, message string, certPEM []byte) error {
+	return c.JSON(http.StatusOK, EnrollResponse{
+		Type:    "SUCCESS",
+		Message: message,
+		Result: &EnrollResult{
+			Certificate:   string(certPEM),
+			CaCertificate: string(v.certPEM),
+		},
+		RespDate: ins.TimeYYmmddHHMMSS(nil),
+	})
+}
+
+/**
+ * 등록 토큰과 CSR 로 게이트웨이 인증서를 발급한다.
+ * 게이트웨이 정보는 토큰에 저장된 값을 사용한다.
+ * 토큰은 인증서를 발급한 뒤, 인증서 저장과 같은 트랜잭션에서 사용 처리된다.
+ */
+func (v *Authority) Enroll(token string, csr *x509.CertificateRequest) (*x509.Certificate, []byte, error) {
+	if len(token) == 0 {
+		return nil, nil, errors.New("enrollment token is empty")
+	}
+
+	hash := tokenHash(token)
+	enrollment, err := v.store.GetToken(hash)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// 게이트웨이 ID 가 없는 토큰으로는 CN 을 정할 수 없으므로 거부한다.
+	if len(enrollment.GwId) == 0 {
+		return nil, nil, errors.New("enrollment token has no gateway id")
+	}
+	if enrollment.GwId != csr.Subject.CommonName {
+		return nil, nil, fmt.Errorf("enrollment token is not for %s", csr.Subject.CommonName)
+	}
+
+	certificate, certPEM, err := v.issue(csr, &enrollment.Gateway)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if err = v.store.UseToken(hash, certificate, certPEM); err != nil {
+		return nil, nil, err
+	}
+	v.issued(certificate)
+
+	return certificate, certPEM, nil
+}
+
+/**
+ * 유효한 기존 인증서의 키로 서명한 CSR 을 받아 인증서를 갱신한다.
+ * 새 키는 발급된 적이 없어야 한다. (갱신 요청 재전송 방지)
+ */
+func (v *Authority) Renew(current *x509.Certificate, csr *x509.CertificateRequest, signature []byte) (*x509.Certificate, []byte, error) {
+	if err := current.CheckSignatureFrom(v.certificate); err != nil {
+		return nil, nil, errors.New("certificate is not issued by this CA")
+	}
+
+	now := time.Now()
+	if now.Before(current.NotBefore) || now.After(current.NotAfter) {
+		return nil, nil, errors.New("certificate is expired")
+	}
+
+	issued, err := v.store.GetCertificate(current.SerialNumber.Text(16))
+	if err != nil {
+		return nil, nil, err
+	}
+	if issued == nil {
+		return nil, nil, errors.New("unknown certificate")
+	}
+	if 0 < issued.Revoked {
+		return nil, nil, errors.New("certificate is revoked")
+	}
+
+	if current.Subject.CommonName != csr.Subject.CommonName {
+		return nil, nil, errors.New("common name mismatch")
+	}
+
+	// 기존 키를 가지고 있는지 확인한다.
+	if err = verifySignature(current.PublicKey, csr.Raw, signature); err != nil {
+		return nil, nil, err
+	}
+
+	gateway := GatewayFromCertificate(current)
+
+	certificate, certPEM, err := v.issue(csr, &gateway)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if err = v.store.InsertRenewedCertificate(certificate, certPEM); err != nil {
+		return nil, nil, err
+	}
+	v.issued(certificate)
+
+	return certificate, certPEM, nil
+}
+
+func verifySignature(publicKey crypto.PublicKey, data, signature []byte) error {
+	digest := sha256.Sum256(data)
+
+	switch key := publicKey.(type) {
+	case *ecdsa.PublicKey:
+		if ecdsa.VerifyASN1(key, digest[:], signature) {
+			return nil
+		}
+	case *rsa.PublicKey:
+		if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature); err == nil {
+			return nil
+		}
+	case ed25519.PublicKey:
+		if ed25519.Verify(key, data, signature) {
+			return nil
+		}
+	default:
+		return errors.New("unsupported public key")
+	}
+
+	return errors.New("invalid renewal signature")
+}
+
+func sign(key crypto.Signer, data []byte) ([]byte, error) {
+	if _, ok := key.(ed25519.PrivateKey); ok {
+		return key.Sign(rand.Reader, data, crypto.Hash(0))
+	}
+
+	digest := sha256.Sum256(data)
+	return key.Sign(rand.Reader, digest[:], crypto.SHA256)
+}
+
+func (v *Authority) handleEnroll(c echo.Context) error {
+	req := new(EnrollRequest)
+	if err := cecho.Unmarshal(c, req); err != nil {
+		return err
+	}
+
+	csr, err := parseCSR(req.Csr)
+	if err != nil {
+		return fail(c, http.StatusBadRequest, err)
+	}
+
+	_, certPEM, err := v.Enroll(req.Token, csr)
+	if err != nil {
+		return fail(c, http.StatusForbidden, err)
+	}
+
+	return v.success(c, "certificate enrolled.", certPEM)
+}
+
+func (v *Authority) handleRenew(c echo.Context) error {
+	req := new(RenewRequest)
+	if err := cecho.Unmarshal(c, req); err != nil {
+		return err
+	}
+
+	current, err := parseCertificate(req.Certificate)
+	if err != nil {
+		return fail(c, http.StatusBadRequest, err)
+	}
+
+	csr, err := parseCSR(req.Csr)
+	if err != nil {
+		return fail(c, http.StatusBadRequest, err)
+	}
+
+	signature, err := base64.StdEncoding.DecodeString(req.Signature)
+	if err != nil {
+		return fail(c, http.StatusBadRequest, err)
+	}
+
+	_, certPEM, err := v.Renew(current, csr, signature)
+	if err != nil {
+		return fail(c, http.StatusForbidden, err)
+	}
+
+	return v.success(c, "certificate renewed.", certPEM)
+}
+
+func (v *Authority) handleCRL(c echo.Context) error {
+	return c.Blob(http.StatusOK, "application/x-pem-file", v.CRL())
+}
+
+func (v *Authority) handleCA(c echo.Context) error {
+	return c.Blob(http.StatusOK, "application/x-pem-file", v.certPEM)
+}
+
+/**
+ * echo 에 등록/갱신/CRL/CA 경로를 등록한다.
+ */
+func (v *Authority) Route(e *echo.Echo, prefix string) {
+	if len(prefix) == 0 {
+		prefix = "/"
+	}
+
+	e.POST(path.Join(prefix, "enroll"), v.handleEnroll)
+	e.POST(path.Join(prefix, "renew"), v.handleRenew)
+	e.GET(path.Join(prefix, "crl"), v.handleCRL)
+	e.GET(path.Join(prefix, "ca"), v.handleCA)
+}
+
+/**
+ * 등록 서비스를 시작한다.
+ */
+func (v *Authority) Start(config *ins.ServiceConfigurations, prefix string) *echo.Echo {
+	v.StartPublisher()
+
+	return cecho.Start(config, v, func(e *echo.Echo) {
+		v.Route(e, prefix)
+	})
+}
+
+/**
+ * 게이트웨이용 CSR 을 생성한다.
+ */
+func CreateCSR(key crypto.Signer, commonName string) ([]byte, error) {
+	template := &x509.CertificateRequest{
+		Subject: pkix.Name{CommonName: commonName},
+	}
+
+	der, err := x509.CreateCertificateRequest(rand.Reader, template, key)
+	if err != nil {
+		return nil, err
+	}
+
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der}), nil
+}
+
+func doEnrollRequest(remote *ins.HttpConfigurations, querypath string, body interface{}) (*EnrollResult, error) {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+
+	param := request.NewRequestParam()
+	param.SetQuerypath(querypath)
+	param.SetHeader("Content-Type", "application/json")
+	param.SetHeader("Accept", "application/json")
+	param.SetData(data)
+
+	response := new(EnrollResponse)
+	httpRequest := request.HttpRequest{HttpConfigurations: *remote}
+	if _, err = httpRequest.DoRequest(param, func(resp *resty.Response) error {
+		if err := json.Unmarshal(resp.Body(), response); err != nil {
+			status := resp.StatusCode()
+			return errors.New(fmt.Sprintf("%d %s - %s", status, http.StatusText(status), resp.Request.URL))
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	if strings.EqualFold(response.Type, "success") == false || response.Result == nil {
+		return nil, errors.New(response.Message)
+	}
+
+	return response.Result, nil
+}
+
+/**
+ * 등록 토큰으로 인증서를 발급 받는다.
+ * 인증서의 게이트웨이 정보는 토큰을 발급할 때 지정된다.
+ */
+func Enroll(remote *ins.HttpConfigurations, token string, key crypto.Signer, commonName string) (*EnrollResult, error) {
+	csr, err := CreateCSR(key, commonName)
+	if err != nil {
+		return nil, err
+	}
+
+	req := EnrollRequest{Token: token, Csr: string(csr)}
+
+	return doEnrollRequest(remote, "enroll", req)
+}
+
+/**
+ * 기존 인증서/키로 새 키의 인증서를 발급 받는다.
+ */
+func Renew(remote *ins.HttpConfigurations, certPEM []byte, key crypto.Signer, newKey crypto.Signer) (*EnrollResult, error) {
+	current, err := parseCertificate(string(certPEM))
+	if err != nil {
+		return nil, err
+	}
+
+	csrPEM, err := CreateCSR(newKey, current.Subject.CommonName)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(csrPEM)
+	signature, err := sign(key, block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	req := RenewRequest{
+		Certificate: string(certPEM),
+		Csr:         string(csrPEM),
+		Signature:   base64.StdEncoding.EncodeToString(signature),
+	}
+
+	return doEnrollRequest(remote, "renew", req)
+}
+
+/**
+ * 발급 받은 인증서와 키를 파일로 저장한다.
+ * CertManager 가 파일 변경을 감지하여 다시 읽는다.
+ */
+func SaveEnrollResult(result *EnrollResult, key crypto.Signer, caFile, certFile, keyFile string) error {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return err
+	}
+
+	if err = writeFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		return err
+	}
+	if err = writeFile(certFile, []byte(result.Certificate), 0644); err != nil {
+		return err
+	}
+	if 0 < len(caFile) {
+		if err = writeFile(caFile, []byte(result.CaCertificate), 0644); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
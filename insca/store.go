@@ -0,0 +1,345 @@
+package insca
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/industry-netsecurity-solution/ins-security-channel/ins"
+	_ "github.com/mattn/go-sqlite3"
+	"math/big"
+	"sync"
+	"time"
+)
+
+// 이미 인증서가 발급된 공개키
+var ErrPublicKeyIssued = errors.New("public key is already issued")
+
+/**
+ * 발급 인증서와 등록 토큰 저장소
+ */
+type Store struct {
+	sync.Mutex
+	conn *sql.DB
+}
+
+/**
+ * 등록 토큰. Gateway 는 발급할 인증서에 기록할 게이트웨이 정보이다.
+ */
+type EnrollmentToken struct {
+	Hash    string
+	GwId    string
+	Gateway ins.GatewayConfigurations
+	Expire  int64
+}
+
+type IssuedCertificate struct {
+	Serial   string
+	GwId     string
+	GwType   string
+	GwSerial string
+	NotAfter int64
+	Revoked  int64
+	Reason   int64
+	Data     []byte
+}
+
+func OpenStore(datasource string) (*Store, error) {
+	conn, err := sql.Open("sqlite3", datasource)
+	if err != nil {
+		return nil, err
+	}
+	db := new(Store)
+	db.conn = conn
+
+	if err = db.InitDB(); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return db, nil
+}
+
+func (v *Store) Close() {
+	v.conn.Close()
+}
+
+func (v *Store) InitDB() error {
+	query := "CREATE TABLE IF NOT EXISTS `tokens` ("
+	query += "`hash` TEXT, "
+	query += "`gwid` TEXT, "
+	query += "`gwtype` TEXT, "
+	query += "`gwserial` TEXT, "
+	query += "`manufacture` TEXT, "
+	query += "`expire` INTEGER, "
+	query += "`used` INTEGER DEFAULT 0, "
+	query += "PRIMARY KEY(`hash`)"
+	query += ")"
+	if _, err := v.conn.Exec(query); err != nil {
+		return err
+	}
+
+	query = "CREATE TABLE IF NOT EXISTS `certificates` ("
+	query += "`serial` TEXT, "
+	query += "`gwid` TEXT, "
+	query += "`gwtype` TEXT, "
+	query += "`gwserial` TEXT, "
+	query += "`notafter` INTEGER, "
+	query += "`pubkey` TEXT, "
+	query += "`revoked` INTEGER DEFAULT 0, "
+	query += "`reason` INTEGER DEFAULT 0, "
+	query += "`data` BLOB, "
+	query += "PRIMARY KEY(`serial`)"
+	query += ")"
+	if _, err := v.conn.Exec(query); err != nil {
+		return err
+	}
+
+	query = "CREATE INDEX IF NOT EXISTS `certificates_pubkey` ON `certificates` (`pubkey`)"
+	if _, err := v.conn.Exec(query); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (v *Store) InsertToken(hash, gwid string, gateway *ins.GatewayConfigurations, expire time.Time) error {
+	v.Lock()
+	defer v.Unlock()
+
+	if gateway == nil {
+		gateway = &ins.GatewayConfigurations{}
+	}
+
+	query := "INSERT INTO `tokens` (`hash`, `gwid`, `gwtype`, `gwserial`, `manufacture`, `expire`, `used`) VALUES (?,?,?,?,?,?,0)"
+	_, err := v.conn.Exec(query, hash, gwid, gateway.Type, gateway.Serial, gateway.Manufacture, expire.Unix())
+
+	return err
+}
+
+/**
+ * 사용되지 않았고 만료되지 않은 토큰을 읽는다.
+ */
+func (v *Store) GetToken(hash string) (*EnrollmentToken, error) {
+	v.Lock()
+	defer v.Unlock()
+
+	token := new(EnrollmentToken)
+	query := "SELECT `hash`, `gwid`, `gwtype`, `gwserial`, `manufacture`, `expire` FROM `tokens` WHERE `hash` = ? AND `used` = 0 AND ? < `expire`"
+	row := v.conn.QueryRow(query, hash, time.Now().Unix())
+	err := row.Scan(&token.Hash, &token.GwId, &token.Gateway.Type, &token.Gateway.Serial, &token.Gateway.Manufacture, &token.Expire)
+	if err == sql.ErrNoRows {
+		return nil, errors.New("invalid or expired enrollment token")
+	} else if err != nil {
+		return nil, err
+	}
+
+	return token, nil
+}
+
+/**
+ * 토큰을 사용 처리하고 발급한 인증서를 저장한다. (하나의 트랜잭션)
+ * 토큰은 한 번만 사용할 수 있다.
+ */
+func (v *Store) UseToken(hash string, cert *x509.Certificate, data []byte) error {
+	v.Lock()
+	defer v.Unlock()
+
+	tx, err := v.conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec("UPDATE `tokens` SET `used` = 1 WHERE `hash` = ? AND `used` = 0 AND ? < `expire`", hash, time.Now().Unix())
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil || n != 1 {
+		return errors.New("invalid or expired enrollment token")
+	}
+
+	if err = insertCertificate(tx, cert, data); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+/**
+ * 만료되었거나 사용된 토큰을 삭제한다.
+ */
+func (v *Store) PurgeTokens() (int64, error) {
+	v.Lock()
+	defer v.Unlock()
+
+	result, err := v.conn.Exec("DELETE FROM `tokens` WHERE `used` = 1 OR `expire` <= ?", time.Now().Unix())
+	if err != nil {
+		return -1, err
+	}
+
+	return result.RowsAffected()
+}
+
+func publicKeyHash(cert *x509.Certificate) string {
+	hash := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return fmt.Sprintf("%x", hash[:])
+}
+
+func insertCertificate(tx *sql.Tx, cert *x509.Certificate, data []byte) error {
+	gateway := GatewayFromCertificate(cert)
+
+	query := "INSERT INTO `certificates` (`serial`, `gwid`, `gwtype`, `gwserial`, `notafter`, `pubkey`, `data`) VALUES (?,?,?,?,?,?,?)"
+	_, err := tx.Exec(query, cert.SerialNumber.Text(16), cert.Subject.CommonName, gateway.Type, gateway.Serial, cert.NotAfter.Unix(), publicKeyHash(cert), data)
+
+	return err
+}
+
+func (v *Store) InsertCertificate(cert *x509.Certificate, data []byte) error {
+	v.Lock()
+	defer v.Unlock()
+
+	tx, err := v.conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err = insertCertificate(tx, cert, data); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+/**
+ * 갱신한 인증서를 저장한다.
+ * 이미 발급된 공개키이면 (재전송된 갱신 요청) 저장하지 않는다.
+ */
+func (v *Store) InsertRenewedCertificate(cert *x509.Certificate, data []byte) error {
+	v.Lock()
+	defer v.Unlock()
+
+	tx, err := v.conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var count int64
+	row := tx.QueryRow("SELECT COUNT(*) FROM `certificates` WHERE `pubkey` = ?", publicKeyHash(cert))
+	if err = row.Scan(&count); err != nil {
+		return err
+	}
+	if 0 < count {
+		return ErrPublicKeyIssued
+	}
+
+	if err = insertCertificate(tx, cert, data); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (v *Store) GetCertificate(serial string) (*IssuedCertificate, error) {
+	v.Lock()
+	defer v.Unlock()
+
+	query := "SELECT `serial`, `gwid`, `gwtype`, `gwserial`, `notafter`, `revoked`, `reason`, `data` FROM `certificates` WHERE `serial` = ?"
+	row := v.conn.QueryRow(query, serial)
+
+	cert := new(IssuedCertificate)
+	err := row.Scan(&cert.Serial, &cert.GwId, &cert.GwType, &cert.GwSerial, &cert.NotAfter, &cert.Revoked, &cert.Reason, &cert.Data)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	return cert, nil
+}
+
+/**
+ * 게이트웨이에 발급된 인증서 목록
+ */
+func (v *Store) GetCertificates(gwid string) (*list.List, error) {
+	v.Lock()
+	defer v.Unlock()
+
+	query := "SELECT `serial`, `gwid`, `gwtype`, `gwserial`, `notafter`, `revoked`, `reason`, `data` FROM `certificates` WHERE `gwid` = ? ORDER BY `notafter` ASC"
+	rows, err := v.conn.Query(query, gwid)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	results := list.New()
+	for rows.Next() {
+		cert := new(IssuedCertificate)
+		err := rows.Scan(&cert.Serial, &cert.GwId, &cert.GwType, &cert.GwSerial, &cert.NotAfter, &cert.Revoked, &cert.Reason, &cert.Data)
+		if err != nil {
+			return nil, err
+		}
+		results.PushBack(cert)
+	}
+
+	return results, nil
+}
+
+func (v *Store) RevokeCertificate(serial string, reason int) error {
+	v.Lock()
+	defer v.Unlock()
+
+	result, err := v.conn.Exec("UPDATE `certificates` SET `revoked` = ?, `reason` = ? WHERE `serial` = ? AND `revoked` = 0", time.Now().Unix(), reason, serial)
+	if err != nil {
+		return err
+	}
+
+	if n, err := result.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return errors.New("unknown or already revoked certificate: " + serial)
+	}
+
+	return nil
+}
+
+/**
+ * 폐기되었고 아직 만료되지 않은 인증서 목록 (CRL 항목)
+ */
+func (v *Store) RevokedCertificates() ([]pkix.RevokedCertificate, error) {
+	v.Lock()
+	defer v.Unlock()
+
+	query := "SELECT `serial`, `revoked` FROM `certificates` WHERE 0 < `revoked` AND ? < `notafter`"
+	rows, err := v.conn.Query(query, time.Now().Unix())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	results := []pkix.RevokedCertificate{}
+	for rows.Next() {
+		var serial string
+		var revoked int64
+		if err := rows.Scan(&serial, &revoked); err != nil {
+			return nil, err
+		}
+
+		number, ok := new(big.Int).SetString(serial, 16)
+		if ok == false {
+			continue
+		}
+
+		results = append(results, pkix.RevokedCertificate{
+			SerialNumber:   number,
+			RevocationTime: time.Unix(revoked, 0),
+		})
+	}
+
+	return results, nil
+}
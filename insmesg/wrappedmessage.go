@@ -66,4 +66,35 @@ func MakeWrappedPacket(data []byte, addtion ins.Map) *bytes.Buffer {
 	}
 
 	return newdata
-}
\ No newline at end of file
+}
+
+/**
+ * MakeWrappedPacket 에 송신 주소(0x8003)를 추가한다.
+ * 송신 주소는 addtion 의 0x8003 값을 사용하며 (PROXY protocol 을 사용하면 실제 클라이언트 주소),
+ * 값이 없으면 MakeWrappedPacket 과 같다.
+ */
+func MakeWrappedPacketWithRemoteAddress(data []byte, addtion ins.Map) *bytes.Buffer {
+	wrapped := MakeWrappedPacket(data, addtion)
+	if wrapped == nil {
+		return nil
+	}
+
+	remoteIp := addtion.Get(ins.MapKey([]byte{0x80, 0x03}))
+	if remoteIp == nil || len(remoteIp.([]byte)) == 0 {
+		return wrapped
+	}
+
+	// 0xEF, F0, length, (tag, length, level 3 payload)
+	packet := wrapped.Bytes()
+	if len(packet) < 12 || binary.LittleEndian.Uint32(packet[2:6]) != binary.LittleEndian.Uint32(packet[8:12])+6 {
+		return wrapped
+	}
+
+	// level 3 payload 끝에 추가하고 level 1, level 2 길이를 늘린다.
+	element := ins.EncTagLnV(binary.LittleEndian, []byte{0x80, 0x03}, 32, remoteIp.([]byte))
+	binary.LittleEndian.PutUint32(packet[2:6], binary.LittleEndian.Uint32(packet[2:6])+uint32(len(element)))
+	binary.LittleEndian.PutUint32(packet[8:12], binary.LittleEndian.Uint32(packet[8:12])+uint32(len(element)))
+	wrapped.Write(element)
+
+	return wrapped
+}
@@ -0,0 +1,414 @@
+package insreport
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/industry-netsecurity-solution/ins-security-channel/ins"
+	"github.com/industry-netsecurity-solution/ins-security-channel/logger"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// 인증서 만료 확인 주기
+var DefaultCertMonitorInterval = 1 * time.Hour
+
+// 만료 경고 기준(일)
+var DefaultCertThresholds = []int64{30, 14, 7, 1}
+
+const DefaultCertEventType = "CERT_EXPIRY"
+
+const (
+	CERT_STATUS_OK      = "OK"
+	CERT_STATUS_WARNING = "WARNING"
+	CERT_STATUS_EXPIRED = "EXPIRED"
+	CERT_STATUS_ERROR   = "ERROR"
+)
+
+// 경고 단계. 만료된 인증서는 certLevelExpired
+const certLevelNone = int64(1<<63 - 1)
+const certLevelExpired = int64(-1)
+
+type CertStatus struct {
+	Name        string `json:"name"`
+	Kind        string `json:"kind"`
+	Subject     string `json:"subject"`
+	Issuer      string `json:"issuer"`
+	Serial      string `json:"serial"`
+	NotAfter    string `json:"notAfter"`
+	DaysLeft    int64  `json:"daysLeft"`
+	Status      string `json:"status"`
+	Error       string `json:"error,omitempty"`
+	fingerprint string
+	level       int64
+}
+
+/**
+ * 프로세스가 사용하는 인증서(서버/클라이언트/MQTT/HTTP 보고 서버/CA 번들)의
+ * 만료일을 주기적으로 확인하고, 기준 일 수에 도달하면 이벤트를 보고한다.
+ * 같은 인증서, 같은 단계의 경고는 한 번만 보고한다.
+ */
+type CertMonitor struct {
+	sync.Mutex
+	config      ins.CertMonitorConfigurations
+	eventUrl    *ins.HttpConfigurations
+	securityUrl *ins.HttpConfigurations
+	sourceId    string
+	evtGwType   string
+	managers    map[string]*ins.CertManager
+	remotes     map[string]*ins.HttpConfigurations
+	status      []CertStatus
+	checkedAt   time.Time
+	reported    map[string]int64
+	stop        chan struct{}
+}
+
+/**
+ * eventUrl 로 ReportLog, securityUrl 로 ReportSecurityLog 를 보낸다.
+ * nil 이면 해당 보고는 생략하고 로그만 남긴다.
+ */
+func NewCertMonitor(config *ins.CertMonitorConfigurations, eventUrl, securityUrl *ins.HttpConfigurations, sourceId, evtGwType string) *CertMonitor {
+	v := new(CertMonitor)
+	if config != nil {
+		v.config = *config
+	}
+	v.eventUrl = eventUrl
+	v.securityUrl = securityUrl
+	v.sourceId = sourceId
+	v.evtGwType = evtGwType
+	v.managers = make(map[string]*ins.CertManager)
+	v.remotes = make(map[string]*ins.HttpConfigurations)
+	v.reported = make(map[string]int64)
+
+	return v
+}
+
+/**
+ * 공유 목록(ins.LoadCertManager)에 없는 인증서 관리자를 감시 대상에 추가한다.
+ */
+func (v *CertMonitor) AddManager(name string, manager *ins.CertManager) {
+	v.Lock()
+	defer v.Unlock()
+
+	v.managers[name] = manager
+}
+
+/**
+ * 원격 서버(HTTP 보고 서버 등)가 제시하는 인증서를 감시 대상에 추가한다.
+ */
+func (v *CertMonitor) AddRemote(name string, remote *ins.HttpConfigurations) {
+	v.Lock()
+	defer v.Unlock()
+
+	v.remotes[name] = remote
+}
+
+func (v *CertMonitor) interval() time.Duration {
+	if 0 < v.config.Interval {
+		return time.Duration(v.config.Interval) * time.Second
+	}
+	return DefaultCertMonitorInterval
+}
+
+func (v *CertMonitor) thresholds() []int64 {
+	thresholds := v.config.Thresholds
+	if len(thresholds) == 0 {
+		thresholds = DefaultCertThresholds
+	}
+
+	results := make([]int64, len(thresholds))
+	copy(results, thresholds)
+	sort.Slice(results, func(i, j int) bool { return results[i] < results[j] })
+
+	return results
+}
+
+func (v *CertMonitor) eventType() string {
+	if 0 < len(v.config.EventType) {
+		return v.config.EventType
+	}
+	return DefaultCertEventType
+}
+
+func (v *CertMonitor) newStatus(name, kind string, cert *x509.Certificate, now time.Time) CertStatus {
+	fingerprint := sha256.Sum256(cert.Raw)
+
+	status := CertStatus{
+		Name:        name,
+		Kind:        kind,
+		Subject:     cert.Subject.String(),
+		Issuer:      cert.Issuer.String(),
+		Serial:      cert.SerialNumber.Text(16),
+		NotAfter:    cert.NotAfter.Format("2006-01-02 15:04:05"),
+		DaysLeft:    int64(cert.NotAfter.Sub(now) / (24 * time.Hour)),
+		Status:      CERT_STATUS_OK,
+		fingerprint: hex.EncodeToString(fingerprint[:]),
+		level:       certLevelNone,
+	}
+
+	if now.After(cert.NotAfter) {
+		status.Status = CERT_STATUS_EXPIRED
+		status.level = certLevelExpired
+		return status
+	}
+
+	for _, threshold := range v.thresholds() {
+		if status.DaysLeft <= threshold {
+			status.Status = CERT_STATUS_WARNING
+			status.level = threshold
+			break
+		}
+	}
+
+	return status
+}
+
+func (v *CertMonitor) managerStatus(name string, manager *ins.CertManager, now time.Time) []CertStatus {
+	results := []CertStatus{}
+
+	if certificate := manager.Certificate(); certificate != nil && certificate.Leaf != nil {
+		results = append(results, v.newStatus(name, "certificate", certificate.Leaf, now))
+	}
+
+	for _, cert := range manager.CaCertificates() {
+		results = append(results, v.newStatus(manager.CaCertFile(), "ca", cert, now))
+	}
+
+	return results
+}
+
+/**
+ * 원격 서버에 연결하여 서버 인증서를 읽는다.
+ * 만료 확인이 목적이므로 strict 정책이 아니면 검증은 하지 않는다.
+ */
+func fetchRemoteCertificate(remote *ins.HttpConfigurations) (*x509.Certificate, error) {
+	timeout := time.Duration(remote.Timeout) * time.Second
+	if timeout <= 0 {
+		timeout = 10 * time.Second
+	}
+
+	address := fmt.Sprintf("%s:%d", remote.Address, remote.Port)
+	dialer := &net.Dialer{Timeout: timeout}
+	config := &tls.Config{
+		ServerName:         remote.Address,
+		InsecureSkipVerify: true,
+	}
+	if remote.TLSPolicy.IsStrict() {
+		// strict 정책은 검증 생략을 허용하지 않는다.
+		var err error
+		if config, err = remote.ClientTLSConfig(); err != nil {
+			return nil, err
+		}
+		config.ServerName = remote.Address
+	}
+
+	conn, err := tls.DialWithDialer(dialer, "tcp", address, config)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	certs := conn.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("%s: no peer certificate", address)
+	}
+
+	return certs[0], nil
+}
+
+/**
+ * 감시 대상 인증서를 모두 확인하고, 새로 도달한 경고 단계를 보고한다.
+ */
+func (v *CertMonitor) Check() []CertStatus {
+	now := time.Now()
+
+	type namedManager struct {
+		name    string
+		manager *ins.CertManager
+	}
+
+	v.Lock()
+	managers := []namedManager{}
+	for name, manager := range v.managers {
+		managers = append(managers, namedManager{name, manager})
+	}
+	remotes := make(map[string]*ins.HttpConfigurations, len(v.remotes))
+	for name, remote := range v.remotes {
+		remotes[name] = remote
+	}
+	v.Unlock()
+
+	for _, manager := range ins.GetCertManagers() {
+		managers = append(managers, namedManager{manager.CertFile(), manager})
+	}
+
+	results := []CertStatus{}
+	seen := make(map[string]bool)
+	for _, m := range managers {
+		for _, status := range v.managerStatus(m.name, m.manager, now) {
+			// 여러 관리자가 같은 인증서/CA 번들을 사용할 수 있다.
+			if seen[status.fingerprint] {
+				continue
+			}
+			seen[status.fingerprint] = true
+			results = append(results, status)
+		}
+	}
+
+	for name, remote := range remotes {
+		if remote.EnableTls == false {
+			continue
+		}
+
+		cert, err := fetchRemoteCertificate(remote)
+		if err != nil {
+			results = append(results, CertStatus{
+				Name:   name,
+				Kind:   "remote",
+				Status: CERT_STATUS_ERROR,
+				Error:  err.Error(),
+				level:  certLevelNone,
+			})
+			continue
+		}
+		results = append(results, v.newStatus(name, "remote", cert, now))
+	}
+
+	sort.Slice(results, func(i, j int) bool { return results[i].DaysLeft < results[j].DaysLeft })
+
+	v.Lock()
+	v.status = results
+	v.checkedAt = now
+	v.Unlock()
+
+	for _, status := range results {
+		v.report(status)
+	}
+
+	return results
+}
+
+func (v *CertMonitor) report(status CertStatus) {
+	if status.Status == CERT_STATUS_ERROR {
+		logger.Warningf("certificate check failed (%s): %s", status.Name, status.Error)
+		return
+	}
+	if status.level == certLevelNone {
+		return
+	}
+
+	v.Lock()
+	if last, ok := v.reported[status.fingerprint]; ok && last <= status.level {
+		v.Unlock()
+		return
+	}
+	v.reported[status.fingerprint] = status.level
+	v.Unlock()
+
+	var message string
+	if status.Status == CERT_STATUS_EXPIRED {
+		message = fmt.Sprintf("certificate expired: %s (%s, notAfter %s)", status.Subject, status.Name, status.NotAfter)
+		logger.Error(message)
+	} else {
+		message = fmt.Sprintf("certificate expires in %d days: %s (%s, notAfter %s)", status.DaysLeft, status.Subject, status.Name, status.NotAfter)
+		logger.Warning(message)
+	}
+
+	content := ""
+	if data, err := json.Marshal(status); err == nil {
+		content = string(data)
+	}
+
+	if err := ins.ReportLog(v.eventUrl, v.sourceId, v.evtGwType, v.eventType(), status.Status, message, content); err != nil {
+		logger.Errorf("certificate expiry report failed: %v", err)
+	}
+	if err := ReportSecurityLog(v.securityUrl, v.eventType(), status.Name, v.evtGwType, v.sourceId, message, content); err != nil {
+		logger.Errorf("certificate expiry security report failed: %v", err)
+	}
+}
+
+/**
+ * 마지막 확인 결과
+ */
+func (v *CertMonitor) Status() []CertStatus {
+	v.Lock()
+	defer v.Unlock()
+
+	results := make([]CertStatus, len(v.status))
+	copy(results, v.status)
+
+	return results
+}
+
+/**
+ * 진단 출력용 문자열
+ */
+func (v *CertMonitor) Diagnostics() []string {
+	v.Lock()
+	checkedAt := v.checkedAt
+	v.Unlock()
+
+	strings := []string{}
+	if checkedAt.IsZero() {
+		return append(strings, "not checked")
+	}
+
+	strings = append(strings, fmt.Sprintf("CheckedAt: %s", checkedAt.Format("2006-01-02 15:04:05")))
+	for _, status := range v.Status() {
+		if status.Status == CERT_STATUS_ERROR {
+			strings = append(strings, fmt.Sprintf("%s [%s] %s: %s", status.Status, status.Kind, status.Name, status.Error))
+			continue
+		}
+		strings = append(strings, fmt.Sprintf("%s [%s] %s: %s, notAfter %s, %d days left", status.Status, status.Kind, status.Name, status.Subject, status.NotAfter, status.DaysLeft))
+	}
+
+	return strings
+}
+
+/**
+ * 주기적 확인을 시작하고 진단 정보에 "certificates" 항목을 등록한다.
+ */
+func (v *CertMonitor) Start() {
+	v.Lock()
+	if v.stop != nil {
+		v.Unlock()
+		return
+	}
+	stop := make(chan struct{})
+	v.stop = stop
+	v.Unlock()
+
+	ins.RegisterDiagnostics("certificates", v.Diagnostics)
+
+	go func() {
+		v.Check()
+
+		ticker := time.NewTicker(v.interval())
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				v.Check()
+			}
+		}
+	}()
+}
+
+func (v *CertMonitor) Stop() {
+	v.Lock()
+	defer v.Unlock()
+
+	if v.stop != nil {
+		close(v.stop)
+		v.stop = nil
+		ins.UnregisterDiagnostics("certificates")
+	}
+}
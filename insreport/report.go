@@ -1,7 +1,6 @@
 package insreport
 
 import (
-	"crypto/tls"
 	"encoding/base64"
 	"encoding/json"
 	"errors"
@@ -67,22 +66,18 @@ func ReportSecurityLog(reportUrl *ins.HttpConfigurations, evtType, eventSource,
 	reportParam.SetHeader("Accept", "application/json")
 	reportParam.SetData(data)
 
+	if u, err = reportUrl.Url(); err != nil {
+		return err
+	}
+
 	r := &request.RequestURL{*u}
 
-	var tr *http.Transport = nil
-	if reportUrl.EnableTls {
-		if 0 < len(reportUrl.TlsCert) {
-			tr = &http.Transport{
-				TLSClientConfig: ins.NewTLSConfig(&reportUrl.CaCert, &reportUrl.TlsCert, &reportUrl.TlsKey),
-			}
-		} else {
-			tr = &http.Transport{
-				TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
-			}
-		}
+	client, err := ins.GetHttpClient(reportUrl)
+	if err != nil {
+		return err
 	}
 
-	if _, e := r.DoRequest(tr, reportParam, func(resp *resty.Response) error {
+	if _, e := r.Do(client, reportParam, func(resp *resty.Response) error {
 		status := resp.StatusCode()
 		if status != 200 && status != 201 && status != 202 && status != 205 {
 			return errors.New(fmt.Sprintf("%d %s - %s", status, http.StatusText(status), resp.Request.URL))
@@ -0,0 +1,465 @@
+package mqttbroker
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"github.com/industry-netsecurity-solution/ins-security-channel/ins"
+	"github.com/industry-netsecurity-solution/ins-security-channel/ins/acl"
+	"golang.org/x/crypto/bcrypt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"unicode/utf8"
+)
+
+// 클라이언트별 전송 대기열 크기 기본값
+var DefaultQueueSize int64 = 1000
+
+// 패킷 최대 크기 기본값
+var DefaultMaxPacketSize int64 = 16 * 1024 * 1024
+
+var ErrBrokerClosed = errors.New("broker closed")
+var ErrInvalidTopicName = errors.New("invalid topic name")
+
+/**
+ * 발행 메시지
+ */
+type Message struct {
+	Topic   string
+	Payload []byte
+	Qos     byte
+	Retain  bool
+}
+
+/**
+ * 연결된 클라이언트 정보
+ * Username 은 인증된 사용자 이름이다. (CertAuth 이면 인증서 CN)
+ */
+type ClientInfo struct {
+	ClientId   string
+	Username   string
+	CommonName string
+	RemoteAddr net.Addr
+}
+
+type brokerListener struct {
+	config ins.ServiceConfigurations
+	tls    *tls.Config
+	server *ins.Server
+}
+
+/**
+ * 프로세스 안에서 동작하는 MQTT 3.1.1 broker
+ *
+ * QoS 0/1 을 지원하며 QoS 2 구독은 QoS 1 로 낮춘다. (QoS 2 발행은 받는다.)
+ * 보관(retained) 메시지, Will, clean session 이 아닌 세션의 구독과 QoS 1 메시지를 메모리에 유지한다.
+ * 테스트 또는 집중 게이트웨이의 로컬 broker 로 사용한다.
+ */
+type Broker struct {
+	sync.RWMutex
+	config    ins.BrokerConfigurations
+	listeners []*brokerListener
+	sessions  map[string]*session
+	retained  map[string]*Message
+	acl       *acl.TopicACL
+	closed    bool
+	clients   int64
+	received  int64
+	sent      int64
+	dropped   int64
+	denied    int64
+}
+
+func NewBroker(config *ins.BrokerConfigurations) (*Broker, error) {
+	if config == nil {
+		return nil, errors.New("BrokerConfigurations is nil")
+	}
+
+	v := new(Broker)
+	v.config = *config
+	if v.config.QueueSize <= 0 {
+		v.config.QueueSize = DefaultQueueSize
+	}
+	if v.config.MaxPacketSize <= 0 {
+		v.config.MaxPacketSize = DefaultMaxPacketSize
+	}
+	v.sessions = make(map[string]*session)
+	v.retained = make(map[string]*Message)
+
+	for _, service := range config.Listeners {
+		listener := new(brokerListener)
+		listener.config = service
+
+		if service.EnableTls {
+			if len(service.ClientAuth) == 0 && 0 < len(service.CaCert) {
+				// 클라이언트 인증서를 보내면 확인한다.
+				service.ClientAuth = ins.CLIENT_AUTH_OPTIONAL
+			}
+			tlsConfig, err := service.ServerTLSConfig()
+			if err != nil {
+				return nil, err
+			}
+			listener.tls = tlsConfig
+		}
+
+		// TLS 는 연결 처리에서 직접 한다. (클라이언트 인증서 확인)
+		service.EnableTls = false
+		listener.server = ins.NewServer(&service, listener, v.serve)
+
+		v.listeners = append(v.listeners, listener)
+	}
+
+	return v, nil
+}
+
+/**
+ * 토픽 접근 규칙을 지정한다. nil 이면 확인하지 않는다.
+ * 허용되지 않은 발행은 버리고(QoS 1 이면 PUBACK 은 보낸다), 구독은 실패(0x80)로 응답한다.
+ */
+func (v *Broker) SetACL(rules *acl.TopicACL) {
+	v.Lock()
+	defer v.Unlock()
+
+	v.acl = rules
+}
+
+/**
+ * 규칙에 사용할 게이트웨이 식별자: 인증된 사용자 이름, 없으면 인증서 CN
+ */
+func (v ClientInfo) Identity() string {
+	if 0 < len(v.Username) {
+		return v.Username
+	}
+	return v.CommonName
+}
+
+func (v *Broker) authorize(info *ClientInfo, action, topic string) bool {
+	v.RLock()
+	rules := v.acl
+	v.RUnlock()
+
+	if rules == nil {
+		return true
+	}
+
+	source := ""
+	if info.RemoteAddr != nil {
+		source = info.RemoteAddr.String()
+	}
+	if rules.Check(info.Identity(), action, topic, source) {
+		return true
+	}
+	atomic.AddInt64(&v.denied, 1)
+
+	return false
+}
+
+/**
+ * 모든 리스너를 연다.
+ */
+func (v *Broker) Start() error {
+	for _, listener := range v.listeners {
+		if err := listener.server.Start(); err != nil {
+			v.Close()
+			return err
+		}
+	}
+
+	return nil
+}
+
+/**
+ * 리스너 주소 (Port 를 0 으로 지정한 경우 실제 포트 확인용)
+ */
+func (v *Broker) Addrs() []net.Addr {
+	addrs := []net.Addr{}
+	for _, listener := range v.listeners {
+		if addr := listener.server.Addr(); addr != nil {
+			addrs = append(addrs, addr)
+		}
+	}
+
+	return addrs
+}
+
+/**
+ * 접속을 인증하고 ACL 에 사용할 identity 를 반환한다.
+ * identity 는 확인된 클라이언트 인증서의 CN 이나 비밀번호를 확인한 username 이며, 인증하지 않은 접속은 빈 문자열이다.
+ */
+func (v *Broker) authenticate(c *connectPacket, commonName string) (string, byte) {
+	if len(v.config.Users) == 0 && v.config.CertAuth == false {
+		// 인증을 설정하지 않았으므로 username 을 확인할 수 없다.
+		return "", CONNACK_ACCEPTED
+	}
+
+	if v.config.CertAuth && 0 < len(commonName) {
+		if c.hasUser && c.username != commonName {
+			return "", CONNACK_NOT_AUTHORIZED
+		}
+		return commonName, CONNACK_ACCEPTED
+	}
+
+	if c.hasUser {
+		stored, ok := v.config.Users[c.username]
+		if ok == false || checkPassword(stored, c.password) == false {
+			return "", CONNACK_BAD_USERNAME
+		}
+		return c.username, CONNACK_ACCEPTED
+	}
+
+	if v.config.AllowAnonymous {
+		return "", CONNACK_ACCEPTED
+	}
+
+	return "", CONNACK_NOT_AUTHORIZED
+}
+
+func checkPassword(stored string, password []byte) bool {
+	if strings.HasPrefix(stored, "$2a$") || strings.HasPrefix(stored, "$2b$") || strings.HasPrefix(stored, "$2y$") {
+		return bcrypt.CompareHashAndPassword([]byte(stored), password) == nil
+	}
+
+	return subtle.ConstantTimeCompare([]byte(stored), password) == 1
+}
+
+/**
+ * 세션을 연결하고 CONNACK 을 보낸다. 같은 ClientId 로 연결된 클라이언트가 있으면 끊는다.
+ * clean session 이 아니면 이전 세션을 이어서 사용한다.
+ */
+func (v *Broker) attach(c *client, clean bool) (*session, error) {
+	v.Lock()
+	if v.closed {
+		v.Unlock()
+		return nil, ErrBrokerClosed
+	}
+
+	old, ok := v.sessions[c.info.ClientId]
+	s := old
+	if ok == false || clean {
+		s = newSession(c.info.ClientId, clean, int(v.config.QueueSize))
+		v.sessions[c.info.ClientId] = s
+	}
+	v.Unlock()
+
+	if ok && s != old {
+		if previous := old.current(); previous != nil {
+			previous.close()
+		}
+	}
+
+	present := ok && clean == false
+	if previous := s.takeover(c, encodeConnack(present, CONNACK_ACCEPTED)); previous != nil {
+		previous.close()
+	}
+
+	return s, nil
+}
+
+func (v *Broker) detach(c *client, s *session) {
+	if s.detach(c) == false {
+		return
+	}
+
+	if s.clean {
+		v.Lock()
+		if v.sessions[s.clientId] == s {
+			delete(v.sessions, s.clientId)
+		}
+		v.Unlock()
+	}
+}
+
+/**
+ * 발행 토픽 확인: 비어 있지 않고 와일드카드를 포함하지 않아야 한다.
+ */
+func ValidTopicName(topic string) bool {
+	if len(topic) == 0 || 65535 < len(topic) || utf8.ValidString(topic) == false {
+		return false
+	}
+
+	return strings.ContainsAny(topic, "+#\x00") == false
+}
+
+/**
+ * 구독 필터 확인: '#' 은 마지막 단계에만, '+' 는 단계 전체로만 쓸 수 있다.
+ */
+func ValidTopicFilter(filter string) bool {
+	if len(filter) == 0 || 65535 < len(filter) || utf8.ValidString(filter) == false || strings.Contains(filter, "\x00") {
+		return false
+	}
+
+	levels := strings.Split(filter, "/")
+	for i, level := range levels {
+		if strings.Contains(level, "#") && (level != "#" || i != len(levels)-1) {
+			return false
+		}
+		if strings.Contains(level, "+") && level != "+" {
+			return false
+		}
+	}
+
+	return true
+}
+
+/**
+ * topic 이 filter 에 해당하는지 확인한다. '$' 로 시작하는 토픽은 첫 단계 와일드카드와 맞지 않는다.
+ */
+func MatchTopic(filter, topic string) bool {
+	if strings.HasPrefix(topic, "$") && (strings.HasPrefix(filter, "+") || strings.HasPrefix(filter, "#")) {
+		return false
+	}
+
+	return ins.MatchTopic(filter, topic)
+}
+
+/**
+ * 메시지를 구독자에게 전달하고, Retain 이면 보관한다.
+ */
+func (v *Broker) route(msg *Message) {
+	atomic.AddInt64(&v.received, 1)
+
+	v.Lock()
+	if msg.Retain {
+		if len(msg.Payload) == 0 {
+			delete(v.retained, msg.Topic)
+		} else {
+			retained := *msg
+			v.retained[msg.Topic] = &retained
+		}
+	}
+	sessions := make([]*session, 0, len(v.sessions))
+	for _, s := range v.sessions {
+		sessions = append(sessions, s)
+	}
+	v.Unlock()
+
+	// 기존 구독자에게는 retain 표시 없이 보낸다.
+	delivered := *msg
+	delivered.Retain = false
+	for _, s := range sessions {
+		if qos, ok := s.match(msg.Topic); ok {
+			if qos > delivered.Qos {
+				qos = delivered.Qos
+			}
+			v.count(s.deliver(&delivered, qos))
+		}
+	}
+}
+
+func (v *Broker) count(sent bool) {
+	if sent {
+		atomic.AddInt64(&v.sent, 1)
+	} else {
+		atomic.AddInt64(&v.dropped, 1)
+	}
+}
+
+/**
+ * filter 에 맞는 보관 메시지
+ */
+func (v *Broker) retainedMessages(filter string) []*Message {
+	v.RLock()
+	defer v.RUnlock()
+
+	messages := []*Message{}
+	for topic, msg := range v.retained {
+		if MatchTopic(filter, topic) {
+			messages = append(messages, msg)
+		}
+	}
+	sort.Slice(messages, func(i, j int) bool {
+		return messages[i].Topic < messages[j].Topic
+	})
+
+	return messages
+}
+
+/**
+ * 프로세스 안에서 메시지를 발행한다.
+ */
+func (v *Broker) Publish(topic string, qos byte, retain bool, payload []byte) error {
+	if ValidTopicName(topic) == false {
+		return ErrInvalidTopicName
+	}
+	if 1 < qos {
+		qos = 1
+	}
+
+	v.RLock()
+	closed := v.closed
+	v.RUnlock()
+	if closed {
+		return ErrBrokerClosed
+	}
+
+	v.route(&Message{Topic: topic, Payload: append([]byte{}, payload...), Qos: qos, Retain: retain})
+
+	return nil
+}
+
+/**
+ * 연결된 클라이언트 목록
+ */
+func (v *Broker) Clients() []ClientInfo {
+	v.RLock()
+	sessions := make([]*session, 0, len(v.sessions))
+	for _, s := range v.sessions {
+		sessions = append(sessions, s)
+	}
+	v.RUnlock()
+
+	clients := []ClientInfo{}
+	for _, s := range sessions {
+		if c := s.current(); c != nil {
+			clients = append(clients, c.info)
+		}
+	}
+	sort.Slice(clients, func(i, j int) bool {
+		return clients[i].ClientId < clients[j].ClientId
+	})
+
+	return clients
+}
+
+/**
+ * 진단 출력용 문자열
+ */
+func (v *Broker) Diagnostics() []string {
+	v.RLock()
+	sessions := len(v.sessions)
+	retained := len(v.retained)
+	v.RUnlock()
+
+	strings := []string{}
+	for _, addr := range v.Addrs() {
+		strings = append(strings, fmt.Sprintf("Listener: %s", addr.String()))
+	}
+	strings = append(strings, fmt.Sprintf("Clients: %d", atomic.LoadInt64(&v.clients)))
+	strings = append(strings, fmt.Sprintf("Sessions: %d", sessions))
+	strings = append(strings, fmt.Sprintf("Retained: %d", retained))
+	strings = append(strings, fmt.Sprintf("Received: %d", atomic.LoadInt64(&v.received)))
+	strings = append(strings, fmt.Sprintf("Sent: %d", atomic.LoadInt64(&v.sent)))
+	strings = append(strings, fmt.Sprintf("Dropped: %d", atomic.LoadInt64(&v.dropped)))
+	strings = append(strings, fmt.Sprintf("Denied: %d", atomic.LoadInt64(&v.denied)))
+
+	return strings
+}
+
+/**
+ * 리스너와 모든 연결을 닫는다.
+ */
+func (v *Broker) Close() error {
+	v.Lock()
+	v.closed = true
+	v.Unlock()
+
+	for _, listener := range v.listeners {
+		listener.server.Close()
+	}
+
+	return nil
+}
@@ -0,0 +1,244 @@
+package mqttbroker
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/industry-netsecurity-solution/ins-security-channel/ins"
+	"github.com/industry-netsecurity-solution/ins-security-channel/ins/acl"
+)
+
+const testTimeout = 5 * time.Second
+
+func newTestBroker(t *testing.T, rules []acl.Rule) *Broker {
+	t.Helper()
+
+	config := &ins.BrokerConfigurations{
+		Listeners: []ins.ServiceConfigurations{{Address: "127.0.0.1", Port: 0}},
+		Users: map[string]string{
+			"GW01": "secret01",
+			"GW02": "secret02",
+		},
+	}
+
+	broker, err := NewBroker(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if rules != nil {
+		topicACL, err := acl.NewTopicACL(&ins.TopicACLConfigurations{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		topicACL.SetRules(rules)
+		broker.SetACL(topicACL)
+	}
+
+	if err := broker.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { broker.Close() })
+
+	return broker
+}
+
+func connectTestClient(t *testing.T, broker *Broker, clientId, username, password string) (mqtt.Client, error) {
+	t.Helper()
+
+	addrs := broker.Addrs()
+	if len(addrs) == 0 {
+		t.Fatal("broker has no listener")
+	}
+
+	options := mqtt.NewClientOptions()
+	options.AddBroker(fmt.Sprintf("tcp://%s", addrs[0].String()))
+	options.SetClientID(clientId)
+	options.SetUsername(username)
+	options.SetPassword(password)
+	options.SetAutoReconnect(false)
+	options.SetConnectRetry(false)
+
+	client := mqtt.NewClient(options)
+	token := client.Connect()
+	if token.WaitTimeout(testTimeout) == false {
+		return nil, fmt.Errorf("connect %s: timeout", clientId)
+	}
+	if err := token.Error(); err != nil {
+		return nil, err
+	}
+	t.Cleanup(func() { client.Disconnect(100) })
+
+	return client, nil
+}
+
+func mustConnect(t *testing.T, broker *Broker, clientId, username, password string) mqtt.Client {
+	t.Helper()
+
+	client, err := connectTestClient(t, broker, clientId, username, password)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return client
+}
+
+func subscribe(t *testing.T, client mqtt.Client, filter string, qos byte) (chan mqtt.Message, byte) {
+	t.Helper()
+
+	received := make(chan mqtt.Message, 10)
+	token := client.Subscribe(filter, qos, func(_ mqtt.Client, msg mqtt.Message) {
+		received <- msg
+	})
+	if token.WaitTimeout(testTimeout) == false {
+		t.Fatalf("subscribe %s: timeout", filter)
+	}
+	if err := token.Error(); err != nil {
+		t.Fatal(err)
+	}
+
+	return received, token.(*mqtt.SubscribeToken).Result()[filter]
+}
+
+func publish(t *testing.T, client mqtt.Client, topic string, qos byte, retain bool, payload string) {
+	t.Helper()
+
+	token := client.Publish(topic, qos, retain, payload)
+	if token.WaitTimeout(testTimeout) == false {
+		t.Fatalf("publish %s: timeout", topic)
+	}
+	if err := token.Error(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func expectMessage(t *testing.T, received chan mqtt.Message, topic, payload string, qos byte, retained bool) {
+	t.Helper()
+
+	select {
+	case msg := <-received:
+		if msg.Topic() != topic || string(msg.Payload()) != payload {
+			t.Fatalf("received %s %q, want %s %q", msg.Topic(), msg.Payload(), topic, payload)
+		}
+		if msg.Qos() != qos {
+			t.Fatalf("%s: qos %d, want %d", topic, msg.Qos(), qos)
+		}
+		if msg.Retained() != retained {
+			t.Fatalf("%s: retained %t, want %t", topic, msg.Retained(), retained)
+		}
+	case <-time.After(testTimeout):
+		t.Fatalf("%s: message not received", topic)
+	}
+}
+
+func expectNoMessage(t *testing.T, received chan mqtt.Message) {
+	t.Helper()
+
+	select {
+	case msg := <-received:
+		t.Fatalf("unexpected message %s %q", msg.Topic(), msg.Payload())
+	case <-time.After(300 * time.Millisecond):
+	}
+}
+
+func TestBrokerConnect(t *testing.T) {
+	broker := newTestBroker(t, nil)
+
+	mustConnect(t, broker, "client-01", "GW01", "secret01")
+
+	if _, err := connectTestClient(t, broker, "client-02", "GW02", "wrong"); err == nil {
+		t.Fatal("connect with wrong password must fail")
+	}
+	if _, err := connectTestClient(t, broker, "client-03", "", ""); err == nil {
+		t.Fatal("anonymous connect must fail")
+	}
+
+	clients := broker.Clients()
+	if len(clients) != 1 || clients[0].ClientId != "client-01" || clients[0].Username != "GW01" {
+		t.Fatalf("clients: %+v", clients)
+	}
+}
+
+func TestBrokerPublishSubscribe(t *testing.T) {
+	broker := newTestBroker(t, nil)
+
+	subscriber := mustConnect(t, broker, "subscriber", "GW01", "secret01")
+	publisher := mustConnect(t, broker, "publisher", "GW02", "secret02")
+
+	received, granted := subscribe(t, subscriber, "ins/test/#", 1)
+	if granted != 1 {
+		t.Fatalf("granted qos %d, want 1", granted)
+	}
+
+	publish(t, publisher, "ins/test/qos0", 0, false, "message 0")
+	expectMessage(t, received, "ins/test/qos0", "message 0", 0, false)
+
+	publish(t, publisher, "ins/test/qos1", 1, false, "message 1")
+	expectMessage(t, received, "ins/test/qos1", "message 1", 1, false)
+
+	publish(t, publisher, "ins/other", 1, false, "other")
+	expectNoMessage(t, received)
+}
+
+func TestBrokerRetained(t *testing.T) {
+	broker := newTestBroker(t, nil)
+
+	publisher := mustConnect(t, broker, "publisher", "GW02", "secret02")
+	publish(t, publisher, "ins/test/state", 1, true, "retained")
+
+	// 구독하면 보관 메시지를 retain 표시와 함께 받는다.
+	subscriber := mustConnect(t, broker, "subscriber", "GW01", "secret01")
+	received, _ := subscribe(t, subscriber, "ins/test/+", 1)
+	expectMessage(t, received, "ins/test/state", "retained", 1, true)
+
+	// 구독 중에 받는 메시지는 retain 표시가 없다.
+	publish(t, publisher, "ins/test/state", 1, true, "updated")
+	expectMessage(t, received, "ins/test/state", "updated", 1, false)
+
+	// 빈 payload 는 보관 메시지를 지운다.
+	publish(t, publisher, "ins/test/state", 1, true, "")
+	expectMessage(t, received, "ins/test/state", "", 1, false)
+
+	late := mustConnect(t, broker, "late", "GW01", "secret01")
+	lateReceived, _ := subscribe(t, late, "ins/test/+", 1)
+	expectNoMessage(t, lateReceived)
+}
+
+func TestBrokerACLDeny(t *testing.T) {
+	broker := newTestBroker(t, []acl.Rule{
+		{Identity: acl.ANY_IDENTITY, Publish: []string{"ins/%u/#"}, Subscribe: []string{"ins/%u/#"}},
+		{Identity: "GW02", Subscribe: []string{"ins/#"}},
+	})
+
+	gw01 := mustConnect(t, broker, "gw01", "GW01", "secret01")
+	gw02 := mustConnect(t, broker, "gw02", "GW02", "secret02")
+
+	// 허용되지 않은 구독은 실패(0x80)로 응답한다.
+	if _, granted := subscribe(t, gw01, "ins/GW02/#", 1); granted != 0x80 {
+		t.Fatalf("granted qos 0x%x, want 0x80", granted)
+	}
+
+	received, granted := subscribe(t, gw02, "ins/#", 1)
+	if granted != 1 {
+		t.Fatalf("granted qos %d, want 1", granted)
+	}
+
+	// 허용되지 않은 발행은 PUBACK 만 받고 전달되지 않는다.
+	publish(t, gw01, "ins/GW02/data", 1, false, "denied")
+	expectNoMessage(t, received)
+
+	publish(t, gw01, "ins/GW01/data", 1, false, "allowed")
+	expectMessage(t, received, "ins/GW01/data", "allowed", 1, false)
+
+	denied := false
+	for _, line := range broker.Diagnostics() {
+		if line == "Denied: 2" {
+			denied = true
+		}
+	}
+	if denied == false {
+		t.Fatalf("diagnostics: %v", broker.Diagnostics())
+	}
+}
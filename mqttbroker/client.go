@@ -0,0 +1,308 @@
+package mqttbroker
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/industry-netsecurity-solution/ins-security-channel/ins/acl"
+	"github.com/industry-netsecurity-solution/ins-security-channel/logger"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// CONNECT(TLS 핸드셰이크 포함) 대기 시간
+var ConnectTimeout = 10 * time.Second
+
+/**
+ * 연결 하나. 받은 패킷은 serve 에서 처리하고, 보낼 패킷은 writer 가 순서대로 쓴다.
+ */
+type client struct {
+	broker *Broker
+	conn   net.Conn
+	info   ClientInfo
+	out    chan []byte
+	done   chan struct{}
+	once   sync.Once
+	will   *Message
+	// 받은 QoS 2 메시지 중 PUBREL 을 기다리는 것
+	received map[uint16]bool
+}
+
+/**
+ * 보낼 패킷을 대기열에 넣는다. 대기열이 가득 차면 느린 클라이언트로 보고 연결을 끊는다.
+ */
+func (v *client) send(data []byte) bool {
+	select {
+	case <-v.done:
+		return false
+	default:
+	}
+
+	select {
+	case v.out <- data:
+		return true
+	default:
+		logger.Warningf("mqtt broker: %s is too slow, disconnecting", v.info.ClientId)
+		v.close()
+		return false
+	}
+}
+
+func (v *client) writer() {
+	for {
+		select {
+		case data := <-v.out:
+			if _, err := v.conn.Write(data); err != nil {
+				v.close()
+				return
+			}
+		case <-v.done:
+			return
+		}
+	}
+}
+
+func (v *client) close() {
+	v.once.Do(func() {
+		close(v.done)
+		v.conn.Close()
+	})
+}
+
+func generateClientId() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+
+	return "auto-" + hex.EncodeToString(b)
+}
+
+/**
+ * ins.Server 의 callback: CONNECT 를 확인하고 연결이 끊어질 때까지 패킷을 처리한다.
+ */
+func (v *Broker) serve(conn net.Conn, ud interface{}) error {
+	listener, _ := ud.(*brokerListener)
+
+	commonName := ""
+	if listener != nil && listener.tls != nil {
+		tlsConn := tls.Server(conn, listener.tls)
+		tlsConn.SetDeadline(time.Now().Add(ConnectTimeout))
+		if err := tlsConn.Handshake(); err != nil {
+			return err
+		}
+		state := tlsConn.ConnectionState()
+		if 0 < len(state.VerifiedChains) {
+			commonName = state.PeerCertificates[0].Subject.CommonName
+		}
+		conn = tlsConn
+	}
+
+	reader := bufio.NewReader(conn)
+	conn.SetDeadline(time.Now().Add(ConnectTimeout))
+	p, err := readPacket(reader, int(v.config.MaxPacketSize))
+	if err != nil {
+		return err
+	}
+	if p.kind != CONNECT {
+		return fmt.Errorf("expected CONNECT, got %s", packetName(p.kind))
+	}
+
+	c, err := decodeConnect(p.body)
+	if err != nil {
+		return err
+	}
+	if (c.protocol != "MQTT" || c.level != 4) && (c.protocol != "MQIsdp" || c.level != 3) {
+		conn.Write(encodeConnack(false, CONNACK_BAD_PROTOCOL))
+		return fmt.Errorf("unsupported protocol %s %d", c.protocol, c.level)
+	}
+	if len(c.clientId) == 0 {
+		if c.clean == false {
+			conn.Write(encodeConnack(false, CONNACK_IDENTIFIER_REJECTED))
+			return errors.New("empty client id without clean session")
+		}
+		c.clientId = generateClientId()
+	}
+	if c.will != nil && ValidTopicName(c.will.Topic) == false {
+		return ErrInvalidTopicName
+	}
+
+	username, code := v.authenticate(c, commonName)
+	if code != CONNACK_ACCEPTED {
+		atomic.AddInt64(&v.denied, 1)
+		conn.Write(encodeConnack(false, code))
+		logger.Warningf("mqtt broker: %s (%s) from %v rejected: %d", c.clientId, c.username, conn.RemoteAddr(), code)
+		return nil
+	}
+	conn.SetDeadline(time.Time{})
+
+	cl := new(client)
+	cl.broker = v
+	cl.conn = conn
+	cl.info = ClientInfo{ClientId: c.clientId, Username: username, CommonName: commonName, RemoteAddr: conn.RemoteAddr()}
+	cl.out = make(chan []byte, v.config.QueueSize)
+	cl.done = make(chan struct{})
+	cl.will = c.will
+	cl.received = make(map[uint16]bool)
+
+	s, err := v.attach(cl, c.clean)
+	if err != nil {
+		conn.Write(encodeConnack(false, CONNACK_SERVER_UNAVAILABLE))
+		return err
+	}
+	atomic.AddInt64(&v.clients, 1)
+	logger.Debugf("mqtt broker: %s connected from %v", c.clientId, conn.RemoteAddr())
+
+	go cl.writer()
+
+	defer func() {
+		cl.close()
+		v.detach(cl, s)
+		atomic.AddInt64(&v.clients, -1)
+		if cl.will != nil && v.authorize(&cl.info, acl.ACTION_PUBLISH, cl.will.Topic) {
+			v.route(cl.will)
+		}
+	}()
+
+	keepAlive := time.Duration(c.keepAlive) * time.Second * 3 / 2
+	for {
+		if 0 < keepAlive {
+			conn.SetReadDeadline(time.Now().Add(keepAlive))
+		}
+		p, err := readPacket(reader, int(v.config.MaxPacketSize))
+		if err != nil {
+			select {
+			case <-cl.done:
+				// 다른 연결이 세션을 가져갔거나 broker 가 종료되었다.
+				return nil
+			default:
+			}
+			return err
+		}
+
+		if err = v.handle(cl, s, p); err != nil {
+			if err == errDisconnect {
+				cl.will = nil
+				return nil
+			}
+			return err
+		}
+	}
+}
+
+var errDisconnect = errors.New("disconnect")
+
+func (v *Broker) handle(c *client, s *session, p *packet) error {
+	switch p.kind {
+	case PUBLISH:
+		msg, id, err := decodePublish(p)
+		if err != nil {
+			return err
+		}
+		if ValidTopicName(msg.Topic) == false {
+			return ErrInvalidTopicName
+		}
+		msg.Payload = append([]byte{}, msg.Payload...)
+
+		// 허용되지 않은 메시지도 응답은 보낸다. (MQTT 3.1.1 에는 거부 응답이 없다.)
+		allowed := v.authorize(&c.info, acl.ACTION_PUBLISH, msg.Topic)
+
+		switch msg.Qos {
+		case 0:
+			if allowed {
+				v.route(msg)
+			}
+		case 1:
+			if allowed {
+				v.route(msg)
+			}
+			c.send(encodeAck(PUBACK, id))
+		case 2:
+			// 같은 메시지를 다시 받으면 전달하지 않는다.
+			if c.received[id] == false {
+				c.received[id] = true
+				if allowed {
+					v.route(msg)
+				}
+			}
+			c.send(encodeAck(PUBREC, id))
+		}
+
+	case PUBACK:
+		id, _, err := readUint16(p.body)
+		if err != nil {
+			return err
+		}
+		s.ack(id)
+
+	case PUBREL:
+		id, _, err := readUint16(p.body)
+		if err != nil {
+			return err
+		}
+		delete(c.received, id)
+		c.send(encodeAck(PUBCOMP, id))
+
+	case PUBREC, PUBCOMP:
+		// broker 는 QoS 2 로 보내지 않는다.
+
+	case SUBSCRIBE:
+		id, subs, err := decodeSubscribe(p.body)
+		if err != nil {
+			return err
+		}
+
+		codes := make([]byte, len(subs))
+		for i, sub := range subs {
+			if ValidTopicFilter(sub.filter) == false || v.authorize(&c.info, acl.ACTION_SUBSCRIBE, sub.filter) == false {
+				codes[i] = SUBACK_FAILURE
+				continue
+			}
+			qos := sub.qos
+			if 1 < qos {
+				qos = 1
+			}
+			s.subscribe(sub.filter, qos)
+			codes[i] = qos
+		}
+		c.send(encodeSuback(id, codes))
+
+		// 보관 메시지를 보낸다.
+		for i, sub := range subs {
+			if codes[i] == SUBACK_FAILURE {
+				continue
+			}
+			for _, msg := range v.retainedMessages(sub.filter) {
+				qos := codes[i]
+				if msg.Qos < qos {
+					qos = msg.Qos
+				}
+				v.count(s.deliver(msg, qos))
+			}
+		}
+
+	case UNSUBSCRIBE:
+		id, filters, err := decodeUnsubscribe(p.body)
+		if err != nil {
+			return err
+		}
+		for _, filter := range filters {
+			s.unsubscribe(filter)
+		}
+		c.send(encodeAck(UNSUBACK, id))
+
+	case PINGREQ:
+		c.send(encodePacket(PINGRESP, 0, nil))
+
+	case DISCONNECT:
+		return errDisconnect
+
+	default:
+		return fmt.Errorf("unexpected %s", packetName(p.kind))
+	}
+
+	return nil
+}
@@ -0,0 +1,356 @@
+package mqttbroker
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"unicode/utf8"
+)
+
+// MQTT 3.1.1 제어 패킷 종류
+const (
+	CONNECT     byte = 1
+	CONNACK     byte = 2
+	PUBLISH     byte = 3
+	PUBACK      byte = 4
+	PUBREC      byte = 5
+	PUBREL      byte = 6
+	PUBCOMP     byte = 7
+	SUBSCRIBE   byte = 8
+	SUBACK      byte = 9
+	UNSUBSCRIBE byte = 10
+	UNSUBACK    byte = 11
+	PINGREQ     byte = 12
+	PINGRESP    byte = 13
+	DISCONNECT  byte = 14
+)
+
+// CONNACK 반환 코드
+const (
+	CONNACK_ACCEPTED            byte = 0x00
+	CONNACK_BAD_PROTOCOL        byte = 0x01
+	CONNACK_IDENTIFIER_REJECTED byte = 0x02
+	CONNACK_SERVER_UNAVAILABLE  byte = 0x03
+	CONNACK_BAD_USERNAME        byte = 0x04
+	CONNACK_NOT_AUTHORIZED      byte = 0x05
+)
+
+// SUBACK 실패 코드
+const SUBACK_FAILURE byte = 0x80
+
+var ErrMalformedPacket = errors.New("malformed MQTT packet")
+var ErrPacketTooLarge = errors.New("MQTT packet too large")
+
+type packet struct {
+	kind  byte
+	flags byte
+	body  []byte
+}
+
+func readPacket(reader *bufio.Reader, max int) (*packet, error) {
+	header, err := reader.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+
+	length := 0
+	multiplier := 1
+	for i := 0; ; i++ {
+		if i == 4 {
+			return nil, ErrMalformedPacket
+		}
+		b, err := reader.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		length += int(b&0x7F) * multiplier
+		if b&0x80 == 0 {
+			break
+		}
+		multiplier *= 128
+	}
+
+	if 0 < max && max < length {
+		return nil, ErrPacketTooLarge
+	}
+
+	body := make([]byte, length)
+	if _, err = io.ReadFull(reader, body); err != nil {
+		return nil, err
+	}
+
+	return &packet{kind: header >> 4, flags: header & 0x0F, body: body}, nil
+}
+
+func encodePacket(kind, flags byte, body []byte) []byte {
+	data := make([]byte, 0, 5+len(body))
+	data = append(data, kind<<4|flags&0x0F)
+
+	length := len(body)
+	for {
+		b := byte(length % 128)
+		length /= 128
+		if 0 < length {
+			b |= 0x80
+		}
+		data = append(data, b)
+		if length == 0 {
+			break
+		}
+	}
+
+	return append(data, body...)
+}
+
+func appendString(data []byte, s string) []byte {
+	return appendBytes(data, []byte(s))
+}
+
+func appendBytes(data []byte, b []byte) []byte {
+	data = binary.BigEndian.AppendUint16(data, uint16(len(b)))
+	return append(data, b...)
+}
+
+func readUint16(data []byte) (uint16, []byte, error) {
+	if len(data) < 2 {
+		return 0, nil, ErrMalformedPacket
+	}
+
+	return binary.BigEndian.Uint16(data), data[2:], nil
+}
+
+func readBytes(data []byte) ([]byte, []byte, error) {
+	length, data, err := readUint16(data)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(data) < int(length) {
+		return nil, nil, ErrMalformedPacket
+	}
+
+	return data[:length], data[length:], nil
+}
+
+func readString(data []byte) (string, []byte, error) {
+	b, data, err := readBytes(data)
+	if err != nil {
+		return "", nil, err
+	}
+	if utf8.Valid(b) == false {
+		return "", nil, ErrMalformedPacket
+	}
+
+	return string(b), data, nil
+}
+
+/**
+ * CONNECT 패킷
+ */
+type connectPacket struct {
+	protocol  string
+	level     byte
+	clean     bool
+	keepAlive uint16
+	clientId  string
+	will      *Message
+	username  string
+	hasUser   bool
+	password  []byte
+	hasPass   bool
+}
+
+func decodeConnect(body []byte) (*connectPacket, error) {
+	v := new(connectPacket)
+
+	var err error
+	if v.protocol, body, err = readString(body); err != nil {
+		return nil, err
+	}
+	if len(body) < 4 {
+		return nil, ErrMalformedPacket
+	}
+	v.level = body[0]
+	flags := body[1]
+	v.keepAlive = binary.BigEndian.Uint16(body[2:4])
+	body = body[4:]
+
+	if flags&0x01 != 0 {
+		return nil, ErrMalformedPacket
+	}
+	v.clean = flags&0x02 != 0
+
+	if v.clientId, body, err = readString(body); err != nil {
+		return nil, err
+	}
+
+	if flags&0x04 != 0 {
+		will := new(Message)
+		will.Qos = (flags >> 3) & 0x03
+		will.Retain = flags&0x20 != 0
+		if 2 < will.Qos {
+			return nil, ErrMalformedPacket
+		}
+		if will.Topic, body, err = readString(body); err != nil {
+			return nil, err
+		}
+		payload, rest, err := readBytes(body)
+		if err != nil {
+			return nil, err
+		}
+		will.Payload = append([]byte{}, payload...)
+		body = rest
+		v.will = will
+	} else if flags&0x38 != 0 {
+		return nil, ErrMalformedPacket
+	}
+
+	if flags&0x80 != 0 {
+		if v.username, body, err = readString(body); err != nil {
+			return nil, err
+		}
+		v.hasUser = true
+	}
+	if flags&0x40 != 0 {
+		password, _, err := readBytes(body)
+		if err != nil {
+			return nil, err
+		}
+		v.password = append([]byte{}, password...)
+		v.hasPass = true
+	}
+
+	return v, nil
+}
+
+func encodeConnack(sessionPresent bool, code byte) []byte {
+	body := []byte{0x00, code}
+	if sessionPresent {
+		body[0] = 0x01
+	}
+
+	return encodePacket(CONNACK, 0, body)
+}
+
+func decodePublish(p *packet) (*Message, uint16, error) {
+	msg := new(Message)
+	msg.Qos = (p.flags >> 1) & 0x03
+	msg.Retain = p.flags&0x01 != 0
+	if 2 < msg.Qos {
+		return nil, 0, ErrMalformedPacket
+	}
+
+	body := p.body
+	var err error
+	if msg.Topic, body, err = readString(body); err != nil {
+		return nil, 0, err
+	}
+
+	var id uint16 = 0
+	if 0 < msg.Qos {
+		if id, body, err = readUint16(body); err != nil {
+			return nil, 0, err
+		}
+		if id == 0 {
+			return nil, 0, ErrMalformedPacket
+		}
+	}
+	msg.Payload = body
+
+	return msg, id, nil
+}
+
+func encodePublish(topic string, payload []byte, qos byte, retain bool, dup bool, id uint16) []byte {
+	flags := qos << 1
+	if retain {
+		flags |= 0x01
+	}
+	if dup {
+		flags |= 0x08
+	}
+
+	body := make([]byte, 0, 2+len(topic)+2+len(payload))
+	body = appendString(body, topic)
+	if 0 < qos {
+		body = binary.BigEndian.AppendUint16(body, id)
+	}
+	body = append(body, payload...)
+
+	return encodePacket(PUBLISH, flags, body)
+}
+
+func encodeAck(kind byte, id uint16) []byte {
+	flags := byte(0)
+	if kind == PUBREL {
+		flags = 0x02
+	}
+
+	return encodePacket(kind, flags, binary.BigEndian.AppendUint16(nil, id))
+}
+
+type subscription struct {
+	filter string
+	qos    byte
+}
+
+func decodeSubscribe(body []byte) (uint16, []subscription, error) {
+	id, body, err := readUint16(body)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	subs := []subscription{}
+	for 0 < len(body) {
+		var filter string
+		if filter, body, err = readString(body); err != nil {
+			return 0, nil, err
+		}
+		if len(body) < 1 || body[0]&0xFC != 0 {
+			return 0, nil, ErrMalformedPacket
+		}
+		subs = append(subs, subscription{filter: filter, qos: body[0]})
+		body = body[1:]
+	}
+	if len(subs) == 0 {
+		return 0, nil, ErrMalformedPacket
+	}
+
+	return id, subs, nil
+}
+
+func decodeUnsubscribe(body []byte) (uint16, []string, error) {
+	id, body, err := readUint16(body)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	filters := []string{}
+	for 0 < len(body) {
+		var filter string
+		if filter, body, err = readString(body); err != nil {
+			return 0, nil, err
+		}
+		filters = append(filters, filter)
+	}
+	if len(filters) == 0 {
+		return 0, nil, ErrMalformedPacket
+	}
+
+	return id, filters, nil
+}
+
+func encodeSuback(id uint16, codes []byte) []byte {
+	body := binary.BigEndian.AppendUint16(nil, id)
+	return encodePacket(SUBACK, 0, append(body, codes...))
+}
+
+func packetName(kind byte) string {
+	names := []string{"", "CONNECT", "CONNACK", "PUBLISH", "PUBACK", "PUBREC", "PUBREL", "PUBCOMP",
+		"SUBSCRIBE", "SUBACK", "UNSUBSCRIBE", "UNSUBACK", "PINGREQ", "PINGRESP", "DISCONNECT"}
+	if 0 < kind && int(kind) < len(names) {
+		return names[kind]
+	}
+
+	return fmt.Sprintf("packet(%d)", kind)
+}
@@ -0,0 +1,192 @@
+package mqttbroker
+
+import (
+	"sync"
+)
+
+/**
+ * 클라이언트 세션: 구독, 응답을 기다리는 QoS 1 메시지, 오프라인 동안 받은 QoS 1 메시지
+ * clean session 이 아니면 연결이 끊어져도 유지한다.
+ */
+type session struct {
+	sync.Mutex
+	clientId string
+	clean    bool
+	size     int
+	client   *client
+	subs     map[string]byte
+	inflight map[uint16]*Message
+	order    []uint16
+	queue    []*Message
+	nextId   uint16
+}
+
+func newSession(clientId string, clean bool, size int) *session {
+	v := new(session)
+	v.clientId = clientId
+	v.clean = clean
+	v.size = size
+	v.subs = make(map[string]byte)
+	v.inflight = make(map[uint16]*Message)
+
+	return v
+}
+
+/**
+ * 클라이언트를 연결하고 connack 을 보낸 뒤, 응답을 받지 못한 메시지와 대기 메시지를 보낸다.
+ * 이전에 연결되어 있던 클라이언트를 반환한다.
+ */
+func (v *session) takeover(c *client, connack []byte) *client {
+	v.Lock()
+	defer v.Unlock()
+
+	previous := v.client
+	v.client = c
+	c.send(connack)
+
+	for _, id := range v.order {
+		msg := v.inflight[id]
+		c.send(encodePublish(msg.Topic, msg.Payload, msg.Qos, msg.Retain, true, id))
+	}
+
+	queue := v.queue
+	v.queue = nil
+	for _, msg := range queue {
+		v.send(msg, msg.Qos)
+	}
+
+	if previous == c {
+		return nil
+	}
+	return previous
+}
+
+/**
+ * c 가 현재 클라이언트이면 연결을 해제하고 true 를 반환한다.
+ */
+func (v *session) detach(c *client) bool {
+	v.Lock()
+	defer v.Unlock()
+
+	if v.client != c {
+		return false
+	}
+	v.client = nil
+
+	return true
+}
+
+func (v *session) current() *client {
+	v.Lock()
+	defer v.Unlock()
+
+	return v.client
+}
+
+func (v *session) subscribe(filter string, qos byte) {
+	v.Lock()
+	defer v.Unlock()
+
+	v.subs[filter] = qos
+}
+
+func (v *session) unsubscribe(filter string) {
+	v.Lock()
+	defer v.Unlock()
+
+	delete(v.subs, filter)
+}
+
+/**
+ * topic 에 맞는 구독 중 가장 높은 QoS
+ */
+func (v *session) match(topic string) (byte, bool) {
+	v.Lock()
+	defer v.Unlock()
+
+	matched := false
+	max := byte(0)
+	for filter, qos := range v.subs {
+		if MatchTopic(filter, topic) {
+			matched = true
+			if max < qos {
+				max = qos
+			}
+		}
+	}
+
+	return max, matched
+}
+
+func (v *session) packetId() uint16 {
+	for {
+		v.nextId++
+		if v.nextId == 0 {
+			continue
+		}
+		if _, ok := v.inflight[v.nextId]; ok == false {
+			return v.nextId
+		}
+	}
+}
+
+/**
+ * 세션에 메시지를 전달한다. 버리면 false 를 반환한다.
+ */
+func (v *session) deliver(msg *Message, qos byte) bool {
+	v.Lock()
+	defer v.Unlock()
+
+	return v.send(msg, qos)
+}
+
+func (v *session) send(msg *Message, qos byte) bool {
+	if v.client == nil {
+		// 오프라인: QoS 1 메시지만 보관한다. 가득 차면 오래된 것부터 버린다.
+		if qos == 0 || v.clean {
+			return false
+		}
+		copied := *msg
+		copied.Qos = qos
+		v.queue = append(v.queue, &copied)
+		if v.size < len(v.queue) {
+			v.queue = v.queue[1:]
+			return false
+		}
+		return true
+	}
+
+	if qos == 0 {
+		return v.client.send(encodePublish(msg.Topic, msg.Payload, 0, msg.Retain, false, 0))
+	}
+
+	if v.size <= len(v.inflight) {
+		return false
+	}
+	copied := *msg
+	copied.Qos = qos
+	id := v.packetId()
+	v.inflight[id] = &copied
+	v.order = append(v.order, id)
+
+	return v.client.send(encodePublish(copied.Topic, copied.Payload, qos, copied.Retain, false, id))
+}
+
+/**
+ * PUBACK 을 받은 메시지를 지운다.
+ */
+func (v *session) ack(id uint16) {
+	v.Lock()
+	defer v.Unlock()
+
+	if _, ok := v.inflight[id]; ok == false {
+		return
+	}
+	delete(v.inflight, id)
+	for i, pending := range v.order {
+		if pending == id {
+			v.order = append(v.order[:i], v.order[i+1:]...)
+			break
+		}
+	}
+}
@@ -0,0 +1,276 @@
+package relay
+
+import (
+	"errors"
+	"fmt"
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+	"github.com/industry-netsecurity-solution/ins-security-channel/ins"
+	"github.com/industry-netsecurity-solution/ins-security-channel/ins/acl"
+	"github.com/industry-netsecurity-solution/ins-security-channel/logger"
+	"github.com/industry-netsecurity-solution/ins-security-channel/shared"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 브리지의 TCP 연결 수
+var DefaultBridgePoolSize = 2
+
+// 브리지 시작 시 MQTT 연결 대기 시간
+var BridgeConnectTimeout = 10 * time.Second
+
+/**
+ * TCP 로 받은 TLV 메시지를 MQTT 로 발행하는 브리지 (PublishConfigurations)
+ *
+ * METHOD_MQTT 메시지는 Dispatcher 가 만든 토픽으로 발행하고,
+ * METHOD_SOCKET 메시지는 Remote 를 지정했을 때 Remote 로 보낸다.
+ */
+type PublishBridge struct {
+	config     ins.PublishConfigurations
+	client     *ins.MQTTClient
+	socket     *ins.PooledRelay
+	dispatcher *Dispatcher
+	relay      *MessageRelay
+	server     *ins.Server
+	once       sync.Once
+}
+
+func NewPublishBridge(config *ins.PublishConfigurations) (*PublishBridge, error) {
+	if config == nil {
+		return nil, errors.New("PublishConfigurations is nil")
+	}
+
+	v := new(PublishBridge)
+	v.config = *config
+
+	var err error
+	if v.client, err = ins.NewMQTTClient(&config.MQTT); err != nil {
+		return nil, err
+	}
+
+	var socket ins.DataRelay = nil
+	if 0 < len(config.Remote.Address) {
+		if v.socket, err = ins.NewPooledRelay(&config.Remote, DefaultBridgePoolSize); err != nil {
+			v.client.Close()
+			return nil, err
+		}
+		socket = v.socket
+	}
+
+	if v.dispatcher, err = NewDispatcher(&ins.DispatchConfigurations{GatewayId: config.SourceId, GatewayType: config.GatewayType}, &config.MQTT, socket, nil); err != nil {
+		v.Close()
+		return nil, err
+	}
+	v.dispatcher.SetPublisher(v.client)
+
+	if v.relay, err = NewMessageRelay(&ins.MessageRelayConfigurations{}, v.dispatcher); err != nil {
+		v.Close()
+		return nil, err
+	}
+
+	v.server = ins.NewServer(&config.Service, nil, v.relay.Serve)
+
+	return v, nil
+}
+
+/**
+ * 화이트리스트를 지정한다. nil 이면 확인하지 않는다.
+ */
+func (v *PublishBridge) SetWhitelist(whiteGateway, whiteDevice shared.ConcurrentMap) {
+	v.relay.SetWhitelist(whiteGateway, whiteDevice)
+}
+
+/**
+ * 토픽 접근 규칙을 지정한다. 게이트웨이(클라이언트 인증서 CN)가
+ * 발행할 수 없는 토픽의 메시지는 보내지 않는다. 클라이언트 인증서가 없는 연결은 빈 identity 로 확인한다.
+ */
+func (v *PublishBridge) SetACL(rules *acl.TopicACL) {
+	v.dispatcher.SetACL(rules)
+}
+
+/**
+ * broker 에 연결하고 서비스를 시작한다.
+ * broker 에 연결되지 않아도 시작하며, 연결은 백그라운드에서 재시도한다.
+ */
+func (v *PublishBridge) Start() error {
+	if err := v.client.Connect(BridgeConnectTimeout); err != nil {
+		logger.Warningf("publish bridge: %v", err)
+	}
+
+	return v.server.Start()
+}
+
+func (v *PublishBridge) Server() *ins.Server {
+	return v.server
+}
+
+/**
+ * 진단 출력용 문자열
+ */
+func (v *PublishBridge) Diagnostics() []string {
+	strings := []string{}
+	strings = append(strings, fmt.Sprintf("Connections: %d", v.server.Count()))
+	strings = append(strings, v.relay.Diagnostics()...)
+	strings = append(strings, v.dispatcher.Diagnostics()...)
+	strings = append(strings, v.client.Diagnostics()...)
+	if v.socket != nil {
+		strings = append(strings, v.socket.Diagnostics()...)
+	}
+
+	return strings
+}
+
+func (v *PublishBridge) Close() error {
+	v.once.Do(func() {
+		if v.server != nil {
+			v.server.Close()
+		}
+		if v.socket != nil {
+			v.socket.Close()
+		}
+		v.client.Close()
+	})
+
+	return nil
+}
+
+/**
+ * MQTT 토픽을 구독하여 받은 TLV 메시지를 Remote 로 보내는 브리지 (SubscribeConfigurations)
+ *
+ * Topics 를 지정하지 않으면 "Prefix/#" 을 구독한다.
+ * payload 가 TLV 메시지 하나가 아니면 버린다.
+ * 발행한 게이트웨이의 토픽 접근 규칙은 broker 에서 확인한다. (mqttbroker.Broker.SetACL)
+ */
+type SubscribeBridge struct {
+	config   ins.SubscribeConfigurations
+	topics   []string
+	client   *ins.MQTTClient
+	socket   *ins.PooledRelay
+	relay    *MessageRelay
+	acl      *acl.TopicACL
+	received int64
+	invalid  int64
+	denied   int64
+	failed   int64
+	once     sync.Once
+}
+
+func NewSubscribeBridge(config *ins.SubscribeConfigurations) (*SubscribeBridge, error) {
+	if config == nil {
+		return nil, errors.New("SubscribeConfigurations is nil")
+	}
+	if len(config.Remote.Address) == 0 {
+		return nil, errors.New("remote address is empty")
+	}
+
+	v := new(SubscribeBridge)
+	v.config = *config
+	v.topics = config.Topics
+	if len(v.topics) == 0 {
+		prefix := strings.Trim(config.MQTT.Prefix, "/")
+		if len(prefix) == 0 {
+			v.topics = []string{"#"}
+		} else {
+			v.topics = []string{prefix + "/#"}
+		}
+	}
+
+	var err error
+	if v.client, err = ins.NewMQTTClient(&config.MQTT); err != nil {
+		return nil, err
+	}
+	if v.socket, err = ins.NewPooledRelay(&config.Remote, DefaultBridgePoolSize); err != nil {
+		v.client.Close()
+		return nil, err
+	}
+	if v.relay, err = NewMessageRelay(&ins.MessageRelayConfigurations{}, v.socket); err != nil {
+		v.Close()
+		return nil, err
+	}
+
+	return v, nil
+}
+
+/**
+ * 화이트리스트를 지정한다. nil 이면 확인하지 않는다.
+ */
+func (v *SubscribeBridge) SetWhitelist(whiteGateway, whiteDevice shared.ConcurrentMap) {
+	v.relay.SetWhitelist(whiteGateway, whiteDevice)
+}
+
+/**
+ * 토픽 접근 규칙을 지정한다. 빈 identity 로 발행할 수 없는 토픽으로 온 메시지는 버린다.
+ *
+ * Deprecated: 발행한 게이트웨이는 payload 로 확인할 수 없으므로 게이트웨이별 규칙은 적용되지 않는다.
+ * broker 에서 확인한다. (mqttbroker.Broker.SetACL)
+ */
+func (v *SubscribeBridge) SetACL(rules *acl.TopicACL) {
+	v.acl = rules
+}
+
+func (v *SubscribeBridge) onMessage(client MQTT.Client, message MQTT.Message) {
+	atomic.AddInt64(&v.received, 1)
+
+	if v.acl != nil && v.acl.Check("", acl.ACTION_PUBLISH, message.Topic(), "") == false {
+		atomic.AddInt64(&v.denied, 1)
+		return
+	}
+
+	err := v.relay.ProcessData(message.Payload(), nil)
+	if err == nil {
+		return
+	}
+
+	if errors.Is(err, ins.ErrInvalidDatagram) || errors.Is(err, ins.ErrMessageTooLarge) {
+		atomic.AddInt64(&v.invalid, 1)
+	} else {
+		atomic.AddInt64(&v.failed, 1)
+	}
+	logger.Warningf("subscribe bridge: %s: %v", message.Topic(), err)
+}
+
+/**
+ * 구독을 등록하고 broker 에 연결한다.
+ * broker 에 연결되지 않아도 시작하며, 연결되면 구독한다.
+ */
+func (v *SubscribeBridge) Start() error {
+	for _, topic := range v.topics {
+		if err := v.client.Subscribe(topic, byte(v.config.MQTT.Qos), v.onMessage); err != nil {
+			return err
+		}
+	}
+
+	if err := v.client.Connect(BridgeConnectTimeout); err != nil {
+		logger.Warningf("subscribe bridge: %v", err)
+	}
+
+	return nil
+}
+
+/**
+ * 진단 출력용 문자열
+ */
+func (v *SubscribeBridge) Diagnostics() []string {
+	strings := []string{}
+	strings = append(strings, fmt.Sprintf("Received: %d", atomic.LoadInt64(&v.received)))
+	strings = append(strings, fmt.Sprintf("Invalid: %d", atomic.LoadInt64(&v.invalid)))
+	strings = append(strings, fmt.Sprintf("Denied: %d", atomic.LoadInt64(&v.denied)))
+	strings = append(strings, fmt.Sprintf("Failed: %d", atomic.LoadInt64(&v.failed)))
+	strings = append(strings, v.relay.Diagnostics()...)
+	strings = append(strings, v.client.Diagnostics()...)
+	strings = append(strings, v.socket.Diagnostics()...)
+
+	return strings
+}
+
+func (v *SubscribeBridge) Close() error {
+	v.once.Do(func() {
+		v.client.Close()
+		if v.socket != nil {
+			v.socket.Close()
+		}
+	})
+
+	return nil
+}
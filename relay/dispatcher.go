@@ -0,0 +1,251 @@
+package relay
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+	"github.com/industry-netsecurity-solution/ins-security-channel/ins"
+	"github.com/industry-netsecurity-solution/ins-security-channel/ins/acl"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// MQTT 발행 완료 대기 시간
+var DispatchPublishTimeout = 10 * time.Second
+
+const (
+	DISPATCH_SOCKET = "socket"
+	DISPATCH_MQTT   = "mqtt"
+	DISPATCH_DROP   = "drop"
+)
+
+var ErrNoSocketRelay = errors.New("socket relay is not configured")
+var ErrNoMQTTClient = errors.New("MQTT client is not configured")
+
+/**
+ * MQTT 발행 (ins.MQTTClient 등)
+ */
+type Publisher interface {
+	Publish(topic string, qos byte, retain bool, payload []byte) error
+}
+
+/**
+ * 메시지를 GetTransmissionMethod 로 분류하여 소켓(DataRelay) 또는 MQTT 로 보내는 DataRelay
+ *
+ * MQTT 토픽은 "Prefix/게이트웨이 ID/메시지 이름" 이다. (GatewayType 을 지정하면 ins.TopicBuilder)
+ * 메시지 종류별 경로(DispatchRouteConfigurations)로 전송 방법과 토픽을 바꿀 수 있다.
+ */
+type Dispatcher struct {
+	config     ins.DispatchConfigurations
+	mqttConfig ins.MQTTConfigurations
+	order      binary.ByteOrder
+	socket     ins.DataRelay
+	client     MQTT.Client
+	publisher  Publisher
+	builder    *ins.TopicBuilder
+	acl        *acl.TopicACL
+	routes     map[string]ins.DispatchRouteConfigurations
+	socketSent int64
+	mqttSent   int64
+	dropped    int64
+	denied     int64
+	failed     int64
+}
+
+/**
+ * socket, client 중 사용하지 않는 것은 nil 로 지정한다.
+ * client 가 nil 이면 SetPublisher 로 발행 방법을 지정할 수 있다.
+ */
+func NewDispatcher(config *ins.DispatchConfigurations, mqttConfig *ins.MQTTConfigurations, socket ins.DataRelay, client MQTT.Client) (*Dispatcher, error) {
+	if config == nil {
+		return nil, errors.New("DispatchConfigurations is nil")
+	}
+
+	v := new(Dispatcher)
+	v.config = *config
+	if mqttConfig != nil {
+		v.mqttConfig = *mqttConfig
+	}
+	v.order = binary.LittleEndian
+	v.socket = socket
+	v.client = client
+	v.routes = make(map[string]ins.DispatchRouteConfigurations)
+	if config.GatewayType != 0 {
+		v.builder = ins.NewTopicBuilder(v.mqttConfig.Prefix, byte(config.GatewayType), config.GatewayId)
+	}
+
+	for _, route := range config.Routes {
+		switch route.Method {
+		case "", DISPATCH_SOCKET, DISPATCH_MQTT, DISPATCH_DROP:
+		default:
+			return nil, fmt.Errorf("unknown dispatch method: %s", route.Method)
+		}
+		v.routes[route.Type] = route
+	}
+
+	return v, nil
+}
+
+/**
+ * 메시지를 보낼 방법(DISPATCH_*)과 MQTT 토픽
+ */
+func (v *Dispatcher) Classify(data []byte) (string, string, error) {
+	mesgType := ins.GetMessageType(v.order, data)
+
+	method := ""
+	topic := ""
+	if route, ok := v.routes[mesgType]; ok {
+		method = route.Method
+		topic = route.Topic
+	}
+
+	if len(method) == 0 {
+		switch ins.GetTransmissionMethod(v.order, data) {
+		case ins.METHOD_SOCKET:
+			method = DISPATCH_SOCKET
+		case ins.METHOD_MQTT:
+			method = DISPATCH_MQTT
+		default:
+			return "", "", fmt.Errorf("unknown transmission method: %s", mesgType)
+		}
+	}
+
+	if method == DISPATCH_MQTT && len(topic) == 0 {
+		topic = v.Topic(data)
+	}
+
+	return method, topic, nil
+}
+
+/**
+ * 기본 MQTT 토픽: Prefix/게이트웨이 ID/메시지 이름
+ * GatewayType 을 지정하면 Prefix/현장 종류/게이트웨이 종류/게이트웨이 ID/메시지 이름 (ins.TopicBuilder)
+ * 게이트웨이 ID 를 지정하지 않았으면 메시지의 송신 ID 를 사용한다.
+ */
+func (v *Dispatcher) Topic(data []byte) string {
+	gatewayId := v.config.GatewayId
+	if len(gatewayId) == 0 {
+		if ids := gatewayIds(v.order, data, 4); 0 < len(ids) {
+			gatewayId = ids[0]
+		}
+	}
+
+	if v.builder != nil {
+		return v.builder.Topic(v.order, data, gatewayId)
+	}
+
+	parts := []string{}
+	for _, part := range []string{strings.Trim(v.mqttConfig.Prefix, "/"), gatewayId, ins.GetMessageName(v.order, data)} {
+		if 0 < len(part) {
+			parts = append(parts, part)
+		}
+	}
+
+	return strings.Join(parts, "/")
+}
+
+/**
+ * MQTT 발행에 client 대신 publisher 를 사용한다.
+ */
+func (v *Dispatcher) SetPublisher(publisher Publisher) {
+	v.publisher = publisher
+}
+
+/**
+ * 토픽 접근 규칙을 지정한다. 메시지를 보낸 연결의 게이트웨이(DoSend 의 identity)가
+ * 발행할 수 없는 토픽이면 보내지 않는다. 메시지 안의 송신 ID 는 사용하지 않는다.
+ * identity 를 모르는 연결(클라이언트 인증서 없음)은 빈 identity 로 확인하므로 모든 게이트웨이에 적용되는 규칙만 맞는다.
+ */
+func (v *Dispatcher) SetACL(rules *acl.TopicACL) {
+	v.acl = rules
+}
+
+func (v *Dispatcher) identity(args []interface{}) string {
+	if 1 < len(args) {
+		if identity, ok := args[1].(string); ok {
+			return identity
+		}
+	}
+	return ""
+}
+
+func (v *Dispatcher) publish(topic string, data []byte) error {
+	if v.publisher != nil {
+		return v.publisher.Publish(topic, byte(v.mqttConfig.Qos), false, data)
+	}
+	if v.client == nil {
+		return ErrNoMQTTClient
+	}
+
+	token := v.client.Publish(topic, byte(v.mqttConfig.Qos), false, data)
+	if token.WaitTimeout(DispatchPublishTimeout) == false {
+		return fmt.Errorf("publish to %s timed out", topic)
+	}
+
+	return token.Error()
+}
+
+/**
+ * 메시지를 분류하여 전송한다. 보낸 바이트 수를 반환한다.
+ * args[0] 은 메시지, args[1] 은 송신 게이트웨이(MessageRelay.Process 의 identity)이다.
+ */
+func (v *Dispatcher) DoSend(args ...interface{}) (interface{}, error) {
+	if len(args) == 0 {
+		return 0, errors.New("no data")
+	}
+	data, ok := args[0].([]byte)
+	if ok == false {
+		return 0, errors.New("data is not []byte")
+	}
+
+	method, topic, err := v.Classify(data)
+	if err != nil {
+		atomic.AddInt64(&v.failed, 1)
+		return 0, err
+	}
+
+	switch method {
+	case DISPATCH_DROP:
+		atomic.AddInt64(&v.dropped, 1)
+		return 0, nil
+	case DISPATCH_MQTT:
+		if v.acl != nil && v.acl.Check(v.identity(args), acl.ACTION_PUBLISH, topic, "") == false {
+			atomic.AddInt64(&v.denied, 1)
+			return 0, acl.ErrTopicDenied
+		}
+		if err = v.publish(topic, data); err != nil {
+			atomic.AddInt64(&v.failed, 1)
+			return 0, err
+		}
+		atomic.AddInt64(&v.mqttSent, 1)
+		return len(data), nil
+	}
+
+	if v.socket == nil {
+		atomic.AddInt64(&v.failed, 1)
+		return 0, ErrNoSocketRelay
+	}
+	if _, err = v.socket.DoSend(data); err != nil {
+		atomic.AddInt64(&v.failed, 1)
+		return 0, err
+	}
+	atomic.AddInt64(&v.socketSent, 1)
+
+	return len(data), nil
+}
+
+/**
+ * 진단 출력용 문자열
+ */
+func (v *Dispatcher) Diagnostics() []string {
+	strings := []string{}
+	strings = append(strings, fmt.Sprintf("Socket: %d", atomic.LoadInt64(&v.socketSent)))
+	strings = append(strings, fmt.Sprintf("MQTT: %d", atomic.LoadInt64(&v.mqttSent)))
+	strings = append(strings, fmt.Sprintf("Dropped: %d", atomic.LoadInt64(&v.dropped)))
+	strings = append(strings, fmt.Sprintf("Denied: %d", atomic.LoadInt64(&v.denied)))
+	strings = append(strings, fmt.Sprintf("Failed: %d", atomic.LoadInt64(&v.failed)))
+
+	return strings
+}
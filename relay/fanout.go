@@ -0,0 +1,334 @@
+package relay
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/industry-netsecurity-solution/ins-security-channel/ins"
+	"github.com/industry-netsecurity-solution/ins-security-channel/logger"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// 목적지별 대기열 크기 기본값
+var DefaultFanoutQueueSize int64 = 1024
+
+/**
+ * 목적지별 처리 건수
+ */
+type DestinationCounter struct {
+	Queued  int64
+	Sent    int64
+	Failed  int64
+	Dropped int64
+	Pending int64
+}
+
+func (v DestinationCounter) ToString() string {
+	return fmt.Sprintf("queued %d, sent %d, failed %d, dropped %d, pending %d",
+		v.Queued, v.Sent, v.Failed, v.Dropped, v.Pending)
+}
+
+type destination struct {
+	name    string
+	relay   ins.DataRelay
+	queue   chan []byte
+	counter DestinationCounter
+}
+
+/**
+ * 경로 규칙에 따라 메시지를 여러 목적지로 보내는 DataRelay
+ *
+ * 목적지마다 대기열과 전송 goroutine 을 따로 두므로 느린 목적지가 다른 목적지를 막지 않는다.
+ * 대기열이 가득 차면 해당 목적지로 가는 메시지는 버린다.
+ */
+type FanoutRelay struct {
+	sync.RWMutex
+	config       ins.FanoutConfigurations
+	order        binary.ByteOrder
+	destinations map[string]*destination
+	unrouted     int64
+	stop         chan struct{}
+	once         sync.Once
+	wg           sync.WaitGroup
+}
+
+func NewFanoutRelay(config *ins.FanoutConfigurations) (*FanoutRelay, error) {
+	if config == nil {
+		return nil, errors.New("FanoutConfigurations is nil")
+	}
+
+	v := new(FanoutRelay)
+	v.config = *config
+	v.order = binary.LittleEndian
+	v.destinations = make(map[string]*destination)
+	v.stop = make(chan struct{})
+
+	return v, nil
+}
+
+/**
+ * 목적지를 등록한다. 규칙의 Destinations 에 name 으로 지정한다.
+ */
+func (v *FanoutRelay) AddDestination(name string, relay ins.DataRelay) error {
+	if relay == nil {
+		return errors.New("relay is nil")
+	}
+
+	size := v.config.QueueSize
+	if size <= 0 {
+		size = DefaultFanoutQueueSize
+	}
+
+	v.Lock()
+	defer v.Unlock()
+
+	if _, ok := v.destinations[name]; ok {
+		return fmt.Errorf("destination %s already exists", name)
+	}
+
+	dest := &destination{
+		name:  name,
+		relay: relay,
+		queue: make(chan []byte, size),
+	}
+	v.destinations[name] = dest
+
+	v.wg.Add(1)
+	go v.deliver(dest)
+
+	return nil
+}
+
+func (v *FanoutRelay) deliver(dest *destination) {
+	defer v.wg.Done()
+
+	for {
+		select {
+		case <-v.stop:
+			return
+		case data := <-dest.queue:
+			if _, err := dest.relay.DoSend(data); err != nil {
+				atomic.AddInt64(&dest.counter.Failed, 1)
+				logger.Warningf("relay to %s failed: %v", dest.name, err)
+				continue
+			}
+			atomic.AddInt64(&dest.counter.Sent, 1)
+		}
+	}
+}
+
+func vendorName(data []byte) string {
+	if bytes.HasPrefix(data, ins.CODE_WRAPPED) {
+		return ins.TYPE_CODE_WRAPPED
+	} else if bytes.HasPrefix(data, ins.CODE_ELSSEN) {
+		return ins.TYPE_CODE_ELSSEN
+	} else if bytes.HasPrefix(data, ins.CODE_YMTECH) {
+		return ins.TYPE_CODE_YMTECH
+	} else if bytes.HasPrefix(data, ins.CODE_TELEFIELD) {
+		return ins.TYPE_CODE_TELEFIELD
+	} else if bytes.HasPrefix(data, ins.CODE_ABRAIN) {
+		return ins.TYPE_CODE_ABRAIN
+	}
+
+	return ins.TYPE_UNKNOWN
+}
+
+/**
+ * 메시지에 포함된 게이트웨이 ID (0x0000 송신 ID, 0x8001 중계 GW ID)
+ */
+func gatewayIds(order binary.ByteOrder, data []byte, depth int) []string {
+	results := []string{}
+	if depth <= 0 {
+		return results
+	}
+
+	offset := 0
+	for offset+6 <= len(data) {
+		// 길이가 남은 데이터보다 크면 TLV 가 아니다. (DecTL32V 는 길이를 확인하지 않는다.)
+		if uint64(len(data)-offset-6) < uint64(order.Uint32(data[offset+2:])) {
+			break
+		}
+		tl32v, err := ins.DecTL32V(order, data[offset:])
+		if err != nil {
+			break
+		}
+		offset += tl32v.Size()
+
+		if bytes.Equal(tl32v.Type, ins.BBx0000) || bytes.Equal(tl32v.Type, []byte{0x80, 0x01}) {
+			if 0 < len(tl32v.Value) {
+				results = append(results, string(tl32v.Value))
+			}
+			continue
+		}
+
+		results = append(results, gatewayIds(order, tl32v.Value, depth-1)...)
+	}
+
+	return results
+}
+
+func matchAny(values []string, candidates ...string) bool {
+	if len(values) == 0 {
+		return true
+	}
+
+	for _, value := range values {
+		for _, candidate := range candidates {
+			if value == candidate {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+/**
+ * 메시지를 보낼 목적지 이름 목록
+ */
+func (v *FanoutRelay) Route(data []byte) []string {
+	mesgType := ins.GetMessageType(v.order, data)
+	vendor := vendorName(data)
+
+	var gateways []string = nil
+	names := []string{}
+	seen := make(map[string]bool)
+
+	for _, route := range v.config.Routes {
+		if matchAny(route.Types, mesgType) == false {
+			continue
+		}
+		if matchAny(route.Vendors, vendor) == false {
+			continue
+		}
+		if 0 < len(route.Gateways) {
+			if gateways == nil {
+				gateways = gatewayIds(v.order, data, 4)
+			}
+			if matchAny(route.Gateways, gateways...) == false {
+				continue
+			}
+		}
+
+		for _, name := range route.Destinations {
+			if seen[name] == false {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+	}
+
+	if len(names) == 0 {
+		return v.config.Default
+	}
+
+	return names
+}
+
+/**
+ * 경로 규칙에 맞는 목적지 대기열에 메시지를 넣는다.
+ * 하나 이상의 대기열에 들어가면 성공이다.
+ */
+func (v *FanoutRelay) DoSend(args ...interface{}) (interface{}, error) {
+	if len(args) == 0 {
+		return 0, errors.New("no data")
+	}
+	data, ok := args[0].([]byte)
+	if ok == false {
+		return 0, errors.New("data is not []byte")
+	}
+
+	select {
+	case <-v.stop:
+		return 0, ins.ErrRelayClosed
+	default:
+	}
+
+	names := v.Route(data)
+	if len(names) == 0 {
+		atomic.AddInt64(&v.unrouted, 1)
+		return 0, errors.New("no route for message")
+	}
+
+	v.RLock()
+	defer v.RUnlock()
+
+	queued := 0
+	for _, name := range names {
+		dest, ok := v.destinations[name]
+		if ok == false {
+			logger.Warningf("unknown relay destination: %s", name)
+			continue
+		}
+
+		select {
+		case dest.queue <- data:
+			atomic.AddInt64(&dest.counter.Queued, 1)
+			queued++
+		default:
+			atomic.AddInt64(&dest.counter.Dropped, 1)
+		}
+	}
+
+	if queued == 0 {
+		return 0, errors.New("all destination queues are full")
+	}
+
+	return len(data), nil
+}
+
+/**
+ * 목적지별 처리 건수
+ */
+func (v *FanoutRelay) Counters() map[string]DestinationCounter {
+	v.RLock()
+	defer v.RUnlock()
+
+	results := make(map[string]DestinationCounter, len(v.destinations))
+	for name, dest := range v.destinations {
+		results[name] = DestinationCounter{
+			Queued:  atomic.LoadInt64(&dest.counter.Queued),
+			Sent:    atomic.LoadInt64(&dest.counter.Sent),
+			Failed:  atomic.LoadInt64(&dest.counter.Failed),
+			Dropped: atomic.LoadInt64(&dest.counter.Dropped),
+			Pending: int64(len(dest.queue)),
+		}
+	}
+
+	return results
+}
+
+/**
+ * 진단 출력용 문자열
+ */
+func (v *FanoutRelay) Diagnostics() []string {
+	counters := v.Counters()
+
+	names := make([]string, 0, len(counters))
+	for name := range counters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	strings := []string{fmt.Sprintf("Unrouted: %d", atomic.LoadInt64(&v.unrouted))}
+	for _, name := range names {
+		strings = append(strings, fmt.Sprintf("%s: %s", name, counters[name].ToString()))
+	}
+
+	return strings
+}
+
+/**
+ * 전송을 멈춘다. 대기열에 남은 메시지는 버린다.
+ */
+func (v *FanoutRelay) Close() error {
+	v.once.Do(func() {
+		close(v.stop)
+		v.wg.Wait()
+	})
+
+	return nil
+}
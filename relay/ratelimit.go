@@ -0,0 +1,62 @@
+package relay
+
+import (
+	"sync"
+	"time"
+)
+
+/**
+ * 토큰 버킷 방식의 전송률 제한
+ * rate 는 초당 허용 수, burst 는 한 번에 허용할 수 있는 최대 수이다.
+ */
+type RateLimiter struct {
+	sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func NewRateLimiter(rate, burst int64) *RateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	if burst < rate {
+		burst = rate
+	}
+
+	v := new(RateLimiter)
+	v.rate = float64(rate)
+	v.burst = float64(burst)
+	v.tokens = v.burst
+	v.last = time.Now()
+
+	return v
+}
+
+/**
+ * 허용되면 토큰 하나를 사용하고 true 를 반환한다.
+ * nil 이면 항상 허용한다.
+ */
+func (v *RateLimiter) Allow() bool {
+	if v == nil {
+		return true
+	}
+
+	v.Lock()
+	defer v.Unlock()
+
+	now := time.Now()
+	v.tokens += now.Sub(v.last).Seconds() * v.rate
+	if v.burst < v.tokens {
+		v.tokens = v.burst
+	}
+	v.last = now
+
+	if v.tokens < 1 {
+		return false
+	}
+	v.tokens--
+
+	return true
+}
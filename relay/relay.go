@@ -0,0 +1,375 @@
+package relay
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/industry-netsecurity-solution/ins-security-channel/ins"
+	"github.com/industry-netsecurity-solution/ins-security-channel/ins/whitelist"
+	"github.com/industry-netsecurity-solution/ins-security-channel/insmesg"
+	"github.com/industry-netsecurity-solution/ins-security-channel/logger"
+	"github.com/industry-netsecurity-solution/ins-security-channel/shared"
+	"io"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 메시지 최대 크기 기본값
+var DefaultMaxMessageSize int64 = 64 * 1024 * 1024
+
+const (
+	ACTION_FORWARD = iota
+	ACTION_DROP
+	ACTION_DENY
+)
+
+/**
+ * 메시지 종류별 처리 건수
+ */
+type MessageCounter struct {
+	Received  int64
+	Forwarded int64
+	Denied    int64
+	Dropped   int64
+	Limited   int64
+	Failed    int64
+	Bytes     int64
+}
+
+func (v MessageCounter) ToString() string {
+	return fmt.Sprintf("received %d, forwarded %d, denied %d, dropped %d, limited %d, failed %d, bytes %d",
+		v.Received, v.Forwarded, v.Denied, v.Dropped, v.Limited, v.Failed, v.Bytes)
+}
+
+/**
+ * 사용자 정의 필터. ACTION_FORWARD 이외의 값을 반환하면 전달하지 않는다.
+ */
+type Filter func(remote net.Addr, tl32v *ins.TL32V) int
+
+/**
+ * TLV 메시지 단위로 읽어서 화이트리스트/필터/전송률 제한을 적용하고,
+ * 이 중계기의 게이트웨이 ID 와 시간을 덧붙여(MakeWrappedPacket) upstream 으로 전달한다.
+ */
+type MessageRelay struct {
+	sync.Mutex
+	config       ins.MessageRelayConfigurations
+	order        binary.ByteOrder
+	upstream     ins.DataRelay
+	whiteGateway shared.ConcurrentMap
+	whiteDevice  shared.ConcurrentMap
+	dropTypes    map[string]bool
+	filters      []Filter
+	limiter      *RateLimiter
+	counters     map[string]*MessageCounter
+}
+
+func NewMessageRelay(config *ins.MessageRelayConfigurations, upstream ins.DataRelay) (*MessageRelay, error) {
+	if config == nil {
+		return nil, errors.New("MessageRelayConfigurations is nil")
+	}
+	if upstream == nil {
+		return nil, errors.New("upstream is nil")
+	}
+
+	v := new(MessageRelay)
+	v.config = *config
+	v.order = binary.LittleEndian
+	v.upstream = upstream
+	v.dropTypes = make(map[string]bool)
+	for _, name := range config.DropTypes {
+		v.dropTypes[name] = true
+	}
+	v.limiter = NewRateLimiter(config.RateLimit, config.RateBurst)
+	v.counters = make(map[string]*MessageCounter)
+
+	return v, nil
+}
+
+/**
+ * 화이트리스트를 지정한다. nil 이면 확인하지 않는다.
+ */
+func (v *MessageRelay) SetWhitelist(whiteGateway, whiteDevice shared.ConcurrentMap) {
+	v.Lock()
+	defer v.Unlock()
+
+	v.whiteGateway = whiteGateway
+	v.whiteDevice = whiteDevice
+}
+
+func (v *MessageRelay) AddFilter(filter Filter) {
+	v.Lock()
+	defer v.Unlock()
+
+	v.filters = append(v.filters, filter)
+}
+
+func (v *MessageRelay) counter(mesgType string) *MessageCounter {
+	v.Lock()
+	defer v.Unlock()
+
+	counter, ok := v.counters[mesgType]
+	if ok == false {
+		counter = new(MessageCounter)
+		v.counters[mesgType] = counter
+	}
+
+	return counter
+}
+
+/**
+ * 메시지 종류별 처리 건수
+ */
+func (v *MessageRelay) Counters() map[string]MessageCounter {
+	v.Lock()
+	defer v.Unlock()
+
+	results := make(map[string]MessageCounter, len(v.counters))
+	for name, counter := range v.counters {
+		results[name] = MessageCounter{
+			Received:  atomic.LoadInt64(&counter.Received),
+			Forwarded: atomic.LoadInt64(&counter.Forwarded),
+			Denied:    atomic.LoadInt64(&counter.Denied),
+			Dropped:   atomic.LoadInt64(&counter.Dropped),
+			Limited:   atomic.LoadInt64(&counter.Limited),
+			Failed:    atomic.LoadInt64(&counter.Failed),
+			Bytes:     atomic.LoadInt64(&counter.Bytes),
+		}
+	}
+
+	return results
+}
+
+/**
+ * 진단 출력용 문자열
+ */
+func (v *MessageRelay) Diagnostics() []string {
+	counters := v.Counters()
+
+	names := make([]string, 0, len(counters))
+	for name := range counters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	strings := []string{}
+	for _, name := range names {
+		strings = append(strings, fmt.Sprintf("%s: %s", name, counters[name].ToString()))
+	}
+
+	return strings
+}
+
+func (v *MessageRelay) maxMessageSize() int64 {
+	if 0 < v.config.MaxMessageSize {
+		return v.config.MaxMessageSize
+	}
+	return DefaultMaxMessageSize
+}
+
+/**
+ * TLV(2 byte 타입, 4 byte 길이) 메시지 하나를 읽는다.
+ */
+func (v *MessageRelay) ReadMessage(conn net.Conn) (*ins.TL32V, error) {
+	header := make([]byte, 6)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return nil, err
+	}
+
+	length := v.order.Uint32(header[2:])
+	if v.maxMessageSize() < int64(length) {
+		return nil, ins.ErrMessageTooLarge
+	}
+
+	value := make([]byte, length)
+	if _, err := io.ReadFull(conn, value); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+
+	return &ins.TL32V{Type: header[:2], Length: length, Value: value}, nil
+}
+
+func (v *MessageRelay) isAllowed(tl32v *ins.TL32V) bool {
+	v.Lock()
+	whiteGateway := v.whiteGateway
+	whiteDevice := v.whiteDevice
+	v.Unlock()
+
+	allow, err := whitelist.IsAllowMessage(v.order, whiteGateway, whiteDevice, tl32v)
+	if err != nil {
+		logger.Warningf("whitelist check failed: %v", err)
+		return false
+	}
+
+	return allow
+}
+
+func (v *MessageRelay) filter(remote net.Addr, tl32v *ins.TL32V) int {
+	v.Lock()
+	filters := make([]Filter, len(v.filters))
+	copy(filters, v.filters)
+	v.Unlock()
+
+	for _, filter := range filters {
+		if action := filter(remote, tl32v); action != ACTION_FORWARD {
+			return action
+		}
+	}
+
+	return ACTION_FORWARD
+}
+
+/**
+ * 메시지에 이 중계기의 게이트웨이 ID, 시간, 송신 주소(WrapRemoteAddress)를 덧붙인다.
+ */
+func (v *MessageRelay) wrap(data []byte, remote net.Addr) []byte {
+	additional := ins.NewMap()
+	additional.Set(ins.MapKey([]byte{0x80, 0x01}), []byte(v.config.GatewayId))
+	additional.Set(ins.MapKey([]byte{0x80, 0x02}), uint32(time.Now().Unix()))
+
+	var wrapped *bytes.Buffer
+	if v.config.WrapRemoteAddress && remote != nil {
+		if host, _, err := net.SplitHostPort(remote.String()); err == nil {
+			additional.Set(ins.MapKey([]byte{0x80, 0x03}), []byte(host))
+		}
+		wrapped = insmesg.MakeWrappedPacketWithRemoteAddress(data, *additional)
+	} else {
+		wrapped = insmesg.MakeWrappedPacket(data, *additional)
+	}
+	if wrapped == nil {
+		// 알 수 없는 메시지는 그대로 전달한다.
+		return data
+	}
+
+	return wrapped.Bytes()
+}
+
+/**
+ * 메시지 하나에 정책을 적용하고 upstream 으로 전달한다.
+ * identity 는 연결에서 확인한 송신 게이트웨이(클라이언트 인증서 CN)이며, 모르면 빈 문자열이다.
+ * upstream 의 DoSend 두 번째 인자로 전달한다. (Dispatcher 의 토픽 접근 규칙)
+ * limiter 가 nil 이면 중계기 전체의 전송률 제한을 사용한다.
+ */
+func (v *MessageRelay) Process(tl32v *ins.TL32V, remote net.Addr, identity string, limiter *RateLimiter) error {
+	data := tl32v.Bytes(v.order)
+	mesgType := ins.GetMessageType(v.order, data)
+
+	counter := v.counter(mesgType)
+	atomic.AddInt64(&counter.Received, 1)
+
+	if v.dropTypes[mesgType] {
+		atomic.AddInt64(&counter.Dropped, 1)
+		return nil
+	}
+
+	if v.isAllowed(tl32v) == false {
+		atomic.AddInt64(&counter.Denied, 1)
+		logger.Warningf("message denied: %s from %v", mesgType, remote)
+		return nil
+	}
+
+	switch v.filter(remote, tl32v) {
+	case ACTION_DROP:
+		atomic.AddInt64(&counter.Dropped, 1)
+		return nil
+	case ACTION_DENY:
+		atomic.AddInt64(&counter.Denied, 1)
+		logger.Warningf("message denied by filter: %s from %v", mesgType, remote)
+		return nil
+	}
+
+	if limiter == nil {
+		limiter = v.limiter
+	}
+	if limiter.Allow() == false {
+		atomic.AddInt64(&counter.Limited, 1)
+		return nil
+	}
+
+	if v.config.Wrap {
+		data = v.wrap(data, remote)
+	}
+
+	if _, err := v.upstream.DoSend(data, identity); err != nil {
+		atomic.AddInt64(&counter.Failed, 1)
+		return err
+	}
+	atomic.AddInt64(&counter.Forwarded, 1)
+	atomic.AddInt64(&counter.Bytes, int64(len(data)))
+
+	return nil
+}
+
+/**
+ * 연결에서 메시지를 읽어 중계한다. StartServer, Server 의 callback 으로 사용한다.
+ * 전송률 제한은 연결마다 적용된다.
+ * TLS 연결이면 확인된 클라이언트 인증서의 CN 을 송신 게이트웨이로 사용한다.
+ * Ack 가 설정되면 메시지마다 처리한 뒤 ack 를 보내고, upstream 전달에 실패하면 ack 없이 연결을 닫는다.
+ */
+func (v *MessageRelay) Serve(conn net.Conn, ud interface{}) error {
+	limiter := NewRateLimiter(v.config.RateLimit, v.config.RateBurst)
+	if limiter == nil {
+		limiter = v.limiter
+	}
+
+	identity := ""
+	for {
+		tl32v, err := v.ReadMessage(conn)
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+
+		if len(identity) == 0 {
+			// 첫 Read 에서 handshake 가 끝난다.
+			identity = ins.PeerCommonName(conn)
+		}
+
+		if err = v.Process(tl32v, conn.RemoteAddr(), identity, limiter); err != nil {
+			logger.Errorf("relay to upstream failed: %v", err)
+			if v.config.Ack {
+				// 보낸 쪽이 ack 를 받지 못한 메시지부터 다시 보낸다.
+				return err
+			}
+			continue
+		}
+
+		if v.config.Ack {
+			if err = ins.WriteAck(conn); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+/**
+ * TLV 메시지 하나(data)를 확인하고 중계한다. remote 는 알 수 없으면 nil 이다.
+ */
+func (v *MessageRelay) ProcessData(data []byte, remote net.Addr) error {
+	if v.maxMessageSize() < int64(len(data)) {
+		return ins.ErrMessageTooLarge
+	}
+
+	tl32v, err := ins.CheckDatagramMessage(v.order, data, len(data))
+	if err != nil {
+		return err
+	}
+
+	return v.Process(tl32v, remote, "", nil)
+}
+
+/**
+ * UDP 로 받은 메시지 하나를 중계한다. ListenDatagram 의 callback 으로 사용한다.
+ * TCP 와 같은 화이트리스트/필터/전송률 제한을 적용한다.
+ */
+func (v *MessageRelay) ServeDatagram(remote net.Addr, data []byte, ud interface{}) error {
+	return v.ProcessData(data, remote)
+}
@@ -1,7 +1,6 @@
 package request
 
 import (
-	"crypto/tls"
 	"encoding/base64"
 	"errors"
 	"fmt"
@@ -9,7 +8,7 @@ import (
 	"github.com/industry-netsecurity-solution/ins-security-channel/ins"
 	"net/http"
 	"net/url"
-	"strings"
+	"sync"
 )
 
 type RequestParam struct {
@@ -53,18 +52,37 @@ type RequestURL struct {
 	url.URL
 }
 
+/**
+ * tr 을 사용해 요청한다. tr 이 nil 이면 기본 공유 클라이언트를 사용한다.
+ */
 func (v *RequestURL) DoRequest(tr *http.Transport, param *RequestParam, handler func(resp *resty.Response) error) (int, error) {
+	var client *ins.HttpClient
+	if tr == nil {
+		client = defaultHttpClient()
+	} else {
+		client = ins.NewHttpClientWithTransport(tr)
+		defer client.Close()
+	}
 
-	httpurl := (*v).String()
+	return v.Do(client, param, handler)
+}
 
-	client := resty.New()
-	if strings.EqualFold((*v).Scheme, "https") {
-		//tr := &http.Transport{
-		//	TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
-		//}
-		client.SetTransport(tr)
-	}
-	client.SetCloseConnection(true)
+var defaultClient struct {
+	sync.Once
+	client *ins.HttpClient
+}
+
+func defaultHttpClient() *ins.HttpClient {
+	defaultClient.Do(func() {
+		defaultClient.client = ins.NewHttpClientWithTransport(nil)
+	})
+
+	return defaultClient.client
+}
+
+func (v *RequestURL) Do(client *ins.HttpClient, param *RequestParam, handler func(resp *resty.Response) error) (int, error) {
+
+	httpurl := (*v).String()
 
 	req := client.R().
 		SetHeaders(param.headers).
@@ -137,20 +155,12 @@ func (v HttpRequest) DoRequest(param *RequestParam, handler func(resp *resty.Res
 		*u,
 	}
 
-	var tr *http.Transport = nil
-	if v.EnableTls {
-		if 0 < len(v.TlsCert) {
-			tr = &http.Transport{
-				TLSClientConfig: ins.NewTLSConfig(&v.CaCert, &v.TlsCert, &v.TlsKey),
-			}
-		} else {
-			tr = &http.Transport{
-				TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
-			}
-		}
+	client, err := ins.GetHttpClient(&v.HttpConfigurations)
+	if err != nil {
+		return -1, err
 	}
 
-	return r.DoRequest(tr, param, handler)
+	return r.Do(client, param, handler)
 }
 
 /*
@@ -0,0 +1,522 @@
+package request
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	resty "github.com/go-resty/resty/v2"
+	"github.com/industry-netsecurity-solution/ins-security-channel/ins"
+	"github.com/industry-netsecurity-solution/ins-security-channel/logger"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const TUS_VERSION = "1.0.0"
+
+// tus 체크섬 확장: 조각 체크섬이 다르면 받는 쪽이 반환하는 상태 코드
+const StatusChecksumMismatch = 460
+
+const DefaultUploadChunkSize int64 = 1024 * 1024
+const DefaultUploadRetries = 5
+
+var ErrUploadOffset = errors.New("upload offset mismatch")
+
+/**
+ * 파일 업로드 요청
+ */
+type UploadParam struct {
+	querypath string
+	headers   map[string]string
+	filepath  string
+	fieldname string
+	fields    map[string]string
+	metadata  map[string]string
+	chunkSize int64
+	retries   int
+	statefile string
+	progress  func(int64, int64)
+}
+
+func NewUploadParam(filepath string) *UploadParam {
+	param := new(UploadParam)
+	param.filepath = filepath
+	param.headers = make(map[string]string)
+	param.fieldname = "file"
+	param.fields = make(map[string]string)
+	param.metadata = make(map[string]string)
+	param.chunkSize = DefaultUploadChunkSize
+	param.retries = DefaultUploadRetries
+
+	return param
+}
+
+func (v *UploadParam) SetQuerypath(querypath string) {
+	v.querypath = querypath
+}
+
+func (v *UploadParam) SetHeader(key, value string) {
+	v.headers[key] = value
+}
+
+/**
+ * multipart 파일 필드 이름 (기본값: file)
+ */
+func (v *UploadParam) SetFieldname(fieldname string) {
+	v.fieldname = fieldname
+}
+
+/**
+ * multipart 폼 필드
+ */
+func (v *UploadParam) SetField(key, value string) {
+	v.fields[key] = value
+}
+
+/**
+ * 이어 올리기의 Upload-Metadata
+ */
+func (v *UploadParam) SetMetadata(key, value string) {
+	v.metadata[key] = value
+}
+
+func (v *UploadParam) SetChunkSize(chunkSize int64) {
+	v.chunkSize = chunkSize
+}
+
+/**
+ * 실패한 요청(조각)을 다시 보내는 횟수
+ */
+func (v *UploadParam) SetRetries(retries int) {
+	v.retries = retries
+}
+
+/**
+ * 이어 올리기 주소를 저장할 파일. 프로세스가 다시 시작되어도 이어서 올린다.
+ */
+func (v *UploadParam) SetStatefile(statefile string) {
+	v.statefile = statefile
+}
+
+/**
+ * 보낸 크기, 전체 크기를 받는 진행 상황 함수
+ */
+func (v *UploadParam) SetProgress(progress func(int64, int64)) {
+	v.progress = progress
+}
+
+/**
+ * 파일 크기와 SHA-256 (base64)
+ */
+func fileDigest(filepath string) (int64, string, error) {
+	file, err := os.Open(filepath)
+	if err != nil {
+		return 0, "", err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	size, err := io.Copy(hash, file)
+	if err != nil {
+		return 0, "", err
+	}
+
+	return size, base64.StdEncoding.EncodeToString(hash.Sum(nil)), nil
+}
+
+/**
+ * 읽은 크기를 진행 상황 함수에 알리는 reader
+ */
+type progressReader struct {
+	reader   io.Reader
+	sent     int64
+	total    int64
+	progress func(int64, int64)
+}
+
+func (v *progressReader) Read(p []byte) (int, error) {
+	n, err := v.reader.Read(p)
+	if 0 < n && v.progress != nil {
+		v.sent += int64(n)
+		v.progress(v.sent, v.total)
+	}
+
+	return n, err
+}
+
+// 5xx 와 요청 제한(429)은 다시 보낸다.
+func retryable(status int) bool {
+	return status == http.StatusTooManyRequests || http.StatusInternalServerError <= status
+}
+
+func backoff(attempt int) time.Duration {
+	delay := time.Duration(1<<uint(attempt)) * 500 * time.Millisecond
+	if 30*time.Second < delay {
+		delay = 30 * time.Second
+	}
+
+	return delay
+}
+
+// 요청마다 보낼 헤더
+func (v HttpRequest) uploadHeaders(param *UploadParam) map[string]string {
+	headers := make(map[string]string)
+	for key, value := range param.headers {
+		headers[key] = value
+	}
+	if 0 < len(v.Authorization) {
+		encoded := base64.StdEncoding.EncodeToString([]byte(v.Authorization))
+		headers["Authorization"] = fmt.Sprintf("Bearer %s", encoded)
+	}
+
+	return headers
+}
+
+/**
+ * 파일을 multipart/form-data 로 올린다. 파일은 메모리에 모으지 않고 읽으면서 보낸다.
+ * 파일 전체의 SHA-256 을 Digest 헤더로 보내고, 연결 오류나 5xx 응답이면 처음부터 다시 보낸다.
+ */
+func (v HttpRequest) UploadMultipart(param *UploadParam, handler func(resp *resty.Response) error) (int, error) {
+	size, digest, err := fileDigest(param.filepath)
+	if err != nil {
+		return -1, err
+	}
+
+	u, err := v.Url(param.querypath)
+	if err != nil {
+		return -1, err
+	}
+
+	client, err := ins.GetHttpClient(&v.HttpConfigurations)
+	if err != nil {
+		return -1, err
+	}
+
+	status := -1
+	for attempt := 0; ; attempt++ {
+		var resp *resty.Response
+		resp, err = v.postMultipart(client, u.String(), param, size, digest)
+		if err == nil {
+			status = resp.StatusCode()
+			resp.RawBody().Close()
+			if retryable(status) == false {
+				if handler != nil {
+					err = handler(resp)
+				}
+				return status, err
+			}
+			err = fmt.Errorf("upload %s: %s", param.filepath, resp.Status())
+		}
+
+		if param.retries <= attempt {
+			return status, err
+		}
+		logger.Warningf("%v, retry %d", err, attempt+1)
+		time.Sleep(backoff(attempt))
+	}
+}
+
+func (v HttpRequest) postMultipart(client *ins.HttpClient, rawurl string, param *UploadParam, size int64, digest string) (*resty.Response, error) {
+	file, err := os.Open(param.filepath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	reader, writer := io.Pipe()
+	form := multipart.NewWriter(writer)
+
+	go func() {
+		keys := make([]string, 0, len(param.fields))
+		for key := range param.fields {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			if err := form.WriteField(key, param.fields[key]); err != nil {
+				writer.CloseWithError(err)
+				return
+			}
+		}
+
+		part, err := form.CreateFormFile(param.fieldname, filepath.Base(param.filepath))
+		if err != nil {
+			writer.CloseWithError(err)
+			return
+		}
+		body := &progressReader{reader: file, total: size, progress: param.progress}
+		if _, err = io.Copy(part, body); err != nil {
+			writer.CloseWithError(err)
+			return
+		}
+		writer.CloseWithError(form.Close())
+	}()
+	defer reader.Close()
+
+	return client.R().
+		SetHeaders(v.uploadHeaders(param)).
+		SetHeader("Content-Type", form.FormDataContentType()).
+		SetHeader("Digest", "sha-256="+digest).
+		SetBody(reader).
+		Post(rawurl)
+}
+
+// 이어 올리기 상태 파일
+type uploadState struct {
+	Location string
+	Size     int64
+	Digest   string
+}
+
+func loadUploadState(statefile string, size int64, digest string) string {
+	if len(statefile) == 0 {
+		return ""
+	}
+
+	data, err := ioutil.ReadFile(statefile)
+	if err != nil {
+		return ""
+	}
+
+	state := uploadState{}
+	if err = json.Unmarshal(data, &state); err != nil || state.Size != size || state.Digest != digest {
+		return ""
+	}
+
+	return state.Location
+}
+
+func saveUploadState(statefile string, state uploadState) {
+	if len(statefile) == 0 {
+		return
+	}
+
+	data, err := json.Marshal(state)
+	if err != nil {
+		return
+	}
+	if err = ioutil.WriteFile(statefile, data, 0644); err != nil {
+		logger.Warningf("upload state %s: %v", statefile, err)
+	}
+}
+
+func encodeUploadMetadata(metadata map[string]string) string {
+	keys := make([]string, 0, len(metadata))
+	for key := range metadata {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	pairs := []string{}
+	for _, key := range keys {
+		pairs = append(pairs, key+" "+base64.StdEncoding.EncodeToString([]byte(metadata[key])))
+	}
+
+	return strings.Join(pairs, ",")
+}
+
+/**
+ * 파일을 나누어 이어 올린다. (tus 1.0 방식)
+ *
+ * POST 로 업로드를 만들고(Upload-Length, Upload-Metadata), Location 에 PATCH 로 조각을 보낸다.
+ * 조각마다 Upload-Offset 과 Upload-Checksum(sha256) 을 보내며, 실패하면 HEAD 로 받은 위치를 다시 확인한 뒤 그 위치부터 보낸다.
+ * 완료하면 업로드 주소를 반환한다.
+ */
+func (v HttpRequest) UploadResumable(param *UploadParam) (string, error) {
+	size, digest, err := fileDigest(param.filepath)
+	if err != nil {
+		return "", err
+	}
+
+	u, err := v.Url(param.querypath)
+	if err != nil {
+		return "", err
+	}
+
+	client, err := ins.GetHttpClient(&v.HttpConfigurations)
+	if err != nil {
+		return "", err
+	}
+	headers := v.uploadHeaders(param)
+	headers["Tus-Resumable"] = TUS_VERSION
+
+	chunkSize := param.chunkSize
+	if chunkSize <= 0 {
+		chunkSize = DefaultUploadChunkSize
+	}
+
+	file, err := os.Open(param.filepath)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	location := loadUploadState(param.statefile, size, digest)
+	offset := int64(-1)
+	chunk := make([]byte, chunkSize)
+	failures := 0
+
+	for {
+		if len(location) == 0 {
+			if location, err = v.createUpload(client, headers, u, param, size, digest); err != nil {
+				return "", err
+			}
+			saveUploadState(param.statefile, uploadState{Location: location, Size: size, Digest: digest})
+			offset = 0
+		}
+
+		if offset < 0 {
+			offset, err = v.uploadOffset(client, headers, location)
+			if err == errUploadGone {
+				// 서버가 업로드를 지웠다. 새로 만든다.
+				location = ""
+				continue
+			}
+		}
+
+		if err == nil {
+			if size <= offset {
+				break
+			}
+
+			n, rerr := file.ReadAt(chunk, offset)
+			if n == 0 && rerr != nil {
+				return "", rerr
+			}
+
+			var next int64
+			next, err = v.patchChunk(client, headers, location, offset, chunk[:n])
+			if err == nil {
+				offset = next
+				failures = 0
+				if param.progress != nil {
+					param.progress(offset, size)
+				}
+				continue
+			}
+		}
+
+		if param.retries <= failures {
+			return "", err
+		}
+		logger.Warningf("upload %s at %d: %v, retry %d", param.filepath, offset, err, failures+1)
+		time.Sleep(backoff(failures))
+		failures++
+		// 받는 쪽이 실제로 받은 위치를 다시 확인한다.
+		offset = -1
+	}
+
+	if 0 < len(param.statefile) {
+		os.Remove(param.statefile)
+	}
+
+	return location, nil
+}
+
+var errUploadGone = errors.New("upload not found")
+
+func (v HttpRequest) createUpload(client *ins.HttpClient, headers map[string]string, u *url.URL, param *UploadParam, size int64, digest string) (string, error) {
+	metadata := map[string]string{}
+	for key, value := range param.metadata {
+		metadata[key] = value
+	}
+	if _, ok := metadata["filename"]; ok == false {
+		metadata["filename"] = filepath.Base(param.filepath)
+	}
+	metadata["sha256"] = digest
+
+	var resp *resty.Response
+	var err error
+	for attempt := 0; ; attempt++ {
+		resp, err = client.R().
+			SetHeaders(headers).
+			SetHeader("Upload-Length", strconv.FormatInt(size, 10)).
+			SetHeader("Upload-Metadata", encodeUploadMetadata(metadata)).
+			Post(u.String())
+		if err == nil {
+			resp.RawBody().Close()
+			if resp.StatusCode() == http.StatusCreated {
+				break
+			}
+			err = fmt.Errorf("create upload: %s", resp.Status())
+			if retryable(resp.StatusCode()) == false {
+				return "", err
+			}
+		}
+		if param.retries <= attempt {
+			return "", err
+		}
+		time.Sleep(backoff(attempt))
+	}
+
+	location, err := u.Parse(resp.Header().Get("Location"))
+	if err != nil || len(resp.Header().Get("Location")) == 0 {
+		return "", errors.New("create upload: no Location")
+	}
+
+	return location.String(), nil
+}
+
+func (v HttpRequest) uploadOffset(client *ins.HttpClient, headers map[string]string, location string) (int64, error) {
+	resp, err := client.R().SetHeaders(headers).Head(location)
+	if err != nil {
+		return -1, err
+	}
+	resp.RawBody().Close()
+
+	switch resp.StatusCode() {
+	case http.StatusOK, http.StatusNoContent:
+	case http.StatusNotFound, http.StatusGone:
+		return -1, errUploadGone
+	default:
+		return -1, fmt.Errorf("upload offset: %s", resp.Status())
+	}
+
+	return strconv.ParseInt(resp.Header().Get("Upload-Offset"), 10, 64)
+}
+
+func (v HttpRequest) patchChunk(client *ins.HttpClient, headers map[string]string, location string, offset int64, data []byte) (int64, error) {
+	sum := sha256.Sum256(data)
+
+	resp, err := client.R().
+		SetHeaders(headers).
+		SetHeader("Content-Type", "application/offset+octet-stream").
+		SetHeader("Upload-Offset", strconv.FormatInt(offset, 10)).
+		SetHeader("Upload-Checksum", "sha256 "+base64.StdEncoding.EncodeToString(sum[:])).
+		SetBody(data).
+		Patch(location)
+	if err != nil {
+		return -1, err
+	}
+	resp.RawBody().Close()
+
+	switch resp.StatusCode() {
+	case http.StatusOK, http.StatusNoContent:
+	case http.StatusConflict:
+		return -1, ErrUploadOffset
+	case StatusChecksumMismatch:
+		return -1, errors.New("chunk checksum mismatch")
+	default:
+		return -1, fmt.Errorf("upload chunk: %s", resp.Status())
+	}
+
+	next, err := strconv.ParseInt(resp.Header().Get("Upload-Offset"), 10, 64)
+	if err != nil {
+		return -1, err
+	}
+	if next <= offset {
+		return -1, ErrUploadOffset
+	}
+
+	return next, nil
+}